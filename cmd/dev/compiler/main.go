@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
 )
 
 const programSource = `
@@ -14,7 +15,10 @@ print("Hello, world!")
 `
 
 func main() {
-	comp := compiler.NewCompiler(strings.NewReader(programSource))
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+
+	comp := compiler.NewCompiler(vm, "program.nut", strings.NewReader(programSource))
 	_, err := comp.Compile()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,68 @@
+// Command disasm prints the compiled functions of Squirrel source files
+// or of .cnut bytecode files.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+var debugInfo = flag.Bool("d", false, "compile sources with debug info")
+
+func load(vm *sqvm.VM, filename string) (*sqvm.FuncProto, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if sqvm.IsBytecode(r) {
+		return sqvm.ReadClosure(r)
+	}
+	proto, err := compiler.Compile(vm, filename, r, false)
+	if err != nil {
+		return nil, err
+	}
+	vm.Pop(1)
+	return proto, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of disasm: [OPTIONS] file.nut|file.cnut...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.EnableDebugInfo(*debugInfo)
+
+	status := 0
+	for i, filename := range flag.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		proto, err := load(vm, filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			status = 1
+			continue
+		}
+		if err := proto.Dump(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
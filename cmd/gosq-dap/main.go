@@ -0,0 +1,165 @@
+// Command gosq-dap is a debug adapter running squirrel scripts for
+// editors speaking the Debug Adapter Protocol. It talks to the editor
+// over stdio or, with -listen, over the first connection to a TCP
+// address.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/debugger"
+	"github.com/dexter3k/go-squirrel/sqstd"
+	"github.com/dexter3k/go-squirrel/sqstd/auxlib"
+	sqio "github.com/dexter3k/go-squirrel/sqstd/io"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+var listenAddr = flag.String("listen", "", "serve a client connecting to this TCP address instead of stdio")
+
+// outputWriter shows what the script writes in the console of the
+// client, stdio being taken by the protocol.
+type outputWriter struct {
+	s        *debugger.Session
+	category string
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.s.Output(w.category, string(p))
+	return len(p), nil
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(mainWithCode())
+}
+
+func mainWithCode() int {
+	var r io.Reader = os.Stdin
+	var w io.Writer = os.Stdout
+	var stdin io.Reader = strings.NewReader("")
+	if *listenAddr != "" {
+		l, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to listen on %s: %v\n", *listenAddr, err)
+			return 1
+		}
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to accept a client: %v\n", err)
+			return 1
+		}
+		defer conn.Close()
+		r, w, stdin = conn, conn, os.Stdin
+	}
+
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+
+	s := debugger.NewSession(vm, r, w)
+	stdout := outputWriter{s: s, category: "stdout"}
+	stderr := outputWriter{s: s, category: "stderr"}
+	if err := registerLibs(vm, stdin, stdout, stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	launch, err := s.Start()
+	if err != nil {
+		return 1
+	}
+	// leaving the session ends the script
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-s.Done():
+			os.Exit(0)
+		case <-finished:
+		}
+	}()
+
+	if launch.Cwd != "" {
+		if err := os.Chdir(launch.Cwd); err != nil {
+			fmt.Fprintf(stderr, "Unable to enter %q: %v\n", launch.Cwd, err)
+			close(finished)
+			s.Exit(1)
+			<-s.Done()
+			return 1
+		}
+	}
+	code := runFile(vm, launch.Program, launch.Args, stderr)
+	close(finished)
+	s.Exit(code)
+	<-s.Done()
+	return code
+}
+
+func registerLibs(vm *sqvm.VM, stdin io.Reader, stdout, stderr io.Writer) error {
+	vm.SetPrintFunc(
+		func(vm *sqvm.VM, format string, args ...any) {
+			fmt.Fprintf(stdout, format, args...)
+		},
+		func(vm *sqvm.VM, format string, args ...any) {
+			fmt.Fprintf(stderr, format, args...)
+		},
+	)
+
+	opts := sqstd.Full()
+	opts.IO = sqio.Config{
+		FS:     sqio.OSFS{},
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	if err := sqstd.Register(vm, opts); err != nil {
+		return err
+	}
+	auxlib.SetErrorHandlers(vm)
+	return nil
+}
+
+// runFile runs a source or bytecode file. The source name is the
+// absolute path of the file, for the breakpoints of the client to match.
+func runFile(vm *sqvm.VM, filename string, args []string, stderr io.Writer) int {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to open %q: %v\n", filename, err)
+		return 1
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if sqvm.IsBytecode(rd) {
+		proto, err := sqvm.ReadClosure(rd)
+		if err != nil {
+			fmt.Fprintf(stderr, "Unable to load %q: %v\n", filename, err)
+			return 1
+		}
+		vm.PushClosure(proto)
+	} else if _, err := compiler.Compile(vm, filename, rd, true); err != nil {
+		return 1
+	}
+
+	vm.PushRootTable()
+	for _, arg := range args {
+		vm.PushString(arg)
+	}
+	if err := vm.Call(1+len(args), true, true); err != nil {
+		return 1
+	}
+	if vm.GetType(-1) == sqvm.TypeInteger {
+		return int(vm.GetInteger(-1))
+	}
+	return 0
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxHistory = 1000
+
+var errInterrupted = errors.New("interrupted")
+
+// lastByteWriter remembers whether the last thing written ended a line,
+// so the console can start its prompts on a fresh one.
+type lastByteWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (w *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.last = p[n-1]
+	}
+	return n, err
+}
+
+// EnsureNewline ends the current line if anything was written on it.
+func (w *lastByteWriter) EnsureNewline() {
+	if w.last != 0 && w.last != '\n' {
+		w.Write([]byte{'\n'})
+	}
+}
+
+var stdout = &lastByteWriter{w: os.Stdout}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gosq_history")
+}
+
+// lineReader reads the lines of the console. When stdin is a terminal it
+// puts it in raw mode while reading and supports basic line editing and
+// history, otherwise it reads plain lines.
+type lineReader struct {
+	in          *bufio.Reader
+	term        *terminal
+	history     []string
+	historyFile *os.File
+}
+
+func newLineReader(historyName string) *lineReader {
+	r := &lineReader{in: bufio.NewReader(os.Stdin)}
+	if t, err := openTerminal(os.Stdin.Fd()); err == nil {
+		r.term = t
+	}
+	if historyName == "" || r.term == nil {
+		return r
+	}
+	if data, err := os.ReadFile(historyName); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				r.history = append(r.history, line)
+			}
+		}
+		if len(r.history) > maxHistory {
+			r.history = r.history[len(r.history)-maxHistory:]
+		}
+	}
+	if f, err := os.OpenFile(historyName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err == nil {
+		r.historyFile = f
+	}
+	return r
+}
+
+func (r *lineReader) Close() error {
+	if r.historyFile != nil {
+		return r.historyFile.Close()
+	}
+	return nil
+}
+
+// AddHistory records line unless it is blank or repeats the previous one.
+func (r *lineReader) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(r.history); n > 0 && r.history[n-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > maxHistory {
+		r.history = r.history[1:]
+	}
+	if r.historyFile != nil {
+		fmt.Fprintln(r.historyFile, line)
+	}
+}
+
+// ReadLine prints prompt and reads a line without its terminator.
+func (r *lineReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(stdout, prompt)
+	if r.term == nil {
+		line, err := r.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		stdout.last = '\n'
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if err := r.term.makeRaw(); err != nil {
+		return "", err
+	}
+	defer r.term.restore()
+	line, err := r.edit(prompt)
+	// OPOST is off in raw mode, end the line by hand
+	os.Stdout.WriteString("\r\n")
+	stdout.last = '\n'
+	return line, err
+}
+
+// edit implements the line editing keys of the terminal.
+func (r *lineReader) edit(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	hist := len(r.history)
+	var saved []rune
+
+	redraw := func() {
+		var sb strings.Builder
+		sb.WriteString("\r")
+		sb.WriteString(prompt)
+		sb.WriteString(string(buf))
+		sb.WriteString("\x1b[K")
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(&sb, "\x1b[%dD", back)
+		}
+		os.Stdout.WriteString(sb.String())
+	}
+	recall := func(i int) {
+		if hist == len(r.history) {
+			saved = buf
+		}
+		hist = i
+		if hist == len(r.history) {
+			buf = saved
+		} else {
+			buf = []rune(r.history[hist])
+		}
+		pos = len(buf)
+		redraw()
+	}
+
+	for {
+		c, err := r.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			return string(buf), nil
+		case 3: // ^C
+			return "", errInterrupted
+		case 4: // ^D
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+				redraw()
+			}
+		case 1: // ^A
+			pos = 0
+			redraw()
+		case 5: // ^E
+			pos = len(buf)
+			redraw()
+		case 11: // ^K
+			buf = buf[:pos]
+			redraw()
+		case 21: // ^U
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+			redraw()
+		case 8, 127: // backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+				redraw()
+			}
+		case 27: // escape sequence
+			seq, err := r.readEscape()
+			if err != nil {
+				return "", err
+			}
+			switch seq {
+			case "[A":
+				if hist > 0 {
+					recall(hist - 1)
+				}
+			case "[B":
+				if hist < len(r.history) {
+					recall(hist + 1)
+				}
+			case "[C":
+				if pos < len(buf) {
+					pos++
+					redraw()
+				}
+			case "[D":
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case "[H", "OH", "[1~":
+				pos = 0
+				redraw()
+			case "[F", "OF", "[4~":
+				pos = len(buf)
+				redraw()
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+					redraw()
+				}
+			}
+		default:
+			if c < 0x20 {
+				continue
+			}
+			ch := rune(c)
+			if c >= utf8.RuneSelf {
+				r.in.UnreadByte()
+				ch, _, err = r.in.ReadRune()
+				if err != nil {
+					return "", err
+				}
+			}
+			buf = append(buf[:pos], append([]rune{ch}, buf[pos:]...)...)
+			pos++
+			redraw()
+		}
+	}
+}
+
+// readEscape reads the rest of a CSI or SS3 sequence following an escape.
+func (r *lineReader) readEscape() (string, error) {
+	c, err := r.in.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if c != '[' && c != 'O' {
+		return string(c), nil
+	}
+	seq := []byte{c}
+	for {
+		c, err := r.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7E {
+			return string(seq), nil
+		}
+	}
+}
@@ -1,89 +1,152 @@
 package main
 
 import (
-    "flag"
-    "fmt"
-    "os"
-
-    "github.com/dexter3k/go-squirrel/sqvm"
-    "github.com/dexter3k/go-squirrel/compiler"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd"
+	"github.com/dexter3k/go-squirrel/sqstd/auxlib"
+	"github.com/dexter3k/go-squirrel/sqvm"
 )
 
+const versionInfo = "go-squirrel wip"
+
 var (
-    showVersionInfo = flag.Bool("v", false, "display version info")
+	showVersionInfo = flag.Bool("v", false, "display version info")
+	compileOnly     = flag.Bool("c", false, "compile the file to bytecode only")
+	outputFile      = flag.String("o", "out.cnut", "output file of the -c option")
+	debugInfo       = flag.Bool("d", false, "generate debug info")
 )
 
 func init() {
-    flag.Usage = func() {
-        fmt.Printf("Usage of gosq: [OPTIONS] [program.nut [ARGS]]\n")
-        flag.PrintDefaults()
-    }
-    flag.Parse()
+	flag.Usage = func() {
+		fmt.Printf("Usage of gosq: [OPTIONS] [program.nut [ARGS]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+}
+
+// loadScript pushes the closure of a source file or of a file holding
+// bytecode. Errors are printed, those of the compiler by its handler.
+func loadScript(vm *sqvm.VM, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Unable to open %q: %v\n", filename, err)
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if sqvm.IsBytecode(r) {
+		proto, err := sqvm.ReadClosure(r)
+		if err != nil {
+			fmt.Printf("Unable to load %q: %v\n", filename, err)
+			return err
+		}
+		vm.PushClosure(proto)
+		return nil
+	}
+
+	// Compiler pushes the resulting closure onto the vm stack
+	_, err = compiler.Compile(vm, filename, r, true)
+	return err
+}
+
+// compileFile writes the bytecode of filename to output.
+func compileFile(vm *sqvm.VM, filename, output string) int {
+	if err := loadScript(vm, filename); err != nil {
+		return 1
+	}
+	proto, err := vm.GetClosureProto(-1)
+	if err != nil {
+		fmt.Printf("Unable to compile %q: %v\n", filename, err)
+		return 1
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		fmt.Printf("Unable to create %q: %v\n", output, err)
+		return 1
+	}
+	err = sqvm.WriteClosure(f, proto)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Printf("Unable to write %q: %v\n", output, err)
+		return 1
+	}
+	return 0
 }
 
 func runFile(vm *sqvm.VM, filename string, args []string) int {
-    f, err := os.Open(filename)
-    if err != nil {
-        fmt.Printf("Unable to open %q: %w\n", filename, err)
-        return 1
-    }
-    defer f.Close()
-
-    // Compiler pushes the resulting closure onto the vm stack
-    if err := compiler.Compile(vm, filename, f); err != nil {
-        fmt.Printf("Unable to compile file %q: %w\n", filename, err)
-        return 1
-    }
-
-    // Push the args
-    vm.PushRootTable() // root table as the local space of the script
-    for _, arg := range args {
-        vm.PushString(arg)
-    }
-
-    // Perform the call
-    if err := vm.Call(1 + len(args), true, true); err != nil {
-        fmt.Printf("Call failed with err %w\n", err)
-        return 1
-    }
-
-    // Expect an integer return type
-    retType := vm.GetType(-1)
-    if retType == sqvm.TypeInteger {
-        return int(vm.GetInteger(-1))
-    }
-
-    return 0
+	if err := loadScript(vm, filename); err != nil {
+		return 1
+	}
+
+	// Push the args
+	vm.PushRootTable() // root table as the local space of the script
+	for _, arg := range args {
+		vm.PushString(arg)
+	}
+
+	// Perform the call, errors are reported by the error handler
+	if err := vm.Call(1+len(args), true, true); err != nil {
+		return 1
+	}
+
+	// Expect an integer return type
+	retType := vm.GetType(-1)
+	if retType == sqvm.TypeInteger {
+		return int(vm.GetInteger(-1))
+	}
+
+	return 0
 }
 
 func main() {
-    os.Exit(mainWithCode())
+	os.Exit(mainWithCode())
 }
 
 func mainWithCode() int {
-    if *showVersionInfo {
-        fmt.Printf("go-squirrel wip\n")
-        return 0
-    }
-
-    vm := sqvm.Open(1024)
-    defer vm.Close()
-
-    vm.SetPrintFunc(
-        func(vm *sqvm.VM, format string, args ...any){
-        },
-        func(vm *sqvm.VM, format string, args ...any){
-        },
-    )
-
-    vm.PushRootTable()
-    // Register libraries
-    // Register error handlers
-
-    if len(flag.Args()) == 0 {
-        fmt.Printf("Interpreter mode is not yet implemented")
-        return 1
-    } else {
-        return runFile(vm, flag.Args()[0], flag.Args()[1:])
-    }
+	if *showVersionInfo {
+		fmt.Printf("%s\n", versionInfo)
+		return 0
+	}
+
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.EnableDebugInfo(*debugInfo)
+
+	vm.SetPrintFunc(
+		func(vm *sqvm.VM, format string, args ...any) {
+			fmt.Fprintf(stdout, format, args...)
+		},
+		func(vm *sqvm.VM, format string, args ...any) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		},
+	)
+
+	opts := sqstd.Full()
+	opts.IO.Stdout = stdout
+	if err := sqstd.Register(vm, opts); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	auxlib.SetErrorHandlers(vm)
+
+	if *compileOnly {
+		if len(flag.Args()) == 0 {
+			flag.Usage()
+			return 1
+		}
+		return compileFile(vm, flag.Args()[0], *outputFile)
+	}
+	if len(flag.Args()) == 0 {
+		return repl(vm)
+	}
+	return runFile(vm, flag.Args()[0], flag.Args()[1:])
 }
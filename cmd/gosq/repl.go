@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/compiler/lexer"
+	"github.com/dexter3k/go-squirrel/compiler/lexer/tokens"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+const (
+	prompt         = "sq> "
+	continuePrompt = "... "
+	replSourceName = "interactive console"
+)
+
+// repl runs the interactive console: every entry is compiled and run as
+// a function with the root table as this, errors are printed by the error
+// handlers and don't end the session.
+func repl(vm *sqvm.VM) int {
+	fmt.Fprintf(stdout, "%s\n", versionInfo)
+
+	done := false
+	vm.PushRootTable()
+	vm.PushString("quit")
+	vm.NewClosure(func(vm *sqvm.VM) (int, error) {
+		done = true
+		return 0, nil
+	}, 0)
+	vm.SetNativeClosureName(-1, "quit")
+	if err := vm.NewSlot(-3, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to register quit: %v\n", err)
+		vm.Pop(1)
+		return 1
+	}
+	vm.Pop(1)
+
+	in := newLineReader(historyPath())
+	defer in.Close()
+
+	for !done {
+		src, err := readEntry(in)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			stdout.EnsureNewline()
+			return 0
+		}
+		runEntry(vm, src)
+		stdout.EnsureNewline()
+	}
+	return 0
+}
+
+// readEntry reads lines until the brackets of the entry are balanced. A
+// line ending with a backslash is always continued.
+func readEntry(in *lineReader) (string, error) {
+	var sb strings.Builder
+	p := prompt
+	for {
+		line, err := in.ReadLine(p)
+		if err != nil {
+			if err == io.EOF && sb.Len() > 0 {
+				return sb.String(), nil
+			}
+			return "", err
+		}
+		in.AddHistory(line)
+		p = continuePrompt
+		if strings.HasSuffix(line, "\\") {
+			sb.WriteString(strings.TrimSuffix(line, "\\"))
+			sb.WriteByte('\n')
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+		if depth, _ := scanEntry(sb.String()); depth <= 0 {
+			return sb.String(), nil
+		}
+	}
+}
+
+// runEntry compiles and runs src. An entry starting with = is an
+// expression whose value gets printed.
+func runEntry(vm *sqvm.VM, src string) {
+	top := vm.GetTop()
+	defer vm.SetTop(top)
+
+	trimmed := strings.TrimSpace(src)
+	if trimmed == "" {
+		return
+	}
+	printResult := strings.HasPrefix(trimmed, "=")
+	if printResult {
+		src = "return (" + trimmed[1:] + ")"
+	} else {
+		src = withPersistentLocals(src)
+	}
+
+	if _, err := compiler.Compile(vm, replSourceName, strings.NewReader(src), true); err != nil {
+		return
+	}
+	vm.PushRootTable()
+	if err := vm.Call(1, printResult, true); err != nil {
+		return
+	}
+	if !printResult {
+		return
+	}
+	if err := vm.ToString(-1); err != nil {
+		fmt.Fprintf(stdout, "%v\n", err)
+		return
+	}
+	fmt.Fprintf(stdout, "%s\n", vm.GetString(-1))
+}
+
+// withPersistentLocals appends to src a slot in the root table for every
+// local declared at the top level, so that the following entries can
+// still use them.
+func withPersistentLocals(src string) string {
+	_, locals := scanEntry(src)
+	if len(locals) == 0 {
+		return src
+	}
+	var sb strings.Builder
+	sb.WriteString(src)
+	sb.WriteString("\n;")
+	for _, name := range locals {
+		fmt.Fprintf(&sb, "::%s <- %s;", name, name)
+	}
+	return sb.String()
+}
+
+// scanEntry returns the bracket depth at the end of src and the names of
+// the locals it declares at the top level. Scanning stops at the first
+// token the lexer fails on, the compiler reports it later.
+func scanEntry(src string) (int, []string) {
+	var toks []lexer.TokenInfo
+	l := lexer.NewLexer(strings.NewReader(src))
+	for {
+		t, err := l.Lex()
+		if err != nil || t.Token == tokens.Undefined {
+			break
+		}
+		toks = append(toks, t)
+	}
+
+	depth := 0
+	for _, t := range toks {
+		switch t.Token {
+		case '{', '(', '[':
+			depth++
+		case '}', ')', ']':
+			depth--
+		}
+	}
+
+	var locals []string
+	seen := make(map[string]bool)
+	addLocal := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			locals = append(locals, name)
+		}
+	}
+	nested := 0
+	for i := 0; i < len(toks); i++ {
+		switch toks[i].Token {
+		case '{', '(', '[':
+			nested++
+		case '}', ')', ']':
+			nested--
+		case tokens.Local:
+			if nested != 0 {
+				continue
+			}
+			if i+2 < len(toks) && toks[i+1].Token == tokens.Function && toks[i+2].Token == tokens.Identifier {
+				addLocal(toks[i+2].String)
+				continue
+			}
+			i = scanLocalNames(toks, i+1, addLocal)
+		}
+	}
+	return depth, locals
+}
+
+// scanLocalNames collects the names of a local statement starting at i:
+// the first identifier and every identifier following a comma outside of
+// the initializers' brackets. It returns the index of the last token of
+// the statement.
+func scanLocalNames(toks []lexer.TokenInfo, i int, add func(string)) int {
+	if i >= len(toks) || toks[i].Token != tokens.Identifier {
+		return i - 1
+	}
+	add(toks[i].String)
+	nested := 0
+	for i++; i < len(toks); i++ {
+		switch toks[i].Token {
+		case '{', '(', '[':
+			nested++
+		case '}', ')', ']':
+			if nested == 0 {
+				return i - 1
+			}
+			nested--
+		case ';', '\n':
+			if nested == 0 {
+				return i
+			}
+		case ',':
+			if nested == 0 && i+1 < len(toks) && toks[i+1].Token == tokens.Identifier {
+				add(toks[i+1].String)
+				i++
+			}
+		}
+	}
+	return i
+}
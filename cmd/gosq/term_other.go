@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+// terminal is not supported on this platform, the console reads plain
+// lines.
+type terminal struct{}
+
+func openTerminal(fd uintptr) (*terminal, error) {
+	return nil, errors.New("terminals are not supported")
+}
+
+func (t *terminal) makeRaw() error { return nil }
+
+func (t *terminal) restore() error { return nil }
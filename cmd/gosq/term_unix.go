@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// terminal switches a terminal between its original and raw modes.
+type terminal struct {
+	fd   uintptr
+	orig syscall.Termios
+}
+
+func ioctlTermios(fd, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openTerminal fails if fd is not a terminal.
+func openTerminal(fd uintptr) (*terminal, error) {
+	t := &terminal{fd: fd}
+	if err := ioctlTermios(fd, ioctlGetTermios, &t.orig); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *terminal) makeRaw() error {
+	raw := t.orig
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	return ioctlTermios(t.fd, ioctlSetTermios, &raw)
+}
+
+func (t *terminal) restore() error {
+	return ioctlTermios(t.fd, ioctlSetTermios, &t.orig)
+}
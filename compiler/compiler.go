@@ -3,68 +3,162 @@ package compiler
 import (
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"runtime"
 
-	"github.com/dexter3k/go-squirrel/sqvm"
 	"github.com/dexter3k/go-squirrel/compiler/lexer"
 	"github.com/dexter3k/go-squirrel/compiler/lexer/tokens"
+	"github.com/dexter3k/go-squirrel/sqvm"
 )
 
 // Compile the code from reader and push resulting closure onto vm stack.
-func Compile(vm *sqvm.VM, filename string, r io.Reader) (*sqvm.FuncProto, error) {
-	return NewCompiler(r).Compile()
+// If raiseError is set, errors are also passed to the compiler error
+// handler of the vm.
+func Compile(vm *sqvm.VM, filename string, r io.Reader, raiseError bool) (*sqvm.FuncProto, error) {
+	proto, err := NewCompiler(vm, filename, r).Compile()
+	if err != nil {
+		if h := vm.CompilerErrorHandler(); raiseError && h != nil {
+			if e, ok := err.(*Error); ok {
+				h(vm, e.Err.Error(), e.Source, int(e.Line), int(e.Column))
+			} else {
+				h(vm, err.Error(), filename, -1, -1)
+			}
+		}
+		return nil, err
+	}
+	vm.PushClosure(proto)
+	return proto, nil
+}
+
+// Kinds of expressions, tell how the value of the last parsed expression
+// is reached
+const (
+	exprValue  = iota + 1 // a value in a temporary
+	exprObject            // a slot of an object, the object and key are targets
+	exprBase              // the base class
+	exprLocal             // a local variable
+	exprOuter             // an outer variable
+)
+
+type expState struct {
+	etype    int
+	epos     int  // stack position, or outer index for exprOuter
+	doNotGet bool // do not dereference the next value
+}
+
+type scope struct {
+	outers    int
+	stackSize int
 }
 
 type compiler struct {
-	lexer lexer.Lexer
+	vm         *sqvm.VM
+	sourceName string
+	lexer      lexer.Lexer
 
 	f *state
 
-	token     tokens.Token
-	tokenInfo lexer.TokenInfo
-	lastToken tokens.Token
+	token         tokens.Token
+	tokenInfo     lexer.TokenInfo
+	lastToken     tokens.Token
+	lastTokenLine uint
+
+	es       expState
+	scope    scope
+	lineInfo bool
 }
 
-func NewCompiler(rr io.Reader) *compiler {
+// NewCompiler creates a compiler of the source read from rr. The vm is
+// used for the constant table, sourceName appears in error messages and
+// debug information.
+func NewCompiler(vm *sqvm.VM, sourceName string, rr io.Reader) *compiler {
 	return &compiler{
-		lexer: lexer.NewLexer(rr),
+		vm:         vm,
+		sourceName: sourceName,
+		lexer:      lexer.NewLexer(rr),
+		lineInfo:   vm.DebugInfoEnabled(),
 	}
 }
 
-func (c *compiler) Compile() (*sqvm.FuncProto, error) {
+func (c *compiler) Compile() (proto *sqvm.FuncProto, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println(c.token)
-			log.Println("Recovered from:", r)
+			if _, isRuntime := r.(runtime.Error); isRuntime {
+				panic(r)
+			}
+			switch e := r.(type) {
+			case *Error:
+				err = e
+			case error:
+				err = c.newError(e)
+			default:
+				panic(r)
+			}
+			proto = nil
 		}
 	}()
 
 	// Create root function definition with args "this" and "vargv"
-	c.f = newState()
+	c.f = newState(nil)
+	c.f.name = "main"
+	c.f.addParameter("this")
+	c.f.addParameter("vargv")
+	c.f.varParams = true
+	c.f.sourceName = c.sourceName
+	stackSize := c.f.getStackSize()
 
 	c.lex()
 
 	for c.token != 0 {
-		c.statement()
+		c.statement(true)
 
 		if c.lastToken != '}' && c.lastToken != ';' {
 			c.optionalSemicolon()
 		}
 	}
 
+	c.f.setStackSize(stackSize)
+	c.f.addLineInfos(c.currentLine(), c.lineInfo, true)
+	c.f.addInstruction(sqvm.OpReturn, 0xFF, 0, 0, 0)
+	c.f.setStackSize(0)
+
 	// Return the built function prototype
-	return c.f.makeFuncProto()
+	return c.f.makeFuncProto(), nil
+}
+
+func (c *compiler) newError(err error) *Error {
+	return &Error{
+		Source: c.sourceName,
+		Line:   c.tokenInfo.Line,
+		Column: c.tokenInfo.Column,
+		Err:    err,
+	}
+}
+
+func (c *compiler) fail(err error) {
+	panic(c.newError(err))
+}
+
+func (c *compiler) errorf(format string, args ...any) {
+	c.fail(fmt.Errorf(format, args...))
+}
+
+func (c *compiler) currentLine() int {
+	return int(c.tokenInfo.Line)
 }
 
 func (c *compiler) lex() {
-	for true {
+	if c.token != '\n' {
+		c.lastTokenLine = c.tokenInfo.Line
+	}
+	for {
 		c.lastToken = c.token
 
 		var err error
 		c.tokenInfo, err = c.lexer.Lex()
 		c.token = c.tokenInfo.Token
 		if err != nil {
-			panic(err)
+			c.fail(err)
 		}
 		if c.token != '\n' {
 			break
@@ -72,13 +166,306 @@ func (c *compiler) lex() {
 	}
 }
 
-func (c *compiler) statement() {
+func tokenName(tok tokens.Token) string {
+	switch tok {
+	case tokens.Identifier:
+		return "IDENTIFIER"
+	case tokens.StringLiteral:
+		return "STRING_LITERAL"
+	case tokens.Integer:
+		return "INTEGER"
+	case tokens.Float:
+		return "FLOAT"
+	}
+	if tok < tokens.Identifier {
+		return string(rune(tok))
+	}
+	return tok.String()
+}
+
+func (c *compiler) expect(tok tokens.Token) lexer.TokenInfo {
+	if c.token != tok && (c.token != tokens.Constructor || tok != tokens.Identifier) {
+		c.errorf("expected '%s'", tokenName(tok))
+	}
+	info := c.tokenInfo
+	c.lex()
+	return info
+}
+
+func (c *compiler) isEndOfStatement() bool {
+	return c.token == 0 || c.lastToken == '\n' || c.token == '}' || c.token == ';'
+}
+
+func (c *compiler) optionalSemicolon() {
+	if c.token == ';' {
+		c.lex()
+		return
+	}
+
+	if !c.isEndOfStatement() {
+		c.fail(ErrExpectStatementEnd)
+	}
+}
+
+func (c *compiler) moveIfCurrentTargetIsLocal() {
+	if trg := c.f.topTarget(); c.f.isLocal(trg) {
+		trg = c.f.popTarget() // pops the target and moves it
+		c.f.addInstruction(sqvm.OpMove, c.f.pushTarget(-1), trg, 0, 0)
+	}
+}
+
+// constant looks a name up in the constant table of the vm.
+func (c *compiler) constant(name string) (sqvm.Object, bool) {
+	c.vm.PushConstTable()
+	defer c.vm.Pop(1)
+	return c.rawGet(name)
+}
+
+func (c *compiler) enumMember(enum sqvm.Object, name string) (sqvm.Object, bool) {
+	c.vm.PushObject(enum)
+	defer c.vm.Pop(1)
+	return c.rawGet(name)
+}
+
+// rawGet looks up name in the table on top of the stack.
+func (c *compiler) rawGet(name string) (sqvm.Object, bool) {
+	c.vm.PushString(name)
+	if err := c.vm.RawGet(-2); err != nil {
+		return sqvm.Null, false
+	}
+	val := c.vm.GetStackObject(-1)
+	c.vm.Pop(1)
+	return val, true
+}
+
+func (c *compiler) setConstant(name string, val sqvm.Object) {
+	c.vm.PushConstTable()
+	c.vm.PushString(name)
+	c.vm.PushObject(val)
+	c.vm.NewSlot(-3, false)
+	c.vm.Pop(1)
+}
+
+func (c *compiler) beginScope() scope {
+	old := c.scope
+	c.scope = scope{
+		outers:    c.f.outers,
+		stackSize: c.f.getStackSize(),
+	}
+	return old
+}
+
+func (c *compiler) resolveOuters() {
+	if c.f.getStackSize() != c.scope.stackSize && c.f.countOuters(c.scope.stackSize) > 0 {
+		c.f.addInstruction(sqvm.OpClose, 0, c.scope.stackSize, 0, 0)
+	}
+}
+
+func (c *compiler) endScopeNoClose(old scope) {
+	if c.f.getStackSize() != c.scope.stackSize {
+		c.f.setStackSize(c.scope.stackSize)
+	}
+	c.scope = old
+}
+
+func (c *compiler) endScope(old scope) {
+	oldOuters := c.f.outers
+	if c.f.getStackSize() != c.scope.stackSize {
+		c.f.setStackSize(c.scope.stackSize)
+		if oldOuters != c.f.outers {
+			c.f.addInstruction(sqvm.OpClose, 0, c.scope.stackSize, 0, 0)
+		}
+	}
+	c.scope = old
+}
+
+type breakableBlock struct {
+	nBreaks    int
+	nContinues int
+}
+
+func (c *compiler) beginBreakableBlock() breakableBlock {
+	b := breakableBlock{
+		nBreaks:    len(c.f.unresolvedBreaks),
+		nContinues: len(c.f.unresolvedContinues),
+	}
+	c.f.breakTargets = append(c.f.breakTargets, 0)
+	c.f.continueTargets = append(c.f.continueTargets, 0)
+	return b
+}
+
+func (c *compiler) endBreakableBlock(b breakableBlock, continueTarget int) {
+	nBreaks := len(c.f.unresolvedBreaks) - b.nBreaks
+	nContinues := len(c.f.unresolvedContinues) - b.nContinues
+	if nContinues > 0 {
+		c.resolveContinues(nContinues, continueTarget)
+	}
+	if nBreaks > 0 {
+		c.resolveBreaks(nBreaks)
+	}
+	c.f.breakTargets = c.f.breakTargets[:len(c.f.breakTargets)-1]
+	c.f.continueTargets = c.f.continueTargets[:len(c.f.continueTargets)-1]
+}
+
+func (c *compiler) resolveBreaks(n int) {
+	for ; n > 0; n-- {
+		pos := c.f.unresolvedBreaks[len(c.f.unresolvedBreaks)-1]
+		c.f.unresolvedBreaks = c.f.unresolvedBreaks[:len(c.f.unresolvedBreaks)-1]
+		c.f.setInstructionParams(pos, 0, c.f.currentPos()-pos, 0, 0)
+	}
+}
+
+func (c *compiler) resolveContinues(n int, target int) {
+	for ; n > 0; n-- {
+		pos := c.f.unresolvedContinues[len(c.f.unresolvedContinues)-1]
+		c.f.unresolvedContinues = c.f.unresolvedContinues[:len(c.f.unresolvedContinues)-1]
+		c.f.setInstructionParams(pos, 0, target-pos, 0, 0)
+	}
+}
+
+func (c *compiler) statements() {
+	for c.token != '}' && c.token != tokens.Default && c.token != tokens.Case {
+		c.statement(true)
+		if c.lastToken != '}' && c.lastToken != ';' {
+			c.optionalSemicolon()
+		}
+	}
+}
+
+func (c *compiler) statement(closeFrame bool) {
+	c.f.addLineInfos(c.currentLine(), c.lineInfo, false)
 	switch c.token {
 	case ';':
 		c.lex()
+	case tokens.If:
+		c.ifStatement()
+	case tokens.While:
+		c.whileStatement()
+	case tokens.Do:
+		c.doWhileStatement()
+	case tokens.For:
+		c.forStatement()
+	case tokens.Foreach:
+		c.foreachStatement()
+	case tokens.Switch:
+		c.switchStatement()
+	case tokens.Local:
+		c.localDeclStatement()
+	case tokens.Return, tokens.Yield:
+		op := sqvm.OpReturn
+		if c.token == tokens.Yield {
+			op = sqvm.OpYield
+			c.f.isGenerator = true
+		}
+		c.lex()
+		if !c.isEndOfStatement() {
+			retExp := c.f.currentPos() + 1
+			c.commaExpression()
+			if op == sqvm.OpReturn && c.f.traps > 0 {
+				c.f.addInstruction(sqvm.OpPopTrap, c.f.traps, 0, 0, 0)
+			}
+			c.f.returnExp = retExp
+			c.f.addInstruction(op, 1, c.f.popTarget(), c.f.getStackSize(), 0)
+		} else {
+			if op == sqvm.OpReturn && c.f.traps > 0 {
+				c.f.addInstruction(sqvm.OpPopTrap, c.f.traps, 0, 0, 0)
+			}
+			c.f.returnExp = -1
+			c.f.addInstruction(op, 0xFF, 0, c.f.getStackSize(), 0)
+		}
+	case tokens.Break:
+		if len(c.f.breakTargets) == 0 {
+			c.fail(ErrBreakOutsideLoop)
+		}
+		if n := c.f.breakTargets[len(c.f.breakTargets)-1]; n > 0 {
+			c.f.addInstruction(sqvm.OpPopTrap, n, 0, 0, 0)
+		}
+		c.resolveOuters()
+		c.f.addInstruction(sqvm.OpJmp, 0, -1234, 0, 0)
+		c.f.unresolvedBreaks = append(c.f.unresolvedBreaks, c.f.currentPos())
+		c.lex()
+	case tokens.Continue:
+		if len(c.f.continueTargets) == 0 {
+			c.fail(ErrContinueOutside)
+		}
+		if n := c.f.continueTargets[len(c.f.continueTargets)-1]; n > 0 {
+			c.f.addInstruction(sqvm.OpPopTrap, n, 0, 0, 0)
+		}
+		c.resolveOuters()
+		c.f.addInstruction(sqvm.OpJmp, 0, -1234, 0, 0)
+		c.f.unresolvedContinues = append(c.f.unresolvedContinues, c.f.currentPos())
+		c.lex()
+	case tokens.Function:
+		c.functionStatement()
+	case tokens.Class:
+		c.classStatement()
+	case tokens.Enum:
+		c.enumStatement()
+	case '{':
+		old := c.beginScope()
+		c.lex()
+		c.statements()
+		c.expect('}')
+		if closeFrame {
+			c.endScope(old)
+		} else {
+			c.endScopeNoClose(old)
+		}
+	case tokens.Try:
+		c.tryCatchStatement()
+	case tokens.Throw:
+		c.lex()
+		c.commaExpression()
+		c.f.addInstruction(sqvm.OpThrow, c.f.popTarget(), 0, 0, 0)
+	case tokens.Const:
+		c.lex()
+		id := c.expect(tokens.Identifier).String
+		c.expect('=')
+		val := c.expectScalar()
+		c.optionalSemicolon()
+		c.setConstant(id, val)
 	default:
 		c.commaExpression()
+		c.f.discardTarget()
+	}
+	c.f.snoozeOpt()
+}
+
+func (c *compiler) emitDerefOp(op sqvm.Opcode) {
+	val := c.f.popTarget()
+	key := c.f.popTarget()
+	src := c.f.popTarget()
+	c.f.addInstruction(op, c.f.pushTarget(-1), src, key, val)
+}
+
+func (c *compiler) emit2ArgsOp(op sqvm.Opcode, p3 int) {
+	p2 := c.f.popTarget() // src in OpGet
+	p1 := c.f.popTarget() // key in OpGet
+	c.f.addInstruction(op, c.f.pushTarget(-1), p1, p2, p3)
+}
+
+func (c *compiler) emitCompoundArith(tok tokens.Token, etype, pos int) {
+	switch etype {
+	case exprLocal:
+		p2 := c.f.popTarget()
+		p1 := c.f.popTarget()
+		c.f.pushTarget(p1)
+		c.f.addInstruction(arithOpByToken(tok), p1, p2, p1, 0)
+		c.f.snoozeOpt()
+	case exprObject, exprBase:
+		val := c.f.popTarget()
+		key := c.f.popTarget()
+		src := c.f.popTarget()
+		// OpCompArith mixes the destination object and the value in arg1
+		c.f.addInstruction(sqvm.OpCompArith, c.f.pushTarget(-1), src<<16|val, key, int(compArithCharByToken(tok)))
+	case exprOuter:
+		val := c.f.topTarget()
+		tmp := c.f.pushTarget(-1)
+		c.f.addInstruction(sqvm.OpGetOuter, tmp, pos, 0, 0)
+		c.f.addInstruction(arithOpByToken(tok), tmp, val, tmp, 0)
+		c.f.popTarget()
 		c.f.popTarget()
+		c.f.addInstruction(sqvm.OpSetOuter, c.f.pushTarget(-1), pos, tmp, 0)
 	}
 }
 
@@ -86,84 +473,1212 @@ func (c *compiler) commaExpression() {
 	c.expression()
 
 	for c.token == ',' {
-		c.lex()
-
 		// Discard result for the last expression
 		c.f.popTarget()
+		c.lex()
 
 		c.expression()
 	}
 }
 
 func (c *compiler) expression() {
-	c.prefixedExpression()
+	es := c.es
+	c.es = expState{etype: exprValue, epos: -1}
+	c.logicalOrExpression()
+
+	switch c.token {
+	case '=', tokens.NewSlot, tokens.MinusEqual, tokens.PlusEqual,
+		tokens.MultiplyEqual, tokens.DivideEqual, tokens.ModuloEqual:
+		op := c.token
+		ds := c.es.etype
+		pos := c.es.epos
+		if ds == exprValue {
+			c.fail(ErrAssignExpression)
+		} else if ds == exprBase {
+			c.fail(ErrAssignBase)
+		}
+		c.lex()
+		c.expression()
+
+		switch op {
+		case tokens.NewSlot:
+			if ds == exprObject || ds == exprBase {
+				c.emitDerefOp(sqvm.OpNewSlot)
+			} else {
+				c.fail(ErrNewSlotLocal)
+			}
+		case '=':
+			switch ds {
+			case exprLocal:
+				src := c.f.popTarget()
+				dst := c.f.topTarget()
+				c.f.addInstruction(sqvm.OpMove, dst, src, 0, 0)
+			case exprObject, exprBase:
+				c.emitDerefOp(sqvm.OpSet)
+			case exprOuter:
+				src := c.f.popTarget()
+				dst := c.f.pushTarget(-1)
+				c.f.addInstruction(sqvm.OpSetOuter, dst, pos, src, 0)
+			}
+		default:
+			c.emitCompoundArith(op, ds, pos)
+		}
+	case '?':
+		c.lex()
+		c.f.addInstruction(sqvm.OpJz, c.f.popTarget(), 0, 0, 0)
+		jzPos := c.f.currentPos()
+		trg := c.f.pushTarget(-1)
+		c.expression()
+		first := c.f.popTarget()
+		if trg != first {
+			c.f.addInstruction(sqvm.OpMove, trg, first, 0, 0)
+		}
+		endFirst := c.f.currentPos()
+		c.f.addInstruction(sqvm.OpJmp, 0, 0, 0, 0)
+		c.expect(':')
+		jmpPos := c.f.currentPos()
+		c.expression()
+		second := c.f.popTarget()
+		if trg != second {
+			c.f.addInstruction(sqvm.OpMove, trg, second, 0, 0)
+		}
+		c.f.setInstructionParam(jmpPos, 1, c.f.currentPos()-jmpPos)
+		c.f.setInstructionParam(jzPos, 1, endFirst-jzPos+1)
+		c.f.snoozeOpt()
+	}
+
+	c.es = es
+}
+
+func (c *compiler) invokeExpression(f func()) {
+	es := c.es
+	c.es = expState{etype: exprValue, epos: -1}
+	f()
+	c.es = es
 }
 
-func (c *compiler) prefixedExpression() error {
-	if err := c.factor(); err != nil {
-		return err
+func (c *compiler) binaryExpression(op sqvm.Opcode, f func(), op3 int) {
+	c.lex()
+	c.invokeExpression(f)
+	op1 := c.f.popTarget()
+	op2 := c.f.popTarget()
+	c.f.addInstruction(op, c.f.pushTarget(-1), op1, op2, op3)
+	c.es.etype = exprValue
+}
+
+func (c *compiler) logicalOrExpression() {
+	c.logicalAndExpression()
+	if c.token == tokens.Or {
+		c.shortCircuit(sqvm.OpOr, c.logicalOrExpression)
+	}
+}
+
+func (c *compiler) logicalAndExpression() {
+	c.bitwiseOrExpression()
+	if c.token == tokens.And {
+		c.shortCircuit(sqvm.OpAnd, c.logicalAndExpression)
 	}
+}
+
+func (c *compiler) shortCircuit(op sqvm.Opcode, f func()) {
+	first := c.f.popTarget()
+	trg := c.f.pushTarget(-1)
+	c.f.addInstruction(op, trg, 0, first, 0)
+	jPos := c.f.currentPos()
+	if trg != first {
+		c.f.addInstruction(sqvm.OpMove, trg, first, 0, 0)
+	}
+	c.lex()
+	c.invokeExpression(f)
+	c.f.snoozeOpt()
+	second := c.f.popTarget()
+	if trg != second {
+		c.f.addInstruction(sqvm.OpMove, trg, second, 0, 0)
+	}
+	c.f.snoozeOpt()
+	c.f.setInstructionParam(jPos, 1, c.f.currentPos()-jPos)
+	c.es.etype = exprValue
+}
+
+func (c *compiler) bitwiseOrExpression() {
+	c.bitwiseXorExpression()
+	for c.token == '|' {
+		c.binaryExpression(sqvm.OpBitW, c.bitwiseXorExpression, sqvm.BitwOr)
+	}
+}
 
+func (c *compiler) bitwiseXorExpression() {
+	c.bitwiseAndExpression()
+	for c.token == '^' {
+		c.binaryExpression(sqvm.OpBitW, c.bitwiseAndExpression, sqvm.BitwXor)
+	}
+}
+
+func (c *compiler) bitwiseAndExpression() {
+	c.equalityExpression()
+	for c.token == '&' {
+		c.binaryExpression(sqvm.OpBitW, c.equalityExpression, sqvm.BitwAnd)
+	}
+}
+
+func (c *compiler) equalityExpression() {
+	c.compareExpression()
+	for {
+		switch c.token {
+		case tokens.Equal:
+			c.binaryExpression(sqvm.OpEq, c.compareExpression, 0)
+		case tokens.NotEqual:
+			c.binaryExpression(sqvm.OpNe, c.compareExpression, 0)
+		case tokens.ThreeWayCompare:
+			c.binaryExpression(sqvm.OpCmp, c.compareExpression, sqvm.Cmp3Way)
+		default:
+			return
+		}
+	}
+}
+
+func (c *compiler) compareExpression() {
+	c.shiftExpression()
 	for {
 		switch c.token {
+		case '>':
+			c.binaryExpression(sqvm.OpCmp, c.shiftExpression, sqvm.CmpGreater)
+		case '<':
+			c.binaryExpression(sqvm.OpCmp, c.shiftExpression, sqvm.CmpLess)
+		case tokens.GreaterEqual:
+			c.binaryExpression(sqvm.OpCmp, c.shiftExpression, sqvm.CmpGreaterEqual)
+		case tokens.LessEqual:
+			c.binaryExpression(sqvm.OpCmp, c.shiftExpression, sqvm.CmpLessEqual)
+		case tokens.In:
+			c.binaryExpression(sqvm.OpExists, c.shiftExpression, 0)
+		case tokens.InstanceOf:
+			c.binaryExpression(sqvm.OpInstanceOf, c.shiftExpression, 0)
+		default:
+			return
+		}
+	}
+}
+
+func (c *compiler) shiftExpression() {
+	c.plusExpression()
+	for {
+		switch c.token {
+		case tokens.UnsignedShiftRight:
+			c.binaryExpression(sqvm.OpBitW, c.plusExpression, sqvm.BitwUShiftRight)
+		case tokens.ShiftLeft:
+			c.binaryExpression(sqvm.OpBitW, c.plusExpression, sqvm.BitwShiftLeft)
+		case tokens.ShiftRight:
+			c.binaryExpression(sqvm.OpBitW, c.plusExpression, sqvm.BitwShiftRight)
+		default:
+			return
+		}
+	}
+}
+
+func arithOpByToken(tok tokens.Token) sqvm.Opcode {
+	switch tok {
+	case tokens.PlusEqual, '+':
+		return sqvm.OpAdd
+	case tokens.MinusEqual, '-':
+		return sqvm.OpSub
+	case tokens.MultiplyEqual, '*':
+		return sqvm.OpMul
+	case tokens.DivideEqual, '/':
+		return sqvm.OpDiv
+	case tokens.ModuloEqual, '%':
+		return sqvm.OpMod
+	}
+	panic("unknown arithmetic token")
+}
+
+func compArithCharByToken(tok tokens.Token) byte {
+	switch tok {
+	case tokens.MinusEqual:
+		return '-'
+	case tokens.PlusEqual:
+		return '+'
+	case tokens.MultiplyEqual:
+		return '*'
+	case tokens.DivideEqual:
+		return '/'
+	case tokens.ModuloEqual:
+		return '%'
+	}
+	panic("unknown compound arithmetic token")
+}
+
+func (c *compiler) plusExpression() {
+	c.multiplyExpression()
+	for c.token == '+' || c.token == '-' {
+		c.binaryExpression(arithOpByToken(c.token), c.multiplyExpression, 0)
+	}
+}
+
+func (c *compiler) multiplyExpression() {
+	c.prefixedExpression()
+	for c.token == '*' || c.token == '/' || c.token == '%' {
+		c.binaryExpression(arithOpByToken(c.token), c.prefixedExpression, 0)
+	}
+}
+
+// if 'pos' != -1 the previous variable is a local variable
+func (c *compiler) prefixedExpression() {
+	pos := c.factor()
+
+	for {
+		switch c.token {
+		case '.':
+			pos = -1
+			c.lex()
+
+			id := c.expect(tokens.Identifier).String
+			c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+			if c.es.etype == exprBase {
+				c.emit2ArgsOp(sqvm.OpGet, 0)
+				pos = c.f.topTarget()
+				c.es.etype = exprValue
+				c.es.epos = pos
+			} else {
+				if c.needGet() {
+					c.emit2ArgsOp(sqvm.OpGet, 0)
+				}
+				c.es.etype = exprObject
+			}
+		case '[':
+			if c.lastToken == '\n' {
+				c.fail(ErrBrokenDeref)
+			}
+			c.lex()
+			c.expression()
+			c.expect(']')
+			pos = -1
+			if c.es.etype == exprBase {
+				c.emit2ArgsOp(sqvm.OpGet, 0)
+				pos = c.f.topTarget()
+				c.es.etype = exprValue
+				c.es.epos = pos
+			} else {
+				if c.needGet() {
+					c.emit2ArgsOp(sqvm.OpGet, 0)
+				}
+				c.es.etype = exprObject
+			}
+		case tokens.Decrease, tokens.Increase:
+			if c.isEndOfStatement() {
+				return
+			}
+			diff := 1
+			if c.token == tokens.Decrease {
+				diff = -1
+			}
+			c.lex()
+			switch c.es.etype {
+			case exprValue:
+				c.fail(ErrIncDecExpression)
+			case exprObject, exprBase:
+				if c.es.doNotGet {
+					c.fail(ErrIncDecExpression)
+				}
+				c.emit2ArgsOp(sqvm.OpPInc, diff)
+			case exprLocal:
+				src := c.f.popTarget()
+				c.f.addInstruction(sqvm.OpPIncL, c.f.pushTarget(-1), src, 0, diff)
+			case exprOuter:
+				tmp1 := c.f.pushTarget(-1)
+				tmp2 := c.f.pushTarget(-1)
+				c.f.addInstruction(sqvm.OpGetOuter, tmp2, c.es.epos, 0, 0)
+				c.f.addInstruction(sqvm.OpPIncL, tmp1, tmp2, 0, diff)
+				c.f.addInstruction(sqvm.OpSetOuter, tmp2, c.es.epos, tmp2, 0)
+				c.f.popTarget()
+			}
+			return
 		case '(':
+			switch c.es.etype {
+			case exprObject:
+				key := c.f.popTarget()           // location of the key
+				table := c.f.popTarget()         // location of the object
+				closure := c.f.pushTarget(-1)    // location for the closure
+				thisTarget := c.f.pushTarget(-1) // location for 'this' pointer
+				c.f.addInstruction(sqvm.OpPrepCall, closure, key, table, thisTarget)
+			case exprOuter:
+				c.f.addInstruction(sqvm.OpGetOuter, c.f.pushTarget(-1), c.es.epos, 0, 0)
+				c.f.addInstruction(sqvm.OpMove, c.f.pushTarget(-1), 0, 0, 0)
+			default:
+				c.f.addInstruction(sqvm.OpMove, c.f.pushTarget(-1), 0, 0, 0)
+			}
+			c.es.etype = exprValue
 			c.lex()
-			c.functionCallArgs()
+			c.functionCallArgs(false)
 		default:
-			return nil
+			return
 		}
 	}
 }
 
-func (c *compiler) factor() error {
+func (c *compiler) factor() int {
 	switch c.token {
-	case tokens.Identifier:
-		id := c.f.makeString(c.tokenInfo.String)
-		fmt.Printf("factor: identifier %d->%q\n", id, c.tokenInfo.String)
-		c.lex()
 	case tokens.StringLiteral:
-		fmt.Printf("factor: string\n")
+		c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(c.tokenInfo.String), 0, 0)
+		c.lex()
+	case tokens.Base:
+		c.lex()
+		c.f.addInstruction(sqvm.OpGetBase, c.f.pushTarget(-1), 0, 0, 0)
+		c.es.etype = exprBase
+		c.es.epos = c.f.topTarget()
+		return c.es.epos
+	case tokens.Identifier, tokens.Constructor, tokens.This:
+		id := c.tokenInfo.String
+		c.lex()
 
+		if pos := c.f.getLocalVariable(id); pos != -1 {
+			// Handle a local variable (includes 'this')
+			c.f.pushTarget(pos)
+			c.es.etype = exprLocal
+			c.es.epos = pos
+		} else if pos := c.f.getOuterVariable(id); pos != -1 {
+			// Handle a free var
+			if c.needGet() {
+				c.es.epos = c.f.pushTarget(-1)
+				c.f.addInstruction(sqvm.OpGetOuter, c.es.epos, pos, 0, 0)
+			} else {
+				c.es.etype = exprOuter
+				c.es.epos = pos
+			}
+		} else if constant, ok := c.constant(id); ok {
+			// Handle named constant
+			constVal := constant
+			if constant.Type() == sqvm.TypeTable {
+				c.expect('.')
+				constID := c.expect(tokens.Identifier).String
+				if constVal, ok = c.enumMember(constant, constID); !ok {
+					c.errorf("invalid constant [%s.%s]", id, constID)
+				}
+			}
+			c.es.epos = c.f.pushTarget(-1)
+
+			// generate direct or literal function depending on size
+			switch constVal.Type() {
+			case sqvm.TypeInteger:
+				c.emitLoadConstInt(constVal.Integer(), c.es.epos)
+			case sqvm.TypeFloat:
+				c.emitLoadConstFloat(constVal.Float(), c.es.epos)
+			case sqvm.TypeBool:
+				loadBool := 0
+				if constVal.Bool() {
+					loadBool = 1
+				}
+				c.f.addInstruction(sqvm.OpLoadBool, c.es.epos, loadBool, 0, 0)
+			default:
+				c.f.addInstruction(sqvm.OpLoad, c.es.epos, c.f.constant(constVal), 0, 0)
+			}
+			c.es.etype = exprValue
+		} else {
+			// Handle a non-local variable, aka a field. Push the 'this'
+			// pointer on the virtual stack (always found in offset 0, so no
+			// instruction needs to be generated), and push the key next.
+			// If we are not using the variable as a deref expression,
+			// generate the OpGet instruction.
+			c.f.pushTarget(0)
+			c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+			if c.needGet() {
+				c.emit2ArgsOp(sqvm.OpGet, 0)
+			}
+			c.es.etype = exprObject
+		}
+		return c.es.epos
+	case tokens.DoubleColon:
+		c.f.addInstruction(sqvm.OpLoadRoot, c.f.pushTarget(-1), 0, 0, 0)
+		c.es.etype = exprObject
+		c.token = '.' // drop into prefixedExpression, case '.'
+		c.es.epos = -1
+		return c.es.epos
+	case tokens.Null:
+		c.f.addInstruction(sqvm.OpLoadNulls, c.f.pushTarget(-1), 1, 0, 0)
 		c.lex()
 	case tokens.Integer:
-		fmt.Printf("factor: integer\n")
-
+		c.emitLoadConstInt(int64(c.tokenInfo.Integer), -1)
 		c.lex()
 	case tokens.Float:
-		fmt.Printf("factor: float\n")
-
+		c.emitLoadConstFloat(c.tokenInfo.Float, -1)
+		c.lex()
+	case tokens.True, tokens.False:
+		value := 0
+		if c.token == tokens.True {
+			value = 1
+		}
+		c.f.addInstruction(sqvm.OpLoadBool, c.f.pushTarget(-1), value, 0, 0)
+		c.lex()
+	case '[':
+		c.f.addInstruction(sqvm.OpNewObj, c.f.pushTarget(-1), 0, 0, sqvm.NewObjArray)
+		aPos := c.f.currentPos()
+		key := 0
+		c.lex()
+		for c.token != ']' {
+			c.expression()
+			if c.token == ',' {
+				c.lex()
+			}
+			val := c.f.popTarget()
+			array := c.f.topTarget()
+			c.f.addInstruction(sqvm.OpAppendArray, array, val, sqvm.AppendStack, 0)
+			key++
+		}
+		c.f.setInstructionParam(aPos, 1, key)
+		c.lex()
+	case '{':
+		c.f.addInstruction(sqvm.OpNewObj, c.f.pushTarget(-1), 0, 0, sqvm.NewObjTable)
+		c.lex()
+		c.parseTableOrClass(',', '}')
+	case tokens.Function:
+		c.functionExpression(false)
+	case '@':
+		c.functionExpression(true)
+	case tokens.Class:
+		c.lex()
+		c.classExpression()
+	case '-':
+		c.lex()
+		switch c.token {
+		case tokens.Integer:
+			c.emitLoadConstInt(-int64(c.tokenInfo.Integer), -1)
+			c.lex()
+		case tokens.Float:
+			c.emitLoadConstFloat(-c.tokenInfo.Float, -1)
+			c.lex()
+		default:
+			c.unaryOp(sqvm.OpNeg)
+		}
+	case '!':
+		c.lex()
+		c.unaryOp(sqvm.OpNot)
+	case '~':
+		c.lex()
+		if c.token == tokens.Integer {
+			c.emitLoadConstInt(^int64(c.tokenInfo.Integer), -1)
+			c.lex()
+			break
+		}
+		c.unaryOp(sqvm.OpBWNot)
+	case tokens.Typeof:
+		c.lex()
+		c.unaryOp(sqvm.OpTypeOf)
+	case tokens.Resume:
+		c.lex()
+		c.unaryOp(sqvm.OpResume)
+	case tokens.Clone:
+		c.lex()
+		c.unaryOp(sqvm.OpClone)
+	case tokens.RawCall:
+		c.lex()
+		c.expect('(')
+		c.functionCallArgs(true)
+	case tokens.Decrease, tokens.Increase:
+		c.prefixIncDec(c.token)
+	case tokens.Delete:
+		c.deleteExpression()
+	case '(':
+		c.lex()
+		c.commaExpression()
+		c.expect(')')
+	case tokens.Line:
+		c.emitLoadConstInt(int64(c.tokenInfo.Line), -1)
+		c.lex()
+	case tokens.File:
+		c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(c.sourceName), 0, 0)
 		c.lex()
 	default:
-		return ErrExpectExpression
+		c.fail(ErrExpectExpression)
+	}
+	c.es.etype = exprValue
+	return -1
+}
+
+func (c *compiler) emitLoadConstInt(value int64, target int) {
+	if target < 0 {
+		target = c.f.pushTarget(-1)
 	}
+	if value <= math.MaxInt32 && value > math.MinInt32 { // does it fit in 32 bits?
+		c.f.addInstruction(sqvm.OpLoadInt, target, int(value), 0, 0)
+	} else {
+		c.f.addInstruction(sqvm.OpLoad, target, c.f.constant(sqvm.IntegerValue(value)), 0, 0)
+	}
+}
+
+func (c *compiler) emitLoadConstFloat(value float64, target int) {
+	if target < 0 {
+		target = c.f.pushTarget(-1)
+	}
+	// Floats are 64 bit wide and never fit in the instruction
+	c.f.addInstruction(sqvm.OpLoad, target, c.f.constant(sqvm.FloatValue(value)), 0, 0)
+}
 
-	return nil
+func (c *compiler) unaryOp(op sqvm.Opcode) {
+	c.prefixedExpression()
+	src := c.f.popTarget()
+	c.f.addInstruction(op, c.f.pushTarget(-1), src, 0, 0)
+}
+
+func (c *compiler) needGet() bool {
+	switch c.token {
+	case '=', '(', tokens.NewSlot, tokens.ModuloEqual, tokens.MultiplyEqual,
+		tokens.DivideEqual, tokens.MinusEqual, tokens.PlusEqual:
+		return false
+	case tokens.Increase, tokens.Decrease:
+		if !c.isEndOfStatement() {
+			return false
+		}
+	}
+	return !c.es.doNotGet || c.token == '.' || c.token == '['
 }
 
-func (c *compiler) functionCallArgs() {
+func (c *compiler) functionCallArgs(rawCall bool) {
+	nArgs := 1 // this
 	for c.token != ')' {
 		c.expression()
+		c.moveIfCurrentTargetIsLocal()
+		nArgs++
 		if c.token == ',' {
 			c.lex()
 			if c.token == ')' {
-				panic(ErrExpectArgument)
+				c.fail(ErrExpectArgument)
 			}
 		}
 	}
 	c.lex()
+	if rawCall {
+		if nArgs < 3 {
+			c.fail(ErrRawCallArgs)
+		}
+		nArgs -= 2 // removes callee and this from count
+	}
+	for i := 0; i < nArgs-1; i++ {
+		c.f.popTarget()
+	}
+	stackBase := c.f.popTarget()
+	closure := c.f.popTarget()
+	c.f.addInstruction(sqvm.OpCall, c.f.pushTarget(-1), closure, stackBase, nArgs)
 }
 
-func (c *compiler) optionalSemicolon() {
-	if c.token == ';' {
+func (c *compiler) parseTableOrClass(separator, terminator tokens.Token) {
+	tPos := c.f.currentPos()
+	nKeys := 0
+	for c.token != terminator {
+		hasAttrs := false
+		isStatic := false
+		// check if is an attribute
+		if separator == ';' {
+			if c.token == tokens.AttributeOpen {
+				c.f.addInstruction(sqvm.OpNewObj, c.f.pushTarget(-1), 0, 0, sqvm.NewObjTable)
+				c.lex()
+				c.parseTableOrClass(',', tokens.AttributeClose)
+				hasAttrs = true
+			}
+			if c.token == tokens.Static {
+				isStatic = true
+				c.lex()
+			}
+		}
+		switch c.token {
+		case tokens.Function, tokens.Constructor:
+			tk := c.token
+			c.lex()
+			id := "constructor"
+			if tk == tokens.Function {
+				id = c.expect(tokens.Identifier).String
+			}
+			c.expect('(')
+			c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+			c.createFunction(id, false)
+			c.f.addInstruction(sqvm.OpClosure, c.f.pushTarget(-1), len(c.f.functions)-1, 0, 0)
+		case '[':
+			c.lex()
+			c.commaExpression()
+			c.expect(']')
+			c.expect('=')
+			c.expression()
+		case tokens.StringLiteral:
+			if separator == ',' { // JSON style, only works for tables
+				str := c.expect(tokens.StringLiteral).String
+				c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(str), 0, 0)
+				c.expect(':')
+				c.expression()
+				break
+			}
+			fallthrough
+		default:
+			id := c.expect(tokens.Identifier).String
+			c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+			c.expect('=')
+			c.expression()
+		}
+		if c.token == separator { // optional comma/semicolon
+			c.lex()
+		}
+		nKeys++
+		val := c.f.popTarget()
+		key := c.f.popTarget()
+		if hasAttrs {
+			c.f.popTarget() // attributes are expected right below the key
+		}
+		flags := 0
+		if hasAttrs {
+			flags |= sqvm.NewSlotAttributes
+		}
+		if isStatic {
+			flags |= sqvm.NewSlotStatic
+		}
+		table := c.f.topTarget()
+		if separator == ',' { // hack recognizes a table from the separator
+			c.f.addInstruction(sqvm.OpNewSlot, 0xFF, table, key, val)
+		} else {
+			// this is for classes only as it invokes _newmember
+			c.f.addInstruction(sqvm.OpNewSlotA, flags, table, key, val)
+		}
+	}
+	if separator == ',' { // hack recognizes a table from the separator
+		c.f.setInstructionParam(tPos, 1, nKeys)
+	}
+	c.lex()
+}
+
+func (c *compiler) localDeclStatement() {
+	c.lex()
+	if c.token == tokens.Function {
 		c.lex()
+		name := c.expect(tokens.Identifier).String
+		c.expect('(')
+		c.createFunction(name, false)
+		c.f.addInstruction(sqvm.OpClosure, c.f.pushTarget(-1), len(c.f.functions)-1, 0, 0)
+		c.f.popTarget()
+		c.f.pushLocalVariable(name)
 		return
 	}
 
-	if !c.isEndOfStatement() {
-		panic(ErrExpectStatementEnd)
+	for {
+		name := c.expect(tokens.Identifier).String
+		if c.token == '=' {
+			c.lex()
+			c.expression()
+			src := c.f.popTarget()
+			dest := c.f.pushTarget(-1)
+			if dest != src {
+				c.f.addInstruction(sqvm.OpMove, dest, src, 0, 0)
+			}
+		} else {
+			c.f.addInstruction(sqvm.OpLoadNulls, c.f.pushTarget(-1), 1, 0, 0)
+		}
+		c.f.popTarget()
+		c.f.pushLocalVariable(name)
+		if c.token != ',' {
+			break
+		}
+		c.lex()
 	}
 }
 
-func (c *compiler) isEndOfStatement() bool {
-	return c.token == 0 || c.lastToken == '\n' || c.token == '}' || c.token == ';'
+func (c *compiler) ifBlock() {
+	if c.token == '{' {
+		old := c.beginScope()
+		c.lex()
+		c.statements()
+		c.expect('}')
+		c.endScope(old)
+	} else {
+		c.statement(true)
+		if c.lastToken != '}' && c.lastToken != ';' {
+			c.optionalSemicolon()
+		}
+	}
+}
+
+func (c *compiler) ifStatement() {
+	hasElse := false
+	c.lex()
+	c.expect('(')
+	c.commaExpression()
+	c.expect(')')
+	c.f.addInstruction(sqvm.OpJz, c.f.popTarget(), 0, 0, 0)
+	jnePos := c.f.currentPos()
+
+	c.ifBlock()
+
+	endIfBlock := c.f.currentPos()
+	if c.token == tokens.Else {
+		hasElse = true
+		c.f.addInstruction(sqvm.OpJmp, 0, 0, 0, 0)
+		jmpPos := c.f.currentPos()
+		c.lex()
+		c.ifBlock()
+		c.f.setInstructionParam(jmpPos, 1, c.f.currentPos()-jmpPos)
+	}
+	offset := endIfBlock - jnePos
+	if hasElse {
+		offset++
+	}
+	c.f.setInstructionParam(jnePos, 1, offset)
+}
+
+func (c *compiler) whileStatement() {
+	jmpPos := c.f.currentPos()
+	c.lex()
+	c.expect('(')
+	c.commaExpression()
+	c.expect(')')
+
+	block := c.beginBreakableBlock()
+	c.f.addInstruction(sqvm.OpJz, c.f.popTarget(), 0, 0, 0)
+	jzPos := c.f.currentPos()
+	old := c.beginScope()
+
+	c.statement(true)
+
+	c.endScope(old)
+	c.f.addInstruction(sqvm.OpJmp, 0, jmpPos-c.f.currentPos()-1, 0, 0)
+	c.f.setInstructionParam(jzPos, 1, c.f.currentPos()-jzPos)
+
+	c.endBreakableBlock(block, jmpPos)
+}
+
+func (c *compiler) doWhileStatement() {
+	c.lex()
+	jmpTarget := c.f.currentPos()
+	block := c.beginBreakableBlock()
+	old := c.beginScope()
+	c.statement(true)
+	c.endScope(old)
+	c.expect(tokens.While)
+	continueTarget := c.f.currentPos()
+	c.expect('(')
+	c.commaExpression()
+	c.expect(')')
+	c.f.addInstruction(sqvm.OpJz, c.f.popTarget(), 1, 0, 0)
+	c.f.addInstruction(sqvm.OpJmp, 0, jmpTarget-c.f.currentPos()-1, 0, 0)
+	c.endBreakableBlock(block, continueTarget)
+}
+
+func (c *compiler) forStatement() {
+	c.lex()
+	old := c.beginScope()
+	c.expect('(')
+	if c.token == tokens.Local {
+		c.localDeclStatement()
+	} else if c.token != ';' {
+		c.commaExpression()
+		c.f.popTarget()
+	}
+	c.expect(';')
+	c.f.snoozeOpt()
+	jmpPos := c.f.currentPos()
+	jzPos := -1
+	if c.token != ';' {
+		c.commaExpression()
+		c.f.addInstruction(sqvm.OpJz, c.f.popTarget(), 0, 0, 0)
+		jzPos = c.f.currentPos()
+	}
+	c.expect(';')
+	c.f.snoozeOpt()
+	expStart := c.f.currentPos() + 1
+	if c.token != ')' {
+		c.commaExpression()
+		c.f.popTarget()
+	}
+	c.expect(')')
+	c.f.snoozeOpt()
+	expEnd := c.f.currentPos()
+	expSize := expEnd - expStart + 1
+	var exp []sqvm.Instruction
+	if expSize > 0 {
+		exp = append(exp, c.f.instructions[expStart:expStart+expSize]...)
+		c.f.popInstructions(expSize)
+	}
+	block := c.beginBreakableBlock()
+	c.statement(true)
+	continueTarget := c.f.currentPos()
+	for _, i := range exp {
+		c.f.emit(i)
+	}
+	c.f.addInstruction(sqvm.OpJmp, 0, jmpPos-c.f.currentPos()-1, 0, 0)
+	if jzPos > 0 {
+		c.f.setInstructionParam(jzPos, 1, c.f.currentPos()-jzPos)
+	}
+
+	c.endBreakableBlock(block, continueTarget)
+
+	c.endScope(old)
+}
+
+func (c *compiler) foreachStatement() {
+	c.lex()
+	c.expect('(')
+	valName := c.expect(tokens.Identifier).String
+	idxName := "@INDEX@"
+	if c.token == ',' {
+		idxName = valName
+		c.lex()
+		valName = c.expect(tokens.Identifier).String
+	}
+	c.expect(tokens.In)
+
+	// save the stack size
+	old := c.beginScope()
+	// put the table in the stack (evaluate the table expression)
+	c.expression()
+	c.expect(')')
+	container := c.f.topTarget()
+	// push the index local var
+	indexPos := c.f.pushLocalVariable(idxName)
+	c.f.addInstruction(sqvm.OpLoadNulls, indexPos, 1, 0, 0)
+	// push the value local var
+	valuePos := c.f.pushLocalVariable(valName)
+	c.f.addInstruction(sqvm.OpLoadNulls, valuePos, 1, 0, 0)
+	// push reference index, an invalid id makes it inaccessible
+	itrPos := c.f.pushLocalVariable("@ITERATOR@")
+	c.f.addInstruction(sqvm.OpLoadNulls, itrPos, 1, 0, 0)
+	jmpPos := c.f.currentPos()
+	c.f.addInstruction(sqvm.OpForeach, container, 0, indexPos, 0)
+	foreachPos := c.f.currentPos()
+	c.f.addInstruction(sqvm.OpPostForeach, container, 0, indexPos, 0)
+	// generate the statement code
+	block := c.beginBreakableBlock()
+	c.statement(true)
+	c.f.addInstruction(sqvm.OpJmp, 0, jmpPos-c.f.currentPos()-1, 0, 0)
+	c.f.setInstructionParam(foreachPos, 1, c.f.currentPos()-foreachPos)
+	c.f.setInstructionParam(foreachPos+1, 1, c.f.currentPos()-foreachPos)
+	c.endBreakableBlock(block, foreachPos-1)
+	// restore the local variable stack (remove index, val and ref idx)
+	c.f.popTarget()
+	c.endScope(old)
+}
+
+func (c *compiler) switchStatement() {
+	c.lex()
+	c.expect('(')
+	c.commaExpression()
+	c.expect(')')
+	c.expect('{')
+	expr := c.f.topTarget()
+	first := true
+	toNextCondJmp := -1
+	skipCondJmp := -1
+	nBreaks := len(c.f.unresolvedBreaks)
+	c.f.breakTargets = append(c.f.breakTargets, 0)
+	for c.token == tokens.Case {
+		if !first {
+			c.f.addInstruction(sqvm.OpJmp, 0, 0, 0, 0)
+			skipCondJmp = c.f.currentPos()
+			c.f.setInstructionParam(toNextCondJmp, 1, c.f.currentPos()-toNextCondJmp)
+		}
+		// condition
+		c.lex()
+		c.expression()
+		c.expect(':')
+		trg := c.f.popTarget()
+		eqTarget := trg
+		local := c.f.isLocal(trg)
+		if local {
+			eqTarget = c.f.pushTarget(-1) // we need to allocate an extra reg
+		}
+		c.f.addInstruction(sqvm.OpEq, eqTarget, trg, expr, 0)
+		c.f.addInstruction(sqvm.OpJz, eqTarget, 0, 0, 0)
+		if local {
+			c.f.popTarget()
+		}
+
+		// end condition
+		if skipCondJmp != -1 {
+			c.f.setInstructionParam(skipCondJmp, 1, c.f.currentPos()-skipCondJmp)
+		}
+		toNextCondJmp = c.f.currentPos()
+		old := c.beginScope()
+		c.statements()
+		c.endScope(old)
+		first = false
+	}
+	if toNextCondJmp != -1 {
+		c.f.setInstructionParam(toNextCondJmp, 1, c.f.currentPos()-toNextCondJmp)
+	}
+	if c.token == tokens.Default {
+		c.lex()
+		c.expect(':')
+		old := c.beginScope()
+		c.statements()
+		c.endScope(old)
+	}
+	c.expect('}')
+	c.f.popTarget()
+	if n := len(c.f.unresolvedBreaks) - nBreaks; n > 0 {
+		c.resolveBreaks(n)
+	}
+	c.f.breakTargets = c.f.breakTargets[:len(c.f.breakTargets)-1]
+}
+
+func (c *compiler) functionStatement() {
+	c.lex()
+	id := c.expect(tokens.Identifier).String
+	c.f.pushTarget(0)
+	c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+	if c.token == tokens.DoubleColon {
+		c.emit2ArgsOp(sqvm.OpGet, 0)
+	}
+
+	for c.token == tokens.DoubleColon {
+		c.lex()
+		id = c.expect(tokens.Identifier).String
+		c.f.addInstruction(sqvm.OpLoad, c.f.pushTarget(-1), c.f.stringConstant(id), 0, 0)
+		if c.token == tokens.DoubleColon {
+			c.emit2ArgsOp(sqvm.OpGet, 0)
+		}
+	}
+	c.expect('(')
+	c.createFunction(id, false)
+	c.f.addInstruction(sqvm.OpClosure, c.f.pushTarget(-1), len(c.f.functions)-1, 0, 0)
+	c.emitDerefOp(sqvm.OpNewSlot)
+	c.f.popTarget()
+}
+
+func (c *compiler) classStatement() {
+	c.lex()
+	es := c.es
+	c.es.doNotGet = true
+	c.prefixedExpression()
+	switch c.es.etype {
+	case exprValue:
+		c.fail(ErrInvalidClassName)
+	case exprObject, exprBase:
+		c.classExpression()
+		c.emitDerefOp(sqvm.OpNewSlot)
+		c.f.popTarget()
+	default:
+		c.fail(ErrClassInLocal)
+	}
+	c.es = es
+}
+
+func (c *compiler) expectScalar() sqvm.Object {
+	var val sqvm.Object
+	switch c.token {
+	case tokens.Integer:
+		val = sqvm.IntegerValue(int64(c.tokenInfo.Integer))
+	case tokens.Float:
+		val = sqvm.FloatValue(c.tokenInfo.Float)
+	case tokens.StringLiteral:
+		val = sqvm.StringValue(c.tokenInfo.String)
+	case tokens.True, tokens.False:
+		val = sqvm.BoolValue(c.token == tokens.True)
+	case '-':
+		c.lex()
+		switch c.token {
+		case tokens.Integer:
+			val = sqvm.IntegerValue(-int64(c.tokenInfo.Integer))
+		case tokens.Float:
+			val = sqvm.FloatValue(-c.tokenInfo.Float)
+		default:
+			c.fail(ErrExpectScalar)
+		}
+	default:
+		c.fail(ErrExpectScalar)
+	}
+	c.lex()
+	return val
+}
+
+func (c *compiler) enumStatement() {
+	c.lex()
+	id := c.expect(tokens.Identifier).String
+	c.expect('{')
+
+	c.vm.NewTable()
+	nVal := int64(0)
+	for c.token != '}' {
+		key := c.expect(tokens.Identifier).String
+		var val sqvm.Object
+		if c.token == '=' {
+			c.lex()
+			val = c.expectScalar()
+		} else {
+			val = sqvm.IntegerValue(nVal)
+			nVal++
+		}
+		c.vm.PushString(key)
+		c.vm.PushObject(val)
+		c.vm.NewSlot(-3, false)
+		if c.token == ',' {
+			c.lex()
+		}
+	}
+	c.setConstant(id, c.vm.GetStackObject(-1))
+	c.vm.Pop(1)
+	c.lex()
+}
+
+func (c *compiler) tryCatchStatement() {
+	c.lex()
+	c.f.addInstruction(sqvm.OpPushTrap, 0, 0, 0, 0)
+	c.f.traps++
+	if n := len(c.f.breakTargets); n > 0 {
+		c.f.breakTargets[n-1]++
+	}
+	if n := len(c.f.continueTargets); n > 0 {
+		c.f.continueTargets[n-1]++
+	}
+	trapPos := c.f.currentPos()
+	old := c.beginScope()
+	c.statement(true)
+	c.endScope(old)
+	c.f.traps--
+	c.f.addInstruction(sqvm.OpPopTrap, 1, 0, 0, 0)
+	if n := len(c.f.breakTargets); n > 0 {
+		c.f.breakTargets[n-1]--
+	}
+	if n := len(c.f.continueTargets); n > 0 {
+		c.f.continueTargets[n-1]--
+	}
+	c.f.addInstruction(sqvm.OpJmp, 0, 0, 0, 0)
+	jmpPos := c.f.currentPos()
+	c.f.setInstructionParam(trapPos, 1, c.f.currentPos()-trapPos)
+	c.expect(tokens.Catch)
+	c.expect('(')
+	exID := c.expect(tokens.Identifier).String
+	c.expect(')')
+
+	old = c.beginScope()
+	exTarget := c.f.pushLocalVariable(exID)
+	c.f.setInstructionParam(trapPos, 0, exTarget)
+	c.statement(true)
+	c.f.setInstructionParams(jmpPos, 0, c.f.currentPos()-jmpPos, 0, 0)
+	c.endScope(old)
+}
+
+func (c *compiler) functionExpression(lambda bool) {
+	c.lex()
+	c.expect('(')
+	c.createFunction("", lambda)
+	c.f.addInstruction(sqvm.OpClosure, c.f.pushTarget(-1), len(c.f.functions)-1, 0, 0)
+}
+
+func (c *compiler) classExpression() {
+	base := -1
+	attrs := -1
+	if c.token == tokens.Extends {
+		c.lex()
+		c.expression()
+		base = c.f.topTarget()
+	}
+	if c.token == tokens.AttributeOpen {
+		c.lex()
+		c.f.addInstruction(sqvm.OpNewObj, c.f.pushTarget(-1), 0, 0, sqvm.NewObjTable)
+		c.parseTableOrClass(',', tokens.AttributeClose)
+		attrs = c.f.topTarget()
+	}
+	c.expect('{')
+	if attrs != -1 {
+		c.f.popTarget()
+	}
+	if base != -1 {
+		c.f.popTarget()
+	}
+	c.f.addInstruction(sqvm.OpNewObj, c.f.pushTarget(-1), base, attrs, sqvm.NewObjClass)
+	c.parseTableOrClass(';', '}')
+}
+
+func (c *compiler) deleteExpression() {
+	c.lex()
+	es := c.es
+	c.es.doNotGet = true
+	c.prefixedExpression()
+	switch c.es.etype {
+	case exprValue:
+		c.fail(ErrDeleteExpression)
+	case exprObject, exprBase:
+		c.emit2ArgsOp(sqvm.OpDelete, 0)
+	default:
+		c.fail(ErrDeleteLocal)
+	}
+	c.es = es
+}
+
+func (c *compiler) prefixIncDec(token tokens.Token) {
+	diff := 1
+	if token == tokens.Decrease {
+		diff = -1
+	}
+	c.lex()
+	es := c.es
+	c.es.doNotGet = true
+	c.prefixedExpression()
+	switch c.es.etype {
+	case exprValue:
+		c.fail(ErrIncDecExpression)
+	case exprObject, exprBase:
+		c.emit2ArgsOp(sqvm.OpInc, diff)
+	case exprLocal:
+		src := c.f.topTarget()
+		c.f.addInstruction(sqvm.OpIncL, src, src, 0, diff)
+	case exprOuter:
+		tmp := c.f.pushTarget(-1)
+		c.f.addInstruction(sqvm.OpGetOuter, tmp, c.es.epos, 0, 0)
+		c.f.addInstruction(sqvm.OpIncL, tmp, tmp, 0, diff)
+		c.f.addInstruction(sqvm.OpSetOuter, tmp, c.es.epos, tmp, 0)
+	}
+	c.es = es
+}
+
+func (c *compiler) createFunction(name string, lambda bool) {
+	f := newState(c.f)
+	f.name = name
+	f.addParameter("this")
+	f.sourceName = c.sourceName
+	defParams := 0
+	for c.token != ')' {
+		if c.token == tokens.VarParams {
+			if defParams > 0 {
+				c.fail(ErrVarParamsDefault)
+			}
+			f.addParameter("vargv")
+			f.varParams = true
+			c.lex()
+			if c.token != ')' {
+				c.errorf("expected ')'")
+			}
+			break
+		}
+		paramName := c.expect(tokens.Identifier).String
+		f.addParameter(paramName)
+		if c.token == '=' {
+			c.lex()
+			c.expression()
+			f.addDefaultParam(c.f.topTarget())
+			defParams++
+		} else if defParams > 0 {
+			c.errorf("expected '='")
+		}
+		if c.token == ',' {
+			c.lex()
+		} else if c.token != ')' {
+			c.errorf("expected ')' or ','")
+		}
+	}
+	c.expect(')')
+	for n := 0; n < defParams; n++ {
+		c.f.popTarget()
+	}
+
+	parent := c.f
+	c.f = f
+	if lambda {
+		c.expression()
+		c.f.addInstruction(sqvm.OpReturn, 1, c.f.popTarget(), 0, 0)
+	} else {
+		c.statement(false)
+	}
+	line := c.currentLine()
+	if c.lastToken == '\n' {
+		line = int(c.lastTokenLine)
+	}
+	f.addLineInfos(line, c.lineInfo, true)
+	f.addInstruction(sqvm.OpReturn, 0xFF, 0, 0, 0)
+	f.setStackSize(0)
+
+	c.f = parent
+	c.f.functions = append(c.f.functions, f.makeFuncProto())
 }
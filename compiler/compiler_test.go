@@ -0,0 +1,181 @@
+package compiler_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// eval compiles and runs src and returns the Go value of its result.
+func eval(vm *sqvm.VM, src string) (any, error) {
+	if _, err := compiler.Compile(vm, "test", strings.NewReader(src), false); err != nil {
+		return nil, err
+	}
+	vm.PushRootTable()
+	if err := vm.Call(1, true, false); err != nil {
+		vm.Pop(1)
+		return nil, err
+	}
+	defer vm.Pop(2)
+	return vm.GetGoValue(-1)
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      any
+	}{
+		{"arithmetic", `return 1 + 2 * 3 - 8 / 4 % 3`, int64(5)},
+		{"float", `return 7 / 2.0`, 3.5},
+		{"string", `local s = "a" + 1; return s + "b"`, "a1b"},
+		{"ternary and logic", `local x = null; return (x || 3) + (true && false ? 1 : 2)`, int64(5)},
+		{"table", `local t = {a = 1, ["b"] = 2}; t.c <- 3; return t.a + t.b + t.c`, int64(6)},
+		{"array", `local a = [1, 2]; a.append(3); return a`, []any{int64(1), int64(2), int64(3)}},
+		{"loops", `
+			local n = 0
+			for (local i = 0; i < 10; i++) {
+				if (i == 2) continue
+				if (i == 5) break
+				n += i
+			}
+			foreach (k, v in [10, 20]) n += k * v
+			local j = 0
+			while (j < 3) j++
+			do { j += 10 } while (j < 20)
+			return n + j`, int64(8 + 20 + 23)},
+		{"switch", `
+			local r = ""
+			foreach (v in [1, 2, 3]) {
+				switch (v) {
+				case 1: r += "one"; break
+				case 2: r += "two"
+				default: r += "other"
+				}
+			}
+			return r`, "onetwootherother"},
+		{"closures", `
+			function counter() {
+				local n = 0
+				return function() { return ++n }
+			}
+			local c = counter()
+			c()
+			c()
+			return c() * 10 + counter()()`, int64(31)},
+		{"lambda and free variables", `
+			local k = 3
+			local add = @(x) x + k
+			k = 10
+			return add(1)`, int64(11)},
+		{"default and variable parameters", `
+			function f(a, b = 2) { return a * b }
+			function g(...) { return vargv.len() }
+			return f(3) + f(3, 3) + g(1, 2, 3)`, int64(18)},
+		{"classes", `
+			class Animal {
+				name = null
+				static kind = "animal"
+				constructor(n) { name = n }
+				function speak() { return name + " makes a sound" }
+			}
+			class Dog extends Animal {
+				function speak() { return base.speak() + ", woof" }
+			}
+			local d = Dog("rex")
+			return [d.speak(), d instanceof Animal, Dog.kind]`,
+			[]any{"rex makes a sound, woof", true, "animal"}},
+		{"metamethods", `
+			class V {
+				x = 0
+				constructor(x) { this.x = x }
+				function _add(o) { return V(x + o.x) }
+				function _cmp(o) { return x <=> o.x }
+			}
+			local v = V(1) + V(2)
+			return [v.x, V(1) < V(2)]`, []any{int64(3), true}},
+		{"generators", `
+			function gen(n) {
+				for (local i = 0; i < n; i++) yield i * i
+				return null
+			}
+			local r = []
+			foreach (v in gen(4)) r.append(v)
+			local g = gen(2)
+			r.append(resume g)
+			r.append(resume g)
+			return r`, []any{int64(0), int64(1), int64(4), int64(9), int64(0), int64(1)}},
+		{"tail calls", `
+			function down(n) {
+				if (n == 0) return "done"
+				return down(n - 1)
+			}
+			return down(100000)`, "done"},
+		// members without a value take the count of those before them
+		{"enums and constants", `
+			enum Color { Red, Green = 5, Blue }
+			const Answer = 42
+			return [Color.Red, Color.Green, Color.Blue, Answer]`,
+			[]any{int64(0), int64(5), int64(1), int64(42)}},
+		{"exceptions", `
+			try {
+				throw "boom"
+			} catch (e) {
+				return "caught " + e
+			}`, "caught boom"},
+		{"delegates and slots", `
+			local t = {a = 1}
+			delete t.a
+			return ["a" in t, typeof t, t.len()]`, []any{false, "table", int64(0)}},
+	}
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	// tail calls don't use up the call depth
+	vm.SetLimits(sqvm.Limits{MaxCallDepth: 200})
+	for _, tt := range tests {
+		got, err := eval(vm, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src          string
+		line, column uint
+		err          error
+	}{
+		{"local x = 1\nbreak", 2, 1, compiler.ErrBreakOutsideLoop},
+		{"continue", 1, 1, compiler.ErrContinueOutside},
+		{"local a = 1\n\nlocal b = 2 3", 3, 13, compiler.ErrExpectStatementEnd},
+		{"1 = 2", 1, 3, compiler.ErrAssignExpression},
+		{"local x\nx <- 1", 2, 6, compiler.ErrNewSlotLocal},
+		{"local x\ndelete x", 2, 8, compiler.ErrDeleteLocal},
+		{"function f(a = 1, ...) {}", 1, 19, compiler.ErrVarParamsDefault},
+		{"return (", 1, 8, compiler.ErrExpectExpression},
+	}
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	for _, tt := range tests {
+		_, err := compiler.Compile(vm, "test", strings.NewReader(tt.src), false)
+		var e *compiler.Error
+		if !errors.As(err, &e) {
+			t.Errorf("%q: got error %v, want a compiler error", tt.src, err)
+			continue
+		}
+		if !errors.Is(err, tt.err) || e.Line != tt.line || e.Column != tt.column || e.Source != "test" {
+			t.Errorf("%q: got %v, want test:%d:%d: %v", tt.src, err, tt.line, tt.column, tt.err)
+		}
+	}
+	if vm.GetTop() != 0 {
+		t.Fatalf("failed compilations left %d values on the stack", vm.GetTop())
+	}
+}
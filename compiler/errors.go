@@ -8,4 +8,37 @@ var (
 	ErrExpectStatementEnd = fmt.Errorf("End of statement expected")
 	ErrExpectArgument     = fmt.Errorf("Argument expected after ','")
 	ErrExpectExpression   = fmt.Errorf("Expression expected")
+	ErrExpectScalar       = fmt.Errorf("Scalar expected")
+	ErrAssignExpression   = fmt.Errorf("Can't assign expression")
+	ErrAssignBase         = fmt.Errorf("'base' cannot be modified")
+	ErrNewSlotLocal       = fmt.Errorf("Can't 'create' a local slot")
+	ErrIncDecExpression   = fmt.Errorf("Can't '++' or '--' an expression")
+	ErrDeleteExpression   = fmt.Errorf("Can't delete an expression")
+	ErrDeleteLocal        = fmt.Errorf("Cannot delete an (outer) local")
+	ErrBreakOutsideLoop   = fmt.Errorf("'break' has to be in a loop block")
+	ErrContinueOutside    = fmt.Errorf("'continue' has to be in a loop block")
+	ErrInvalidClassName   = fmt.Errorf("Invalid class name")
+	ErrClassInLocal       = fmt.Errorf("Cannot create a class in a local with the syntax (class <local>)")
+	ErrBrokenDeref        = fmt.Errorf("Cannot break deref or comma needed after [exp]=exp slot declaration")
+	ErrVarParamsDefault   = fmt.Errorf("Function with default parameters cannot have variable number of parameters")
+	ErrRawCallArgs        = fmt.Errorf("rawcall requires at least 2 parameters (callee and this)")
+
+	errTooManyLiterals = fmt.Errorf("Internal compiler error: too many literals")
+	errTooManyLocals   = fmt.Errorf("Internal compiler error: too many locals")
 )
+
+// Error is returned when the source cannot be compiled.
+type Error struct {
+	Source string
+	Line   uint
+	Column uint
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Source, e.Line, e.Column, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -2,9 +2,9 @@ package lexer
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"strconv"
 	"strings"
 
@@ -20,6 +20,7 @@ var (
 	ErrUnfinishedString = fmt.Errorf("String is left unterminated")
 	ErrBadEscape        = fmt.Errorf("Unknown escape character")
 	ErrBadCharacter     = fmt.Errorf("Unknown character")
+	ErrHexExpected      = fmt.Errorf("Hexadecimal number expected")
 )
 
 var keywords = map[string]tokens.Token{
@@ -58,6 +59,7 @@ var keywords = map[string]tokens.Token{
 	"static":      tokens.Static,
 	"enum":        tokens.Enum,
 	"const":       tokens.Const,
+	"rawcall":     tokens.RawCall,
 	"__FILE__":    tokens.File,
 	"__LINE__":    tokens.Line,
 }
@@ -81,11 +83,19 @@ type lexer struct {
 
 	currentChar rune
 	nextChar    rune
+
+	line   uint
+	column uint
+
+	tokenLine   uint
+	tokenColumn uint
 }
 
 func NewLexer(rr io.Reader) *lexer {
 	l := &lexer{
 		source: bufio.NewReader(rr),
+		line:   1,
+		column: 1,
 	}
 
 	l.next()
@@ -94,8 +104,18 @@ func NewLexer(rr io.Reader) *lexer {
 	return l
 }
 
+// Lex returns the next token along with the position it starts at.
 func (l *lexer) Lex() (TokenInfo, error) {
+	info, err := l.lex()
+	info.Line = l.tokenLine
+	info.Column = l.tokenColumn
+	return info, err
+}
+
+func (l *lexer) lex() (TokenInfo, error) {
 	for l.currentChar != 0 {
+		l.tokenLine, l.tokenColumn = l.line, l.column
+
 		switch l.currentChar {
 		case '\t', '\r', ' ':
 			l.next()
@@ -161,7 +181,7 @@ func (l *lexer) Lex() (TokenInfo, error) {
 				}
 				return TokenInfo{Token: tokens.ShiftRight}, nil
 			}
-			return TokenInfo{Token: tokens.Token('<')}, nil
+			return TokenInfo{Token: tokens.Token('>')}, nil
 		case '!':
 			l.next()
 			if l.currentChar == '=' {
@@ -227,6 +247,13 @@ func (l *lexer) Lex() (TokenInfo, error) {
 				return TokenInfo{Token: tokens.ModuloEqual}, nil
 			}
 			return TokenInfo{Token: tokens.Token('%')}, nil
+		case '*':
+			l.next()
+			if l.currentChar == '=' {
+				l.next()
+				return TokenInfo{Token: tokens.MultiplyEqual}, nil
+			}
+			return TokenInfo{Token: tokens.Token('*')}, nil
 		case '+':
 			l.next()
 			if l.currentChar == '=' {
@@ -255,7 +282,7 @@ func (l *lexer) Lex() (TokenInfo, error) {
 			} else if isAlpha(l.currentChar) || l.currentChar == '_' {
 				return l.readIdentifier()
 			}
-			
+
 			return TokenInfo{
 				Token:  tokens.Undefined,
 				String: string(l.currentChar),
@@ -267,6 +294,12 @@ func (l *lexer) Lex() (TokenInfo, error) {
 }
 
 func (l *lexer) next() {
+	if l.currentChar == '\n' {
+		l.line++
+		l.column = 1
+	} else if l.currentChar != 0 {
+		l.column++
+	}
 	l.currentChar = l.nextChar
 
 	var err error
@@ -332,6 +365,19 @@ func (l *lexer) readString(delimiter rune, verbatim bool) (TokenInfo, error) {
 					builder.WriteRune('\f')
 				case '0':
 					builder.WriteRune(0)
+				case 'x':
+					if !isHex(l.nextChar) {
+						return TokenInfo{
+							Token:  tokens.StringLiteral,
+							String: builder.String(),
+						}, ErrHexExpected
+					}
+					var value byte
+					for i := 0; i < 2 && isHex(l.nextChar); i++ {
+						l.next()
+						value = value<<4 | hexValue(l.currentChar)
+					}
+					builder.WriteByte(value)
 				case '\\':
 					builder.WriteRune('\\')
 				case '"':
@@ -447,7 +493,10 @@ func (l *lexer) readNumber() (TokenInfo, error) {
 
 		val, err := strconv.ParseUint(str, 16, 64)
 		if err != nil {
-			panic(err) // TODO
+			return TokenInfo{
+				Token:  tokens.Integer,
+				String: str,
+			}, ErrHexExpected
 		}
 
 		return TokenInfo{
@@ -480,81 +529,55 @@ func (l *lexer) readNumber() (TokenInfo, error) {
 		}, nil
 	}
 
-	// Read int/float first and then parse integer exponent if present
-
+	// Read the digits, an optional fraction and an optional exponent and
+	// let strconv do the conversion
 	var builder strings.Builder
-	builder.WriteRune(l.currentChar)
-	l.next()
-
-	var hasDot bool
+	isFloat := false
 	for isDigit(l.currentChar) || l.currentChar == '.' {
 		// Detect double point
 		if l.currentChar == '.' {
-			if hasDot {
+			if isFloat {
 				return TokenInfo{
-					Token:  tokens.Integer,
+					Token:  tokens.Float,
 					String: builder.String(),
 				}, ErrFloatFormat
-			} else {
-				hasDot = true
 			}
+			isFloat = true
 		}
 
 		builder.WriteRune(l.currentChar)
 		l.next()
 	}
 
-	// If we have a dot, then parse float right away
-	var float float64
-	if hasDot {
-		var err error
-		float, err = strconv.ParseFloat(builder.String(), 10)
-		if err != nil {
-			return TokenInfo{
-				Token:  tokens.Float,
-				String: builder.String(),
-			}, ErrFloatFormat
-		}
-	}
-
-	// Optionally read exponent
 	if isExponent(l.currentChar) {
+		isFloat = true
+		builder.WriteRune(l.currentChar)
 		l.next()
 
-		sign := l.currentChar == '-'
 		if l.currentChar == '+' || l.currentChar == '-' {
+			builder.WriteRune(l.currentChar)
 			l.next()
 		}
-
-		var expBuilder strings.Builder
-		for isDigit(l.currentChar) {
-			expBuilder.WriteRune(l.currentChar)
-			l.next()
-		}
-		if l.currentChar == '.' || isExponent(l.currentChar) {
+		if !isDigit(l.currentChar) {
 			return TokenInfo{
-				Token: tokens.Float,
+				Token:  tokens.Float,
+				String: builder.String(),
 			}, ErrFloatFormat
 		}
+		for isDigit(l.currentChar) {
+			builder.WriteRune(l.currentChar)
+			l.next()
+		}
+	}
 
-		exp, err := strconv.ParseUint(expBuilder.String(), 10, 64)
-		if err != nil {
+	if isFloat {
+		float, err := strconv.ParseFloat(builder.String(), 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
 			return TokenInfo{
-				Token: tokens.Float,
+				Token:  tokens.Float,
+				String: builder.String(),
 			}, ErrFloatFormat
 		}
-		if sign {
-			exp = -exp
-		}
-
-		return TokenInfo{
-			Token:  tokens.Float,
-			String: builder.String(),
-			Float:  float * math.Pow10(int(int64(exp))),
-		}, nil
-	}
-
-	if hasDot {
 		return TokenInfo{
 			Token:  tokens.Float,
 			String: builder.String(),
@@ -102,5 +102,5 @@ func (t Token) String() string {
 		"Extends", "Constructor", "InstanceOf", "VarParams", "Line", "File", "True",
 		"False", "MultiplyEqual", "DivideEqual", "ModuloEqual", "AttributeOpen",
 		"AttributeClose", "Static", "Enum", "Const", "RawCall",
-	}[t - Identifier]
+	}[t-Identifier]
 }
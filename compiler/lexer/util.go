@@ -23,3 +23,13 @@ func isAlpha(r rune) bool {
 func isAlnum(r rune) bool {
 	return isDigit(r) || isAlpha(r)
 }
+
+func hexValue(r rune) byte {
+	switch {
+	case isDigit(r):
+		return byte(r - '0')
+	case r >= 'a' && r <= 'f':
+		return byte(r - 'a' + 10)
+	}
+	return byte(r - 'A' + 10)
+}
@@ -4,30 +4,409 @@ import (
 	"github.com/dexter3k/go-squirrel/sqvm"
 )
 
+const (
+	maxLiterals = 0x7FFFFFFF
+)
+
+type localVar struct {
+	name    string
+	named   bool // temporaries have no name
+	outer   bool // captured by a nested function
+	pos     int
+	startOp int
+	endOp   int
+}
+
+// state holds a function being compiled, it mirrors SQFuncState.
 type state struct {
-	strings  map[string]int
-	strTable []string
+	parent *state
+
+	name       string
+	sourceName string
+
+	literals  map[sqvm.Object]int
+	nLiterals int
+
+	returnExp   int
+	vlocals     []localVar
+	targetStack []int
+	stackSize   int
+	varParams   bool
+	isGenerator bool
+
+	unresolvedBreaks    []int
+	unresolvedContinues []int
+	breakTargets        []int
+	continueTargets     []int
+
+	functions     []*sqvm.FuncProto
+	parameters    []string
+	outerValues   []sqvm.OuterValue
+	instructions  []sqvm.Instruction
+	localVarInfos []sqvm.LocalVarInfo
+	lineInfos     []sqvm.LineInfo
+	defaultParams []int
+
+	lastLine     int
+	traps        int
+	outers       int
+	optimization bool
 }
 
-func newState() *state {
+func newState(parent *state) *state {
 	return &state{
-		strings:  map[string]int{},
-		strTable: []string{},
+		parent:       parent,
+		literals:     map[sqvm.Object]int{},
+		returnExp:    0,
+		optimization: true,
 	}
 }
 
-func (s *state) makeString(str string) int {
-	if i, present := s.strings[str]; present {
+// constant returns the literal index of o, adding it if needed.
+func (s *state) constant(o sqvm.Object) int {
+	if i, present := s.literals[o]; present {
 		return i
 	}
-	s.strings[str] = len(s.strings)
-	strTable = append(strTable, str)
-	return len(s.strings) - 1
+	s.literals[o] = s.nLiterals
+	s.nLiterals++
+	if s.nLiterals > maxLiterals {
+		panic(errTooManyLiterals)
+	}
+	return s.nLiterals - 1
+}
+
+func (s *state) stringConstant(str string) int {
+	return s.constant(sqvm.StringValue(str))
+}
+
+func (s *state) currentPos() int {
+	return len(s.instructions) - 1
+}
+
+func (s *state) setInstructionParams(pos, arg0, arg1, arg2, arg3 int) {
+	i := &s.instructions[pos]
+	i.Arg0 = uint8(arg0)
+	i.Arg1 = int32(arg1)
+	i.Arg2 = uint8(arg2)
+	i.Arg3 = uint8(arg3)
+}
+
+func (s *state) setInstructionParam(pos, arg, val int) {
+	i := &s.instructions[pos]
+	switch arg {
+	case 0:
+		i.Arg0 = uint8(val)
+	case 1:
+		i.Arg1 = int32(val)
+	case 2:
+		i.Arg2 = uint8(val)
+	case 3:
+		i.Arg3 = uint8(val)
+	}
+}
+
+func (s *state) allocStackPos() int {
+	pos := len(s.vlocals)
+	s.vlocals = append(s.vlocals, localVar{})
+	if len(s.vlocals) > s.stackSize {
+		if s.stackSize > sqvm.MaxFuncStackSize {
+			panic(errTooManyLocals)
+		}
+		s.stackSize = len(s.vlocals)
+	}
+	return pos
+}
+
+// pushTarget pushes n on the target stack, or a new temporary if n is -1.
+func (s *state) pushTarget(n int) int {
+	if n == -1 {
+		n = s.allocStackPos()
+	}
+	s.targetStack = append(s.targetStack, n)
+	return n
+}
+
+func (s *state) topTarget() int {
+	return s.targetStack[len(s.targetStack)-1]
+}
+
+func (s *state) popTarget() int {
+	pos := s.topTarget()
+	if !s.vlocals[pos].named {
+		s.vlocals = s.vlocals[:len(s.vlocals)-1]
+	}
+	s.targetStack = s.targetStack[:len(s.targetStack)-1]
+	return pos
+}
+
+// discardTarget pops a target whose value is never used, sparing the
+// store of the last instruction when possible.
+func (s *state) discardTarget() {
+	discarded := s.popTarget()
+	if len(s.instructions) > 0 && s.optimization {
+		pi := &s.instructions[len(s.instructions)-1]
+		switch pi.Op {
+		case sqvm.OpSet, sqvm.OpNewSlot, sqvm.OpSetOuter, sqvm.OpCall:
+			if int(pi.Arg0) == discarded {
+				pi.Arg0 = 0xFF
+			}
+		}
+	}
+}
+
+func (s *state) getStackSize() int {
+	return len(s.vlocals)
+}
+
+func (s *state) countOuters(stackSize int) int {
+	outers := 0
+	for k := len(s.vlocals) - 1; k >= stackSize; k-- {
+		if s.vlocals[k].outer {
+			outers++
+		}
+	}
+	return outers
+}
+
+func (s *state) setStackSize(n int) {
+	for len(s.vlocals) > n {
+		lv := s.vlocals[len(s.vlocals)-1]
+		if lv.named {
+			if lv.outer {
+				s.outers--
+			}
+			s.localVarInfos = append(s.localVarInfos, sqvm.LocalVarInfo{
+				Name:    lv.name,
+				Pos:     lv.pos,
+				StartOp: lv.startOp,
+				EndOp:   s.currentPos(),
+			})
+		}
+		s.vlocals = s.vlocals[:len(s.vlocals)-1]
+	}
+}
+
+func (s *state) isLocal(pos int) bool {
+	return pos < len(s.vlocals) && s.vlocals[pos].named
+}
+
+func (s *state) pushLocalVariable(name string) int {
+	pos := len(s.vlocals)
+	s.vlocals = append(s.vlocals, localVar{
+		name:    name,
+		named:   true,
+		pos:     pos,
+		startOp: s.currentPos() + 1,
+	})
+	if len(s.vlocals) > s.stackSize {
+		s.stackSize = len(s.vlocals)
+	}
+	return pos
+}
+
+func (s *state) getLocalVariable(name string) int {
+	for i := len(s.vlocals) - 1; i >= 0; i-- {
+		if lv := s.vlocals[i]; lv.named && lv.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *state) markLocalAsOuter(pos int) {
+	s.vlocals[pos].outer = true
+	s.outers++
+}
+
+func (s *state) getOuterVariable(name string) int {
+	for i, ov := range s.outerValues {
+		if ov.Name == name {
+			return i
+		}
+	}
+	if s.parent == nil {
+		return -1
+	}
+	if pos := s.parent.getLocalVariable(name); pos != -1 {
+		s.parent.markLocalAsOuter(pos)
+		s.outerValues = append(s.outerValues, sqvm.OuterValue{Type: sqvm.OuterLocal, Src: pos, Name: name})
+		return len(s.outerValues) - 1
+	}
+	if pos := s.parent.getOuterVariable(name); pos != -1 {
+		s.outerValues = append(s.outerValues, sqvm.OuterValue{Type: sqvm.OuterOuter, Src: pos, Name: name})
+		return len(s.outerValues) - 1
+	}
+	return -1
+}
+
+func (s *state) addParameter(name string) {
+	s.pushLocalVariable(name)
+	s.parameters = append(s.parameters, name)
+}
+
+func (s *state) addDefaultParam(target int) {
+	s.defaultParams = append(s.defaultParams, target)
+}
+
+func (s *state) addLineInfos(line int, lineOp, force bool) {
+	if s.lastLine == line && !force {
+		return
+	}
+	li := sqvm.LineInfo{Line: line, Op: s.currentPos() + 1}
+	if lineOp {
+		s.addInstruction(sqvm.OpLine, 0, line, 0, 0)
+	}
+	if s.lastLine != line {
+		s.lineInfos = append(s.lineInfos, li)
+	}
+	s.lastLine = line
 }
 
-func (s state) makeFuncProto() (*sqvm.FuncProto, error) {
-	return nil, nil
+func (s *state) snoozeOpt() {
+	s.optimization = false
 }
 
-func (s *state) popTarget() {
+func (s *state) addInstruction(op sqvm.Opcode, arg0, arg1, arg2, arg3 int) {
+	s.emit(sqvm.Instruction{
+		Op:   op,
+		Arg0: uint8(arg0),
+		Arg1: int32(arg1),
+		Arg2: uint8(arg2),
+		Arg3: uint8(arg3),
+	})
+}
+
+// emit appends an instruction, merging it with the previous one when the
+// peephole optimizer finds a match.
+func (s *state) emit(i sqvm.Instruction) {
+	if size := len(s.instructions); size > 0 && s.optimization {
+		pi := &s.instructions[size-1]
+		switch i.Op {
+		case sqvm.OpJz:
+			if pi.Op == sqvm.OpCmp && pi.Arg1 < 0xFF {
+				pi.Op = sqvm.OpJCmp
+				pi.Arg0 = uint8(pi.Arg1)
+				pi.Arg1 = i.Arg1
+				return
+			}
+		case sqvm.OpSet, sqvm.OpNewSlot:
+			if i.Arg0 == i.Arg3 {
+				i.Arg0 = 0xFF
+			}
+		case sqvm.OpSetOuter:
+			if i.Arg0 == i.Arg2 {
+				i.Arg0 = 0xFF
+			}
+		case sqvm.OpReturn:
+			if s.parent != nil && i.Arg0 != sqvm.MaxFuncStackSize && pi.Op == sqvm.OpCall && s.returnExp < size-1 {
+				pi.Op = sqvm.OpTailCall
+			} else if pi.Op == sqvm.OpClose {
+				*pi = i
+				return
+			}
+		case sqvm.OpGet:
+			if pi.Op == sqvm.OpLoad && int32(pi.Arg0) == int32(i.Arg2) && !s.isLocal(int(pi.Arg0)) {
+				pi.Arg2 = uint8(i.Arg1)
+				pi.Op = sqvm.OpGetK
+				pi.Arg0 = i.Arg0
+				return
+			}
+		case sqvm.OpPrepCall:
+			if pi.Op == sqvm.OpLoad && int32(pi.Arg0) == i.Arg1 && !s.isLocal(int(pi.Arg0)) {
+				pi.Op = sqvm.OpPrepCallK
+				pi.Arg0 = i.Arg0
+				pi.Arg2 = i.Arg2
+				pi.Arg3 = i.Arg3
+				return
+			}
+		case sqvm.OpAppendArray:
+			aat := -1
+			switch pi.Op {
+			case sqvm.OpLoad:
+				aat = sqvm.AppendLiteral
+			case sqvm.OpLoadInt:
+				aat = sqvm.AppendInt
+			case sqvm.OpLoadBool:
+				aat = sqvm.AppendBool
+			case sqvm.OpLoadFloat:
+				aat = sqvm.AppendFloat
+			}
+			if aat != -1 && int32(pi.Arg0) == i.Arg1 && !s.isLocal(int(pi.Arg0)) {
+				pi.Op = sqvm.OpAppendArray
+				pi.Arg0 = i.Arg0
+				pi.Arg2 = uint8(aat)
+				pi.Arg3 = sqvm.MaxFuncStackSize
+				return
+			}
+		case sqvm.OpMove:
+			switch pi.Op {
+			case sqvm.OpGet, sqvm.OpAdd, sqvm.OpSub, sqvm.OpMul, sqvm.OpDiv, sqvm.OpMod, sqvm.OpBitW,
+				sqvm.OpLoadInt, sqvm.OpLoadFloat, sqvm.OpLoadBool, sqvm.OpLoad:
+				if int32(pi.Arg0) == i.Arg1 {
+					pi.Arg0 = i.Arg0
+					s.optimization = false
+					return
+				}
+			}
+			if pi.Op == sqvm.OpMove {
+				pi.Op = sqvm.OpDMove
+				pi.Arg2 = i.Arg0
+				pi.Arg3 = uint8(i.Arg1)
+				return
+			}
+		case sqvm.OpLoad:
+			if pi.Op == sqvm.OpLoad && i.Arg1 < 256 {
+				pi.Op = sqvm.OpDLoad
+				pi.Arg2 = i.Arg0
+				pi.Arg3 = uint8(i.Arg1)
+				return
+			}
+		case sqvm.OpEq, sqvm.OpNe:
+			if pi.Op == sqvm.OpLoad && int32(pi.Arg0) == i.Arg1 && !s.isLocal(int(pi.Arg0)) {
+				pi.Op = i.Op
+				pi.Arg0 = i.Arg0
+				pi.Arg2 = i.Arg2
+				pi.Arg3 = sqvm.MaxFuncStackSize
+				return
+			}
+		case sqvm.OpLoadNulls:
+			if pi.Op == sqvm.OpLoadNulls && int32(pi.Arg0)+pi.Arg1 == int32(i.Arg0) {
+				pi.Arg1++
+				return
+			}
+		case sqvm.OpLine:
+			if pi.Op == sqvm.OpLine {
+				s.instructions = s.instructions[:size-1]
+				s.lineInfos = s.lineInfos[:len(s.lineInfos)-1]
+			}
+		}
+	}
+	s.optimization = true
+	s.instructions = append(s.instructions, i)
+}
+
+func (s *state) popInstructions(n int) {
+	s.instructions = s.instructions[:len(s.instructions)-n]
+}
+
+func (s *state) makeFuncProto() *sqvm.FuncProto {
+	literals := make([]sqvm.Object, s.nLiterals)
+	for o, i := range s.literals {
+		literals[i] = o
+	}
+	return &sqvm.FuncProto{
+		SourceName:    s.sourceName,
+		Name:          s.name,
+		Literals:      literals,
+		Parameters:    s.parameters,
+		OuterValues:   s.outerValues,
+		LocalVarInfos: s.localVarInfos,
+		LineInfos:     s.lineInfos,
+		DefaultParams: s.defaultParams,
+		Instructions:  s.instructions,
+		Functions:     s.functions,
+		StackSize:     s.stackSize,
+		IsGenerator:   s.isGenerator,
+		VarParams:     s.varParams,
+	}
 }
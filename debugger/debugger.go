@@ -0,0 +1,423 @@
+// Package debugger lets an editor debug the scripts run by a VM through
+// the Debug Adapter Protocol.
+//
+// A Session reads the requests of the client on its own goroutine. The
+// script keeps running on the goroutine of the host, the session stops
+// it from the debug hook of the VM and answers the requests that
+// inspect it there, until the client resumes it.
+package debugger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// threadID is the only thread reported to the client, the threads of the
+// VM all run on the goroutine of the host.
+const threadID = 1
+
+// ErrDisconnected is returned by Start when the client leaves before the
+// configuration is done.
+var ErrDisconnected = errors.New("the client disconnected")
+
+// LaunchArgs are the arguments of the launch or attach request.
+type LaunchArgs struct {
+	Program     string   `json:"program"`
+	Args        []string `json:"args"`
+	Cwd         string   `json:"cwd"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+	NoDebug     bool     `json:"noDebug"`
+}
+
+type stepKind int
+
+const (
+	stepNone stepKind = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+type location struct {
+	vm    *sqvm.VM
+	depth int
+	src   string
+	line  int
+}
+
+// Session is a debugging session of a client connected through r and w.
+type Session struct {
+	vm *sqvm.VM
+	r  *bufio.Reader
+
+	wmu sync.Mutex
+	w   io.Writer
+	seq int
+
+	mu          sync.Mutex
+	breakpoints map[string]map[int]bool
+	pause       bool
+	stopped     bool
+	launch      LaunchArgs
+
+	configured chan struct{}
+	configOnce sync.Once
+	done       chan struct{}
+	doneOnce   sync.Once
+	requests   chan *request
+
+	// the state below belongs to the goroutine running the script
+	entry     bool
+	step      stepKind
+	stepVM    *sqvm.VM
+	stepDepth int
+	last      location
+	cur       *sqvm.VM
+	handles   []handle
+}
+
+// NewSession creates a session reading the requests of the client from r
+// and writing to w.
+func NewSession(vm *sqvm.VM, r io.Reader, w io.Writer) *Session {
+	return &Session{
+		vm:          vm,
+		r:           bufio.NewReader(r),
+		w:           w,
+		breakpoints: make(map[string]map[int]bool),
+		configured:  make(chan struct{}),
+		done:        make(chan struct{}),
+		requests:    make(chan *request, 16),
+	}
+}
+
+// Start serves the client until it is done configuring the session and
+// returns the arguments it launched the script with. Unless the client
+// asked to run without debugging, debug info is enabled and the debug
+// hook of the VM is set: the scripts compiled afterwards can be stopped.
+func (s *Session) Start() (LaunchArgs, error) {
+	go s.readLoop()
+	select {
+	case <-s.configured:
+	case <-s.done:
+		return LaunchArgs{}, ErrDisconnected
+	}
+	s.mu.Lock()
+	launch := s.launch
+	s.mu.Unlock()
+	if !launch.NoDebug {
+		s.entry = launch.StopOnEntry
+		s.vm.EnableDebugInfo(true)
+		s.vm.SetDebugHook(s.hook)
+	}
+	return launch, nil
+}
+
+// Done is closed when the client disconnects.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Output shows text in the console of the client. The category is
+// "console", "stdout" or "stderr".
+func (s *Session) Output(category, text string) {
+	s.sendEvent("output", map[string]any{"category": category, "output": text})
+}
+
+// Exit tells the client the script ended with code.
+func (s *Session) Exit(code int) {
+	s.sendEvent("exited", map[string]any{"exitCode": code})
+	s.sendEvent("terminated", nil)
+}
+
+func (s *Session) send(msg any) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	// a failed write means the client is gone, the reader notices it
+	writeMessage(s.w, msg)
+}
+
+func (s *Session) sendEvent(name string, body any) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+func (s *Session) respond(req *request, body any) {
+	s.send(&response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (s *Session) fail(req *request, format string, args ...any) {
+	s.send(&response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: fmt.Sprintf(format, args...)})
+}
+
+func (s *Session) disconnect() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// readLoop answers the requests that don't need the script to be
+// stopped and hands the others to the goroutine running it.
+func (s *Session) readLoop() {
+	defer s.disconnect()
+	for {
+		data, err := readMessage(s.r)
+		if err != nil {
+			return
+		}
+		req := &request{}
+		if err := json.Unmarshal(data, req); err != nil || req.Type != "request" {
+			continue
+		}
+		switch req.Command {
+		case "initialize":
+			s.respond(req, capabilities{
+				SupportsConfigurationDoneRequest: true,
+				SupportsEvaluateForHovers:        true,
+				SupportsTerminateRequest:         true,
+			})
+			s.sendEvent("initialized", nil)
+		case "launch", "attach":
+			var args LaunchArgs
+			if len(req.Arguments) != 0 {
+				if err := json.Unmarshal(req.Arguments, &args); err != nil {
+					s.fail(req, "invalid arguments: %v", err)
+					continue
+				}
+			}
+			s.mu.Lock()
+			s.launch = args
+			s.mu.Unlock()
+			s.respond(req, nil)
+		case "setBreakpoints":
+			s.setBreakpoints(req)
+		case "setExceptionBreakpoints":
+			s.respond(req, nil)
+		case "configurationDone":
+			s.respond(req, nil)
+			s.configOnce.Do(func() {
+				close(s.configured)
+			})
+		case "threads":
+			s.respond(req, map[string]any{"threads": []thread{{ID: threadID, Name: "main"}}})
+		case "pause":
+			s.mu.Lock()
+			s.pause = true
+			s.mu.Unlock()
+			s.respond(req, nil)
+		case "disconnect", "terminate":
+			s.respond(req, nil)
+			return
+		default:
+			s.mu.Lock()
+			stopped := s.stopped
+			s.mu.Unlock()
+			if !stopped {
+				s.fail(req, "the script is running")
+				continue
+			}
+			s.requests <- req
+		}
+	}
+}
+
+func (s *Session) setBreakpoints(req *request) {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, "invalid arguments: %v", err)
+		return
+	}
+	lines := args.Lines
+	if args.Breakpoints != nil {
+		lines = lines[:0]
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+	}
+	set := make(map[int]bool)
+	bps := make([]breakpoint, 0, len(lines))
+	for _, line := range lines {
+		set[line] = true
+		bps = append(bps, breakpoint{Verified: true, Line: line})
+	}
+	s.mu.Lock()
+	s.breakpoints[sourcePath(args.Source.Path)] = set
+	s.mu.Unlock()
+	s.respond(req, map[string]any{"breakpoints": bps})
+}
+
+// sourcePath makes the paths of the client and the source names of the
+// scripts comparable.
+func sourcePath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+// hook is the debug hook of the VM, it stops the script when a line is
+// reached that the client is waiting for.
+func (s *Session) hook(vm *sqvm.VM, ev sqvm.DebugEvent, src string, line int, funcName string) {
+	select {
+	case <-s.done:
+		vm.SetDebugHook(nil)
+		return
+	default:
+	}
+	if ev != sqvm.DebugLine {
+		return
+	}
+	loc := location{vm: vm, depth: vm.CallDepth(), src: src, line: line}
+	repeated := loc == s.last
+	s.last = loc
+
+	s.mu.Lock()
+	pause := s.pause
+	s.pause = false
+	bp := s.breakpoints[sourcePath(src)][line]
+	s.mu.Unlock()
+
+	var reason string
+	switch {
+	case s.entry:
+		s.entry = false
+		reason = "entry"
+	case pause:
+		reason = "pause"
+	case bp && !repeated:
+		reason = "breakpoint"
+	case s.step == stepIn,
+		s.step == stepOver && vm == s.stepVM && loc.depth <= s.stepDepth,
+		s.step == stepOut && vm == s.stepVM && loc.depth < s.stepDepth:
+		reason = "step"
+	default:
+		return
+	}
+	s.stop(vm, reason)
+}
+
+// stop answers the requests of the client until it resumes the script.
+func (s *Session) stop(vm *sqvm.VM, reason string) {
+	s.cur = vm
+	s.step = stepNone
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	defer s.resume()
+
+	s.sendEvent("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+	for {
+		select {
+		case <-s.done:
+			vm.SetDebugHook(nil)
+			return
+		case req := <-s.requests:
+			if s.handle(req) {
+				return
+			}
+		}
+	}
+}
+
+// resume forgets what was valid only while stopped and fails the
+// requests that came too late.
+func (s *Session) resume() {
+	s.releaseHandles()
+	s.cur = nil
+	s.mu.Lock()
+	s.stopped = false
+	s.mu.Unlock()
+	for {
+		select {
+		case req := <-s.requests:
+			s.fail(req, "the script is running")
+		default:
+			return
+		}
+	}
+}
+
+// handle answers a request received while stopped and reports whether
+// the script must resume.
+func (s *Session) handle(req *request) bool {
+	switch req.Command {
+	case "continue":
+		s.respond(req, map[string]any{"allThreadsContinued": true})
+		return true
+	case "next":
+		s.startStep(stepOver)
+		s.respond(req, nil)
+		return true
+	case "stepIn":
+		s.startStep(stepIn)
+		s.respond(req, nil)
+		return true
+	case "stepOut":
+		s.startStep(stepOut)
+		s.respond(req, nil)
+		return true
+	case "stackTrace":
+		s.stackTrace(req)
+	case "scopes":
+		s.scopes(req)
+	case "variables":
+		s.variables(req)
+	case "evaluate":
+		s.evaluate(req)
+	default:
+		s.fail(req, "unsupported request %q", req.Command)
+	}
+	return false
+}
+
+func (s *Session) startStep(kind stepKind) {
+	s.step = kind
+	s.stepVM = s.cur
+	s.stepDepth = s.cur.CallDepth()
+}
+
+func (s *Session) stackTrace(req *request) {
+	var args stackTraceArguments
+	if len(req.Arguments) != 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			s.fail(req, "invalid arguments: %v", err)
+			return
+		}
+	}
+	total := s.cur.CallDepth()
+	end := total
+	if args.Levels > 0 && args.StartFrame+args.Levels < end {
+		end = args.StartFrame + args.Levels
+	}
+	frames := []stackFrame{}
+	for level := args.StartFrame; level < end; level++ {
+		si, err := s.cur.GetStackInfos(level)
+		if err != nil {
+			break
+		}
+		f := stackFrame{ID: level + 1, Name: si.FuncName}
+		if si.Line >= 0 {
+			f.Source = &source{Name: filepath.Base(si.Source), Path: sourcePath(si.Source)}
+			f.Line = si.Line
+			f.Column = 1
+		}
+		frames = append(frames, f)
+	}
+	s.respond(req, map[string]any{"stackFrames": frames, "totalFrames": total})
+}
@@ -0,0 +1,259 @@
+package debugger
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+type handleKind int
+
+const (
+	localsHandle handleKind = iota
+	outersHandle
+	valueHandle
+)
+
+// handle is what a variables reference of the client stands for. The
+// references are only valid while the script is stopped, the values are
+// kept alive until then.
+type handle struct {
+	kind  handleKind
+	level int
+	obj   sqvm.Object
+}
+
+func (s *Session) newHandle(h handle) int {
+	if h.kind == valueHandle {
+		s.cur.AddRef(h.obj)
+	}
+	s.handles = append(s.handles, h)
+	return len(s.handles)
+}
+
+func (s *Session) releaseHandles() {
+	for _, h := range s.handles {
+		if h.kind == valueHandle {
+			s.cur.Release(h.obj)
+		}
+	}
+	s.handles = s.handles[:0]
+}
+
+func (s *Session) scopes(req *request) {
+	var args scopesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, "invalid arguments: %v", err)
+		return
+	}
+	level := args.FrameID - 1
+	scopes := []scope{}
+	if proto := s.cur.GetFrameProto(level); proto != nil {
+		scopes = append(scopes, scope{
+			Name:               "Locals",
+			VariablesReference: s.newHandle(handle{kind: localsHandle, level: level}),
+		})
+		if len(proto.OuterValues) > 0 {
+			scopes = append(scopes, scope{
+				Name:               "Outers",
+				VariablesReference: s.newHandle(handle{kind: outersHandle, level: level}),
+			})
+		}
+	}
+	s.cur.PushRootTable()
+	scopes = append(scopes, scope{
+		Name:               "Globals",
+		VariablesReference: s.newHandle(handle{kind: valueHandle, obj: s.cur.GetStackObject(-1)}),
+		Expensive:          true,
+	})
+	s.cur.Pop(1)
+	s.respond(req, map[string]any{"scopes": scopes})
+}
+
+func (s *Session) variables(req *request) {
+	var args variablesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, "invalid arguments: %v", err)
+		return
+	}
+	ref := args.VariablesReference
+	if ref < 1 || ref > len(s.handles) {
+		s.fail(req, "invalid variables reference")
+		return
+	}
+	h := s.handles[ref-1]
+	vm := s.cur
+	vars := []variable{}
+	switch h.kind {
+	case localsHandle, outersHandle:
+		nOuters := len(vm.GetFrameProto(h.level).OuterValues)
+		idx, end := nOuters, -1
+		if h.kind == outersHandle {
+			idx, end = 0, nOuters
+		}
+		for ; idx != end; idx++ {
+			name, ok := vm.GetLocal(h.level, idx)
+			if !ok {
+				break
+			}
+			vars = append(vars, s.variable(name, -1))
+			vm.Pop(1)
+		}
+	case valueHandle:
+		vars = s.members(h.obj)
+	}
+	s.respond(req, map[string]any{"variables": vars})
+}
+
+// members lists the slots of a table, class or instance or the items of
+// an array.
+func (s *Session) members(obj sqvm.Object) []variable {
+	vm := s.cur
+	top := vm.GetTop()
+	defer vm.SetTop(top)
+
+	vars := []variable{}
+	vm.PushObject(obj)
+	if vm.GetType(-1) == sqvm.TypeInstance {
+		if err := vm.GetClass(-1); err != nil {
+			return vars
+		}
+		vm.PushNull()
+		for vm.Next(-2) {
+			// the value of the instance, not the default of the class
+			vm.Pop(1)
+			vm.Push(-1)
+			if err := vm.Get(-5); err != nil {
+				vm.PushNull()
+			}
+			vars = append(vars, s.variable(keyName(vm, -2), -1))
+			vm.Pop(2)
+		}
+		return vars
+	}
+	vm.PushNull()
+	for vm.Next(-2) {
+		vars = append(vars, s.variable(keyName(vm, -2), -1))
+		vm.Pop(2)
+	}
+	return vars
+}
+
+func keyName(vm *sqvm.VM, idx int) string {
+	switch vm.GetType(idx) {
+	case sqvm.TypeString:
+		return vm.GetString(idx)
+	case sqvm.TypeInteger:
+		return fmt.Sprintf("[%d]", vm.GetInteger(idx))
+	}
+	return "[" + describe(vm, idx) + "]"
+}
+
+// variable describes the value at idx, which can be expanded by the
+// client if it has members.
+func (s *Session) variable(name string, idx int) variable {
+	vm := s.cur
+	v := variable{Name: name, Value: describe(vm, idx), Type: vm.GetType(idx).String()}
+	switch vm.GetType(idx) {
+	case sqvm.TypeTable, sqvm.TypeArray, sqvm.TypeClass, sqvm.TypeInstance:
+		v.VariablesReference = s.newHandle(handle{kind: valueHandle, obj: vm.GetStackObject(idx)})
+	}
+	return v
+}
+
+// describe formats the value at idx without running any script code.
+func describe(vm *sqvm.VM, idx int) string {
+	t := vm.GetType(idx)
+	switch t {
+	case sqvm.TypeNull, sqvm.TypeInteger, sqvm.TypeFloat, sqvm.TypeBool:
+		if err := vm.ToString(idx); err != nil {
+			return t.String()
+		}
+		str := vm.GetString(-1)
+		vm.Pop(1)
+		return str
+	case sqvm.TypeString:
+		return strconv.Quote(vm.GetString(idx))
+	case sqvm.TypeTable, sqvm.TypeArray:
+		n, _ := vm.GetSize(idx)
+		return fmt.Sprintf("%s (%d)", t, n)
+	case sqvm.TypeClosure:
+		if proto, err := vm.GetClosureProto(idx); err == nil && proto.Name != "" {
+			return "function " + proto.Name
+		}
+	}
+	return t.String()
+}
+
+// evaluate runs an expression in a frame. The expression is compiled as
+// a function getting the values of the variables of the frame, so they
+// can be read but assigning them changes copies only.
+func (s *Session) evaluate(req *request) {
+	var args evaluateArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		s.fail(req, "invalid arguments: %v", err)
+		return
+	}
+	vm := s.cur
+	top := vm.GetTop()
+	defer vm.SetTop(top)
+
+	level := args.FrameID - 1
+	if args.FrameID == 0 {
+		level = 0
+	}
+	// the values stay alive on the stack of the frame
+	var names []string
+	var values []sqvm.Object
+	index := make(map[string]int)
+	vm.PushRootTable()
+	this := vm.GetStackObject(-1)
+	vm.Pop(1)
+	if vm.GetFrameProto(level) != nil {
+		for idx := 0; ; idx++ {
+			name, ok := vm.GetLocal(level, idx)
+			if !ok {
+				break
+			}
+			obj := vm.GetStackObject(-1)
+			vm.Pop(1)
+			if name == "this" {
+				this = obj
+				continue
+			}
+			// an inner variable shadows an outer one
+			if i, seen := index[name]; seen {
+				values[i] = obj
+				continue
+			}
+			index[name] = len(names)
+			names = append(names, name)
+			values = append(values, obj)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("local __args = vargv;\n")
+	for i, name := range names {
+		fmt.Fprintf(&sb, "local %s = __args[%d];\n", name, i)
+	}
+	fmt.Fprintf(&sb, "return (%s);\n", args.Expression)
+	if _, err := compiler.Compile(vm, "evaluate", strings.NewReader(sb.String()), false); err != nil {
+		s.fail(req, "%v", err)
+		return
+	}
+	vm.PushObject(this)
+	for _, obj := range values {
+		vm.PushObject(obj)
+	}
+	if err := vm.Call(1+len(names), true, false); err != nil {
+		s.fail(req, "%v", err)
+		return
+	}
+	v := s.variable("", -1)
+	s.respond(req, map[string]any{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference})
+}
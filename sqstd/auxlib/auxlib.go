@@ -0,0 +1,100 @@
+// Package auxlib implements the default error handlers of Squirrel.
+// They report errors through the error PrintFunc of the VM.
+package auxlib
+
+import (
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// maxLocalsLevels is how many frames PrintCallStack prints the locals of.
+const maxLocalsLevels = 10
+
+// PrintCallStack prints the functions of the call stack and their local
+// variables, skipping the function that calls it.
+func PrintCallStack(vm *sqvm.VM) {
+	pf := vm.ErrorFunc()
+	if pf == nil {
+		return
+	}
+	pf(vm, "\nCALLSTACK\n")
+	for level := 1; ; level++ {
+		si, err := vm.GetStackInfos(level)
+		if err != nil {
+			break
+		}
+		pf(vm, "*FUNCTION [%s()] %s line [%d]\n", si.FuncName, si.Source, si.Line)
+	}
+	pf(vm, "\nLOCALS\n")
+	for level := 0; level < maxLocalsLevels; level++ {
+		for seq := 0; ; seq++ {
+			name, ok := vm.GetLocal(level, seq)
+			if !ok {
+				break
+			}
+			printLocal(vm, pf, name)
+			vm.Pop(1)
+		}
+	}
+}
+
+var typeNames = map[sqvm.ObjectType]string{
+	sqvm.TypeUserPointer:   "USERPOINTER",
+	sqvm.TypeTable:         "TABLE",
+	sqvm.TypeArray:         "ARRAY",
+	sqvm.TypeClosure:       "CLOSURE",
+	sqvm.TypeNativeClosure: "NATIVECLOSURE",
+	sqvm.TypeGenerator:     "GENERATOR",
+	sqvm.TypeUserData:      "USERDATA",
+	sqvm.TypeThread:        "THREAD",
+	sqvm.TypeClass:         "CLASS",
+	sqvm.TypeInstance:      "INSTANCE",
+	sqvm.TypeWeakRef:       "WEAKREF",
+}
+
+// printLocal prints the local variable on top of the stack.
+func printLocal(vm *sqvm.VM, pf sqvm.PrintFunc, name string) {
+	switch t := vm.GetType(-1); t {
+	case sqvm.TypeNull:
+		pf(vm, "[%s] NULL\n", name)
+	case sqvm.TypeInteger:
+		pf(vm, "[%s] %d\n", name, vm.GetInteger(-1))
+	case sqvm.TypeFloat:
+		pf(vm, "[%s] %.14g\n", name, vm.GetFloat(-1))
+	case sqvm.TypeString:
+		pf(vm, "[%s] \"%s\"\n", name, vm.GetString(-1))
+	case sqvm.TypeBool:
+		pf(vm, "[%s] %t\n", name, vm.GetBool(-1))
+	default:
+		pf(vm, "[%s] %s\n", name, typeNames[t])
+	}
+}
+
+// printError is the runtime error handler, it prints the error and the
+// call stack.
+func printError(vm *sqvm.VM) (int, error) {
+	pf := vm.ErrorFunc()
+	if pf == nil {
+		return 0, nil
+	}
+	if vm.GetType(2) == sqvm.TypeString {
+		pf(vm, "\nAN ERROR HAS OCCURRED [%s]\n", vm.GetString(2))
+	} else {
+		pf(vm, "\nAN ERROR HAS OCCURRED [unknown]\n")
+	}
+	PrintCallStack(vm)
+	return 0, nil
+}
+
+func compilerError(vm *sqvm.VM, desc, source string, line, column int) {
+	if pf := vm.ErrorFunc(); pf != nil {
+		pf(vm, "%s line = (%d) column = (%d) : error %s\n", source, line, column, desc)
+	}
+}
+
+// SetErrorHandlers installs the handlers printing runtime and compilation
+// errors.
+func SetErrorHandlers(vm *sqvm.VM) {
+	vm.SetCompilerErrorHandler(compilerError)
+	vm.NewClosure(printError, 0)
+	vm.SetErrorHandler()
+}
@@ -0,0 +1,248 @@
+// Package base implements the base library of Squirrel, the global
+// functions that scripts expect to always be there.
+package base
+
+import (
+	"math"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+var funcs = []lib.Func{
+	{Name: "seterrorhandler", Fn: setErrorHandler, NParams: 2, TypeMask: ""},
+	{Name: "setdebughook", Fn: setDebugHook, NParams: 2, TypeMask: ""},
+	{Name: "enabledebuginfo", Fn: enableDebugInfo, NParams: 2, TypeMask: ""},
+	{Name: "getstackinfos", Fn: getStackInfos, NParams: 2, TypeMask: ".n"},
+	{Name: "getroottable", Fn: getRootTable, NParams: 1, TypeMask: ""},
+	{Name: "setroottable", Fn: setRootTable, NParams: 2, TypeMask: ""},
+	{Name: "getconsttable", Fn: getConstTable, NParams: 1, TypeMask: ""},
+	{Name: "setconsttable", Fn: setConstTable, NParams: 2, TypeMask: ""},
+	{Name: "assert", Fn: assert, NParams: -2, TypeMask: ""},
+	{Name: "print", Fn: printValue, NParams: 2, TypeMask: ""},
+	{Name: "error", Fn: printError, NParams: 2, TypeMask: ""},
+	{Name: "compilestring", Fn: compileString, NParams: -2, TypeMask: ".ss"},
+	{Name: "newthread", Fn: newThread, NParams: 2, TypeMask: ".c"},
+	{Name: "suspend", Fn: suspend, NParams: -1, TypeMask: ""},
+	{Name: "array", Fn: newArray, NParams: -2, TypeMask: ".n"},
+	{Name: "type", Fn: typeOf, NParams: 2, TypeMask: ""},
+	{Name: "callee", Fn: callee, NParams: 0, TypeMask: ""},
+	{Name: "collectgarbage", Fn: collectGarbage, NParams: 0, TypeMask: ""},
+	{Name: "resurrectunreachable", Fn: resurrectUnreachable, NParams: 0, TypeMask: ""},
+}
+
+// Version constants, as defined by the reference implementation
+const (
+	versionNumber = 310
+	version       = "Squirrel 3.1 stable"
+)
+
+// Register adds the base library functions to the root table.
+func Register(vm *sqvm.VM) error {
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	if err := lib.Register(vm, funcs); err != nil {
+		return err
+	}
+	consts := []struct {
+		name  string
+		value int64
+	}{
+		{"_versionnumber_", versionNumber},
+		{"_charsize_", 1},
+		{"_intsize_", 8},
+		{"_floatsize_", 8},
+	}
+	for _, c := range consts {
+		vm.PushString(c.name)
+		vm.PushInteger(c.value)
+		if err := vm.NewSlot(-3, false); err != nil {
+			return err
+		}
+	}
+	vm.PushString("_version_")
+	vm.PushString(version)
+	return vm.NewSlot(-3, false)
+}
+
+func setErrorHandler(vm *sqvm.VM) (int, error) {
+	vm.SetErrorHandler()
+	return 0, nil
+}
+
+func setDebugHook(vm *sqvm.VM) (int, error) {
+	if err := vm.SetDebugHookClosure(); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+func enableDebugInfo(vm *sqvm.VM) (int, error) {
+	vm.EnableDebugInfo(vm.ToBool(2))
+	return 0, nil
+}
+
+func getStackInfos(vm *sqvm.VM) (int, error) {
+	level := int(vm.GetInteger(2))
+	si, err := vm.GetStackInfos(level)
+	if err != nil {
+		return 0, nil
+	}
+	vm.NewTable()
+	vm.PushString("func")
+	vm.PushString(si.FuncName)
+	vm.NewSlot(-3, false)
+	vm.PushString("src")
+	vm.PushString(si.Source)
+	vm.NewSlot(-3, false)
+	vm.PushString("line")
+	vm.PushInteger(int64(si.Line))
+	vm.NewSlot(-3, false)
+	vm.PushString("locals")
+	vm.NewTable()
+	for idx := 0; ; idx++ {
+		name, ok := vm.GetLocal(level, idx)
+		if !ok {
+			break
+		}
+		vm.PushString(name)
+		vm.Push(-2)
+		vm.NewSlot(-4, false)
+		vm.Pop(1)
+	}
+	vm.NewSlot(-3, false)
+	return 1, nil
+}
+
+func getRootTable(vm *sqvm.VM) (int, error) {
+	vm.PushRootTable()
+	return 1, nil
+}
+
+// setRootTable returns the previous root table.
+func setRootTable(vm *sqvm.VM) (int, error) {
+	vm.PushRootTable()
+	vm.Push(2)
+	if err := vm.SetRootTable(); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+func getConstTable(vm *sqvm.VM) (int, error) {
+	vm.PushConstTable()
+	return 1, nil
+}
+
+// setConstTable returns the previous const table.
+func setConstTable(vm *sqvm.VM) (int, error) {
+	vm.PushConstTable()
+	vm.Push(2)
+	if err := vm.SetConstTable(); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+func assert(vm *sqvm.VM) (int, error) {
+	if vm.ToBool(2) {
+		return 0, nil
+	}
+	if vm.GetTop() > 2 && vm.ToString(3) == nil {
+		return vm.ThrowError("%s", vm.GetString(-1))
+	}
+	return vm.ThrowError("assertion failed")
+}
+
+func printValue(vm *sqvm.VM) (int, error) {
+	return output(vm, vm.PrintFunc())
+}
+
+func printError(vm *sqvm.VM) (int, error) {
+	return output(vm, vm.ErrorFunc())
+}
+
+func output(vm *sqvm.VM, fn sqvm.PrintFunc) (int, error) {
+	if err := vm.ToString(2); err != nil {
+		return 0, err
+	}
+	if fn != nil {
+		fn(vm, "%s", vm.GetString(-1))
+	}
+	return 0, nil
+}
+
+func compileString(vm *sqvm.VM) (int, error) {
+	name := "unnamedbuffer"
+	if vm.GetTop() > 2 {
+		name = vm.GetString(3)
+	}
+	if _, err := compiler.Compile(vm, name, strings.NewReader(vm.GetString(2)), false); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+func newThread(vm *sqvm.VM) (int, error) {
+	t := vm.NewThread(sqvm.ThreadStackSize)
+	t.Move(vm, 2)
+	return 1, nil
+}
+
+func suspend(vm *sqvm.VM) (int, error) {
+	if vm.GetTop() < 2 {
+		vm.PushNull()
+	}
+	return vm.SuspendVM()
+}
+
+func newArray(vm *sqvm.VM) (int, error) {
+	size := vm.GetInteger(2)
+	if size < 0 {
+		return vm.ThrowError("size must be positive")
+	}
+	fill := vm.GetTop() > 2
+	n := int(size)
+	if int64(n) != size {
+		// too large for ArrayResize to accept anyway
+		n = math.MaxInt
+	}
+	vm.NewArray(0)
+	if err := vm.ArrayResize(-1, n); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if fill {
+		for i := int64(0); i < size; i++ {
+			vm.PushInteger(i)
+			vm.Push(3)
+			if err := vm.Set(-3); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return 1, nil
+}
+
+func typeOf(vm *sqvm.VM) (int, error) {
+	vm.PushString(vm.GetType(2).String())
+	return 1, nil
+}
+
+func callee(vm *sqvm.VM) (int, error) {
+	if err := vm.GetCallee(); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+func collectGarbage(vm *sqvm.VM) (int, error) {
+	vm.PushInteger(int64(vm.CollectGarbage()))
+	return 1, nil
+}
+
+func resurrectUnreachable(vm *sqvm.VM) (int, error) {
+	vm.ResurrectUnreachable()
+	return 1, nil
+}
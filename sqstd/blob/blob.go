@@ -0,0 +1,249 @@
+// Package blob implements the blob library of Squirrel: the blob class,
+// a byte buffer derived from std_stream, and functions to reinterpret
+// and byte swap numbers.
+//
+// Hosts exchange byte slices with scripts through PushBlob and GetBlob,
+// neither of them copies the data. They are functions of this package
+// rather than methods of sqvm.VM, which cannot depend on the standard
+// libraries: blob.PushBlob(vm, data) stands for vm.PushBlob(data).
+package blob
+
+import (
+	"math"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqstd/internal/stream"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+type classTag string
+
+const blobTag classTag = "std_blob"
+
+var blobFuncs = []lib.Func{
+	{Name: "constructor", Fn: blobConstructor, NParams: -1, TypeMask: "xn"},
+	{Name: "resize", Fn: blobResize, NParams: 2, TypeMask: "xn"},
+	{Name: "swap2", Fn: blobSwap2, NParams: 1, TypeMask: "x"},
+	{Name: "swap4", Fn: blobSwap4, NParams: 1, TypeMask: "x"},
+	{Name: "_set", Fn: blobSet, NParams: 3, TypeMask: "xnn"},
+	{Name: "_get", Fn: blobGet, NParams: 2, TypeMask: "x."},
+	{Name: "_typeof", Fn: blobTypeOf, NParams: 1, TypeMask: "x"},
+	{Name: "_nexti", Fn: blobNextI, NParams: 2, TypeMask: "x"},
+	{Name: "_cloned", Fn: blobCloned, NParams: 2, TypeMask: "xx"},
+}
+
+var funcs = []lib.Func{
+	{Name: "castf2i", Fn: castF2I, NParams: 2, TypeMask: ".n"},
+	{Name: "casti2f", Fn: castI2F, NParams: 2, TypeMask: ".n"},
+	{Name: "swap2", Fn: swap2, NParams: 2, TypeMask: ".n"},
+	{Name: "swap4", Fn: swap4, NParams: 2, TypeMask: ".n"},
+}
+
+// Register adds the blob class and the blob library functions to the
+// root table.
+func Register(vm *sqvm.VM) error {
+	if err := stream.PushClass(vm); err != nil {
+		return err
+	}
+	if err := vm.NewClass(true); err != nil {
+		vm.Pop(1)
+		return err
+	}
+	defer vm.Pop(1)
+	vm.SetTypeTag(-1, blobTag)
+	if err := lib.Register(vm, blobFuncs); err != nil {
+		return err
+	}
+	vm.Push(-1)
+	if err := stream.SetBlobClass(vm); err != nil {
+		return err
+	}
+
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	vm.PushString("blob")
+	vm.Push(-3)
+	if err := vm.NewSlot(-3, false); err != nil {
+		return err
+	}
+	return lib.Register(vm, funcs)
+}
+
+// PushBlob pushes a blob whose buffer is data. Writes of the script are
+// visible in data until the blob grows beyond its capacity.
+func PushBlob(vm *sqvm.VM, data []byte) error {
+	return stream.PushBlob(vm, data)
+}
+
+// GetBlob returns the buffer of the blob at idx. It stays valid until
+// the blob grows or is resized.
+func GetBlob(vm *sqvm.VM, idx int) ([]byte, error) {
+	b, err := stream.GetBlob(vm, idx)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func getBlob(vm *sqvm.VM) (*stream.Blob, bool) {
+	b, err := stream.GetBlob(vm, 1)
+	return b, err == nil
+}
+
+func blobConstructor(vm *sqvm.VM) (int, error) {
+	size := int64(0)
+	if vm.GetTop() > 1 {
+		size = vm.GetInteger(2)
+	}
+	if size < 0 {
+		return vm.ThrowError("cannot create blob with negative size")
+	}
+	if err := vm.ChargeAllocation(size); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if err := vm.SetInstanceUp(1, stream.NewBlob(make([]byte, size))); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+func blobResize(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	size := vm.GetInteger(2)
+	if size < 0 {
+		return vm.ThrowError("negative size")
+	}
+	if err := vm.ChargeAllocation(size - int64(len(b.Bytes()))); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	b.Resize(int(size))
+	return 0, nil
+}
+
+func blobSwap2(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	buf := b.Bytes()
+	for i := 0; i+1 < len(buf); i += 2 {
+		buf[i], buf[i+1] = buf[i+1], buf[i]
+	}
+	return 0, nil
+}
+
+func blobSwap4(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	buf := b.Bytes()
+	for i := 0; i+3 < len(buf); i += 4 {
+		buf[i], buf[i+1], buf[i+2], buf[i+3] = buf[i+3], buf[i+2], buf[i+1], buf[i]
+	}
+	return 0, nil
+}
+
+func blobSet(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	buf := b.Bytes()
+	idx := vm.GetInteger(2)
+	if idx < 0 || idx >= int64(len(buf)) {
+		return vm.ThrowError("index out of range")
+	}
+	buf[idx] = byte(vm.GetInteger(3))
+	vm.Push(3)
+	return 1, nil
+}
+
+// blobGet throws null for keys that aren't integers so that they are
+// looked up as missing.
+func blobGet(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	if vm.GetType(2) != sqvm.TypeInteger {
+		vm.PushNull()
+		return vm.ThrowObject()
+	}
+	buf := b.Bytes()
+	idx := vm.GetInteger(2)
+	if idx < 0 || idx >= int64(len(buf)) {
+		return vm.ThrowError("index out of range")
+	}
+	vm.PushInteger(int64(buf[idx]))
+	return 1, nil
+}
+
+func blobTypeOf(vm *sqvm.VM) (int, error) {
+	vm.PushString("blob")
+	return 1, nil
+}
+
+func blobNextI(vm *sqvm.VM) (int, error) {
+	b, ok := getBlob(vm)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	next := int64(0)
+	switch vm.GetType(2) {
+	case sqvm.TypeNull:
+	case sqvm.TypeInteger:
+		next = vm.GetInteger(2) + 1
+	default:
+		return vm.ThrowError("internal error (_nexti) wrong argument type")
+	}
+	if next < b.Len() {
+		vm.PushInteger(next)
+	} else {
+		vm.PushNull()
+	}
+	return 1, nil
+}
+
+// blobCloned gives the clone a copy of the buffer of the original.
+func blobCloned(vm *sqvm.VM) (int, error) {
+	other, err := stream.GetBlob(vm, 2)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	data := append([]byte(nil), other.Bytes()...)
+	if err := vm.SetInstanceUp(1, stream.NewBlob(data)); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+// castF2I returns the bits of a float as an integer.
+func castF2I(vm *sqvm.VM) (int, error) {
+	vm.PushInteger(int64(math.Float64bits(vm.GetFloat(2))))
+	return 1, nil
+}
+
+// castI2F returns the float made of the bits of an integer.
+func castI2F(vm *sqvm.VM) (int, error) {
+	vm.PushFloat(math.Float64frombits(uint64(vm.GetInteger(2))))
+	return 1, nil
+}
+
+// swap2 swaps the bytes of the low 16 bits of an integer, the result is
+// sign extended.
+func swap2(vm *sqvm.VM) (int, error) {
+	s := uint16(vm.GetInteger(2))
+	vm.PushInteger(int64(int16(s<<8 | s>>8)))
+	return 1, nil
+}
+
+// swap4 swaps the bytes of the low 32 bits of an integer.
+func swap4(vm *sqvm.VM) (int, error) {
+	d := uint32(vm.GetInteger(2))
+	vm.PushInteger(int64(d<<24 | d<<8&0xFF0000 | d>>8&0xFF00 | d>>24))
+	return 1, nil
+}
@@ -0,0 +1,45 @@
+// Package lib holds the helpers the standard libraries use to register
+// their native functions.
+package lib
+
+import (
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Func describes a native function of a library.
+type Func struct {
+	Name     string
+	Fn       sqvm.NativeFunc
+	NParams  int
+	TypeMask string
+}
+
+// Register adds funcs to the table or class on top of the stack.
+func Register(vm *sqvm.VM, funcs []Func) error {
+	for _, f := range funcs {
+		vm.PushString(f.Name)
+		vm.NewClosure(f.Fn, 0)
+		if err := vm.SetParamsCheck(f.NParams, f.TypeMask); err != nil {
+			vm.Pop(2)
+			return err
+		}
+		vm.SetNativeClosureName(-1, f.Name)
+		if err := vm.NewSlot(-3, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterClass creates a class with the methods funcs, tags it with tag
+// and stores it as name in the table on top of the stack.
+func RegisterClass(vm *sqvm.VM, name string, tag any, funcs []Func) error {
+	vm.PushString(name)
+	vm.NewClass(false)
+	vm.SetTypeTag(-1, tag)
+	if err := Register(vm, funcs); err != nil {
+		vm.Pop(2)
+		return err
+	}
+	return vm.NewSlot(-3, false)
+}
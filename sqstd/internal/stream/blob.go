@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+)
+
+// Blob is an in-memory stream. Writing past its end makes it grow.
+type Blob struct {
+	buf []byte
+	ptr int
+}
+
+// NewBlob returns a blob using data as its buffer, without copying it.
+func NewBlob(data []byte) *Blob {
+	return &Blob{buf: data}
+}
+
+// Bytes returns the buffer of the blob. It stays valid until the blob
+// grows or is resized.
+func (b *Blob) Bytes() []byte {
+	return b.buf
+}
+
+func (b *Blob) Resize(n int) {
+	if n <= cap(b.buf) {
+		old := len(b.buf)
+		b.buf = b.buf[:n]
+		for i := old; i < n; i++ {
+			b.buf[i] = 0
+		}
+	} else {
+		b.buf = append(b.buf, make([]byte, n-len(b.buf))...)
+	}
+	if b.ptr > n {
+		b.ptr = n
+	}
+}
+
+func (b *Blob) Read(p []byte) (int, error) {
+	if b.ptr >= len(b.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[b.ptr:])
+	b.ptr += n
+	return n, nil
+}
+
+func (b *Blob) Write(p []byte) (int, error) {
+	if end := b.ptr + len(p); end > len(b.buf) {
+		b.Resize(end)
+	}
+	n := copy(b.buf[b.ptr:], p)
+	b.ptr += n
+	return n, nil
+}
+
+func (b *Blob) Flush() error {
+	return nil
+}
+
+func (b *Blob) Tell() int64 {
+	return int64(b.ptr)
+}
+
+func (b *Blob) Len() int64 {
+	return int64(len(b.buf))
+}
+
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(b.ptr)
+	case io.SeekEnd:
+		offset += int64(len(b.buf))
+	}
+	if offset < 0 || offset > int64(len(b.buf)) {
+		return 0, fmt.Errorf("invalid seek position")
+	}
+	b.ptr = int(offset)
+	return offset, nil
+}
+
+func (b *Blob) EOS() bool {
+	return b.ptr == len(b.buf)
+}
+
+func (b *Blob) IsValid() bool {
+	return true
+}
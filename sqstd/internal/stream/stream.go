@@ -0,0 +1,318 @@
+// Package stream implements std_stream, the base class of blob and file,
+// and the Blob type the stream methods exchange data with.
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Stream is the instance data of the classes derived from std_stream.
+type Stream interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	Flush() error
+	Tell() int64
+	Len() int64
+	EOS() bool
+	IsValid() bool
+}
+
+type classTag string
+
+const (
+	// streamKey and blobKey are the registry slots of the classes
+	streamKey = "std_stream"
+	blobKey   = "std_blob"
+
+	streamTag classTag = "std_stream"
+)
+
+var funcs = []lib.Func{
+	{Name: "readblob", Fn: readBlob, NParams: 2, TypeMask: "xn"},
+	{Name: "readn", Fn: readN, NParams: 2, TypeMask: "xn"},
+	{Name: "writeblob", Fn: writeBlob, NParams: -2, TypeMask: "xx"},
+	{Name: "writen", Fn: writeN, NParams: 3, TypeMask: "xnn"},
+	{Name: "seek", Fn: seek, NParams: -2, TypeMask: "xnn"},
+	{Name: "tell", Fn: tell, NParams: 1, TypeMask: "x"},
+	{Name: "len", Fn: length, NParams: 1, TypeMask: "x"},
+	{Name: "eos", Fn: eos, NParams: 1, TypeMask: "x"},
+	{Name: "flush", Fn: flush, NParams: 1, TypeMask: "x"},
+}
+
+// PushClass pushes the std_stream class, creating it the first time.
+func PushClass(vm *sqvm.VM) error {
+	vm.PushRegistryTable()
+	vm.PushString(streamKey)
+	if err := vm.RawGet(-2); err == nil {
+		vm.Remove(-2)
+		return nil
+	}
+	vm.PushString(streamKey)
+	vm.NewClass(false)
+	vm.SetTypeTag(-1, streamTag)
+	if err := lib.Register(vm, funcs); err != nil {
+		vm.Pop(3)
+		return err
+	}
+	if err := vm.RawSet(-3); err != nil {
+		vm.Pop(1)
+		return err
+	}
+	vm.PushString(streamKey)
+	err := vm.RawGet(-2)
+	vm.Remove(-2)
+	return err
+}
+
+// SetBlobClass pops the class used to create blobs.
+func SetBlobClass(vm *sqvm.VM) error {
+	vm.PushRegistryTable()
+	vm.PushString(blobKey)
+	vm.Push(-3)
+	err := vm.RawSet(-3)
+	vm.Pop(2)
+	return err
+}
+
+// PushBlob pushes a blob instance using data as its buffer.
+func PushBlob(vm *sqvm.VM, data []byte) error {
+	vm.PushRegistryTable()
+	vm.PushString(blobKey)
+	if err := vm.RawGet(-2); err != nil {
+		vm.Pop(1)
+		return fmt.Errorf("the blob library is not registered")
+	}
+	if err := vm.CreateInstance(-1); err != nil {
+		vm.Pop(2)
+		return err
+	}
+	vm.SetInstanceUp(-1, NewBlob(data))
+	vm.Remove(-2)
+	vm.Remove(-2)
+	return nil
+}
+
+// GetBlob returns the blob instance at idx.
+func GetBlob(vm *sqvm.VM, idx int) (*Blob, error) {
+	up, err := vm.GetInstanceUp(idx)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := up.(*Blob)
+	if !ok {
+		return nil, fmt.Errorf("the object is not a blob")
+	}
+	return b, nil
+}
+
+func getStream(vm *sqvm.VM) (Stream, error) {
+	up, _ := vm.GetInstanceUp(1)
+	s, ok := up.(Stream)
+	if !ok {
+		return nil, fmt.Errorf("invalid type tag")
+	}
+	if !s.IsValid() {
+		return nil, fmt.Errorf("the stream is invalid")
+	}
+	return s, nil
+}
+
+func readBlob(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	size := vm.GetInteger(2)
+	if size < 0 {
+		return vm.ThrowError("invalid size")
+	}
+	if err := vm.ChargeAllocation(size); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	data := make([]byte, size)
+	n, _ := io.ReadFull(s, data)
+	if n <= 0 {
+		return vm.ThrowError("no data left to read")
+	}
+	if err := PushBlob(vm, data[:n]); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+// sizeOf returns the size of the values of a readn/writen format.
+func sizeOf(format int64) int {
+	switch format {
+	case 'l', 'd':
+		return 8
+	case 'i', 'f':
+		return 4
+	case 's', 'w':
+		return 2
+	case 'c', 'b':
+		return 1
+	}
+	return 0
+}
+
+func readN(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	format := vm.GetInteger(2)
+	size := sizeOf(format)
+	if size == 0 {
+		return vm.ThrowError("invalid format")
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(s, buf[:size]); err != nil {
+		return vm.ThrowError("io error")
+	}
+	le := binary.LittleEndian
+	switch format {
+	case 'l':
+		vm.PushInteger(int64(le.Uint64(buf[:])))
+	case 'i':
+		vm.PushInteger(int64(int32(le.Uint32(buf[:]))))
+	case 's':
+		vm.PushInteger(int64(int16(le.Uint16(buf[:]))))
+	case 'w':
+		vm.PushInteger(int64(le.Uint16(buf[:])))
+	case 'c':
+		vm.PushInteger(int64(int8(buf[0])))
+	case 'b':
+		vm.PushInteger(int64(buf[0]))
+	case 'f':
+		vm.PushFloat(float64(math.Float32frombits(le.Uint32(buf[:]))))
+	case 'd':
+		vm.PushFloat(math.Float64frombits(le.Uint64(buf[:])))
+	}
+	return 1, nil
+}
+
+func writeBlob(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	b, err := GetBlob(vm, 2)
+	if err != nil {
+		return vm.ThrowError("invalid parameter")
+	}
+	data := b.Bytes()
+	if n, err := s.Write(data); err != nil || n != len(data) {
+		return vm.ThrowError("io error")
+	}
+	vm.PushInteger(int64(len(data)))
+	return 1, nil
+}
+
+func writeN(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	format := vm.GetInteger(3)
+	size := sizeOf(format)
+	if size == 0 {
+		return vm.ThrowError("invalid format")
+	}
+	var buf [8]byte
+	le := binary.LittleEndian
+	switch format {
+	case 'l':
+		le.PutUint64(buf[:], uint64(vm.GetInteger(2)))
+	case 'i':
+		le.PutUint32(buf[:], uint32(vm.GetInteger(2)))
+	case 's', 'w':
+		le.PutUint16(buf[:], uint16(vm.GetInteger(2)))
+	case 'c', 'b':
+		buf[0] = byte(vm.GetInteger(2))
+	case 'f':
+		le.PutUint32(buf[:], math.Float32bits(float32(vm.GetFloat(2))))
+	case 'd':
+		le.PutUint64(buf[:], math.Float64bits(vm.GetFloat(2)))
+	}
+	if n, err := s.Write(buf[:size]); err != nil || n != size {
+		return vm.ThrowError("io error")
+	}
+	return 0, nil
+}
+
+// seek returns 0 on success and -1 if the position is out of the stream.
+// The origin is 'b' (the default), 'c' or 'e'.
+func seek(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	offset := vm.GetInteger(2)
+	whence := io.SeekStart
+	if vm.GetTop() > 2 {
+		switch vm.GetInteger(3) {
+		case 'b':
+			whence = io.SeekStart
+		case 'c':
+			whence = io.SeekCurrent
+		case 'e':
+			whence = io.SeekEnd
+		default:
+			return vm.ThrowError("invalid origin")
+		}
+	}
+	if _, err := s.Seek(offset, whence); err != nil {
+		vm.PushInteger(-1)
+	} else {
+		vm.PushInteger(0)
+	}
+	return 1, nil
+}
+
+func tell(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushInteger(s.Tell())
+	return 1, nil
+}
+
+func length(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushInteger(s.Len())
+	return 1, nil
+}
+
+func eos(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushBool(s.EOS())
+	return 1, nil
+}
+
+// flush returns 1 on success and null otherwise.
+func flush(vm *sqvm.VM) (int, error) {
+	s, err := getStream(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if s.Flush() != nil {
+		vm.PushNull()
+	} else {
+		vm.PushInteger(1)
+	}
+	return 1, nil
+}
@@ -0,0 +1,174 @@
+package io
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// File is a file opened for writing by a WritableFS.
+type File interface {
+	fs.File
+	io.Writer
+}
+
+// WritableFS is a filesystem files can be created and written in. Files
+// are only opened for writing when the filesystem given to the library
+// implements it.
+type WritableFS interface {
+	fs.FS
+	// OpenFile opens a file with the flags of os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+}
+
+// OSFS is the filesystem of the operating system. Names are paths of the
+// host, relative to the working directory.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (OSFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+// openFile opens name with a mode of fopen.
+func openFile(fsys fs.FS, name, mode string) (*file, error) {
+	var flag int
+	switch strings.NewReplacer("b", "", "t", "").Replace(mode) {
+	case "r":
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return newFile(f, true), nil
+	case "r+":
+		flag = os.O_RDWR
+	case "w":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "w+":
+		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	case "a":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	case "a+":
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	default:
+		return nil, fmt.Errorf("invalid mode %q", mode)
+	}
+	wfs, ok := fsys.(WritableFS)
+	if !ok {
+		return nil, fmt.Errorf("the filesystem is read-only")
+	}
+	f, err := wfs.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(f, true), nil
+}
+
+// file is the stream of file instances. It wraps whatever the handle
+// implements of reading, writing, seeking and closing.
+type file struct {
+	handle any
+	owns   bool
+	pos    int64
+	eof    bool
+}
+
+func newFile(handle any, owns bool) *file {
+	return &file{handle: handle, owns: owns}
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	r, ok := f.handle.(io.Reader)
+	if !ok {
+		return 0, fmt.Errorf("the file is not readable")
+	}
+	n, err := io.ReadFull(r, p)
+	f.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		f.eof = true
+	}
+	return n, err
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	w, ok := f.handle.(io.Writer)
+	if !ok {
+		return 0, fmt.Errorf("the file is not writable")
+	}
+	n, err := w.Write(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.handle.(io.Seeker)
+	if !ok {
+		return 0, fmt.Errorf("the file is not seekable")
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	f.pos, f.eof = pos, false
+	return pos, nil
+}
+
+func (f *file) Flush() error {
+	if fl, ok := f.handle.(interface{ Flush() error }); ok {
+		return fl.Flush()
+	}
+	return nil
+}
+
+func (f *file) Tell() int64 {
+	if s, ok := f.handle.(io.Seeker); ok {
+		if pos, err := s.Seek(0, io.SeekCurrent); err == nil {
+			return pos
+		}
+	}
+	return f.pos
+}
+
+func (f *file) Len() int64 {
+	if st, ok := f.handle.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	}
+	return 0
+}
+
+func (f *file) EOS() bool {
+	return f.eof
+}
+
+func (f *file) IsValid() bool {
+	return f.handle != nil
+}
+
+// Close closes the handle if the file owns it. Files that don't, like
+// stdout, stay usable.
+func (f *file) Close() error {
+	if f.handle == nil || !f.owns {
+		return nil
+	}
+	var err error
+	if c, ok := f.handle.(io.Closer); ok {
+		err = c.Close()
+	}
+	f.handle, f.owns = nil, false
+	return err
+}
@@ -0,0 +1,240 @@
+// Package io implements the io library of Squirrel: the file class,
+// derived from std_stream, the stdin, stdout and stderr files and the
+// functions loading scripts.
+//
+// The library only reaches files through the fs.FS it is given. Files
+// can be written if it also implements WritableFS, OSFS gives access to
+// the whole filesystem of the host.
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqstd/internal/stream"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Config tells the library where files come from. A nil FS forbids
+// opening files, nil standard streams are not registered.
+type Config struct {
+	FS     fs.FS
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type classTag string
+
+const fileTag classTag = "std_file"
+
+// Register adds the file class, the standard files and the io library
+// functions to the root table.
+func Register(vm *sqvm.VM, cfg Config) error {
+	if err := stream.PushClass(vm); err != nil {
+		return err
+	}
+	if err := vm.NewClass(true); err != nil {
+		vm.Pop(1)
+		return err
+	}
+	defer vm.Pop(1)
+	vm.SetTypeTag(-1, fileTag)
+	err := lib.Register(vm, []lib.Func{
+		{Name: "constructor", Fn: fileConstructor(cfg.FS), NParams: 3, TypeMask: "x"},
+		{Name: "_typeof", Fn: fileTypeOf, NParams: 1, TypeMask: "x"},
+		{Name: "close", Fn: fileClose, NParams: 1, TypeMask: "x"},
+	})
+	if err != nil {
+		return err
+	}
+
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	vm.PushString("file")
+	vm.Push(-3)
+	if err := vm.NewSlot(-3, false); err != nil {
+		return err
+	}
+	std := []struct {
+		name   string
+		handle any
+	}{
+		{"stdin", cfg.Stdin},
+		{"stdout", cfg.Stdout},
+		{"stderr", cfg.Stderr},
+	}
+	for _, s := range std {
+		if s.handle == nil {
+			continue
+		}
+		vm.PushString(s.name)
+		vm.CreateInstance(-3)
+		vm.SetInstanceUp(-1, newFile(s.handle, false))
+		if err := vm.NewSlot(-3, false); err != nil {
+			return err
+		}
+	}
+	return lib.Register(vm, []lib.Func{
+		{Name: "dofile", Fn: doFile(cfg.FS), NParams: -2, TypeMask: ".sb"},
+		{Name: "loadfile", Fn: loadFile(cfg.FS), NParams: -2, TypeMask: ".sb"},
+		{Name: "writeclosuretofile", Fn: writeClosureToFile(cfg.FS), NParams: 3, TypeMask: ".sc"},
+	})
+}
+
+// LoadFile compiles the script name of fsys and pushes its closure.
+// Files starting with the bytecode tag are read as serialized closures.
+// Compilation errors go to the compiler error handler if printError is
+// set.
+func LoadFile(vm *sqvm.VM, fsys fs.FS, name string, printError bool) error {
+	if fsys == nil {
+		return fmt.Errorf("cannot open the file")
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("cannot open the file")
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if sqvm.IsBytecode(r) {
+		proto, err := sqvm.ReadClosure(r)
+		if err != nil {
+			return err
+		}
+		vm.PushClosure(proto)
+		return nil
+	}
+	if head, _ := r.Peek(3); bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}) {
+		r.Discard(3)
+	}
+	_, err = compiler.Compile(vm, name, r, printError)
+	return err
+}
+
+// DoFile runs the script name of fsys with the value on top of the stack
+// as this. The return value is pushed if retVal is set. Runtime errors
+// always go to the error handler, compilation errors only if printError
+// is set.
+func DoFile(vm *sqvm.VM, fsys fs.FS, name string, retVal, printError bool) error {
+	if err := LoadFile(vm, fsys, name, printError); err != nil {
+		return err
+	}
+	vm.Push(-2)
+	if err := vm.Call(1, retVal, true); err != nil {
+		vm.Pop(1)
+		return err
+	}
+	if retVal {
+		vm.Remove(-2)
+	} else {
+		vm.Pop(1)
+	}
+	return nil
+}
+
+func fileConstructor(fsys fs.FS) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		var f *file
+		switch {
+		case vm.GetType(2) == sqvm.TypeString && vm.GetType(3) == sqvm.TypeString:
+			if fsys == nil {
+				return vm.ThrowError("cannot open file")
+			}
+			var err error
+			f, err = openFile(fsys, vm.GetString(2), vm.GetString(3))
+			if err != nil {
+				return vm.ThrowError("cannot open file")
+			}
+		case vm.GetType(2) == sqvm.TypeUserPointer:
+			f = newFile(vm.GetUserPointer(2), vm.GetType(3) != sqvm.TypeNull)
+		default:
+			return vm.ThrowError("wrong parameter")
+		}
+		if err := vm.SetInstanceUp(1, f); err != nil {
+			f.Close()
+			return vm.ThrowError("%s", err)
+		}
+		vm.SetReleaseHook(1, func(up any) {
+			up.(*file).Close()
+		})
+		return 0, nil
+	}
+}
+
+func fileTypeOf(vm *sqvm.VM) (int, error) {
+	vm.PushString("file")
+	return 1, nil
+}
+
+func fileClose(vm *sqvm.VM) (int, error) {
+	up, _ := vm.GetInstanceUp(1)
+	f, ok := up.(*file)
+	if !ok {
+		return vm.ThrowError("invalid type tag")
+	}
+	if err := f.Close(); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+func loadFile(fsys fs.FS) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		printError := vm.GetTop() > 2 && vm.GetBool(3)
+		if err := LoadFile(vm, fsys, vm.GetString(2), printError); err != nil {
+			return vm.ThrowError("%s", err)
+		}
+		return 1, nil
+	}
+}
+
+func doFile(fsys fs.FS) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		printError := vm.GetTop() > 2 && vm.GetBool(3)
+		vm.Push(1)
+		if err := DoFile(vm, fsys, vm.GetString(2), true, printError); err != nil {
+			// errors of the script are raised again as they are
+			return 0, err
+		}
+		return 1, nil
+	}
+}
+
+// WriteClosureToFile serializes the closure on top of the stack to the
+// file name of fsys, which has to be a WritableFS.
+func WriteClosureToFile(vm *sqvm.VM, fsys fs.FS, name string) error {
+	proto, err := vm.GetClosureProto(-1)
+	if err != nil {
+		return err
+	}
+	if fsys == nil {
+		return fmt.Errorf("cannot open the file")
+	}
+	f, err := openFile(fsys, name, "wb+")
+	if err != nil {
+		return fmt.Errorf("cannot open the file")
+	}
+	if err := sqvm.WriteClosure(f, proto); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeClosureToFile(fsys fs.FS) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		if err := WriteClosureToFile(vm, fsys, vm.GetString(2)); err != nil {
+			return vm.ThrowError("%s", err)
+		}
+		return 0, nil
+	}
+}
@@ -0,0 +1,177 @@
+package io_test
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/blob"
+	sqio "github.com/dexter3k/go-squirrel/sqstd/io"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// memFS is a WritableFS keeping files in a fstest.MapFS. Written files
+// are stored when they are closed.
+type memFS struct {
+	fstest.MapFS
+}
+
+func (m memFS) OpenFile(name string, flag int, perm fs.FileMode) (sqio.File, error) {
+	f := &memFile{fs: m, name: name}
+	if old, ok := m.MapFS[name]; ok && flag&os.O_TRUNC == 0 {
+		f.Write(old.Data)
+	} else if !ok && flag&os.O_CREATE == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
+
+type memFile struct {
+	bytes.Buffer
+	fs   memFS
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return nil, fs.ErrInvalid
+}
+
+func (f *memFile) Close() error {
+	f.fs.MapFS[f.name] = &fstest.MapFile{Data: f.Bytes()}
+	return nil
+}
+
+func newVM(t *testing.T, fsys fs.FS) *sqvm.VM {
+	t.Helper()
+	vm := sqvm.Open(1024)
+	t.Cleanup(vm.Close)
+	if err := blob.Register(vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqio.Register(vm, sqio.Config{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func run(t *testing.T, vm *sqvm.VM, src string) error {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	vm.PushRootTable()
+	err := vm.Call(1, false, false)
+	vm.Pop(1)
+	return err
+}
+
+func TestFileRead(t *testing.T) {
+	vm := newVM(t, fstest.MapFS{
+		"data.bin": {Data: []byte("0123456789")},
+	})
+	err := run(t, vm, `
+		local f = file("data.bin", "rb")
+		if (f.len() != 10) throw "len is " + f.len()
+		f.seek(4)
+		local b = f.readblob(3)
+		if (b.len() != 3 || b[0] != '4' || b[2] != '6') throw "bad blob read at 4"
+		if (f.tell() != 7) throw "tell is " + f.tell()
+		f.seek(-2, 'e')
+		b = f.readblob(10)
+		if (b.len() != 2 || b[1] != '9') throw "bad blob read at the end"
+		if (!f.eos()) throw "not at the end"
+		f.seek(1, 'b')
+		if (f.readn('c') != '1') throw "bad char read"
+		f.close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	vm := newVM(t, fstest.MapFS{
+		"double.nut": {Data: []byte("return x * 2")},
+		"bom.nut":    {Data: []byte("\xEF\xBB\xBFreturn 7")},
+		"bad.nut":    {Data: []byte("return (")},
+	})
+	err := run(t, vm, `
+		::x <- 21
+		if (dofile("double.nut") != 42) throw "bad dofile result"
+		local f = loadfile("double.nut")
+		if (f.call({x = 2}) != 4) throw "bad loadfile result"
+		if (dofile("bom.nut") != 7) throw "bad result with a byte order mark"
+		foreach (name in ["bad.nut", "missing.nut"]) {
+			local caught = false
+			try {
+				loadfile(name)
+			} catch (e) {
+				caught = true
+			}
+			if (!caught) throw "loading " + name + " succeeded"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnlyFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"data.bin": {Data: []byte("data")},
+	}
+	vm := newVM(t, fsys)
+	err := run(t, vm, `
+		foreach (mode in ["w", "wb", "a", "r+"]) {
+			local caught = false
+			try {
+				file("data.bin", mode)
+			} catch (e) {
+				caught = true
+			}
+			if (!caught) throw "opened with mode " + mode
+		}
+		local caught = false
+		try {
+			writeclosuretofile("out.cnut", @() 1)
+		} catch (e) {
+			caught = true
+		}
+		if (!caught) throw "wrote a closure"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fsys["data.bin"].Data) != "data" {
+		t.Fatal("the file was modified")
+	}
+}
+
+func TestWritableFS(t *testing.T) {
+	fsys := memFS{fstest.MapFS{}}
+	vm := newVM(t, fsys)
+	err := run(t, vm, `
+		local f = file("out.txt", "w")
+		f.writen('h', 'c')
+		f.writen('i', 'c')
+		f.close()
+		f = file("out.txt", "a")
+		local b = blob()
+		b.writen('!', 'c')
+		f.writeblob(b)
+		f.close()
+
+		writeclosuretofile("out.cnut", function() { return "from bytecode" })
+		if (dofile("out.cnut") != "from bytecode") throw "bad closure read back"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fsys.MapFS["out.txt"].Data); got != "hi!" {
+		t.Fatalf("wrote %q, want %q", got, "hi!")
+	}
+}
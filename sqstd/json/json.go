@@ -0,0 +1,154 @@
+// Package json implements a JSON library for scripts, the json table
+// with encode and decode. Values are converted with VM.GetGoValue and
+// VM.PushGoValue.
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+var funcs = []lib.Func{
+	{Name: "encode", Fn: encode, NParams: -2, TypeMask: "..i|s"},
+	{Name: "decode", Fn: decode, NParams: 2, TypeMask: ".s"},
+}
+
+// Register adds the json table to the root table.
+func Register(vm *sqvm.VM) error {
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	vm.PushString("json")
+	vm.NewTable()
+	if err := lib.Register(vm, funcs); err != nil {
+		vm.Pop(2)
+		return err
+	}
+	return vm.NewSlot(-3, false)
+}
+
+// Encode returns the JSON text of the value at idx. Keys of objects are
+// sorted, floats keep a fraction so that they decode as floats.
+func Encode(vm *sqvm.VM, idx int, indent string) (string, error) {
+	v, err := vm.GetGoValue(idx)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(markFloats(v)); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Decode pushes the value of a JSON text. Numbers without a fraction or
+// an exponent become integers if they fit.
+func Decode(vm *sqvm.VM, text string) error {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("invalid character after top-level value")
+	}
+	return vm.PushGoValue(convertNumbers(v))
+}
+
+// maxIndent is the largest number of spaces encode indents with.
+const maxIndent = 64
+
+func encode(vm *sqvm.VM) (int, error) {
+	indent := ""
+	if vm.GetTop() > 2 {
+		if vm.GetType(3) == sqvm.TypeString {
+			indent = vm.GetString(3)
+		} else {
+			n := vm.GetInteger(3)
+			if n < 0 || n > maxIndent {
+				return vm.ThrowError("indent must be between 0 and %d", maxIndent)
+			}
+			indent = strings.Repeat(" ", int(n))
+		}
+	}
+	s, err := Encode(vm, 2, indent)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushString(s)
+	return 1, nil
+}
+
+func decode(vm *sqvm.VM) (int, error) {
+	if err := Decode(vm, vm.GetString(2)); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+// jsonFloat is a float64 that is always encoded with a fraction or an
+// exponent.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("unsupported float value %v", v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.ContainsAny(b, ".eE") {
+		b = append(b, ".0"...)
+	}
+	return b, nil
+}
+
+func markFloats(v any) any {
+	switch v := v.(type) {
+	case float64:
+		return jsonFloat(v)
+	case []any:
+		for i := range v {
+			v[i] = markFloats(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = markFloats(v[k])
+		}
+	}
+	return v
+}
+
+func convertNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if !strings.ContainsAny(string(v), ".eE") {
+			if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return i
+			}
+		}
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return f
+	case []any:
+		for i := range v {
+			v[i] = convertNumbers(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = convertNumbers(v[k])
+		}
+	}
+	return v
+}
@@ -0,0 +1,113 @@
+package json_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/json"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+func newVM(t *testing.T) *sqvm.VM {
+	t.Helper()
+	vm := sqvm.Open(1024)
+	t.Cleanup(vm.Close)
+	if err := json.Register(vm); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+// eval runs src and pushes the value it returns, nothing is pushed if it
+// fails.
+func eval(t *testing.T, vm *sqvm.VM, src string) error {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	vm.PushRootTable()
+	if err := vm.Call(1, true, false); err != nil {
+		vm.Pop(1)
+		return err
+	}
+	vm.Remove(-2)
+	return nil
+}
+
+func TestEncode(t *testing.T) {
+	vm := newVM(t)
+	tests := []struct {
+		src, want string
+	}{
+		{`return json.encode({b = [1, 2.0, "x"], a = null, c = true})`, `{"a":null,"b":[1,2.0,"x"],"c":true}`},
+		{`return json.encode([1], 2)`, "[\n  1\n]"},
+		{`return json.encode([1], "\t")`, "[\n\t1\n]"},
+	}
+	for _, tt := range tests {
+		if err := eval(t, vm, tt.src); err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		if got := vm.GetString(-1); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.src, got, tt.want)
+		}
+		vm.Pop(1)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	vm := newVM(t)
+	tests := []struct {
+		src, err string
+	}{
+		{`json.encode([1], -1)`, "indent must be between"},
+		{`json.encode({a = 1}, 1 << 62)`, "indent must be between"},
+		{`local a = [1]; a.append(a); json.encode(a)`, "cycle detected"},
+		{`local t = {}; t.t <- {u = t}; json.encode(t)`, "cycle detected"},
+		{`json.encode({[1] = "one"})`, "is not a string"},
+		{`json.encode(1.0 / 0.0)`, "unsupported float value"},
+	}
+	for _, tt := range tests {
+		err := eval(t, vm, tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	vm := newVM(t)
+	if err := json.Decode(vm, `{"i": 9223372036854775807, "u": 18446744073709551616, "f": 1.5, "e": 1e3}`); err != nil {
+		t.Fatal(err)
+	}
+	v, err := vm.GetGoValue(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := v.(map[string]any)
+	// numbers beyond the integers become floats rather than wrapping
+	if m["i"] != int64(math.MaxInt64) || m["u"] != float64(1<<64) || m["f"] != 1.5 || m["e"] != 1000.0 {
+		t.Fatalf("decoded %#v", m)
+	}
+	if err := json.Decode(vm, `[1] 2`); err == nil {
+		t.Fatal("trailing data was accepted")
+	}
+}
+
+func TestPushUnsignedOverflow(t *testing.T) {
+	vm := newVM(t)
+	top := vm.GetTop()
+	if err := vm.PushGoValue(map[string]any{"u": uint64(math.MaxUint64)}); err == nil {
+		t.Fatal("an unsigned value overflowing an integer was converted")
+	}
+	if vm.GetTop() != top {
+		t.Fatal("a value was pushed for a failed conversion")
+	}
+	if err := vm.PushGoValue(uint64(math.MaxInt64)); err != nil {
+		t.Fatal(err)
+	}
+	if vm.GetInteger(-1) != math.MaxInt64 {
+		t.Fatalf("got %d", vm.GetInteger(-1))
+	}
+}
@@ -0,0 +1,135 @@
+// Package math implements the math library of Squirrel.
+//
+// Every VM has its own generator for rand(), seeded with 1 like the C
+// library, so scripts that call srand() or hosts that call Seed get
+// reproducible sequences.
+package math
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// randKey is the registry slot holding the generator of the VM.
+const randKey = "sqstd.math.rand"
+
+var funcs = []lib.Func{
+	{Name: "sqrt", Fn: floatFunc(math.Sqrt), NParams: 2, TypeMask: ".n"},
+	{Name: "sin", Fn: floatFunc(math.Sin), NParams: 2, TypeMask: ".n"},
+	{Name: "cos", Fn: floatFunc(math.Cos), NParams: 2, TypeMask: ".n"},
+	{Name: "asin", Fn: floatFunc(math.Asin), NParams: 2, TypeMask: ".n"},
+	{Name: "acos", Fn: floatFunc(math.Acos), NParams: 2, TypeMask: ".n"},
+	{Name: "log", Fn: floatFunc(math.Log), NParams: 2, TypeMask: ".n"},
+	{Name: "log10", Fn: floatFunc(math.Log10), NParams: 2, TypeMask: ".n"},
+	{Name: "tan", Fn: floatFunc(math.Tan), NParams: 2, TypeMask: ".n"},
+	{Name: "atan", Fn: floatFunc(math.Atan), NParams: 2, TypeMask: ".n"},
+	{Name: "atan2", Fn: floatFunc2(math.Atan2), NParams: 3, TypeMask: ".nn"},
+	{Name: "pow", Fn: floatFunc2(math.Pow), NParams: 3, TypeMask: ".nn"},
+	{Name: "floor", Fn: floatFunc(math.Floor), NParams: 2, TypeMask: ".n"},
+	{Name: "ceil", Fn: floatFunc(math.Ceil), NParams: 2, TypeMask: ".n"},
+	{Name: "exp", Fn: floatFunc(math.Exp), NParams: 2, TypeMask: ".n"},
+	{Name: "srand", Fn: srand, NParams: 2, TypeMask: ".n"},
+	{Name: "rand", Fn: random, NParams: 1, TypeMask: ""},
+	{Name: "fabs", Fn: floatFunc(math.Abs), NParams: 2, TypeMask: ".n"},
+	{Name: "abs", Fn: abs, NParams: 2, TypeMask: ".n"},
+}
+
+// Register adds the math library functions and constants to the root
+// table.
+func Register(vm *sqvm.VM) error {
+	vm.PushRegistryTable()
+	vm.PushString(randKey)
+	vm.PushUserPointer(NewRand(1))
+	err := vm.RawSet(-3)
+	vm.Pop(1)
+	if err != nil {
+		return err
+	}
+
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	if err := lib.Register(vm, funcs); err != nil {
+		return err
+	}
+	vm.PushString("RAND_MAX")
+	vm.PushInteger(RandMax)
+	if err := vm.NewSlot(-3, false); err != nil {
+		return err
+	}
+	vm.PushString("PI")
+	vm.PushFloat(math.Pi)
+	return vm.NewSlot(-3, false)
+}
+
+// Seed seeds the generator of rand(), like srand() does.
+func Seed(vm *sqvm.VM, seed uint32) error {
+	r, err := getRand(vm)
+	if err != nil {
+		return err
+	}
+	r.Seed(seed)
+	return nil
+}
+
+func getRand(vm *sqvm.VM) (*Rand, error) {
+	vm.PushRegistryTable()
+	vm.PushString(randKey)
+	err := vm.RawGet(-2)
+	if err != nil {
+		vm.Pop(1)
+		return nil, fmt.Errorf("the math library is not registered")
+	}
+	r, _ := vm.GetUserPointer(-1).(*Rand)
+	vm.Pop(2)
+	if r == nil {
+		return nil, fmt.Errorf("the math library is not registered")
+	}
+	return r, nil
+}
+
+// floatFunc makes a native of fn, integer arguments are converted to
+// float and the result is always a float.
+func floatFunc(fn func(float64) float64) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		vm.PushFloat(fn(vm.GetFloat(2)))
+		return 1, nil
+	}
+}
+
+func floatFunc2(fn func(float64, float64) float64) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		vm.PushFloat(fn(vm.GetFloat(2), vm.GetFloat(3)))
+		return 1, nil
+	}
+}
+
+func srand(vm *sqvm.VM) (int, error) {
+	r, err := getRand(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	r.Seed(uint32(vm.GetInteger(2)))
+	return 0, nil
+}
+
+func random(vm *sqvm.VM) (int, error) {
+	r, err := getRand(vm)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushInteger(r.Int())
+	return 1, nil
+}
+
+// abs takes the integer value of its argument, floats are truncated.
+func abs(vm *sqvm.VM) (int, error) {
+	n := vm.GetInteger(2)
+	if n < 0 {
+		n = -n
+	}
+	vm.PushInteger(n)
+	return 1, nil
+}
@@ -0,0 +1,53 @@
+package math
+
+// Rand is the pseudo-random generator behind rand(). It is the additive
+// feedback generator of the glibc rand(), so seeded scripts produce the
+// same numbers as the reference implementation built on Linux.
+type Rand struct {
+	ring [34]int32
+	pos  int
+}
+
+// RandMax is the largest number Rand returns.
+const RandMax = 0x7FFFFFFF
+
+func NewRand(seed uint32) *Rand {
+	r := &Rand{}
+	r.Seed(seed)
+	return r
+}
+
+func (r *Rand) Seed(seed uint32) {
+	if seed == 0 {
+		seed = 1
+	}
+	r.ring[0] = int32(seed)
+	for i := 1; i < 31; i++ {
+		// 16807 * r[i-1] % 2147483647 without overflowing
+		hi, lo := r.ring[i-1]/127773, r.ring[i-1]%127773
+		word := 16807*lo - 2836*hi
+		if word < 0 {
+			word += RandMax
+		}
+		r.ring[i] = word
+	}
+	for i := 31; i < 34; i++ {
+		r.ring[i] = r.ring[i-31]
+	}
+	r.pos = 0
+	for i := 34; i < 344; i++ {
+		r.next()
+	}
+}
+
+func (r *Rand) next() int32 {
+	v := r.ring[(r.pos+3)%34] + r.ring[(r.pos+31)%34]
+	r.ring[r.pos] = v
+	r.pos = (r.pos + 1) % 34
+	return v
+}
+
+// Int returns a number between 0 and RandMax.
+func (r *Rand) Int() int64 {
+	return int64(uint32(r.next()) >> 1)
+}
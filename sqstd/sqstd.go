@@ -0,0 +1,147 @@
+// Package sqstd registers a chosen set of the standard libraries at once.
+// Full gives scripts everything, including access to the host, Safe only
+// what untrusted code can use without reaching out of the VM.
+package sqstd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dexter3k/go-squirrel/sqstd/base"
+	"github.com/dexter3k/go-squirrel/sqstd/blob"
+	sqio "github.com/dexter3k/go-squirrel/sqstd/io"
+	"github.com/dexter3k/go-squirrel/sqstd/json"
+	sqmath "github.com/dexter3k/go-squirrel/sqstd/math"
+	"github.com/dexter3k/go-squirrel/sqstd/str"
+	"github.com/dexter3k/go-squirrel/sqstd/system"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Library is a set of standard libraries.
+type Library uint
+
+const (
+	Base Library = 1 << iota
+	String
+	Math
+	Blob
+	IO
+	System
+	JSON
+	// Regexp2 is the regexp2 class of the string library, which uses
+	// the RE2 syntax of the Go regexp package.
+	Regexp2
+
+	AllLibraries = Base | String | Math | Blob | IO | System | JSON | Regexp2
+)
+
+// Options tells Register which libraries to install and how.
+type Options struct {
+	Libraries Library
+	IO        sqio.Config
+	System    system.Config
+	// Blocked lists the global functions removed once the libraries
+	// are registered. Names no library defined are ignored.
+	Blocked []string
+	// Limits are set on the VM unless they are all zero, which leaves
+	// the limits of the VM as they are.
+	Limits sqvm.Limits
+}
+
+// Full installs all the libraries with access to the files, the
+// environment and the commands of the host.
+func Full() Options {
+	return Options{
+		Libraries: AllLibraries,
+		IO: sqio.Config{
+			FS:     sqio.OSFS{},
+			Stdin:  os.Stdin,
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		},
+		System: system.Config{
+			Executor: system.ShellExecutor{},
+			FS:       sqio.OSFS{},
+		},
+	}
+}
+
+// Safe installs the libraries for untrusted code: no io library, the
+// system library only tells the time and the functions that compile
+// code or change the state of the VM are blocked. The call depth, the
+// instructions and the allocations of each call of the host are limited
+// to defaults that hosts can change in the Limits of the options. Wall
+// clock time is not bounded, hosts that need a deadline call the scripts
+// with vm.CallContext.
+func Safe() Options {
+	return Options{
+		Libraries: Base | String | Math | Blob | System | JSON | Regexp2,
+		System: system.Config{
+			Env: noEnv{},
+		},
+		Blocked: []string{
+			"compilestring",
+			"setroottable",
+			"setconsttable",
+			"seterrorhandler",
+			"setdebughook",
+			"enabledebuginfo",
+			"resurrectunreachable",
+			"getenv",
+			"system",
+			"remove",
+			"rename",
+		},
+		Limits: sqvm.Limits{
+			MaxInstructions: 100_000_000,
+			MaxCallDepth:    1000,
+			AllocationQuota: 64 << 20,
+		},
+	}
+}
+
+// noEnv is an empty environment.
+type noEnv struct{}
+
+func (noEnv) LookupEnv(name string) (string, bool) {
+	return "", false
+}
+
+// Register installs the libraries of opts in the root table.
+func Register(vm *sqvm.VM, opts Options) error {
+	libs := []struct {
+		lib      Library
+		name     string
+		register func() error
+	}{
+		{Base, "base", func() error { return base.Register(vm) }},
+		{Blob, "blob", func() error { return blob.Register(vm) }},
+		{IO, "io", func() error { return sqio.Register(vm, opts.IO) }},
+		{JSON, "json", func() error { return json.Register(vm) }},
+		{Math, "math", func() error { return sqmath.Register(vm) }},
+		{System, "system", func() error { return system.Register(vm, opts.System) }},
+		{String, "string", func() error { return str.Register(vm) }},
+		{Regexp2, "regexp2", func() error { return str.RegisterRegexp2(vm) }},
+	}
+	for _, l := range libs {
+		if opts.Libraries&l.lib == 0 {
+			continue
+		}
+		if err := l.register(); err != nil {
+			return fmt.Errorf("unable to register the %s library: %w", l.name, err)
+		}
+	}
+
+	if opts.Limits != (sqvm.Limits{}) {
+		vm.SetLimits(opts.Limits)
+	}
+
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	for _, name := range opts.Blocked {
+		vm.PushString(name)
+		// a missing slot is not an error, the key is popped anyway
+		vm.DeleteSlot(-2, false)
+	}
+	return nil
+}
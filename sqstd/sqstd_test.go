@@ -0,0 +1,92 @@
+package sqstd_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+func TestSafe(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	if err := sqstd.Register(vm, sqstd.Safe()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src, err string
+	}{
+		{`compilestring("return 1")`, "compilestring"},
+		{`system("true")`, "system"},
+		{`while (true) {}`, "instruction limit exceeded"},
+		{`array(1 << 22)`, "allocation quota exceeded"},
+		{`blob(1 << 27)`, "allocation quota exceeded"},
+		{`function f(n) { return f(n + 1) + 1 } f(0)`, "stack overflow"},
+	}
+	for _, tt := range tests {
+		if _, err := compiler.Compile(vm, "test", strings.NewReader(tt.src), false); err != nil {
+			t.Fatalf("compile %q: %v", tt.src, err)
+		}
+		vm.PushRootTable()
+		err := vm.Call(1, false, false)
+		vm.Pop(1)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestFullAllocationSizes(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	if err := sqstd.Register(vm, sqstd.Full()); err != nil {
+		t.Fatal(err)
+	}
+	// without a quota, sizes that can't be allocated raise errors that
+	// scripts can catch
+	src := `
+		local b = blob(4)
+		local tests = [
+			@() array(1 << 62),
+			@() array(1 << 62, 0),
+			@() [1].resize(1 << 62),
+			@() blob(1 << 62),
+			@() b.resize(1 << 62),
+			@() b.readblob(1 << 62),
+		]
+		foreach (i, f in tests) {
+			local caught = false
+			try {
+				f()
+			} catch (e) {
+				caught = true
+			}
+			if (!caught) throw "test " + i + " was not refused"
+		}
+	`
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatal(err)
+	}
+	vm.PushRootTable()
+	if err := vm.Call(1, false, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegexp2(t *testing.T) {
+	for _, libs := range []sqstd.Library{sqstd.String, sqstd.String | sqstd.Regexp2} {
+		vm := sqvm.Open(1024)
+		if err := sqstd.Register(vm, sqstd.Options{Libraries: libs}); err != nil {
+			t.Fatal(err)
+		}
+		vm.PushRootTable()
+		vm.PushString("regexp2")
+		found := vm.RawGet(-2) == nil
+		vm.Close()
+		if want := libs&sqstd.Regexp2 != 0; found != want {
+			t.Errorf("libraries %b: regexp2 registered %v, want %v", libs, found, want)
+		}
+	}
+}
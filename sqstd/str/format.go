@@ -0,0 +1,130 @@
+package str
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+const (
+	maxFormatLen  = 20
+	maxWFormatLen = 3
+)
+
+func isFormatFlag(c byte) bool {
+	switch c {
+	case '-', '+', ' ', '#', '0':
+		return true
+	}
+	return false
+}
+
+// Format formats the arguments following the format string at idx with
+// printf semantics, like the format() function of scripts. Integers are
+// 64 bit, %o, %u, %x and %X print them unsigned.
+func Format(vm *sqvm.VM, idx int) (string, error) {
+	format := vm.GetString(idx)
+	nParam := idx + 1
+	var sb strings.Builder
+	for n := 0; n < len(format); {
+		if format[n] != '%' {
+			sb.WriteByte(format[n])
+			n++
+			continue
+		}
+		if n+1 < len(format) && format[n+1] == '%' {
+			sb.WriteByte('%')
+			n += 2
+			continue
+		}
+		n++
+		if nParam > vm.GetTop() {
+			return "", fmt.Errorf("not enough parameters for the given format string")
+		}
+		spec, end, hasPrec, err := validateFormat(format, n)
+		if err != nil {
+			return "", err
+		}
+		n = end
+		var verb byte
+		if n < len(format) {
+			verb = format[n]
+		}
+		switch verb {
+		case 's':
+			if vm.GetType(nParam) != sqvm.TypeString {
+				return "", fmt.Errorf("string expected for the specified format")
+			}
+			fmt.Fprintf(&sb, "%"+spec+"s", vm.GetString(nParam))
+		case 'i', 'd', 'o', 'u', 'x', 'X', 'c':
+			if !isNumber(vm.GetType(nParam)) {
+				return "", fmt.Errorf("integer expected for the specified format")
+			}
+			i := vm.GetInteger(nParam)
+			switch verb {
+			case 'i', 'd':
+				fmt.Fprintf(&sb, "%"+spec+"d", i)
+			case 'u':
+				fmt.Fprintf(&sb, "%"+spec+"d", uint64(i))
+			case 'c':
+				fmt.Fprintf(&sb, "%"+spec+"s", string([]byte{byte(i)}))
+			default:
+				fmt.Fprintf(&sb, "%"+spec+string(verb), uint64(i))
+			}
+		case 'f', 'g', 'G', 'e', 'E':
+			if !isNumber(vm.GetType(nParam)) {
+				return "", fmt.Errorf("float expected for the specified format")
+			}
+			if !hasPrec {
+				// Go defaults %g to the shortest representation, C to 6
+				spec += ".6"
+			}
+			fmt.Fprintf(&sb, "%"+spec+string(verb), vm.GetFloat(nParam))
+		default:
+			return "", fmt.Errorf("invalid format")
+		}
+		n++
+		nParam++
+	}
+	return sb.String(), nil
+}
+
+func isNumber(t sqvm.ObjectType) bool {
+	return t == sqvm.TypeInteger || t == sqvm.TypeFloat || t == sqvm.TypeBool
+}
+
+// validateFormat parses the flags, width and precision starting at n and
+// returns them with the index of the conversion character.
+func validateFormat(src string, n int) (spec string, end int, hasPrec bool, err error) {
+	at := func(i int) byte {
+		if i < len(src) {
+			return src[i]
+		}
+		return 0
+	}
+	start := n
+	for isFormatFlag(at(n)) {
+		n++
+	}
+	for wc := 0; isDigit(at(n)); wc++ {
+		if wc+1 >= maxWFormatLen {
+			return "", 0, false, fmt.Errorf("width format too long")
+		}
+		n++
+	}
+	if at(n) == '.' {
+		hasPrec = true
+		n++
+		for wc := 0; isDigit(at(n)); wc++ {
+			if wc+1 >= maxWFormatLen {
+				return "", 0, false, fmt.Errorf("precision format too long")
+			}
+			n++
+		}
+	}
+	if n-start > maxFormatLen {
+		return "", 0, false, fmt.Errorf("format too long")
+	}
+	return src[start:n], n, hasPrec, nil
+}
@@ -0,0 +1,266 @@
+package str
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// classTag tags the classes of the library so their instances can be
+// told apart from script classes.
+type classTag string
+
+const (
+	regexpTag  classTag = "regexp"
+	regexp2Tag classTag = "regexp2"
+)
+
+var regexpFuncs = []lib.Func{
+	{Name: "constructor", Fn: regexpConstructor, NParams: 2, TypeMask: ".s"},
+	{Name: "search", Fn: regexpSearch, NParams: -2, TypeMask: "xsn"},
+	{Name: "match", Fn: regexpMatch, NParams: 2, TypeMask: "xs"},
+	{Name: "capture", Fn: regexpCapture, NParams: -2, TypeMask: "xsn"},
+	{Name: "subexpcount", Fn: regexpSubExpCount, NParams: 1, TypeMask: "x"},
+	{Name: "_typeof", Fn: regexpTypeOf, NParams: 1, TypeMask: "x"},
+}
+
+var regexp2Funcs = []lib.Func{
+	{Name: "constructor", Fn: regexp2Constructor, NParams: 2, TypeMask: ".s"},
+	{Name: "search", Fn: regexp2Search, NParams: -2, TypeMask: "xsn"},
+	{Name: "match", Fn: regexp2Match, NParams: 2, TypeMask: "xs"},
+	{Name: "capture", Fn: regexp2Capture, NParams: -2, TypeMask: "xsn"},
+	{Name: "subexpcount", Fn: regexp2SubExpCount, NParams: 1, TypeMask: "x"},
+	{Name: "_typeof", Fn: regexp2TypeOf, NParams: 1, TypeMask: "x"},
+}
+
+// pushMatch pushes a {begin, end} table.
+func pushMatch(vm *sqvm.VM, begin, end int) {
+	vm.NewTable()
+	vm.PushString("begin")
+	vm.PushInteger(int64(begin))
+	vm.RawSet(-3)
+	vm.PushString("end")
+	vm.PushInteger(int64(end))
+	vm.RawSet(-3)
+}
+
+// searchArgs returns the string to search and the optional starting
+// position.
+func searchArgs(vm *sqvm.VM) (string, int, bool) {
+	s := vm.GetString(2)
+	start := 0
+	if vm.GetTop() > 2 {
+		start = int(vm.GetInteger(3))
+	}
+	return s, start, start >= 0 && start <= len(s)
+}
+
+func getRex(vm *sqvm.VM) (*rex, bool) {
+	up, _ := vm.GetInstanceUp(1)
+	r, ok := up.(*rex)
+	return r, ok
+}
+
+func regexpConstructor(vm *sqvm.VM) (int, error) {
+	r, err := compileRex(vm.GetString(2))
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if err := vm.SetInstanceUp(1, r); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+func regexpMatch(vm *sqvm.VM) (int, error) {
+	r, ok := getRex(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	vm.PushBool(r.match(vm.GetString(2)))
+	return 1, nil
+}
+
+func regexpSearch(vm *sqvm.VM) (int, error) {
+	r, ok := getRex(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	s, start, ok := searchArgs(vm)
+	if !ok {
+		return vm.ThrowError("invalid starting position")
+	}
+	begin, end, found := r.search(s, start)
+	if !found {
+		return 0, nil
+	}
+	pushMatch(vm, begin, end)
+	return 1, nil
+}
+
+// regexpCapture returns the bounds of the whole match followed by those
+// of every subexpression, empty ones are reported as {begin = 0, end = 0}.
+func regexpCapture(vm *sqvm.VM) (int, error) {
+	r, ok := getRex(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	s, start, ok := searchArgs(vm)
+	if !ok {
+		return vm.ThrowError("invalid starting position")
+	}
+	if _, _, found := r.search(s, start); !found {
+		return 0, nil
+	}
+	vm.NewArray(0)
+	for _, m := range r.matches {
+		if m.begin >= 0 && m.len > 0 {
+			pushMatch(vm, m.begin, m.begin+m.len)
+		} else {
+			pushMatch(vm, 0, 0)
+		}
+		vm.ArrayAppend(-2)
+	}
+	return 1, nil
+}
+
+func regexpSubExpCount(vm *sqvm.VM) (int, error) {
+	r, ok := getRex(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	vm.PushInteger(int64(r.subExpCount()))
+	return 1, nil
+}
+
+func regexpTypeOf(vm *sqvm.VM) (int, error) {
+	vm.PushString("regexp")
+	return 1, nil
+}
+
+// goRegexp is the instance data of regexp2. match needs the whole string
+// to match, which leftmost-first searching doesn't guarantee, so it has
+// an anchored copy of the expression. The Go package can't start a search
+// in the middle of a string, after is a copy that consumes one rune first
+// so that searching from the rune before the position keeps the context
+// of ^ and \b.
+type goRegexp struct {
+	re       *regexp.Regexp
+	anchored *regexp.Regexp
+	after    *regexp.Regexp
+}
+
+// find returns the bounds of the first match found from start and of its
+// subexpressions, nil if there is none.
+func (r *goRegexp) find(s string, start int) []int {
+	if start == 0 {
+		return r.re.FindStringSubmatchIndex(s)
+	}
+	_, size := utf8.DecodeLastRuneInString(s[:start])
+	from := start - size
+	loc := r.after.FindStringSubmatchIndex(s[from:])
+	if loc == nil {
+		return nil
+	}
+	// group 1 wraps the expression
+	loc = loc[2:]
+	for i := range loc {
+		if loc[i] >= 0 {
+			loc[i] += from
+		}
+	}
+	return loc
+}
+
+func getGoRegexp(vm *sqvm.VM) (*goRegexp, bool) {
+	up, _ := vm.GetInstanceUp(1)
+	r, ok := up.(*goRegexp)
+	return r, ok
+}
+
+func regexp2Constructor(vm *sqvm.VM) (int, error) {
+	pattern := vm.GetString(2)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	anchored, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	after, err := regexp.Compile(`(?s:.)(` + pattern + `)`)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if err := vm.SetInstanceUp(1, &goRegexp{re: re, anchored: anchored, after: after}); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 0, nil
+}
+
+func regexp2Match(vm *sqvm.VM) (int, error) {
+	r, ok := getGoRegexp(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	vm.PushBool(r.anchored.MatchString(vm.GetString(2)))
+	return 1, nil
+}
+
+func regexp2Search(vm *sqvm.VM) (int, error) {
+	r, ok := getGoRegexp(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	s, start, ok := searchArgs(vm)
+	if !ok {
+		return vm.ThrowError("invalid starting position")
+	}
+	loc := r.find(s, start)
+	if loc == nil {
+		return 0, nil
+	}
+	pushMatch(vm, loc[0], loc[1])
+	return 1, nil
+}
+
+func regexp2Capture(vm *sqvm.VM) (int, error) {
+	r, ok := getGoRegexp(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	s, start, ok := searchArgs(vm)
+	if !ok {
+		return vm.ThrowError("invalid starting position")
+	}
+	loc := r.find(s, start)
+	if loc == nil {
+		return 0, nil
+	}
+	vm.NewArray(0)
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] >= 0 && loc[i+1] > loc[i] {
+			pushMatch(vm, loc[i], loc[i+1])
+		} else {
+			pushMatch(vm, 0, 0)
+		}
+		vm.ArrayAppend(-2)
+	}
+	return 1, nil
+}
+
+func regexp2SubExpCount(vm *sqvm.VM) (int, error) {
+	r, ok := getGoRegexp(vm)
+	if !ok {
+		return vm.ThrowError("invalid regexp")
+	}
+	vm.PushInteger(int64(r.re.NumSubexp() + 1))
+	return 1, nil
+}
+
+func regexp2TypeOf(vm *sqvm.VM) (int, error) {
+	vm.PushString("regexp2")
+	return 1, nil
+}
@@ -0,0 +1,649 @@
+package str
+
+// A port of sqstdrex.c, the small backtracking regular expression engine
+// of the reference implementation. Its dialect differs from RE2: there
+// are no lazy quantifiers, \m balanced matches are supported and
+// character classes use Lua-like escapes such as \a and \p.
+
+const (
+	maxChar = 0xFF
+
+	opGreedy    = maxChar + 1 + iota // * + ? {n}
+	opOr                             // |
+	opExpr                           // ()
+	opNoCapExpr                      // (?:)
+	opDot
+	opClass
+	opCClass // \a, \d and friends
+	opNClass // [^
+	opRange
+	opChar
+	opEOL
+	opBOL
+	opWB // word boundary
+	opMB // balanced match
+)
+
+const greedyMax = 0xFFFF
+
+type rexNode struct {
+	typ   int
+	left  int
+	right int
+	next  int
+}
+
+type rexMatch struct {
+	begin int // -1 if the subexpression didn't match
+	len   int
+}
+
+type rexError string
+
+func (e rexError) Error() string {
+	return string(e)
+}
+
+type rex struct {
+	pattern string
+	p       int
+
+	nodes    []rexNode
+	first    int
+	nSubExpr int
+	matches  []rexMatch
+
+	text       string
+	bol, eol   int
+	currSubExp int
+}
+
+// compileRex compiles a pattern written in Squirrel's regex dialect.
+func compileRex(pattern string) (r *rex, err error) {
+	r = &rex{pattern: pattern}
+	defer func() {
+		if e := recover(); e != nil {
+			re, ok := e.(rexError)
+			if !ok {
+				panic(e)
+			}
+			r, err = nil, re
+		}
+	}()
+	r.first = r.newNode(opExpr)
+	res := r.list()
+	r.nodes[r.first].left = res
+	if r.peek() != 0 {
+		r.fail("unexpected character")
+	}
+	r.matches = make([]rexMatch, r.nSubExpr)
+	return r, nil
+}
+
+func (r *rex) fail(msg string) {
+	panic(rexError(msg))
+}
+
+// peek returns the current pattern character, 0 at the end like the C
+// string terminator.
+func (r *rex) peek() byte {
+	if r.p < len(r.pattern) {
+		return r.pattern[r.p]
+	}
+	return 0
+}
+
+// next returns the current pattern character and advances.
+func (r *rex) next() byte {
+	c := r.peek()
+	r.p++
+	return c
+}
+
+func (r *rex) newNode(typ int) int {
+	n := rexNode{typ: typ, left: -1, right: -1, next: -1}
+	if typ == opExpr {
+		n.right = r.nSubExpr
+		r.nSubExpr++
+	}
+	r.nodes = append(r.nodes, n)
+	return len(r.nodes) - 1
+}
+
+func (r *rex) expect(c byte) {
+	if r.peek() != c {
+		r.fail("expected paren")
+	}
+	r.p++
+}
+
+// isPrint is isprint of the "C" locale, except that bytes of multibyte
+// characters are accepted as literals.
+func isPrint(c byte) bool {
+	return c >= 0x20 && c < 0x7F || c >= 0x80
+}
+
+func (r *rex) escapeChar() int {
+	if r.peek() == '\\' {
+		r.p++
+		switch c := r.next(); c {
+		case 'v':
+			return '\v'
+		case 'n':
+			return '\n'
+		case 't':
+			return '\t'
+		case 'r':
+			return '\r'
+		case 'f':
+			return '\f'
+		default:
+			return int(c)
+		}
+	} else if !isPrint(r.peek()) {
+		r.fail("letter expected")
+	}
+	return int(r.next())
+}
+
+func (r *rex) charClass(classID byte) int {
+	n := r.newNode(opCClass)
+	r.nodes[n].left = int(classID)
+	return n
+}
+
+func (r *rex) charNode(isClass bool) int {
+	if r.peek() == '\\' {
+		r.p++
+		switch c := r.peek(); c {
+		case 'n':
+			r.p++
+			return r.newNode('\n')
+		case 't':
+			r.p++
+			return r.newNode('\t')
+		case 'r':
+			r.p++
+			return r.newNode('\r')
+		case 'f':
+			r.p++
+			return r.newNode('\f')
+		case 'v':
+			r.p++
+			return r.newNode('\v')
+		case 'a', 'A', 'w', 'W', 's', 'S', 'd', 'D', 'x', 'X', 'c', 'C', 'p', 'P', 'l', 'u':
+			r.p++
+			return r.charClass(c)
+		case 'm':
+			r.p++
+			cb := r.next()
+			ce := r.next()
+			if cb == 0 || ce == 0 {
+				r.fail("balanced chars expected")
+			}
+			if cb == ce {
+				r.fail("open/close char can't be the same")
+			}
+			n := r.newNode(opMB)
+			r.nodes[n].left = int(cb)
+			r.nodes[n].right = int(ce)
+			return n
+		case 0:
+			r.fail("letter expected for argument of escape sequence")
+		case 'b', 'B':
+			if !isClass {
+				n := r.newNode(opWB)
+				r.nodes[n].left = int(c)
+				r.p++
+				return n
+			}
+		}
+		return r.newNode(int(r.next()))
+	} else if !isPrint(r.peek()) {
+		r.fail("letter expected")
+	}
+	return r.newNode(int(r.next()))
+}
+
+func (r *rex) class() int {
+	var ret int
+	if r.peek() == '^' {
+		ret = r.newNode(opNClass)
+		r.p++
+	} else {
+		ret = r.newNode(opClass)
+	}
+	if r.peek() == ']' {
+		r.fail("empty class")
+	}
+	chain := ret
+	first := -1
+	for r.peek() != ']' {
+		if r.peek() == '-' && first != -1 {
+			r.p++
+			rng := r.newNode(opRange)
+			if r.nodes[first].typ > int(r.peek()) {
+				r.fail("invalid range")
+			}
+			if r.nodes[first].typ == opCClass {
+				r.fail("cannot use character classes in ranges")
+			}
+			r.nodes[rng].left = r.nodes[first].typ
+			r.nodes[rng].right = r.escapeChar()
+			r.nodes[chain].next = rng
+			chain = rng
+			first = -1
+		} else {
+			if first != -1 {
+				r.nodes[chain].next = first
+				chain = first
+			}
+			first = r.charNode(true)
+		}
+	}
+	if first != -1 {
+		r.nodes[chain].next = first
+	}
+	// the members hang from left, next is the node following the class
+	r.nodes[ret].left = r.nodes[ret].next
+	r.nodes[ret].next = -1
+	return ret
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (r *rex) parseNumber() int {
+	ret := int(r.next() - '0')
+	positions := 10
+	for isDigit(r.peek()) {
+		ret = ret*10 + int(r.next()-'0')
+		if positions == 1000000000 {
+			r.fail("overflow in numeric constant")
+		}
+		positions *= 10
+	}
+	return ret
+}
+
+func (r *rex) element() int {
+	var ret int
+	switch r.peek() {
+	case '(':
+		r.p++
+		var expr int
+		if r.peek() == '?' {
+			r.p++
+			r.expect(':')
+			expr = r.newNode(opNoCapExpr)
+		} else {
+			expr = r.newNode(opExpr)
+		}
+		n := r.list()
+		r.nodes[expr].left = n
+		ret = expr
+		r.expect(')')
+	case '[':
+		r.p++
+		ret = r.class()
+		r.expect(']')
+	case '$':
+		r.p++
+		ret = r.newNode(opEOL)
+	case '.':
+		r.p++
+		ret = r.newNode(opDot)
+	default:
+		ret = r.charNode(false)
+	}
+
+	isGreedy := false
+	p0, p1 := 0, 0
+	switch r.peek() {
+	case '*':
+		p0, p1 = 0, greedyMax
+		r.p++
+		isGreedy = true
+	case '+':
+		p0, p1 = 1, greedyMax
+		r.p++
+		isGreedy = true
+	case '?':
+		p0, p1 = 0, 1
+		r.p++
+		isGreedy = true
+	case '{':
+		r.p++
+		if !isDigit(r.peek()) {
+			r.fail("number expected")
+		}
+		p0 = r.parseNumber() & 0xFFFF
+		switch r.peek() {
+		case '}':
+			p1 = p0
+			r.p++
+		case ',':
+			r.p++
+			p1 = greedyMax
+			if isDigit(r.peek()) {
+				p1 = r.parseNumber() & 0xFFFF
+			}
+			r.expect('}')
+		default:
+			r.fail(", or } expected")
+		}
+		isGreedy = true
+	}
+	if isGreedy {
+		n := r.newNode(opGreedy)
+		r.nodes[n].left = ret
+		r.nodes[n].right = p0<<16 | p1
+		ret = n
+	}
+
+	switch r.peek() {
+	case '|', ')', '*', '+', 0:
+	default:
+		n := r.element()
+		r.nodes[ret].next = n
+	}
+	return ret
+}
+
+func (r *rex) list() int {
+	ret := -1
+	if r.peek() == '^' {
+		r.p++
+		ret = r.newNode(opBOL)
+	}
+	e := r.element()
+	if ret != -1 {
+		r.nodes[ret].next = e
+	} else {
+		ret = e
+	}
+	if r.peek() == '|' {
+		r.p++
+		temp := r.newNode(opOr)
+		r.nodes[temp].left = ret
+		right := r.list()
+		r.nodes[temp].right = right
+		ret = temp
+	}
+	return ret
+}
+
+func isAlpha(c byte) bool  { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isAlnum(c byte) bool  { return isAlpha(c) || isDigit(c) }
+func isSpace(c byte) bool  { return c == ' ' || c >= '\t' && c <= '\r' }
+func isCntrl(c byte) bool  { return c < 0x20 || c == 0x7F }
+func isLower(c byte) bool  { return c >= 'a' && c <= 'z' }
+func isUpper(c byte) bool  { return c >= 'A' && c <= 'Z' }
+func isPunct(c byte) bool  { return c > 0x20 && c < 0x7F && !isAlnum(c) }
+func isXDigit(c byte) bool { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' }
+
+func matchCClass(class int, c byte) bool {
+	switch class {
+	case 'a':
+		return isAlpha(c)
+	case 'A':
+		return !isAlpha(c)
+	case 'w':
+		return isAlnum(c) || c == '_'
+	case 'W':
+		return !isAlnum(c) && c != '_'
+	case 's':
+		return isSpace(c)
+	case 'S':
+		return !isSpace(c)
+	case 'd':
+		return isDigit(c)
+	case 'D':
+		return !isDigit(c)
+	case 'x':
+		return isXDigit(c)
+	case 'X':
+		return !isXDigit(c)
+	case 'c':
+		return isCntrl(c)
+	case 'C':
+		return !isCntrl(c)
+	case 'p':
+		return isPunct(c)
+	case 'P':
+		return !isPunct(c)
+	case 'l':
+		return isLower(c)
+	case 'u':
+		return isUpper(c)
+	}
+	return false
+}
+
+func (r *rex) matchClass(node int, c byte) bool {
+	for ; node != -1; node = r.nodes[node].next {
+		n := &r.nodes[node]
+		switch n.typ {
+		case opRange:
+			if int(c) >= n.left && int(c) <= n.right {
+				return true
+			}
+		case opCClass:
+			if matchCClass(n.left, c) {
+				return true
+			}
+		default:
+			if int(c) == n.typ {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// at returns the text byte at i, 0 past the end like the C terminator.
+func (r *rex) at(i int) byte {
+	if i >= 0 && i < len(r.text) {
+		return r.text[i]
+	}
+	return 0
+}
+
+// matchNode matches node at position str of the text and returns the
+// position after the match, or -1. next is the node that follows in the
+// enclosing expression, used by greedy operators to know where to stop.
+func (r *rex) matchNode(node, str, next int) int {
+	n := r.nodes[node]
+	switch n.typ {
+	case opGreedy:
+		p0, p1 := n.right>>16&0xFFFF, n.right&0xFFFF
+		nMatches := 0
+		s, good := str, str
+		greedyStop := next
+		if n.next != -1 {
+			greedyStop = n.next
+		}
+		for nMatches == greedyMax || nMatches < p1 {
+			if s = r.matchNode(n.left, s, greedyStop); s == -1 {
+				break
+			}
+			nMatches++
+			good = s
+			if greedyStop != -1 {
+				// checks whether zero matches of the following node
+				// satisfy the expression, if so the loop could stop
+				gs := r.nodes[greedyStop]
+				if gs.typ != opGreedy || gs.right>>16&0xFFFF != 0 {
+					gNext := -1
+					if gs.next != -1 {
+						gNext = gs.next
+					} else if next != -1 && r.nodes[next].next != -1 {
+						gNext = r.nodes[next].next
+					}
+					if r.matchNode(greedyStop, s, gNext) != -1 {
+						if p0 == p1 && p0 == nMatches ||
+							nMatches >= p0 && p1 == greedyMax ||
+							nMatches >= p0 && nMatches <= p1 {
+							break
+						}
+					}
+				}
+			}
+			if s >= r.eol {
+				break
+			}
+		}
+		if p0 == p1 && p0 == nMatches ||
+			nMatches >= p0 && p1 == greedyMax ||
+			nMatches >= p0 && nMatches <= p1 {
+			return good
+		}
+		return -1
+	case opOr:
+		for _, branch := range []int{n.left, n.right} {
+			asd := str
+			for temp := branch; ; temp = r.nodes[temp].next {
+				if asd = r.matchNode(temp, asd, -1); asd == -1 {
+					break
+				}
+				if r.nodes[temp].next == -1 {
+					return asd
+				}
+			}
+		}
+		return -1
+	case opExpr, opNoCapExpr:
+		cur := str
+		capture := -1
+		if n.typ != opNoCapExpr && n.right == r.currSubExp {
+			capture = r.currSubExp
+			r.matches[capture].begin = cur
+			r.currSubExp++
+		}
+		tempCap := r.currSubExp
+		for sub := n.left; sub != -1; sub = r.nodes[sub].next {
+			subNext := next
+			if r.nodes[sub].next != -1 {
+				subNext = r.nodes[sub].next
+			}
+			if cur = r.matchNode(sub, cur, subNext); cur == -1 {
+				if capture != -1 {
+					r.matches[capture] = rexMatch{begin: -1}
+				}
+				return -1
+			}
+		}
+		r.currSubExp = tempCap
+		if capture != -1 {
+			r.matches[capture].len = cur - r.matches[capture].begin
+		}
+		return cur
+	case opWB:
+		if str == r.bol && !isSpace(r.at(str)) ||
+			str == r.eol && !isSpace(r.at(str-1)) ||
+			!isSpace(r.at(str)) && isSpace(r.at(str+1)) ||
+			isSpace(r.at(str)) && !isSpace(r.at(str+1)) {
+			if n.left == 'b' {
+				return str
+			}
+			return -1
+		}
+		if n.left == 'b' {
+			return -1
+		}
+		return str
+	case opBOL:
+		if str == r.bol {
+			return str
+		}
+		return -1
+	case opEOL:
+		if str == r.eol {
+			return str
+		}
+		return -1
+	case opDot:
+		if str == r.eol {
+			return -1
+		}
+		return str + 1
+	case opClass, opNClass:
+		if str == r.eol {
+			return -1
+		}
+		if r.matchClass(n.left, r.at(str)) == (n.typ == opClass) {
+			return str + 1
+		}
+		return -1
+	case opCClass:
+		if str == r.eol {
+			return -1
+		}
+		if matchCClass(n.left, r.at(str)) {
+			return str + 1
+		}
+		return -1
+	case opMB:
+		if int(r.at(str)) != n.left {
+			return -1
+		}
+		count := 1
+		for str++; str < r.eol; str++ {
+			if c := int(r.at(str)); c == n.right {
+				if count--; count == 0 {
+					return str + 1
+				}
+			} else if c == n.left {
+				count++
+			}
+		}
+		return -1
+	default: // a character
+		if str == r.eol || int(r.at(str)) != n.typ {
+			return -1
+		}
+		return str + 1
+	}
+}
+
+func (r *rex) reset(text string) {
+	r.text = text
+	r.bol, r.eol = 0, len(text)
+	r.currSubExp = 0
+	for i := range r.matches {
+		r.matches[i] = rexMatch{begin: -1}
+	}
+}
+
+// match reports whether the whole text matches.
+func (r *rex) match(text string) bool {
+	r.reset(text)
+	return r.matchNode(0, 0, -1) == len(text)
+}
+
+// search finds the first match starting at or after start and returns
+// its bounds.
+func (r *rex) search(text string, start int) (int, int, bool) {
+	r.reset(text)
+	if start >= len(text) {
+		return 0, 0, false
+	}
+	for begin := start; begin < len(text); begin++ {
+		cur := begin
+		for node := r.first; node != -1; node = r.nodes[node].next {
+			r.currSubExp = 0
+			if cur = r.matchNode(node, cur, -1); cur == -1 {
+				break
+			}
+		}
+		if cur != -1 {
+			return begin, cur, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (r *rex) subExpCount() int {
+	return r.nSubExpr
+}
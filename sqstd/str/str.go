@@ -0,0 +1,136 @@
+// Package str implements the string library of Squirrel: formatting,
+// trimming and splitting of strings and the regexp class.
+package str
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+var funcs = []lib.Func{
+	{Name: "format", Fn: format, NParams: -2, TypeMask: ".s"},
+	{Name: "strip", Fn: strip, NParams: 2, TypeMask: ".s"},
+	{Name: "lstrip", Fn: lstrip, NParams: 2, TypeMask: ".s"},
+	{Name: "rstrip", Fn: rstrip, NParams: 2, TypeMask: ".s"},
+	{Name: "split", Fn: split, NParams: 3, TypeMask: ".ss"},
+	{Name: "escape", Fn: escape, NParams: 2, TypeMask: ".s"},
+	{Name: "startswith", Fn: startsWith, NParams: 3, TypeMask: ".ss"},
+	{Name: "endswith", Fn: endsWith, NParams: 3, TypeMask: ".ss"},
+}
+
+// Register adds the string library functions and the regexp class to the
+// root table.
+func Register(vm *sqvm.VM) error {
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	if err := lib.Register(vm, funcs); err != nil {
+		return err
+	}
+	return lib.RegisterClass(vm, "regexp", regexpTag, regexpFuncs)
+}
+
+// RegisterRegexp2 adds the regexp2 class to the root table. It has the
+// methods of regexp but uses the RE2 syntax of the Go regexp package.
+func RegisterRegexp2(vm *sqvm.VM) error {
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	return lib.RegisterClass(vm, "regexp2", regexp2Tag, regexp2Funcs)
+}
+
+func format(vm *sqvm.VM) (int, error) {
+	s, err := Format(vm, 2)
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushString(s)
+	return 1, nil
+}
+
+const spaces = " \t\n\v\f\r"
+
+func strip(vm *sqvm.VM) (int, error) {
+	vm.PushString(strings.Trim(vm.GetString(2), spaces))
+	return 1, nil
+}
+
+func lstrip(vm *sqvm.VM) (int, error) {
+	vm.PushString(strings.TrimLeft(vm.GetString(2), spaces))
+	return 1, nil
+}
+
+func rstrip(vm *sqvm.VM) (int, error) {
+	vm.PushString(strings.TrimRight(vm.GetString(2), spaces))
+	return 1, nil
+}
+
+// split cuts the string at every character of the separators. Empty
+// pieces are kept, except for a trailing one.
+func split(vm *sqvm.VM) (int, error) {
+	s, seps := vm.GetString(2), vm.GetString(3)
+	if seps == "" {
+		return vm.ThrowError("empty separators string")
+	}
+	vm.NewArray(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(seps, s[i]) < 0 {
+			continue
+		}
+		vm.PushString(s[start:i])
+		vm.ArrayAppend(-2)
+		start = i + 1
+	}
+	if start != len(s) {
+		vm.PushString(s[start:])
+		vm.ArrayAppend(-2)
+	}
+	return 1, nil
+}
+
+// escape returns the string written as a Squirrel string literal would
+// be, without the quotes.
+func escape(vm *sqvm.VM) (int, error) {
+	s := vm.GetString(2)
+	var sb strings.Builder
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var esc byte
+		switch c {
+		case '\\', '"', '\'':
+			esc = c
+		case 0:
+			esc = '0'
+		}
+		switch {
+		case esc != 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(esc)
+			escaped = true
+		case c >= 0x20 && c < 0x7F:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+			escaped = true
+		}
+	}
+	if !escaped {
+		vm.Push(2)
+		return 1, nil
+	}
+	vm.PushString(sb.String())
+	return 1, nil
+}
+
+func startsWith(vm *sqvm.VM) (int, error) {
+	vm.PushBool(strings.HasPrefix(vm.GetString(2), vm.GetString(3)))
+	return 1, nil
+}
+
+func endsWith(vm *sqvm.VM) (int, error) {
+	vm.PushBool(strings.HasSuffix(vm.GetString(2), vm.GetString(3)))
+	return 1, nil
+}
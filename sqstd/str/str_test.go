@@ -0,0 +1,138 @@
+package str_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/str"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+func newVM(t *testing.T) *sqvm.VM {
+	t.Helper()
+	vm := sqvm.Open(1024)
+	t.Cleanup(vm.Close)
+	if err := str.Register(vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.RegisterRegexp2(vm); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+// eval runs src and returns the Go value of its result.
+func eval(t *testing.T, vm *sqvm.VM, src string) (any, error) {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile %q: %v", src, err)
+	}
+	vm.PushRootTable()
+	if err := vm.Call(1, true, false); err != nil {
+		vm.Pop(1)
+		return nil, err
+	}
+	defer vm.Pop(2)
+	return vm.GetGoValue(-1)
+}
+
+type evalTest struct {
+	src  string
+	want any
+}
+
+func runTests(t *testing.T, tests []evalTest) {
+	t.Helper()
+	vm := newVM(t)
+	for _, tt := range tests {
+		got, err := eval(t, vm, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+// match is the Go value of a {begin, end} table.
+func match(begin, end int64) map[string]any {
+	return map[string]any{"begin": begin, "end": end}
+}
+
+func TestFormat(t *testing.T) {
+	runTests(t, []evalTest{
+		{`return format("%d-%5.2f-%s-%x", 42, 3.14159, "s", 255)`, "42- 3.14-s-ff"},
+		{`return format("%%|%-4d|%c|%05i", 7, 65, -3)`, "%|7   |A|-0003"},
+		{`return format("%u %X %o", -1, 171, 8)`, "18446744073709551615 AB 10"},
+		{`return format("%g %e", 0.5, 1500.0)`, "0.5 1.500000e+03"},
+		{`return format("%10s|%-3s|", "right", "l")`, "     right|l  |"},
+		{`return format("no verbs")`, "no verbs"},
+	})
+}
+
+func TestFormatErrors(t *testing.T) {
+	vm := newVM(t)
+	tests := []struct {
+		src, err string
+	}{
+		{`format("%d")`, "not enough parameters"},
+		{`format("%d", "x")`, "integer expected"},
+		{`format("%s", 1)`, "string expected"},
+		{`format("%f", "x")`, "float expected"},
+		{`format("%y", 1)`, "invalid format"},
+		{`format("%1234d", 1)`, "width format too long"},
+	}
+	for _, tt := range tests {
+		if _, err := eval(t, vm, tt.src); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	runTests(t, []evalTest{
+		{`return split("a,b;;c,", ",;")`, []any{"a", "b", "", "c"}},
+		{`return split("abc", ",")`, []any{"abc"}},
+		{`return split("", ",")`, []any{}},
+		{`return strip(" \t x y \n")`, "x y"},
+		{`return lstrip("  x ")`, "x "},
+		{`return rstrip("  x ")`, "  x"},
+		{`return escape("plain")`, "plain"},
+		{`return escape("a\"b'c\\d\n\x01")`, `a\"b\'c\\d\x0a\x01`},
+		{`return startswith("squirrel", "squ") && !startswith("sq", "squ")`, true},
+		{`return endswith("squirrel", "rel") && !endswith("squirrel", "squ")`, true},
+	})
+}
+
+func TestRegexp(t *testing.T) {
+	runTests(t, []evalTest{
+		{`return regexp("[a-z]+").match("abc")`, true},
+		{`return regexp("[a-z]+").match("abc1")`, false},
+		{`return regexp("[0-9]+").search("ab123c45")`, match(2, 5)},
+		{`return regexp("[0-9]+").search("ab123c45", 5)`, match(6, 8)},
+		{`return regexp("[0-9]+").search("abc")`, nil},
+		{`return regexp("(\\w+)=(\\w+)").capture("x key=val")`, []any{match(2, 9), match(2, 5), match(6, 9)}},
+		{`return regexp("(\\w+)=(\\w+)").subexpcount()`, int64(3)},
+	})
+}
+
+func TestRegexp2(t *testing.T) {
+	runTests(t, []evalTest{
+		{`return regexp2("[a-z]+").match("abc")`, true},
+		{`return regexp2("a|ab").match("ab")`, true},
+		{`return regexp2("[0-9]+").search("ab123c45", 5)`, match(6, 8)},
+		{`return regexp2("(\\w+)=(\\w+)?").capture("x key=")`, []any{match(2, 6), match(2, 5), match(0, 0)}},
+		{`return regexp2("(\\w+)=(\\w+)").capture("a=b c=d", 3)`, []any{match(4, 7), match(4, 5), match(6, 7)}},
+		{`return regexp2("(\\w+)=(\\w+)").subexpcount()`, int64(3)},
+		// searches from a position keep the context of the string
+		{`return regexp2("^a").search("aaa", 1)`, nil},
+		{`return regexp2("(?m)^a").search("a\na", 1)`, match(2, 3)},
+		{`return regexp2("\\bb").search("ab b", 1)`, match(3, 4)},
+		{`return regexp2("\\Bb").search("ab b", 1)`, match(1, 2)},
+		{`return regexp2("é").search("éé", 1)`, match(2, 4)},
+	})
+}
@@ -0,0 +1,214 @@
+// Package system implements the system library of Squirrel.
+//
+// Everything the library reads from or does to the host goes through the
+// Config it is registered with, so tests can freeze the time and
+// sandboxes can hide the environment. system() is disabled unless an
+// Executor is given.
+package system
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/dexter3k/go-squirrel/sqstd/internal/lib"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Clock is the time source of time(), date() and clock().
+type Clock interface {
+	Now() time.Time
+	// Elapsed returns the time clock() reports, the processor time
+	// used by the program in the reference implementation.
+	Elapsed() time.Duration
+}
+
+// Env looks up environment variables for getenv().
+type Env interface {
+	LookupEnv(key string) (string, bool)
+}
+
+// Executor runs the commands of system() and returns their exit status.
+type Executor interface {
+	System(command string) (int, error)
+}
+
+// FS removes and renames files for remove() and rename().
+type FS interface {
+	Remove(name string) error
+	Rename(oldName, newName string) error
+}
+
+// Config holds the host services of the library. A nil Clock, Env or
+// Location uses the ones of the host, a nil Executor disables system()
+// and a nil FS makes remove() and rename() fail.
+type Config struct {
+	Clock    Clock
+	Env      Env
+	Executor Executor
+	FS       FS
+	// Location is the time zone of the local time of date().
+	Location *time.Location
+}
+
+type hostClock struct {
+	start time.Time
+}
+
+func (c hostClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c hostClock) Elapsed() time.Duration {
+	return time.Since(c.start)
+}
+
+// HostClock returns the clock of the host, clock() counts from the call.
+func HostClock() Clock {
+	return hostClock{start: time.Now()}
+}
+
+// HostEnv is the environment of the process.
+type HostEnv struct{}
+
+func (HostEnv) LookupEnv(key string) (string, bool) {
+	return os.LookupEnv(key)
+}
+
+// ShellExecutor runs commands with the shell of the host.
+type ShellExecutor struct{}
+
+func (ShellExecutor) System(command string) (int, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// Register adds the system library functions to the root table.
+func Register(vm *sqvm.VM, cfg Config) error {
+	if cfg.Clock == nil {
+		cfg.Clock = HostClock()
+	}
+	if cfg.Env == nil {
+		cfg.Env = HostEnv{}
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.Local
+	}
+	s := &system{cfg}
+	vm.PushRootTable()
+	defer vm.Pop(1)
+	return lib.Register(vm, []lib.Func{
+		{Name: "getenv", Fn: s.getenv, NParams: 2, TypeMask: ".s"},
+		{Name: "system", Fn: s.system, NParams: 2, TypeMask: ".s"},
+		{Name: "clock", Fn: s.clock, NParams: 0, TypeMask: ""},
+		{Name: "time", Fn: s.time, NParams: 1, TypeMask: ""},
+		{Name: "date", Fn: s.date, NParams: -1, TypeMask: ".nn"},
+		{Name: "remove", Fn: s.remove, NParams: 2, TypeMask: ".s"},
+		{Name: "rename", Fn: s.rename, NParams: 3, TypeMask: ".ss"},
+	})
+}
+
+type system struct {
+	cfg Config
+}
+
+func (s *system) getenv(vm *sqvm.VM) (int, error) {
+	if v, ok := s.cfg.Env.LookupEnv(vm.GetString(2)); ok {
+		vm.PushString(v)
+	} else {
+		vm.PushNull()
+	}
+	return 1, nil
+}
+
+func (s *system) system(vm *sqvm.VM) (int, error) {
+	if s.cfg.Executor == nil {
+		return vm.ThrowError("system() is disabled")
+	}
+	status, err := s.cfg.Executor.System(vm.GetString(2))
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	vm.PushInteger(int64(status))
+	return 1, nil
+}
+
+// clock returns the elapsed time in seconds.
+func (s *system) clock(vm *sqvm.VM) (int, error) {
+	vm.PushFloat(s.cfg.Clock.Elapsed().Seconds())
+	return 1, nil
+}
+
+// time returns the Unix time in seconds.
+func (s *system) time(vm *sqvm.VM) (int, error) {
+	vm.PushInteger(s.cfg.Clock.Now().Unix())
+	return 1, nil
+}
+
+// date returns the fields of a Unix time, the current time by default.
+// The format is 'l' for the local time of the configured location (the
+// default) or 'u' for UTC. Months and days of the year count from 0, as
+// in the C library.
+func (s *system) date(vm *sqvm.VM) (int, error) {
+	t := s.cfg.Clock.Now()
+	format := int64('l')
+	if vm.GetTop() > 1 {
+		t = time.Unix(vm.GetInteger(2), 0)
+		if vm.GetTop() > 2 {
+			format = vm.GetInteger(3)
+		}
+	}
+	if format == 'u' {
+		t = t.UTC()
+	} else {
+		t = t.In(s.cfg.Location)
+	}
+	vm.NewTable()
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"sec", t.Second()},
+		{"min", t.Minute()},
+		{"hour", t.Hour()},
+		{"day", t.Day()},
+		{"month", int(t.Month()) - 1},
+		{"year", t.Year()},
+		{"wday", int(t.Weekday())},
+		{"yday", t.YearDay() - 1},
+	}
+	for _, f := range fields {
+		vm.PushString(f.name)
+		vm.PushInteger(int64(f.value))
+		vm.RawSet(-3)
+	}
+	return 1, nil
+}
+
+func (s *system) remove(vm *sqvm.VM) (int, error) {
+	if s.cfg.FS == nil || s.cfg.FS.Remove(vm.GetString(2)) != nil {
+		return vm.ThrowError("remove() failed")
+	}
+	return 0, nil
+}
+
+func (s *system) rename(vm *sqvm.VM) (int, error) {
+	if s.cfg.FS == nil || s.cfg.FS.Rename(vm.GetString(2), vm.GetString(3)) != nil {
+		return vm.ThrowError("rename() failed")
+	}
+	return 0, nil
+}
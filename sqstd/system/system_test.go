@@ -0,0 +1,128 @@
+package system_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqstd/system"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+type fixedClock struct {
+	now     time.Time
+	elapsed time.Duration
+}
+
+func (c fixedClock) Now() time.Time         { return c.now }
+func (c fixedClock) Elapsed() time.Duration { return c.elapsed }
+
+type mapEnv map[string]string
+
+func (e mapEnv) LookupEnv(key string) (string, bool) {
+	v, ok := e[key]
+	return v, ok
+}
+
+// recorder is an Executor keeping the commands it is given.
+type recorder struct {
+	commands []string
+}
+
+func (r *recorder) System(command string) (int, error) {
+	r.commands = append(r.commands, command)
+	if command == "fail" {
+		return 0, errors.New("cannot run")
+	}
+	return len(command), nil
+}
+
+func newVM(t *testing.T, cfg system.Config) *sqvm.VM {
+	t.Helper()
+	vm := sqvm.Open(1024)
+	t.Cleanup(vm.Close)
+	if err := system.Register(vm, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func run(t *testing.T, vm *sqvm.VM, src string) error {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	vm.PushRootTable()
+	err := vm.Call(1, false, false)
+	vm.Pop(1)
+	return err
+}
+
+func TestClock(t *testing.T) {
+	// Monday 2024-03-04 10:20:30 UTC, the 64th day of the year
+	now := time.Date(2024, time.March, 4, 10, 20, 30, 0, time.UTC)
+	vm := newVM(t, system.Config{
+		Clock:    fixedClock{now: now, elapsed: 1500 * time.Millisecond},
+		Location: time.FixedZone("UTC+2", 2*60*60),
+	})
+	err := run(t, vm, `
+		if (time() != 1709547630) throw "time is " + time()
+		if (clock() != 1.5) throw "clock is " + clock()
+		local d = date()
+		if (d.hour != 12 || d.min != 20 || d.sec != 30) throw "bad local time"
+		if (d.year != 2024 || d.month != 2 || d.day != 4) throw "bad local date"
+		if (d.wday != 1 || d.yday != 63) throw "bad week or year day"
+		d = date(time(), 'u')
+		if (d.hour != 10) throw "bad UTC hour " + d.hour
+		d = date(0)
+		if (d.year != 1970 || d.hour != 2) throw "bad epoch"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	vm := newVM(t, system.Config{
+		Env: mapEnv{"HOME": "/home/sq", "EMPTY": ""},
+	})
+	err := run(t, vm, `
+		if (getenv("HOME") != "/home/sq") throw "bad HOME"
+		if (getenv("EMPTY") != "") throw "bad EMPTY"
+		if (getenv("PATH") != null) throw "PATH is set"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	r := &recorder{}
+	vm := newVM(t, system.Config{Executor: r})
+	err := run(t, vm, `
+		if (system("echo hi") != 7) throw "bad status"
+		local caught = false
+		try {
+			system("fail")
+		} catch (e) {
+			caught = true
+		}
+		if (!caught) throw "the executor error was not raised"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.commands) != 2 || r.commands[0] != "echo hi" {
+		t.Fatalf("ran %q", r.commands)
+	}
+}
+
+func TestSystemDisabled(t *testing.T) {
+	vm := newVM(t, system.Config{})
+	err := run(t, vm, `system("echo hi")`)
+	if err == nil || !strings.Contains(err.Error(), "system() is disabled") {
+		t.Fatalf("got error %v, want system() to be disabled", err)
+	}
+}
@@ -0,0 +1,98 @@
+package sqvm
+
+type array struct {
+	gcHeader
+
+	values []Object
+}
+
+func newArray(size int) *array {
+	return &array{values: make([]Object, size)}
+}
+
+func (a *array) get(idx int64) (Object, bool) {
+	if idx < 0 || idx >= int64(len(a.values)) {
+		return Null, false
+	}
+	return realVal(a.values[idx]), true
+}
+
+func (a *array) set(idx int64, val Object) bool {
+	if idx < 0 || idx >= int64(len(a.values)) {
+		return false
+	}
+	assign(&a.values[idx], val)
+	return true
+}
+
+func (a *array) append(val Object) {
+	incRef(val)
+	a.values = append(a.values, val)
+	a.ss.charge(valueSize)
+}
+
+func (a *array) resize(size int, fill Object) {
+	if size < len(a.values) {
+		for i := size; i < len(a.values); i++ {
+			decRef(a.values[i])
+			a.values[i] = Null
+		}
+		a.values = a.values[:size]
+		return
+	}
+	a.ss.charge((size - len(a.values)) * valueSize)
+	if size > cap(a.values) {
+		values := make([]Object, len(a.values), size)
+		copy(values, a.values)
+		a.values = values
+	}
+	for len(a.values) < size {
+		incRef(fill)
+		a.values = append(a.values, fill)
+	}
+}
+
+// checkGrow returns an error if growing to size allocates too much.
+func (a *array) checkGrow(size int64) error {
+	return a.ss.checkAllocation(size-int64(len(a.values)), valueSize)
+}
+
+func (a *array) insert(idx int64, val Object) bool {
+	if idx < 0 || idx > int64(len(a.values)) {
+		return false
+	}
+	a.values = append(a.values, Null)
+	a.ss.charge(valueSize)
+	copy(a.values[idx+1:], a.values[idx:])
+	a.values[idx] = val
+	incRef(val)
+	return true
+}
+
+func (a *array) remove(idx int64) bool {
+	if idx < 0 || idx >= int64(len(a.values)) {
+		return false
+	}
+	old := a.values[idx]
+	copy(a.values[idx:], a.values[idx+1:])
+	a.values[len(a.values)-1] = Null
+	a.values = a.values[:len(a.values)-1]
+	decRef(old)
+	return true
+}
+
+func (a *array) next(pos int) (int, Object, Object) {
+	if pos < 0 || pos >= len(a.values) {
+		return -1, Null, Null
+	}
+	return pos + 1, IntegerValue(int64(pos)), realVal(a.values[pos])
+}
+
+func (a *array) clone() *array {
+	na := newArray(len(a.values))
+	for i, v := range a.values {
+		incRef(v)
+		na.values[i] = v
+	}
+	return na
+}
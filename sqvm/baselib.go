@@ -0,0 +1,863 @@
+package sqvm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The methods of the default delegates, see initDefaultDelegates. They
+// follow sqbaselib.cpp of the reference implementation.
+
+// callFunc calls fn with this and the arguments and returns its result.
+func (vm *VM) callFunc(fn Object, raiseError bool, args ...Object) (Object, error) {
+	for _, a := range args {
+		vm.push(a)
+	}
+	res, err := vm.call(fn, len(args), vm.top-len(args), raiseError)
+	vm.pop(len(args))
+	return res, err
+}
+
+// str2num parses the number at the start of s like strtol and strtod
+// would: leading whitespace is skipped and trailing garbage ignored.
+func str2num(s string, base int) (Object, bool) {
+	s = strings.TrimLeft(s, " \t\n\v\f\r")
+	if strings.ContainsAny(s, ".eE") && base == 10 {
+		end := floatPrefix(s)
+		if end == 0 {
+			return Null, false
+		}
+		f, _ := strconv.ParseFloat(s[:end], 64)
+		return FloatValue(f), true
+	}
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	digits := s[:i]
+	if base == 16 && strings.HasPrefix(strings.ToLower(s[i:]), "0x") {
+		i += 2
+	}
+	start := i
+	for i < len(s) && digitValue(s[i]) < base {
+		i++
+	}
+	if i == start {
+		return Null, false
+	}
+	n, err := strconv.ParseInt(digits+s[start:i], base, 64)
+	if err != nil && n == 0 {
+		return Null, false
+	}
+	return IntegerValue(n), true
+}
+
+func digitValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	}
+	return 36
+}
+
+// floatPrefix returns the length of the decimal float at the start of s.
+func floatPrefix(s string) int {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	nDigits := 0
+	for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+		nDigits++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for ; i < len(s) && s[i] >= '0' && s[i] <= '9'; i++ {
+			nDigits++
+		}
+	}
+	if nDigits == 0 {
+		return 0
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '-' || s[j] == '+') {
+			j++
+		}
+		if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
+
+func defaultDelegateLen(vm *VM) (int, error) {
+	n, err := vm.GetSize(1)
+	if err != nil {
+		return 0, err
+	}
+	vm.push(IntegerValue(int64(n)))
+	return 1, nil
+}
+
+func defaultDelegateToFloat(vm *VM) (int, error) {
+	o := vm.at(1)
+	switch o.typ {
+	case TypeString:
+		res, ok := str2num(o.Str(), 10)
+		if !ok {
+			return vm.ThrowError("cannot convert the string")
+		}
+		vm.push(FloatValue(res.toFloat()))
+	case TypeInteger, TypeFloat:
+		vm.push(FloatValue(o.toFloat()))
+	case TypeBool:
+		vm.push(FloatValue(float64(o.num)))
+	default:
+		vm.push(Null)
+	}
+	return 1, nil
+}
+
+func defaultDelegateToInteger(vm *VM) (int, error) {
+	o := vm.at(1)
+	switch o.typ {
+	case TypeString:
+		base := 10
+		if vm.GetTop() > 1 {
+			base = int(vm.at(2).toInteger())
+			if base < 2 || base > 36 {
+				return vm.ThrowError("invalid base")
+			}
+		}
+		res, ok := str2num(o.Str(), base)
+		if !ok {
+			return vm.ThrowError("cannot convert the string")
+		}
+		vm.push(IntegerValue(res.toInteger()))
+	case TypeInteger, TypeFloat:
+		vm.push(IntegerValue(o.toInteger()))
+	case TypeBool:
+		vm.push(IntegerValue(int64(o.num)))
+	default:
+		vm.push(Null)
+	}
+	return 1, nil
+}
+
+func defaultDelegateToString(vm *VM) (int, error) {
+	s, err := vm.toString(vm.at(1))
+	if err != nil {
+		return 0, err
+	}
+	vm.push(StringValue(s))
+	return 1, nil
+}
+
+func numberToChar(vm *VM) (int, error) {
+	c := byte(vm.at(1).toInteger())
+	vm.push(StringValue(string([]byte{c})))
+	return 1, nil
+}
+
+func objClear(vm *VM) (int, error) {
+	o := vm.at(1)
+	switch o.typ {
+	case TypeTable:
+		o.table().clear()
+	case TypeArray:
+		o.array().resize(0, Null)
+	default:
+		return vm.ThrowError("clear only works on table and array")
+	}
+	return 0, nil
+}
+
+func containerRawGet(vm *VM) (int, error) {
+	val, err := vm.rawGet(vm.at(1), vm.at(2))
+	if err != nil {
+		return 0, err
+	}
+	vm.push(val)
+	return 1, nil
+}
+
+func containerRawSet(vm *VM) (int, error) {
+	if err := vm.rawSet(vm.at(1), vm.at(2), vm.at(3)); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func containerRawExists(vm *VM) (int, error) {
+	_, err := vm.rawGet(vm.at(1), vm.at(2))
+	vm.push(BoolValue(err == nil))
+	return 1, nil
+}
+
+// table
+
+func tableRawDelete(vm *VM) (int, error) {
+	t := vm.at(1).table()
+	key := vm.at(2)
+	val, _ := t.get(key)
+	vm.push(val)
+	t.remove(key)
+	return 1, nil
+}
+
+func tableSetDelegate(vm *VM) (int, error) {
+	vm.Push(2)
+	if err := vm.SetDelegate(1); err != nil {
+		return 0, err
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+func tableGetDelegate(vm *VM) (int, error) {
+	if err := vm.GetDelegate(1); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func tableFilter(vm *VM) (int, error) {
+	self := vm.at(1)
+	fn := vm.at(2)
+	t := self.table()
+	res := vm.ss.newObject(TypeTable, newTable(0))
+	vm.push(res)
+	for pos, key, val := t.next(0); pos >= 0; pos, key, val = t.next(pos) {
+		keep, err := vm.callFunc(fn, false, self, key, val)
+		if err != nil {
+			return 0, err
+		}
+		if !keep.isFalse() {
+			res.table().newSlot(key, val)
+		}
+	}
+	return 1, nil
+}
+
+func tableKeys(vm *VM) (int, error) {
+	t := vm.at(1).table()
+	a := newArray(0)
+	for pos, key, _ := t.next(0); pos >= 0; pos, key, _ = t.next(pos) {
+		a.append(key)
+	}
+	vm.push(vm.ss.newObject(TypeArray, a))
+	return 1, nil
+}
+
+func tableValues(vm *VM) (int, error) {
+	t := vm.at(1).table()
+	a := newArray(0)
+	for pos, _, val := t.next(0); pos >= 0; pos, _, val = t.next(pos) {
+		a.append(val)
+	}
+	vm.push(vm.ss.newObject(TypeArray, a))
+	return 1, nil
+}
+
+// array
+
+func arrayAppend(vm *VM) (int, error) {
+	vm.at(1).array().append(vm.at(2))
+	vm.Push(1)
+	return 1, nil
+}
+
+func arrayExtend(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	for _, v := range vm.at(2).array().values {
+		a.append(v)
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+func arrayPop(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	if len(a.values) == 0 {
+		return vm.ThrowError("empty array")
+	}
+	vm.push(a.values[len(a.values)-1])
+	a.resize(len(a.values)-1, Null)
+	return 1, nil
+}
+
+func arrayTop(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	if len(a.values) == 0 {
+		return vm.ThrowError("top() on a empty array")
+	}
+	vm.push(realVal(a.values[len(a.values)-1]))
+	return 1, nil
+}
+
+func arrayInsert(vm *VM) (int, error) {
+	if !vm.at(1).array().insert(vm.at(2).toInteger(), vm.at(3)) {
+		return vm.ThrowError("index out of range")
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+func arrayRemove(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	idx := vm.at(2).toInteger()
+	val, ok := a.get(idx)
+	if !ok {
+		return vm.ThrowError("idx out of range")
+	}
+	vm.push(val)
+	a.remove(idx)
+	return 1, nil
+}
+
+func arrayResize(vm *VM) (int, error) {
+	size := vm.at(2).toInteger()
+	if size < 0 {
+		return vm.ThrowError("resizing to negative length")
+	}
+	a := vm.at(1).array()
+	if err := a.checkGrow(size); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	var fill Object
+	if vm.GetTop() > 2 {
+		fill = vm.at(3)
+	}
+	a.resize(int(size), fill)
+	vm.Push(1)
+	return 1, nil
+}
+
+func arrayReverse(vm *VM) (int, error) {
+	values := vm.at(1).array().values
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+// sortCompare compares two values with the compare function of sort, or
+// with the usual comparison when there is none.
+func (vm *VM) sortCompare(a, b, fn Object) (int64, error) {
+	if fn.IsNull() {
+		return vm.objCmp(a, b)
+	}
+	res, err := vm.callFunc(fn, false, vm.rootTable, a, b)
+	if err != nil {
+		if vm.lastError.typ != TypeString {
+			return 0, vm.raise("compare func failed")
+		}
+		return 0, err
+	}
+	if res.typ != TypeInteger {
+		return 0, vm.raise("numeric value expected as return value of the compare function")
+	}
+	return res.Integer(), nil
+}
+
+// heapSiftDown is the sift down step of the heap sort used by sort. Like
+// the reference implementation it sorts in place with a heap sort so that
+// inconsistent compare functions give the same results.
+func (vm *VM) heapSiftDown(a *array, root, bottom int, fn Object) error {
+	for root*2 <= bottom {
+		if bottom >= len(a.values) {
+			return vm.raise("array resized during sort")
+		}
+		root2 := root * 2
+		maxChild := root2
+		if root2 != bottom {
+			ret, err := vm.sortCompare(a.values[root2], a.values[root2+1], fn)
+			if err != nil {
+				return err
+			}
+			if ret <= 0 {
+				maxChild = root2 + 1
+			}
+		}
+		ret, err := vm.sortCompare(a.values[root], a.values[maxChild], fn)
+		if err != nil {
+			return err
+		}
+		if ret >= 0 {
+			return nil
+		}
+		if root == maxChild {
+			return vm.raise("inconsistent compare function")
+		}
+		a.values[root], a.values[maxChild] = a.values[maxChild], a.values[root]
+		root = maxChild
+	}
+	return nil
+}
+
+func arraySort(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	var fn Object
+	if vm.GetTop() > 1 {
+		fn = vm.at(2)
+	}
+	size := len(a.values)
+	if size > 1 {
+		for i := size / 2; i >= 0; i-- {
+			if err := vm.heapSiftDown(a, i, size-1, fn); err != nil {
+				return 0, err
+			}
+		}
+		for i := size - 1; i >= 1; i-- {
+			if i >= len(a.values) {
+				return vm.ThrowError("array resized during sort")
+			}
+			a.values[0], a.values[i] = a.values[i], a.values[0]
+			if err := vm.heapSiftDown(a, 0, i-1, fn); err != nil {
+				return 0, err
+			}
+		}
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+// sliceParams returns the bounds given to slice, negative ones counting
+// from the end.
+func (vm *VM) sliceParams(length int) (int, int, error) {
+	start, end := int64(0), int64(length)
+	if vm.GetTop() > 1 {
+		start = vm.at(2).toInteger()
+	}
+	if vm.GetTop() > 2 {
+		end = vm.at(3).toInteger()
+	}
+	if start < 0 {
+		start += int64(length)
+	}
+	if end < 0 {
+		end += int64(length)
+	}
+	if end < start {
+		return 0, 0, vm.raise("wrong indexes")
+	}
+	if end > int64(length) || start < 0 {
+		return 0, 0, vm.raise("slice out of range")
+	}
+	return int(start), int(end), nil
+}
+
+func arraySlice(vm *VM) (int, error) {
+	a := vm.at(1).array()
+	start, end, err := vm.sliceParams(len(a.values))
+	if err != nil {
+		return 0, err
+	}
+	res := newArray(0)
+	for _, v := range a.values[start:end] {
+		res.append(v)
+	}
+	vm.push(vm.ss.newObject(TypeArray, res))
+	return 1, nil
+}
+
+// mapArray stores fn(value) for every value of src in dest.
+func (vm *VM) mapArray(dest, src Object, fn Object) error {
+	a := src.array()
+	for n := 0; n < len(a.values); n++ {
+		res, err := vm.callFunc(fn, false, src, realVal(a.values[n]))
+		if err != nil {
+			return err
+		}
+		dest.array().set(int64(n), res)
+	}
+	return nil
+}
+
+func arrayMap(vm *VM) (int, error) {
+	self := vm.at(1)
+	res := vm.ss.newObject(TypeArray, newArray(len(self.array().values)))
+	vm.push(res)
+	if err := vm.mapArray(res, self, vm.at(2)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func arrayApply(vm *VM) (int, error) {
+	self := vm.at(1)
+	if err := vm.mapArray(self, self, vm.at(2)); err != nil {
+		return 0, err
+	}
+	vm.Push(1)
+	return 1, nil
+}
+
+func arrayReduce(vm *VM) (int, error) {
+	self := vm.at(1)
+	fn := vm.at(2)
+	a := self.array()
+	if len(a.values) == 0 {
+		return 0, nil
+	}
+	vm.push(realVal(a.values[0]))
+	for n := 1; n < len(a.values); n++ {
+		res, err := vm.callFunc(fn, false, self, vm.at(-1), realVal(a.values[n]))
+		if err != nil {
+			return 0, err
+		}
+		assign(&vm.stack[vm.top-1], res)
+	}
+	return 1, nil
+}
+
+func arrayFilter(vm *VM) (int, error) {
+	self := vm.at(1)
+	fn := vm.at(2)
+	a := self.array()
+	res := vm.ss.newObject(TypeArray, newArray(0))
+	vm.push(res)
+	for n := 0; n < len(a.values); n++ {
+		val := realVal(a.values[n])
+		keep, err := vm.callFunc(fn, false, self, IntegerValue(int64(n)), val)
+		if err != nil {
+			return 0, err
+		}
+		if !keep.isFalse() {
+			res.array().append(val)
+		}
+	}
+	return 1, nil
+}
+
+func arrayFind(vm *VM) (int, error) {
+	val := vm.at(2)
+	for n, v := range vm.at(1).array().values {
+		if isEqual(realVal(v), val) {
+			vm.push(IntegerValue(int64(n)))
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// string
+
+func stringSlice(vm *VM) (int, error) {
+	s := vm.at(1).Str()
+	start, end, err := vm.sliceParams(len(s))
+	if err != nil {
+		return 0, err
+	}
+	vm.push(StringValue(s[start:end]))
+	return 1, nil
+}
+
+func stringFind(vm *VM) (int, error) {
+	s := vm.at(1).Str()
+	start := int64(0)
+	if vm.GetTop() > 2 {
+		start = vm.at(3).toInteger()
+	}
+	if start >= 0 && start < int64(len(s)) {
+		if i := strings.Index(s[start:], vm.at(2).Str()); i >= 0 {
+			vm.push(IntegerValue(start + int64(i)))
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// mapASCII converts the ASCII letters of the string, other bytes are
+// left alone like the C library does in the "C" locale.
+func mapASCII(s string, from, to byte) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= from && c <= from+'z'-'a' {
+			b[i] = c - from + to
+		}
+	}
+	return string(b)
+}
+
+func stringToLower(vm *VM) (int, error) {
+	vm.push(StringValue(mapASCII(vm.at(1).Str(), 'A', 'a')))
+	return 1, nil
+}
+
+func stringToUpper(vm *VM) (int, error) {
+	vm.push(StringValue(mapASCII(vm.at(1).Str(), 'a', 'A')))
+	return 1, nil
+}
+
+// closure
+
+func closureCall(vm *VM) (int, error) {
+	return vm.closureCall(true)
+}
+
+func closurePCall(vm *VM) (int, error) {
+	return vm.closureCall(false)
+}
+
+func (vm *VM) closureCall(raiseError bool) (int, error) {
+	nArgs := vm.GetTop() - 1
+	for i := 2; i <= nArgs+1; i++ {
+		vm.Push(i)
+	}
+	res, err := vm.call(vm.at(1), nArgs, vm.top-nArgs, raiseError)
+	vm.pop(nArgs)
+	if err != nil {
+		return 0, err
+	}
+	vm.push(res)
+	return 1, nil
+}
+
+func closureACall(vm *VM) (int, error) {
+	return vm.closureACall(true)
+}
+
+func closurePACall(vm *VM) (int, error) {
+	return vm.closureACall(false)
+}
+
+func (vm *VM) closureACall(raiseError bool) (int, error) {
+	res, err := vm.callFunc(vm.at(1), raiseError, vm.at(2).array().values...)
+	if err != nil {
+		return 0, err
+	}
+	vm.push(res)
+	return 1, nil
+}
+
+// closureBindEnv returns a copy of the closure that is always called with
+// the object as "this". The object is only weakly referenced.
+func closureBindEnv(vm *VM) (int, error) {
+	o := vm.at(1)
+	env := vm.ss.weakRefOf(vm.at(2))
+	var res Object
+	switch o.typ {
+	case TypeClosure:
+		c := o.closure().clone()
+		assign(&c.env, env)
+		res = vm.ss.newObject(TypeClosure, c)
+	case TypeNativeClosure:
+		c := o.nativeClosure().clone()
+		assign(&c.env, env)
+		res = vm.ss.newObject(TypeNativeClosure, c)
+	}
+	vm.push(res)
+	return 1, nil
+}
+
+func closureGetInfos(vm *VM) (int, error) {
+	o := vm.at(1)
+	res := newTable(0)
+	vm.push(vm.ss.newObject(TypeTable, res))
+	slot := func(key string, val Object) {
+		res.newSlot(StringValue(key), val)
+	}
+	if o.typ == TypeClosure {
+		c := o.closure()
+		proto := c.proto
+		params := newArray(0)
+		for _, p := range proto.Parameters {
+			params.append(StringValue(p))
+		}
+		if proto.VarParams {
+			params.append(StringValue("..."))
+		}
+		defParams := newArray(0)
+		for _, v := range c.defaultParams {
+			defParams.append(v)
+		}
+		slot("native", BoolValue(false))
+		slot("name", nameValue(proto.Name))
+		slot("src", nameValue(proto.SourceName))
+		slot("parameters", vm.ss.newObject(TypeArray, params))
+		slot("varargs", BoolValue(proto.VarParams))
+		slot("defparams", vm.ss.newObject(TypeArray, defParams))
+	} else {
+		nc := o.nativeClosure()
+		slot("native", BoolValue(true))
+		slot("name", nameValue(nc.name))
+		slot("paramscheck", IntegerValue(int64(nc.paramsCheck)))
+		var typeCheck Object
+		if len(nc.typeCheck) > 0 {
+			a := newArray(0)
+			for _, m := range nc.typeCheck {
+				a.append(IntegerValue(int64(m)))
+			}
+			typeCheck = vm.ss.newObject(TypeArray, a)
+		}
+		slot("typecheck", typeCheck)
+	}
+	return 1, nil
+}
+
+// nameValue returns null for missing names.
+func nameValue(name string) Object {
+	if name == "" {
+		return Null
+	}
+	return StringValue(name)
+}
+
+func closureGetRoot(vm *VM) (int, error) {
+	o := vm.at(1)
+	if o.typ != TypeClosure {
+		return vm.ThrowError("closure expected")
+	}
+	vm.push(o.closure().root)
+	return 1, nil
+}
+
+func closureSetRoot(vm *VM) (int, error) {
+	o := vm.at(1)
+	if o.typ != TypeClosure {
+		return vm.ThrowError("closure expected")
+	}
+	assign(&o.closure().root, vm.at(2))
+	return 0, nil
+}
+
+// generator
+
+var generatorStateNames = [...]string{
+	generatorRunning:   "running",
+	generatorSuspended: "suspended",
+	generatorDead:      "dead",
+}
+
+func generatorGetStatus(vm *VM) (int, error) {
+	vm.push(StringValue(generatorStateNames[vm.at(1).generator().state]))
+	return 1, nil
+}
+
+// thread
+
+func threadGetStackInfos(vm *VM) (int, error) {
+	t := vm.at(1).thread()
+	res, ok := t.stackInfosTable(int(vm.at(2).toInteger()))
+	if !ok {
+		return 0, nil
+	}
+	vm.push(res)
+	return 1, nil
+}
+
+// stackInfosTable returns the stack infos of level as the table
+// getstackinfos returns, with the values of the locals by name.
+func (vm *VM) stackInfosTable(level int) (Object, bool) {
+	si, err := vm.GetStackInfos(level)
+	if err != nil {
+		return Null, false
+	}
+	locals := vm.ss.newObject(TypeTable, newTable(0))
+	for idx := 0; ; idx++ {
+		name, ok := vm.GetLocal(level, idx)
+		if !ok {
+			break
+		}
+		locals.table().newSlot(StringValue(name), vm.at(-1))
+		vm.pop(1)
+	}
+	t := newTable(4)
+	t.newSlot(StringValue("func"), StringValue(si.FuncName))
+	t.newSlot(StringValue("src"), StringValue(si.Source))
+	t.newSlot(StringValue("line"), IntegerValue(int64(si.Line)))
+	t.newSlot(StringValue("locals"), locals)
+	return vm.ss.newObject(TypeTable, t), true
+}
+
+// class
+
+func classGetAttributes(vm *VM) (int, error) {
+	c := vm.at(1).class()
+	key := vm.at(2)
+	if key.IsNull() {
+		vm.push(c.attributes)
+		return 1, nil
+	}
+	m, ok := c.member(key)
+	if !ok {
+		return vm.ThrowError("wrong index")
+	}
+	vm.push(m.attrs)
+	return 1, nil
+}
+
+// classSetAttributes returns the previous attributes.
+func classSetAttributes(vm *VM) (int, error) {
+	c := vm.at(1).class()
+	key, val := vm.at(2), vm.at(3)
+	var dst *Object
+	if key.IsNull() {
+		dst = &c.attributes
+	} else {
+		m, ok := c.member(key)
+		if !ok {
+			return vm.ThrowError("wrong index")
+		}
+		dst = &m.attrs
+	}
+	vm.push(*dst)
+	assign(dst, val)
+	return 1, nil
+}
+
+func classInstance(vm *VM) (int, error) {
+	vm.push(vm.ss.newObject(TypeInstance, vm.at(1).class().createInstance()))
+	return 1, nil
+}
+
+func classGetBase(vm *VM) (int, error) {
+	if base := vm.at(1).class().base; base != nil {
+		vm.push(makeObject(TypeClass, base))
+	} else {
+		vm.push(Null)
+	}
+	return 1, nil
+}
+
+func classNewMember(vm *VM) (int, error) {
+	return vm.classNewMember(false)
+}
+
+func classRawNewMember(vm *VM) (int, error) {
+	return vm.classNewMember(true)
+}
+
+// classNewMember implements newmember(key, val, attrs = null,
+// static = false).
+func (vm *VM) classNewMember(raw bool) (int, error) {
+	var attrs Object
+	static := false
+	if vm.GetTop() > 3 {
+		attrs = vm.at(4)
+	}
+	if vm.GetTop() > 4 {
+		static = !vm.at(5).isFalse()
+	}
+	if err := vm.newSlotA(vm.at(1), vm.at(2), vm.at(3), attrs, static, raw); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// instance
+
+func instanceGetClass(vm *VM) (int, error) {
+	vm.push(makeObject(TypeClass, vm.at(1).instance().class))
+	return 1, nil
+}
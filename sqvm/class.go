@@ -0,0 +1,232 @@
+package sqvm
+
+// Class members are stored in the members table as integers tagging the
+// index into either the field or the method list.
+const (
+	memberMethod = 0x01000000
+	memberField  = 0x02000000
+	memberMask   = 0x00FFFFFF
+)
+
+func isField(idx Object) bool {
+	return idx.Integer()&memberField != 0
+}
+
+func memberIndex(idx Object) int {
+	return int(idx.Integer() & memberMask)
+}
+
+type classMember struct {
+	val   Object
+	attrs Object
+}
+
+type class struct {
+	gcHeader
+
+	base           *class
+	members        *table
+	defaultValues  []classMember
+	methods        []classMember
+	metaMethods    [metaMethodCount]Object
+	attributes     Object
+	constructorIdx int
+	typeTag        any
+	hook           ReleaseHook
+	locked         bool
+}
+
+func newClass(base *class) *class {
+	c := &class{
+		base:           base,
+		constructorIdx: -1,
+	}
+	if base != nil {
+		base.incRef()
+		c.constructorIdx = base.constructorIdx
+		c.defaultValues = append([]classMember(nil), base.defaultValues...)
+		c.methods = append([]classMember(nil), base.methods...)
+		c.metaMethods = base.metaMethods
+		c.members = base.members.clone()
+		c.hook = base.hook
+		for _, m := range c.defaultValues {
+			incRef(m.val)
+			incRef(m.attrs)
+		}
+		for _, m := range c.methods {
+			incRef(m.val)
+			incRef(m.attrs)
+		}
+		for _, mm := range c.metaMethods {
+			incRef(mm)
+		}
+	} else {
+		c.members = newTable(0)
+	}
+	return c
+}
+
+func (c *class) lock() {
+	c.locked = true
+	if c.base != nil {
+		c.base.lock()
+	}
+}
+
+func (c *class) get(key Object) (Object, bool) {
+	idx, ok := c.members.get(key)
+	if !ok {
+		return Null, false
+	}
+	if isField(idx) {
+		return realVal(c.defaultValues[memberIndex(idx)].val), true
+	}
+	return realVal(c.methods[memberIndex(idx)].val), true
+}
+
+func (c *class) newSlot(ss *sharedState, key, val Object, static bool) bool {
+	isMethod := val.typ == TypeClosure || val.typ == TypeNativeClosure
+	belongsToStatic := isMethod || static
+	if c.locked && !belongsToStatic {
+		return false // the class already has an instance so cannot be modified
+	}
+	idx, found := c.members.get(key)
+	if found && isField(idx) {
+		// overrides the default value
+		assign(&c.defaultValues[memberIndex(idx)].val, val)
+		return true
+	}
+	if belongsToStatic {
+		if mm := ss.metaMethodIndex(key); isMethod && mm >= 0 {
+			assign(&c.metaMethods[mm], val)
+			return true
+		}
+		if c.base != nil && val.typ == TypeClosure {
+			method := val.closure().clone()
+			method.setBase(c.base)
+			val = ss.newObject(TypeClosure, method)
+		}
+		if !found {
+			if key.typ == TypeString && key.Str() == "constructor" {
+				c.constructorIdx = len(c.methods)
+			}
+			c.members.newSlot(key, IntegerValue(int64(memberMethod|len(c.methods))))
+			incRef(val)
+			c.methods = append(c.methods, classMember{val: val})
+		} else {
+			assign(&c.methods[memberIndex(idx)].val, val)
+		}
+		return true
+	}
+	c.members.newSlot(key, IntegerValue(int64(memberField|len(c.defaultValues))))
+	incRef(val)
+	c.defaultValues = append(c.defaultValues, classMember{val: val})
+	return true
+}
+
+func (c *class) member(key Object) (*classMember, bool) {
+	idx, ok := c.members.get(key)
+	if !ok {
+		return nil, false
+	}
+	if isField(idx) {
+		return &c.defaultValues[memberIndex(idx)], true
+	}
+	return &c.methods[memberIndex(idx)], true
+}
+
+func (c *class) constructor() (Object, bool) {
+	if c.constructorIdx < 0 {
+		return Null, false
+	}
+	return c.methods[c.constructorIdx].val, true
+}
+
+func (c *class) next(pos int) (int, Object, Object) {
+	pos, key, idx := c.members.next(pos)
+	if pos < 0 {
+		return pos, key, idx
+	}
+	if isField(idx) {
+		return pos, key, c.defaultValues[memberIndex(idx)].val
+	}
+	return pos, key, c.methods[memberIndex(idx)].val
+}
+
+func (c *class) createInstance() *instance {
+	if !c.locked {
+		c.lock()
+	}
+	c.incRef()
+	inst := &instance{
+		class:  c,
+		values: make([]Object, len(c.defaultValues)),
+		hook:   c.hook,
+	}
+	for i, m := range c.defaultValues {
+		incRef(m.val)
+		inst.values[i] = m.val
+	}
+	return inst
+}
+
+type instance struct {
+	gcHeader
+
+	class  *class
+	values []Object
+	up     any
+	hook   ReleaseHook
+}
+
+func (i *instance) get(key Object) (Object, bool) {
+	idx, ok := i.class.members.get(key)
+	if !ok {
+		return Null, false
+	}
+	if isField(idx) {
+		return realVal(i.values[memberIndex(idx)]), true
+	}
+	return realVal(i.class.methods[memberIndex(idx)].val), true
+}
+
+func (i *instance) set(key, val Object) bool {
+	idx, ok := i.class.members.get(key)
+	if ok && isField(idx) {
+		assign(&i.values[memberIndex(idx)], val)
+		return true
+	}
+	return false
+}
+
+func (i *instance) instanceOf(c *class) bool {
+	for parent := i.class; parent != nil; parent = parent.base {
+		if parent == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *instance) clone() *instance {
+	ni := &instance{
+		class:  i.class,
+		values: append([]Object(nil), i.values...),
+		up:     i.up,
+		hook:   i.hook,
+	}
+	ni.class.incRef()
+	for _, v := range ni.values {
+		incRef(v)
+	}
+	return ni
+}
+
+type userData struct {
+	gcHeader
+
+	value    any
+	delegate *table
+	typeTag  any
+	hook     ReleaseHook
+}
@@ -0,0 +1,272 @@
+package sqvm
+
+// NativeFunc is a Go function callable from scripts. Arguments are found
+// on the stack starting at index 1 ("this"). Returning 1 makes the value
+// at the top of the stack the result of the call, 0 returns null.
+type NativeFunc func(vm *VM) (int, error)
+
+type closure struct {
+	gcHeader
+
+	proto         *FuncProto
+	outers        []*outer
+	defaultParams []Object
+	env           Object
+	root          Object
+	base          *class
+}
+
+func newClosure(proto *FuncProto, root Object) *closure {
+	incRef(root)
+	return &closure{
+		proto:         proto,
+		outers:        make([]*outer, len(proto.OuterValues)),
+		defaultParams: make([]Object, len(proto.DefaultParams)),
+		root:          root,
+	}
+}
+
+func (c *closure) clone() *closure {
+	nc := &closure{
+		proto:         c.proto,
+		outers:        append([]*outer(nil), c.outers...),
+		defaultParams: append([]Object(nil), c.defaultParams...),
+		env:           c.env,
+		root:          c.root,
+		base:          c.base,
+	}
+	nc.traverse(func(g gcObject) {
+		g.header().incRef()
+	})
+	return nc
+}
+
+func (c *closure) setBase(base *class) {
+	if base != nil {
+		base.incRef()
+	}
+	if c.base != nil {
+		c.base.decRef()
+	}
+	c.base = base
+}
+
+// outer is a local captured by a closure. While the function owning the
+// local is running it refers to the stack slot, once the function returns
+// the value is moved into the outer itself.
+type outer struct {
+	gcHeader
+
+	vm    *VM
+	idx   int
+	value Object
+	open  bool
+	next  *outer
+}
+
+func (o *outer) get() Object {
+	if o.open {
+		return o.vm.stack[o.idx]
+	}
+	return o.value
+}
+
+func (o *outer) set(val Object) {
+	if o.open {
+		assign(&o.vm.stack[o.idx], val)
+		return
+	}
+	assign(&o.value, val)
+}
+
+type nativeClosure struct {
+	gcHeader
+
+	fn          NativeFunc
+	name        string
+	outers      []Object
+	paramsCheck int
+	typeCheck   []typeMask
+	env         Object
+}
+
+func (c *nativeClosure) clone() *nativeClosure {
+	nc := &nativeClosure{
+		fn:          c.fn,
+		name:        c.name,
+		outers:      append([]Object(nil), c.outers...),
+		paramsCheck: c.paramsCheck,
+		typeCheck:   c.typeCheck,
+		env:         c.env,
+	}
+	nc.traverse(func(g gcObject) {
+		g.header().incRef()
+	})
+	return nc
+}
+
+type generatorState int
+
+const (
+	generatorRunning generatorState = iota
+	generatorSuspended
+	generatorDead
+)
+
+// generator keeps a copy of the suspended frame of a generator function.
+type generator struct {
+	gcHeader
+
+	closure Object
+	stack   []Object
+	ci      callInfo
+	traps   []exceptionTrap
+	state   generatorState
+}
+
+func newGenerator(c Object) *generator {
+	incRef(c)
+	return &generator{
+		closure: c,
+		state:   generatorRunning,
+	}
+}
+
+func (g *generator) kill() {
+	g.state = generatorDead
+	g.traverse(dropRef)
+	g.stack = nil
+	g.closure = Null
+}
+
+// yield moves the running frame of vm into the generator.
+func (g *generator) yield(vm *VM, target int) error {
+	switch g.state {
+	case generatorSuspended:
+		return vm.raise("internal vm error, yielding dead generator")
+	case generatorDead:
+		return vm.raise("internal vm error, yielding a dead generator")
+	}
+	size := vm.top - vm.stackBase
+	g.stack = make([]Object, size)
+	g.stack[0] = vm.stack[vm.stackBase]
+	for n := 1; n < target; n++ {
+		g.stack[n] = vm.stack[vm.stackBase+n]
+	}
+	for _, v := range g.stack {
+		incRef(v)
+	}
+	for j := 0; j < size; j++ {
+		assign(&vm.stack[vm.stackBase+j], Null)
+	}
+
+	g.ci = *vm.ci
+	g.ci.generator = nil
+	for i := 0; i < g.ci.traps; i++ {
+		et := vm.traps[len(vm.traps)-1]
+		vm.traps = vm.traps[:len(vm.traps)-1]
+		// keep the trap relative to the frame, it can be resumed elsewhere
+		et.stackBase -= vm.stackBase
+		et.top -= vm.stackBase
+		g.traps = append(g.traps, et)
+	}
+	g.state = generatorSuspended
+	return nil
+}
+
+// resume pushes the generator frame back on vm, the result of the next
+// yield or return lands in the stack slot target of the current frame.
+func (g *generator) resume(vm *VM, target int) error {
+	switch g.state {
+	case generatorDead:
+		return vm.raise("resuming dead generator")
+	case generatorRunning:
+		return vm.raise("resuming active generator")
+	}
+	size := len(g.stack)
+	newBase := vm.top
+	if err := vm.enterFrame(newBase, newBase+size, false); err != nil {
+		return err
+	}
+	vm.ci.generator = g
+	g.incRef()
+	vm.ci.target = target
+	assign(&vm.ci.closure, g.ci.closure)
+	vm.ci.ip = g.ci.ip
+	vm.ci.literals = g.ci.literals
+	vm.ci.nCalls = g.ci.nCalls
+	vm.ci.traps = g.ci.traps
+	vm.ci.root = g.ci.root
+
+	for i := 0; i < g.ci.traps; i++ {
+		et := g.traps[len(g.traps)-1]
+		g.traps = g.traps[:len(g.traps)-1]
+		et.stackBase += newBase
+		et.top += newBase
+		vm.traps = append(vm.traps, et)
+	}
+	for n := 0; n < size; n++ {
+		assign(&vm.stack[vm.stackBase+n], g.stack[n])
+		decRef(g.stack[n])
+		g.stack[n] = Null
+	}
+	g.state = generatorRunning
+	return nil
+}
+
+// typeMask is a set of object types accepted as a native parameter.
+type typeMask uint32
+
+const typeMaskAny typeMask = 0xFFFFFFFF
+
+func (m typeMask) has(t ObjectType) bool {
+	return m&(1<<uint(t)) != 0
+}
+
+var typeMaskChars = map[byte]typeMask{
+	'o': 1 << TypeNull,
+	'i': 1 << TypeInteger,
+	'f': 1 << TypeFloat,
+	'n': 1<<TypeInteger | 1<<TypeFloat,
+	's': 1 << TypeString,
+	't': 1 << TypeTable,
+	'a': 1 << TypeArray,
+	'u': 1 << TypeUserData,
+	'c': 1<<TypeClosure | 1<<TypeNativeClosure,
+	'b': 1 << TypeBool,
+	'g': 1 << TypeGenerator,
+	'p': 1 << TypeUserPointer,
+	'v': 1 << TypeThread,
+	'x': 1 << TypeInstance,
+	'y': 1 << TypeClass,
+	'r': 1 << TypeWeakRef,
+	'.': typeMaskAny,
+}
+
+// compileTypeMask parses a typemask string such as "tsn|b" into one mask
+// per parameter.
+func compileTypeMask(s string) ([]typeMask, bool) {
+	var res []typeMask
+	var mask typeMask
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' {
+			continue
+		}
+		m, ok := typeMaskChars[c]
+		if !ok {
+			return nil, false
+		}
+		mask |= m
+		if i+1 < len(s) && s[i+1] == '|' {
+			i++
+			if i+1 >= len(s) {
+				return nil, false
+			}
+			continue
+		}
+		res = append(res, mask)
+		mask = 0
+	}
+	return res, true
+}
@@ -0,0 +1,39 @@
+package sqvm_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+func TestCallContext(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	top := vm.GetTop()
+	// the cancellation cannot be caught by the script
+	src := `while (true) { try { while (true) {} } catch (e) {} }`
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatal(err)
+	}
+	vm.PushRootTable()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := vm.CallContext(ctx, 1, false, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline of the context", err)
+	}
+	vm.Pop(1)
+	if vm.GetTop() != top {
+		t.Fatalf("stack top is %d after the cancellation, want %d", vm.GetTop(), top)
+	}
+
+	// the context doesn't outlive the call
+	if err := run(t, vm, `for (local i = 0; i < 100; i++) {}`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package sqvm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// PushGoValue pushes the Squirrel equivalent of a Go value. Booleans,
+// numbers and strings become the matching scalars, slices and arrays
+// become arrays, maps with string keys become tables and nil becomes
+// null. Objects are pushed as they are. Unsigned values too large for an
+// integer are errors.
+func (vm *VM) PushGoValue(v any) error {
+	o, err := vm.goToObject(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	vm.push(o)
+	return nil
+}
+
+func (vm *VM) goToObject(v reflect.Value) (Object, error) {
+	if !v.IsValid() {
+		return Null, nil
+	}
+	if o, ok := v.Interface().(Object); ok {
+		return o, nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return Null, nil
+		}
+		return vm.goToObject(v.Elem())
+	case reflect.Bool:
+		return BoolValue(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntegerValue(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return Null, fmt.Errorf("%d overflows an integer", u)
+		}
+		return IntegerValue(int64(u)), nil
+	case reflect.Float32, reflect.Float64:
+		return FloatValue(v.Float()), nil
+	case reflect.String:
+		return StringValue(v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return Null, nil
+		}
+		a := newArray(0)
+		o := vm.ss.newObject(TypeArray, a)
+		for i := 0; i < v.Len(); i++ {
+			val, err := vm.goToObject(v.Index(i))
+			if err != nil {
+				// o is released with the unused objects
+				return Null, err
+			}
+			a.append(val)
+		}
+		return o, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return Null, nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return Null, fmt.Errorf("cannot convert map with %s keys", v.Type().Key())
+		}
+		t := newTable(v.Len())
+		o := vm.ss.newObject(TypeTable, t)
+		iter := v.MapRange()
+		for iter.Next() {
+			val, err := vm.goToObject(iter.Value())
+			if err != nil {
+				// o is released with the unused objects
+				return Null, err
+			}
+			t.newSlot(StringValue(iter.Key().String()), val)
+		}
+		return o, nil
+	}
+	return Null, fmt.Errorf("cannot convert %s", v.Type())
+}
+
+// GetGoValue returns the Go equivalent of the value at idx: nil, bool,
+// int64, float64, string, []any for arrays and map[string]any for tables.
+// Other types, tables with keys that aren't strings and containers that
+// contain themselves are errors.
+func (vm *VM) GetGoValue(idx int) (any, error) {
+	return objectToGo(vm.at(idx), map[any]bool{})
+}
+
+func objectToGo(o Object, visiting map[any]bool) (any, error) {
+	o = realVal(o)
+	switch o.typ {
+	case TypeNull:
+		return nil, nil
+	case TypeBool:
+		return o.Bool(), nil
+	case TypeInteger:
+		return o.Integer(), nil
+	case TypeFloat:
+		return o.Float(), nil
+	case TypeString:
+		return o.Str(), nil
+	case TypeArray:
+		a := o.array()
+		if visiting[a] {
+			return nil, fmt.Errorf("cycle detected")
+		}
+		visiting[a] = true
+		defer delete(visiting, a)
+		res := make([]any, len(a.values))
+		for i, val := range a.values {
+			v, err := objectToGo(val, visiting)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v
+		}
+		return res, nil
+	case TypeTable:
+		t := o.table()
+		if visiting[t] {
+			return nil, fmt.Errorf("cycle detected")
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		res := make(map[string]any, t.count)
+		for pos, key, val := t.next(0); pos >= 0; pos, key, val = t.next(pos) {
+			if key.typ != TypeString {
+				return nil, fmt.Errorf("table key of type %s is not a string", key.typ)
+			}
+			v, err := objectToGo(val, visiting)
+			if err != nil {
+				return nil, err
+			}
+			res[key.Str()] = v
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s", o.typ)
+}
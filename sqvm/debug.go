@@ -0,0 +1,203 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// StackInfo describes a function running on the call stack.
+type StackInfo struct {
+	FuncName string
+	Source   string
+	Line     int // -1 for native functions
+}
+
+// GetStackInfos returns the function running at level of the call stack,
+// 0 being the current function.
+func (vm *VM) GetStackInfos(level int) (StackInfo, error) {
+	n := len(vm.callStack)
+	if level < 0 || level >= n {
+		return StackInfo{}, fmt.Errorf("the level doesn't exist")
+	}
+	ci := vm.callStack[n-level-1]
+	si := StackInfo{FuncName: "unknown", Source: "unknown", Line: -1}
+	switch ci.closure.typ {
+	case TypeClosure:
+		proto := ci.closure.closure().proto
+		if proto.Name != "" {
+			si.FuncName = proto.Name
+		}
+		if proto.SourceName != "" {
+			si.Source = proto.SourceName
+		}
+		si.Line = proto.LineAt(ci.ip - 1)
+	case TypeNativeClosure:
+		si.Source = "NATIVE"
+		if name := ci.closure.nativeClosure().name; name != "" {
+			si.FuncName = name
+		}
+	}
+	return si, nil
+}
+
+// FunctionInfo describes a script function.
+type FunctionInfo struct {
+	FuncID *FuncProto // identifies the function, shared by its closures
+	Name   string
+	Source string
+	Line   int // the first line of the function
+}
+
+// GetFunctionInfo describes the script function running at level of the
+// call stack.
+func (vm *VM) GetFunctionInfo(level int) (FunctionInfo, error) {
+	proto := vm.GetFrameProto(level)
+	if proto == nil {
+		return FunctionInfo{}, fmt.Errorf("the object is not a closure")
+	}
+	fi := FunctionInfo{FuncID: proto, Name: "unknown", Source: "unknown", Line: -1}
+	if proto.Name != "" {
+		fi.Name = proto.Name
+	}
+	if proto.SourceName != "" {
+		fi.Source = proto.SourceName
+	}
+	if len(proto.LineInfos) > 0 {
+		fi.Line = proto.LineInfos[0].Line
+	}
+	return fi, nil
+}
+
+// CallDepth returns the number of functions on the call stack.
+func (vm *VM) CallDepth() int {
+	return len(vm.callStack)
+}
+
+// GetFrameProto returns the prototype of the script function running at
+// level of the call stack, nil for native functions.
+func (vm *VM) GetFrameProto(level int) *FuncProto {
+	n := len(vm.callStack)
+	if level < 0 || level >= n {
+		return nil
+	}
+	ci := vm.callStack[n-level-1]
+	if ci.closure.typ != TypeClosure {
+		return nil
+	}
+	return ci.closure.closure().proto
+}
+
+// GetCallee pushes the closure that called the running native function.
+func (vm *VM) GetCallee() error {
+	n := len(vm.callStack)
+	if n < 2 {
+		return fmt.Errorf("no closure in the calls stack")
+	}
+	vm.push(vm.callStack[n-2].closure)
+	return nil
+}
+
+// GetLocal pushes the value of the local variable idx of the function
+// running at level of the call stack and returns its name. The outer
+// variables of the closure come first, then the locals alive at the
+// current instruction. Nothing is pushed if there is no such variable.
+func (vm *VM) GetLocal(level, idx int) (string, bool) {
+	n := len(vm.callStack)
+	if level < 0 || level >= n || idx < 0 {
+		return "", false
+	}
+	stackBase := vm.stackBase
+	for i := 0; i < level; i++ {
+		stackBase -= vm.callStack[n-i-1].prevStackBase
+	}
+	ci := vm.callStack[n-level-1]
+	if ci.closure.typ != TypeClosure {
+		return "", false
+	}
+	c := ci.closure.closure()
+	proto := c.proto
+	if idx < len(proto.OuterValues) {
+		vm.push(c.outers[idx].get())
+		return proto.OuterValues[idx].Name, true
+	}
+	idx -= len(proto.OuterValues)
+	locals := proto.LocalsAt(ci.ip - 1)
+	if idx >= len(locals) {
+		return "", false
+	}
+	lv := locals[idx]
+	vm.push(vm.stack[stackBase+lv.Pos])
+	return lv.Name, true
+}
+
+// DebugEvent tells why a debug hook is called.
+type DebugEvent byte
+
+const (
+	DebugLine   DebugEvent = 'l' // a new line is about to run
+	DebugCall   DebugEvent = 'c' // a function was entered
+	DebugReturn DebugEvent = 'r' // a function is returning
+)
+
+// DebugHook is called for the events of script functions. Line events
+// only come from code compiled with debug info enabled. funcName is empty
+// for anonymous functions.
+type DebugHook func(vm *VM, event DebugEvent, src string, line int, funcName string)
+
+// SetDebugHook makes h the debug hook of the vm, replacing any hook set
+// by SetDebugHookClosure. A nil h removes it. Threads created afterwards
+// inherit the hook.
+func (vm *VM) SetDebugHook(h DebugHook) {
+	vm.debugHook = h
+	assign(&vm.debugHookClosure, Null)
+	vm.debugHooked = h != nil
+}
+
+// SetDebugHookClosure pops a closure and makes it the debug hook, null
+// removes the hook. The closure is called with the root table as this
+// and the event as an integer, the source name, the line and the
+// function name, null for anonymous functions.
+func (vm *VM) SetDebugHookClosure() error {
+	o := vm.stack[vm.top-1]
+	if o.typ != TypeClosure && o.typ != TypeNativeClosure && o.typ != TypeNull {
+		return fmt.Errorf("invalid param")
+	}
+	vm.debugHook = nil
+	assign(&vm.debugHookClosure, o)
+	vm.debugHooked = !o.IsNull()
+	vm.pop(1)
+	return nil
+}
+
+// callDebugHook reports event for the running function. A non zero line
+// is reported instead of the line of the current instruction. The hook
+// is disabled while it runs and its errors are ignored.
+func (vm *VM) callDebugHook(event DebugEvent, line int) {
+	proto := vm.ci.closure.closure().proto
+	if line == 0 {
+		pc := vm.ci.ip - 1
+		if pc < 0 {
+			pc = 0
+		}
+		line = proto.LineAt(pc)
+	}
+	vm.debugHooked = false
+	defer func() {
+		// the hook may have removed itself
+		vm.debugHooked = vm.debugHook != nil || !vm.debugHookClosure.IsNull()
+	}()
+	if vm.debugHook != nil {
+		vm.debugHook(vm, event, proto.SourceName, line, proto.Name)
+		return
+	}
+	name := Null
+	if proto.Name != "" {
+		name = StringValue(proto.Name)
+	}
+	vm.push(vm.rootTable)
+	vm.push(IntegerValue(int64(event)))
+	vm.push(StringValue(proto.SourceName))
+	vm.push(IntegerValue(int64(line)))
+	vm.push(name)
+	vm.call(vm.debugHookClosure, 5, vm.top-5, false)
+	vm.pop(5)
+}
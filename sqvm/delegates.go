@@ -0,0 +1,193 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// regFunc describes a native function of a default delegate, see
+// SetParamsCheck for nParams and typeMask.
+type regFunc struct {
+	name     string
+	fn       NativeFunc
+	nParams  int
+	typeMask string
+}
+
+// newNativeClosure creates the closure described by f. The typemasks are
+// part of the source so a bad one is a programming error.
+func (ss *sharedState) newNativeClosure(f regFunc) Object {
+	nc := &nativeClosure{fn: f.fn, name: f.name, paramsCheck: f.nParams}
+	if f.typeMask != "" {
+		mask, ok := compileTypeMask(f.typeMask)
+		if !ok {
+			panic("sqvm: invalid typemask for " + f.name)
+		}
+		nc.typeCheck = mask
+		if f.nParams == MatchTypeMask {
+			nc.paramsCheck = len(mask)
+		}
+	}
+	return ss.newObject(TypeNativeClosure, nc)
+}
+
+func (ss *sharedState) newDelegate(funcs []regFunc) Object {
+	t := newTable(len(funcs))
+	for _, f := range funcs {
+		t.newSlot(StringValue(f.name), ss.newNativeClosure(f))
+	}
+	var res Object
+	assign(&res, ss.newObject(TypeTable, t))
+	return res
+}
+
+// defaultDelegateKind maps object types to the default delegate used to
+// look up the methods all values of the type share.
+func defaultDelegateKind(t ObjectType) ObjectType {
+	switch t {
+	case TypeInteger, TypeFloat, TypeBool:
+		return TypeInteger
+	case TypeNativeClosure:
+		return TypeClosure
+	}
+	return t
+}
+
+func (ss *sharedState) initDefaultDelegates() {
+	var (
+		weakRef  = regFunc{name: "weakref", fn: objWeakRef, nParams: 1}
+		toString = regFunc{name: "tostring", fn: defaultDelegateToString, nParams: 1, typeMask: "."}
+		clear    = regFunc{name: "clear", fn: objClear, nParams: 1, typeMask: "."}
+	)
+	ss.defaultDelegates[TypeTable] = ss.newDelegate([]regFunc{
+		{name: "len", fn: defaultDelegateLen, nParams: 1, typeMask: "t"},
+		{name: "rawget", fn: containerRawGet, nParams: 2, typeMask: "t"},
+		{name: "rawset", fn: containerRawSet, nParams: 3, typeMask: "t"},
+		{name: "rawdelete", fn: tableRawDelete, nParams: 2, typeMask: "t"},
+		{name: "rawin", fn: containerRawExists, nParams: 2, typeMask: "t"},
+		weakRef,
+		toString,
+		clear,
+		{name: "setdelegate", fn: tableSetDelegate, nParams: 2, typeMask: ".t|o"},
+		{name: "getdelegate", fn: tableGetDelegate, nParams: 1, typeMask: "."},
+		{name: "filter", fn: tableFilter, nParams: 2, typeMask: "tc"},
+		{name: "keys", fn: tableKeys, nParams: 1, typeMask: "t"},
+		{name: "values", fn: tableValues, nParams: 1, typeMask: "t"},
+	})
+	ss.defaultDelegates[TypeArray] = ss.newDelegate([]regFunc{
+		{name: "len", fn: defaultDelegateLen, nParams: 1, typeMask: "a"},
+		{name: "append", fn: arrayAppend, nParams: 2, typeMask: "a"},
+		{name: "extend", fn: arrayExtend, nParams: 2, typeMask: "aa"},
+		{name: "push", fn: arrayAppend, nParams: 2, typeMask: "a"},
+		{name: "pop", fn: arrayPop, nParams: 1, typeMask: "a"},
+		{name: "top", fn: arrayTop, nParams: 1, typeMask: "a"},
+		{name: "insert", fn: arrayInsert, nParams: 3, typeMask: "an"},
+		{name: "remove", fn: arrayRemove, nParams: 2, typeMask: "an"},
+		{name: "resize", fn: arrayResize, nParams: -2, typeMask: "an"},
+		{name: "reverse", fn: arrayReverse, nParams: 1, typeMask: "a"},
+		{name: "sort", fn: arraySort, nParams: -1, typeMask: "ac"},
+		{name: "slice", fn: arraySlice, nParams: -1, typeMask: "ann"},
+		weakRef,
+		toString,
+		clear,
+		{name: "map", fn: arrayMap, nParams: 2, typeMask: "ac"},
+		{name: "apply", fn: arrayApply, nParams: 2, typeMask: "ac"},
+		{name: "reduce", fn: arrayReduce, nParams: 2, typeMask: "ac"},
+		{name: "filter", fn: arrayFilter, nParams: 2, typeMask: "ac"},
+		{name: "find", fn: arrayFind, nParams: 2, typeMask: "a."},
+	})
+	ss.defaultDelegates[TypeString] = ss.newDelegate([]regFunc{
+		{name: "len", fn: defaultDelegateLen, nParams: 1, typeMask: "s"},
+		{name: "tointeger", fn: defaultDelegateToInteger, nParams: -1, typeMask: "sn"},
+		{name: "tofloat", fn: defaultDelegateToFloat, nParams: 1, typeMask: "s"},
+		toString,
+		{name: "slice", fn: stringSlice, nParams: -1, typeMask: "snn"},
+		{name: "find", fn: stringFind, nParams: -2, typeMask: "ssn"},
+		{name: "tolower", fn: stringToLower, nParams: 1, typeMask: "s"},
+		{name: "toupper", fn: stringToUpper, nParams: 1, typeMask: "s"},
+		weakRef,
+	})
+	// shared by integers, floats and bools
+	ss.defaultDelegates[TypeInteger] = ss.newDelegate([]regFunc{
+		{name: "tointeger", fn: defaultDelegateToInteger, nParams: 1, typeMask: "n|b"},
+		{name: "tofloat", fn: defaultDelegateToFloat, nParams: 1, typeMask: "n|b"},
+		toString,
+		{name: "tochar", fn: numberToChar, nParams: 1, typeMask: "n|b"},
+		weakRef,
+	})
+	ss.defaultDelegates[TypeClosure] = ss.newDelegate([]regFunc{
+		{name: "call", fn: closureCall, nParams: -1, typeMask: "c"},
+		{name: "pcall", fn: closurePCall, nParams: -1, typeMask: "c"},
+		{name: "acall", fn: closureACall, nParams: 2, typeMask: "ca"},
+		{name: "pacall", fn: closurePACall, nParams: 2, typeMask: "ca"},
+		weakRef,
+		toString,
+		{name: "bindenv", fn: closureBindEnv, nParams: 2, typeMask: "cx|y|t"},
+		{name: "getinfos", fn: closureGetInfos, nParams: 1, typeMask: "c"},
+		{name: "getroot", fn: closureGetRoot, nParams: 1, typeMask: "c"},
+		{name: "setroot", fn: closureSetRoot, nParams: 2, typeMask: "ct"},
+	})
+	ss.defaultDelegates[TypeGenerator] = ss.newDelegate([]regFunc{
+		{name: "getstatus", fn: generatorGetStatus, nParams: 1, typeMask: "g"},
+		weakRef,
+		toString,
+	})
+	ss.defaultDelegates[TypeThread] = ss.newDelegate([]regFunc{
+		{name: "call", fn: threadCall, nParams: -1, typeMask: "v"},
+		{name: "wakeup", fn: threadWakeup, nParams: -1, typeMask: "v"},
+		{name: "wakeupthrow", fn: threadWakeupThrow, nParams: -2, typeMask: "v.b"},
+		{name: "getstatus", fn: threadGetStatus, nParams: 1, typeMask: "v"},
+		weakRef,
+		{name: "getstackinfos", fn: threadGetStackInfos, nParams: 2, typeMask: "vn"},
+		toString,
+	})
+	ss.defaultDelegates[TypeClass] = ss.newDelegate([]regFunc{
+		{name: "getattributes", fn: classGetAttributes, nParams: 2, typeMask: "y."},
+		{name: "setattributes", fn: classSetAttributes, nParams: 3, typeMask: "y.."},
+		{name: "rawget", fn: containerRawGet, nParams: 2, typeMask: "y"},
+		{name: "rawset", fn: containerRawSet, nParams: 3, typeMask: "y"},
+		{name: "rawin", fn: containerRawExists, nParams: 2, typeMask: "y"},
+		weakRef,
+		toString,
+		{name: "instance", fn: classInstance, nParams: 1, typeMask: "y"},
+		{name: "getbase", fn: classGetBase, nParams: 1, typeMask: "y"},
+		{name: "newmember", fn: classNewMember, nParams: -3, typeMask: "y"},
+		{name: "rawnewmember", fn: classRawNewMember, nParams: -3, typeMask: "y"},
+	})
+	ss.defaultDelegates[TypeInstance] = ss.newDelegate([]regFunc{
+		{name: "getclass", fn: instanceGetClass, nParams: 1, typeMask: "x"},
+		{name: "rawget", fn: containerRawGet, nParams: 2, typeMask: "x"},
+		{name: "rawset", fn: containerRawSet, nParams: 3, typeMask: "x"},
+		{name: "rawin", fn: containerRawExists, nParams: 2, typeMask: "x"},
+		weakRef,
+		toString,
+	})
+	ss.defaultDelegates[TypeWeakRef] = ss.newDelegate([]regFunc{
+		{name: "ref", fn: weakRefRef, nParams: 1, typeMask: "r"},
+		weakRef,
+		toString,
+	})
+}
+
+// GetDefaultDelegate pushes the table holding the methods shared by all
+// values of type t, such as len for strings. Hosts can add their own
+// methods to it. Integers, floats and bools share one delegate, and so
+// do closures and native closures.
+func (vm *VM) GetDefaultDelegate(t ObjectType) error {
+	if t < 0 || t > TypeOuter {
+		return fmt.Errorf("invalid object type")
+	}
+	d := vm.ss.defaultDelegates[defaultDelegateKind(t)]
+	if d.IsNull() {
+		return fmt.Errorf("type %s has no default delegate", t)
+	}
+	vm.push(d)
+	return nil
+}
+
+func (vm *VM) invokeDefaultDelegate(self, key Object) (Object, bool) {
+	d := vm.ss.defaultDelegates[defaultDelegateKind(self.typ)]
+	if d.typ != TypeTable {
+		return Null, false
+	}
+	return d.table().get(key)
+}
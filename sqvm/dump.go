@@ -0,0 +1,340 @@
+package sqvm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Dump writes a readable listing of the function and of the functions
+// nested in it: literals, parameters, outer values, locals, line info and
+// the instructions with their operands decoded.
+func (p *FuncProto) Dump(w io.Writer) error {
+	d := &dumper{w: w}
+	d.proto(p, "", -1)
+	return d.err
+}
+
+type dumper struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dumper) printf(format string, args ...any) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, format, args...)
+}
+
+// proto dumps p, the function index of its parent, whose path is given.
+func (d *dumper) proto(p *FuncProto, path string, index int) {
+	name := p.Name
+	if name == "" {
+		name = "(anonymous)"
+	}
+	path += name
+	if index >= 0 {
+		d.printf("function %s [%d] (%s)\n", path, index, p.SourceName)
+	} else {
+		d.printf("function %s (%s)\n", path, p.SourceName)
+	}
+	flags := ""
+	if p.VarParams {
+		flags += ", varparams"
+	}
+	if p.IsGenerator {
+		flags += ", generator"
+	}
+	d.printf("  stack size %d%s\n", p.StackSize, flags)
+
+	d.printf("  parameters:\n")
+	for i, name := range p.Parameters {
+		d.printf("    [%d] %s\n", i, name)
+	}
+	for i, pos := range p.DefaultParams {
+		d.printf("    default of [%d] from r%d of the parent\n", len(p.Parameters)-len(p.DefaultParams)+i, pos)
+	}
+
+	d.printf("  literals:\n")
+	for i, o := range p.Literals {
+		d.printf("    [%d] %s\n", i, literalString(o))
+	}
+
+	d.printf("  outer values:\n")
+	for i, ov := range p.OuterValues {
+		kind := "local"
+		if ov.Type == OuterOuter {
+			kind = "outer"
+		}
+		d.printf("    [%d] %s %s %d\n", i, ov.Name, kind, ov.Src)
+	}
+
+	d.printf("  locals:\n")
+	for _, lv := range p.LocalVarInfos {
+		d.printf("    r%-3d %-16s %04d-%04d\n", lv.Pos, lv.Name, lv.StartOp, lv.EndOp)
+	}
+
+	d.printf("  line info:\n")
+	for _, li := range p.LineInfos {
+		d.printf("    %04d line %d\n", li.Op, li.Line)
+	}
+
+	d.printf("  code:\n")
+	for pc, i := range p.Instructions {
+		d.printf("    %04d %-12s %3d %5d %3d %3d", pc, i.Op, i.Arg0, i.Arg1, i.Arg2, i.Arg3)
+		if s := describe(p, pc, i); s != "" {
+			d.printf("  ; %s", s)
+		}
+		d.printf("\n")
+	}
+
+	for i, f := range p.Functions {
+		d.printf("\n")
+		d.proto(f, path+"/", i)
+	}
+}
+
+func literalString(o Object) string {
+	if o.typ == TypeString {
+		return fmt.Sprintf("%q", o.Str())
+	}
+	return o.String()
+}
+
+// describe decodes the operands of the instruction at pc.
+func describe(p *FuncProto, pc int, i Instruction) string {
+	a0, a1, a2, a3 := int(i.Arg0), int(i.Arg1), int(i.Arg2), int(i.Arg3)
+	lit := func(n int) string {
+		if n < 0 || n >= len(p.Literals) {
+			return fmt.Sprintf("lit[%d]?", n)
+		}
+		return literalString(p.Literals[n])
+	}
+	jump := func(n int) string {
+		return fmt.Sprintf("%04d", pc+1+n)
+	}
+	reg := func(n int) string {
+		return fmt.Sprintf("r%d", n)
+	}
+	target := func(n int) string {
+		if n == MaxFuncStackSize {
+			return ""
+		}
+		return reg(n) + " = "
+	}
+	float := func(n int32) string {
+		return fmt.Sprint(math.Float32frombits(uint32(n)))
+	}
+
+	switch i.Op {
+	case OpLine:
+		return fmt.Sprintf("line %d", a1)
+	case OpLoad:
+		return fmt.Sprintf("r%d = %s", a0, lit(a1))
+	case OpLoadInt:
+		return fmt.Sprintf("r%d = %d", a0, i.Arg1)
+	case OpLoadFloat:
+		return fmt.Sprintf("r%d = %s", a0, float(i.Arg1))
+	case OpDLoad:
+		return fmt.Sprintf("r%d = %s, r%d = %s", a0, lit(a1), a2, lit(a3))
+	case OpTailCall, OpCall:
+		t := ""
+		if int8(i.Arg0) >= 0 {
+			t = reg(int(int8(i.Arg0))) + " = "
+		}
+		return fmt.Sprintf("%sr%d(r%d, %d args)", t, a1, a2, a3)
+	case OpPrepCall:
+		return fmt.Sprintf("r%d = r%d[r%d], r%d = r%d", a0, a2, a1, a3, a2)
+	case OpPrepCallK:
+		return fmt.Sprintf("r%d = r%d[%s], r%d = r%d", a0, a2, lit(a1), a3, a2)
+	case OpGetK:
+		return fmt.Sprintf("r%d = r%d[%s]", a0, a2, lit(a1))
+	case OpMove:
+		return fmt.Sprintf("r%d = r%d", a0, a1)
+	case OpNewSlot:
+		return fmt.Sprintf("%sr%d[r%d] <- r%d", target(a0), a1, a2, a3)
+	case OpDelete:
+		return fmt.Sprintf("r%d = delete r%d[r%d]", a0, a1, a2)
+	case OpSet:
+		return fmt.Sprintf("%sr%d[r%d] = r%d", target(a0), a1, a2, a3)
+	case OpGet:
+		return fmt.Sprintf("r%d = r%d[r%d]", a0, a1, a2)
+	case OpEq, OpNe:
+		op := "=="
+		if i.Op == OpNe {
+			op = "!="
+		}
+		other := reg(a1)
+		if a3 != 0 {
+			other = lit(a1)
+		}
+		return fmt.Sprintf("r%d = r%d %s %s", a0, a2, op, other)
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod:
+		return fmt.Sprintf("r%d = r%d %c r%d", a0, a2, arithOps[i.Op-OpAdd], a1)
+	case OpBitW:
+		return fmt.Sprintf("r%d = r%d %s r%d", a0, a2, bitwOpString(a3), a1)
+	case OpReturn:
+		if a0 == MaxFuncStackSize {
+			return "return"
+		}
+		return fmt.Sprintf("return r%d", a1)
+	case OpLoadNulls:
+		return fmt.Sprintf("r%d..r%d = null", a0, a0+a1-1)
+	case OpLoadRoot:
+		return fmt.Sprintf("r%d = root table", a0)
+	case OpLoadBool:
+		return fmt.Sprintf("r%d = %t", a0, a1 != 0)
+	case OpDMove:
+		return fmt.Sprintf("r%d = r%d, r%d = r%d", a0, a1, a2, a3)
+	case OpJmp:
+		return "jump to " + jump(a1)
+	case OpJCmp:
+		return fmt.Sprintf("if !(r%d %s r%d) jump to %s", a2, cmpOpString(a3), a0, jump(a1))
+	case OpJz:
+		return fmt.Sprintf("if !r%d jump to %s", a0, jump(a1))
+	case OpSetOuter:
+		return fmt.Sprintf("%souter[%d] = r%d", target(a0), a1, a2)
+	case OpGetOuter:
+		return fmt.Sprintf("r%d = outer[%d]", a0, a1)
+	case OpNewObj:
+		switch a3 {
+		case NewObjTable:
+			return fmt.Sprintf("r%d = table, size %d", a0, a1)
+		case NewObjArray:
+			return fmt.Sprintf("r%d = array, size %d", a0, a1)
+		case NewObjClass:
+			s := fmt.Sprintf("r%d = class", a0)
+			if a1 != -1 {
+				s += fmt.Sprintf(" extends r%d", a1)
+			}
+			if a2 != MaxFuncStackSize {
+				s += fmt.Sprintf(", attributes r%d", a2)
+			}
+			return s
+		}
+	case OpAppendArray:
+		var val string
+		switch a2 {
+		case AppendStack:
+			val = reg(a1)
+		case AppendLiteral:
+			val = lit(a1)
+		case AppendInt:
+			val = fmt.Sprint(i.Arg1)
+		case AppendFloat:
+			val = float(i.Arg1)
+		case AppendBool:
+			val = fmt.Sprint(a1 != 0)
+		}
+		return fmt.Sprintf("r%d.append(%s)", a0, val)
+	case OpCompArith:
+		return fmt.Sprintf("r%d = r%d[r%d] %c= r%d", a0, uint32(i.Arg1)>>16, a2, rune(a3), i.Arg1&0xFFFF)
+	case OpInc:
+		return fmt.Sprintf("r%d = r%d[r%d] += %d", a0, a1, a2, int8(i.Arg3))
+	case OpPInc:
+		return fmt.Sprintf("r%d = r%d[r%d]++ by %d", a0, a1, a2, int8(i.Arg3))
+	case OpIncL:
+		return fmt.Sprintf("r%d = r%d += %d", a0, a1, int8(i.Arg3))
+	case OpPIncL:
+		return fmt.Sprintf("r%d = r%d++ by %d", a0, a1, int8(i.Arg3))
+	case OpCmp:
+		return fmt.Sprintf("r%d = r%d %s r%d", a0, a2, cmpOpString(a3), a1)
+	case OpExists:
+		return fmt.Sprintf("r%d = r%d in r%d", a0, a2, a1)
+	case OpInstanceOf:
+		return fmt.Sprintf("r%d = r%d instanceof r%d", a0, a2, a1)
+	case OpAnd:
+		return fmt.Sprintf("if !r%d { r%d = r%d, jump to %s }", a2, a0, a2, jump(a1))
+	case OpOr:
+		return fmt.Sprintf("if r%d { r%d = r%d, jump to %s }", a2, a0, a2, jump(a1))
+	case OpNeg:
+		return fmt.Sprintf("r%d = -r%d", a0, a1)
+	case OpNot:
+		return fmt.Sprintf("r%d = !r%d", a0, a1)
+	case OpBWNot:
+		return fmt.Sprintf("r%d = ~r%d", a0, a1)
+	case OpClosure:
+		name := "?"
+		if a1 >= 0 && a1 < len(p.Functions) {
+			if name = p.Functions[a1].Name; name == "" {
+				name = "(anonymous)"
+			}
+		}
+		return fmt.Sprintf("r%d = closure of function %d, %s", a0, a1, name)
+	case OpYield:
+		if a1 == MaxFuncStackSize {
+			return "yield"
+		}
+		return fmt.Sprintf("yield r%d", a1)
+	case OpResume:
+		return fmt.Sprintf("r%d = resume r%d", a0, a1)
+	case OpForeach:
+		return fmt.Sprintf("foreach in r%d, key r%d, value r%d, exit to %s", a0, a2, a2+1, jump(a1))
+	case OpPostForeach:
+		return fmt.Sprintf("if generator r%d is dead jump to %s", a0, jump(a1-1))
+	case OpClone:
+		return fmt.Sprintf("r%d = clone r%d", a0, a1)
+	case OpTypeOf:
+		return fmt.Sprintf("r%d = typeof r%d", a0, a1)
+	case OpPushTrap:
+		return fmt.Sprintf("trap to %s, exception in r%d", jump(a1), a0)
+	case OpPopTrap:
+		return fmt.Sprintf("pop %d traps", a0)
+	case OpThrow:
+		return fmt.Sprintf("throw r%d", a0)
+	case OpNewSlotA:
+		var flags []string
+		if a0&NewSlotAttributes != 0 {
+			flags = append(flags, fmt.Sprintf("attributes r%d", a2-1))
+		}
+		if a0&NewSlotStatic != 0 {
+			flags = append(flags, "static")
+		}
+		s := fmt.Sprintf("r%d[r%d] <- r%d", a1, a2, a3)
+		if len(flags) > 0 {
+			s += ", " + strings.Join(flags, ", ")
+		}
+		return s
+	case OpGetBase:
+		return fmt.Sprintf("r%d = base", a0)
+	case OpClose:
+		return fmt.Sprintf("close outers from r%d", a1)
+	}
+	return ""
+}
+
+func bitwOpString(op int) string {
+	switch op {
+	case BitwAnd:
+		return "&"
+	case BitwOr:
+		return "|"
+	case BitwXor:
+		return "^"
+	case BitwShiftLeft:
+		return "<<"
+	case BitwShiftRight:
+		return ">>"
+	case BitwUShiftRight:
+		return ">>>"
+	}
+	return "?"
+}
+
+func cmpOpString(op int) string {
+	switch op {
+	case CmpGreater:
+		return ">"
+	case CmpGreaterEqual:
+		return ">="
+	case CmpLess:
+		return "<"
+	case CmpLessEqual:
+		return "<="
+	case Cmp3Way:
+		return "<=>"
+	}
+	return "?"
+}
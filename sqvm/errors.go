@@ -0,0 +1,90 @@
+package sqvm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error is returned by the API when a script raised an error. Value holds
+// the thrown object, which does not have to be a string. Err is the cause
+// of the errors the host made the VM raise, such as the cancellation of
+// the context of CallContext.
+type Error struct {
+	Value Object
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Value.typ == TypeString {
+		return e.Value.Str()
+	}
+	return e.Value.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// errThrown means that the thrown object is stored in vm.lastError.
+	errThrown = errors.New("sqvm: error thrown")
+	// errNoSlot is a failed lookup, also stored in vm.lastError unless
+	// the caller asked not to raise it.
+	errNoSlot = errors.New("sqvm: slot does not exist")
+	// errSuspended is returned by natives that suspend the vm.
+	errSuspended = errors.New("sqvm: vm suspended")
+)
+
+func (vm *VM) raise(format string, args ...any) error {
+	assign(&vm.lastError, StringValue(fmt.Sprintf(format, args...)))
+	return errThrown
+}
+
+func (vm *VM) raiseObject(o Object) error {
+	assign(&vm.lastError, o)
+	return errThrown
+}
+
+// raiseNative turns an error returned by a native function into a thrown
+// object.
+func (vm *VM) raiseNative(err error) error {
+	if err == errThrown || err == errNoSlot {
+		return errThrown
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return vm.raiseObject(e.Value)
+	}
+	return vm.raise("%s", err.Error())
+}
+
+func (vm *VM) raiseIdxError(key Object, flags int) error {
+	if flags&getNoError != 0 {
+		return errNoSlot
+	}
+	if key.typ == TypeString {
+		assign(&vm.lastError, StringValue(fmt.Sprintf("the index '%s' does not exist", key.Str())))
+	} else {
+		assign(&vm.lastError, StringValue(fmt.Sprintf("the index '%s' does not exist", vm.printObjVal(key))))
+	}
+	return errNoSlot
+}
+
+func (vm *VM) raiseParamTypeError(n int, mask typeMask, t ObjectType) error {
+	var names []string
+	for i := TypeNull; i <= TypeOuter; i++ {
+		if mask.has(i) {
+			names = append(names, i.String())
+		}
+	}
+	return vm.raise("parameter %d has an invalid type '%s' ; expected: '%s'", n, t, strings.Join(names, "|"))
+}
+
+// apiError converts an internal error into the one returned to Go code.
+func (vm *VM) apiError(err error) error {
+	if err == errThrown || err == errNoSlot {
+		return &Error{Value: vm.lastError}
+	}
+	return err
+}
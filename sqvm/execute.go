@@ -0,0 +1,920 @@
+package sqvm
+
+import (
+	"math"
+)
+
+const (
+	maxNativeCalls   = 100
+	minStackOverhead = 15
+)
+
+type callInfo struct {
+	ip            int
+	literals      []Object
+	closure       Object
+	generator     *generator
+	traps         int
+	prevStackBase int
+	prevTop       int
+	target        int
+	nCalls        int
+	root          bool
+	// returnThis makes constructor calls evaluate to the new instance
+	returnThis bool
+}
+
+// clear drops the references of a frame that is left.
+func (ci *callInfo) clear() {
+	assign(&ci.closure, Null)
+	if ci.generator != nil {
+		ci.generator.decRef()
+		ci.generator = nil
+	}
+}
+
+type exceptionTrap struct {
+	top       int
+	stackBase int
+	ip        int
+	exTarget  int
+}
+
+func (vm *VM) enterFrame(newBase, newTop int, tailCall bool) error {
+	if vm.ss.done != nil {
+		if err := vm.checkContext(); err != nil {
+			return err
+		}
+	}
+	if !tailCall {
+		if max := vm.ss.limits.MaxCallDepth; max > 0 && len(vm.callStack) >= max {
+			return vm.raise("stack overflow")
+		}
+		// call infos are reused so that pointers to them stay valid
+		n := len(vm.callStack)
+		if n < cap(vm.callStack) {
+			vm.callStack = vm.callStack[:n+1]
+		} else {
+			vm.callStack = append(vm.callStack, nil)
+		}
+		if vm.callStack[n] == nil {
+			vm.callStack[n] = &callInfo{}
+		}
+		vm.ci = vm.callStack[n]
+		*vm.ci = callInfo{
+			prevStackBase: newBase - vm.stackBase,
+			prevTop:       vm.top - vm.stackBase,
+			nCalls:        1,
+		}
+	} else {
+		vm.ci.nCalls++
+	}
+
+	vm.stackBase = newBase
+	vm.top = newTop
+	if newTop+minStackOverhead > len(vm.stack) {
+		vm.growStack(newTop + minStackOverhead<<2)
+	}
+	return nil
+}
+
+func (vm *VM) leaveFrame() {
+	lastTop := vm.top
+	lastStackBase := vm.stackBase
+
+	vm.stackBase -= vm.ci.prevStackBase
+	vm.top = vm.stackBase + vm.ci.prevTop
+	vm.ci.clear()
+	vm.callStack = vm.callStack[:len(vm.callStack)-1]
+	if len(vm.callStack) > 0 {
+		vm.ci = vm.callStack[len(vm.callStack)-1]
+	} else {
+		vm.ci = nil
+	}
+
+	if vm.openOuters != nil {
+		vm.closeOuters(lastStackBase)
+	}
+	// the frame can overlap the temporaries of the caller, clear it
+	// whole so that its locals can be released
+	bottom := vm.top
+	if lastStackBase < bottom {
+		bottom = lastStackBase
+	}
+	for ; lastTop >= bottom; lastTop-- {
+		clearSlot(&vm.stack[lastTop])
+	}
+}
+
+// growStack makes room for size slots, at least doubling the stack so
+// that deep recursions don't copy it at every call.
+func (vm *VM) growStack(size int) {
+	if size <= len(vm.stack) {
+		return
+	}
+	if size < 2*len(vm.stack) {
+		size = 2 * len(vm.stack)
+	}
+	stack := make([]Object, size)
+	copy(stack, vm.stack)
+	vm.stack = stack
+}
+
+func (vm *VM) startCall(clo Object, target, nArgs, stackBase int, tailCall bool) error {
+	c := clo.closure()
+	proto := c.proto
+
+	paramsSize := len(proto.Parameters)
+	newTop := stackBase + proto.StackSize
+	if proto.VarParams {
+		paramsSize--
+		if nArgs < paramsSize {
+			return vm.raise("wrong number of parameters")
+		}
+		nVarArgs := nArgs - paramsSize
+		if stackBase+paramsSize+nVarArgs+1 > len(vm.stack) {
+			vm.growStack(stackBase + paramsSize + nVarArgs + minStackOverhead)
+		}
+		vargv := newArray(nVarArgs)
+		pbase := stackBase + paramsSize
+		for n := 0; n < nVarArgs; n++ {
+			vargv.values[n] = vm.stack[pbase]
+			incRef(vargv.values[n])
+			assign(&vm.stack[pbase], Null)
+			pbase++
+		}
+		assign(&vm.stack[stackBase+paramsSize], vm.ss.newObject(TypeArray, vargv))
+	} else if paramsSize != nArgs {
+		nDef := len(proto.DefaultParams)
+		diff := paramsSize - nArgs
+		if nDef == 0 || nArgs > paramsSize || diff > nDef {
+			return vm.raise("wrong number of parameters")
+		}
+		for n := nDef - diff; n < nDef; n++ {
+			assign(&vm.stack[stackBase+nArgs], c.defaultParams[n])
+			nArgs++
+		}
+	}
+
+	if !c.env.IsNull() {
+		assign(&vm.stack[stackBase], realVal(c.env))
+	}
+
+	if err := vm.enterFrame(stackBase, newTop, tailCall); err != nil {
+		return err
+	}
+	assign(&vm.ci.closure, clo)
+	vm.ci.literals = proto.Literals
+	vm.ci.ip = 0
+	vm.ci.target = target
+	if vm.debugHooked {
+		vm.callDebugHook(DebugCall, 0)
+	}
+
+	if proto.IsGenerator {
+		gen := newGenerator(clo)
+		genObj := vm.ss.newObject(TypeGenerator, gen)
+		if err := gen.yield(vm, proto.StackSize); err != nil {
+			return err
+		}
+		vm.leaveFrame()
+		if target >= 0 {
+			assign(&vm.stack[vm.stackBase+target], genObj)
+		}
+	}
+	return nil
+}
+
+// ret pops the current frame and stores the value in stack slot src into
+// the target of the call. It reports whether the frame was the root one,
+// whose result is returned to the Go caller instead.
+func (vm *VM) ret(hasValue bool, src int) (Object, bool) {
+	if vm.debugHooked {
+		for n := 0; n < vm.ci.nCalls; n++ {
+			vm.callDebugHook(DebugReturn, 0)
+		}
+	}
+	isRoot := vm.ci.root
+	callerBase := vm.stackBase - vm.ci.prevStackBase
+
+	var val Object
+	if hasValue {
+		val = vm.stack[vm.stackBase+src]
+	}
+	if vm.ci.returnThis {
+		val = vm.stack[vm.stackBase]
+	}
+	target := vm.ci.target
+	vm.leaveFrame()
+	if !isRoot && target >= 0 {
+		assign(&vm.stack[callerBase+target], val)
+	}
+	return val, isRoot
+}
+
+func (vm *VM) findOuter(idx int) *outer {
+	pp := &vm.openOuters
+	for p := *pp; p != nil && p.idx >= idx; p = *pp {
+		if p.idx == idx {
+			return p
+		}
+		pp = &p.next
+	}
+	o := &outer{vm: vm, idx: idx, open: true, next: *pp}
+	vm.ss.newObject(TypeOuter, o)
+	*pp = o
+	return o
+}
+
+// unlinkOuter removes an open outer that is being released.
+func (vm *VM) unlinkOuter(o *outer) {
+	for pp := &vm.openOuters; *pp != nil; pp = &(*pp).next {
+		if *pp == o {
+			*pp = o.next
+			o.next = nil
+			return
+		}
+	}
+}
+
+// closeOuters detaches all outers referring to stack slots at or above idx.
+func (vm *VM) closeOuters(idx int) {
+	for p := vm.openOuters; p != nil && p.idx >= idx; p = vm.openOuters {
+		p.value = vm.stack[p.idx]
+		incRef(p.value)
+		p.open = false
+		p.vm = nil
+		vm.openOuters = p.next
+		p.next = nil
+	}
+}
+
+func (vm *VM) newClosureOp(proto *FuncProto) Object {
+	c := newClosure(proto, vm.rootTable)
+	cur := vm.ci.closure.closure()
+	for i, ov := range proto.OuterValues {
+		switch ov.Type {
+		case OuterLocal:
+			c.outers[i] = vm.findOuter(vm.stackBase + ov.Src)
+		case OuterOuter:
+			c.outers[i] = cur.outers[ov.Src]
+		}
+		c.outers[i].incRef()
+	}
+	for i, pos := range proto.DefaultParams {
+		c.defaultParams[i] = vm.stack[vm.stackBase+pos]
+		incRef(c.defaultParams[i])
+	}
+	return vm.ss.newObject(TypeClosure, c)
+}
+
+// execute runs a script closure whose arguments are on the stack starting
+// at stackBase.
+func (vm *VM) execute(clo Object, nArgs, stackBase int, raiseError bool) (Object, error) {
+	if vm.nNativeCalls+1 > maxNativeCalls {
+		return Null, vm.raise("Native stack overflow")
+	}
+	vm.nNativeCalls++
+	vm.ss.nesting++
+	defer func() {
+		vm.nNativeCalls--
+		vm.ss.nesting--
+	}()
+
+	traps := 0
+	prevDepth := len(vm.callStack)
+	if err := vm.startCall(clo, stackBase-vm.stackBase, nArgs, stackBase, false); err != nil {
+		if vm.ci == nil {
+			vm.callErrorHandler(vm.lastError)
+		}
+		return Null, err
+	}
+	if len(vm.callStack) == prevDepth {
+		// generator functions return straight away
+		return vm.stack[stackBase], nil
+	}
+	vm.ci.root = true
+	return vm.loop(&traps, raiseError, nil)
+}
+
+// resume continues the execution suspended by a native function,
+// throwing the last error at the point of suspension if throwError is
+// set.
+func (vm *VM) resume(raiseError, throwError bool) (Object, error) {
+	if vm.nNativeCalls+1 > maxNativeCalls {
+		return Null, vm.raise("Native stack overflow")
+	}
+	vm.ss.startBudget()
+	vm.nNativeCalls++
+	vm.ss.nesting++
+	defer func() {
+		vm.nNativeCalls--
+		vm.ss.nesting--
+	}()
+
+	vm.suspended = false
+	traps := vm.suspendedTraps
+	var err error
+	if throwError {
+		err = errThrown
+	}
+	return vm.loop(&traps, raiseError, err)
+}
+
+// loop runs frames until the root frame of the execute call returns, the
+// code is suspended or an error is not caught. A non nil err is handled
+// as if run had raised it.
+func (vm *VM) loop(traps *int, raiseError bool, err error) (Object, error) {
+	for {
+		var res Object
+		if err == nil {
+			res, err = vm.run(traps)
+		}
+		switch {
+		case err == nil:
+			return res, nil
+		case err == errSuspended:
+			vm.suspended = true
+			vm.suspendedTraps = *traps
+			res = vm.suspendedValue
+			assign(&vm.suspendedValue, Null)
+			return res, nil
+		case !vm.unwind(traps, raiseError):
+			return Null, err
+		}
+		err = nil
+	}
+}
+
+// unwind looks for an exception trap in the frames run by the current
+// execute call, popping frames that have none. It reports whether
+// execution can continue at a trap.
+func (vm *VM) unwind(traps *int, raiseError bool) bool {
+	currError := vm.lastError
+	lastTop := vm.top
+
+	if *traps == 0 && raiseError {
+		vm.callErrorHandler(currError)
+	}
+
+	for vm.ci != nil {
+		if vm.ci.traps > 0 {
+			et := vm.traps[len(vm.traps)-1]
+			vm.traps = vm.traps[:len(vm.traps)-1]
+			vm.ci.ip = et.ip
+			vm.top = et.top
+			vm.stackBase = et.stackBase
+			assign(&vm.stack[vm.stackBase+et.exTarget], currError)
+			*traps--
+			vm.ci.traps--
+			for ; lastTop >= vm.top; lastTop-- {
+				clearSlot(&vm.stack[lastTop])
+			}
+			return true
+		}
+		if vm.ci.generator != nil {
+			vm.ci.generator.kill()
+		}
+		mustBreak := vm.ci.root
+		vm.leaveFrame()
+		if mustBreak {
+			break
+		}
+	}
+
+	assign(&vm.lastError, currError)
+	return false
+}
+
+func (vm *VM) run(traps *int) (Object, error) {
+	ss := vm.ss
+	for {
+		if len(ss.zeroRefs) > 0 || len(ss.fresh) > ss.freshKept {
+			ss.releaseDropped()
+		}
+		ci := vm.ci
+		proto := ci.closure.closure().proto
+		i := proto.Instructions[ci.ip]
+		ci.ip++
+		if vm.ss.limited {
+			if err := vm.checkBudget(); err != nil {
+				return Null, err
+			}
+		}
+
+		base := vm.stackBase
+		arg0 := int(i.Arg0)
+		arg1 := int(i.Arg1)
+		arg2 := int(i.Arg2)
+		arg3 := int(i.Arg3)
+		tgt := base + arg0
+
+		switch i.Op {
+		case OpLine:
+			if vm.debugHooked {
+				vm.callDebugHook(DebugLine, arg1)
+			}
+		case OpLoad:
+			assign(&vm.stack[tgt], ci.literals[arg1])
+		case OpLoadInt:
+			assign(&vm.stack[tgt], IntegerValue(int64(i.Arg1)))
+		case OpLoadFloat:
+			assign(&vm.stack[tgt], FloatValue(float64(math.Float32frombits(uint32(i.Arg1)))))
+		case OpDLoad:
+			assign(&vm.stack[tgt], ci.literals[arg1])
+			assign(&vm.stack[base+arg2], ci.literals[arg3])
+		case OpTailCall:
+			clo := vm.stack[base+arg1]
+			if clo.typ == TypeClosure && !clo.closure().proto.IsGenerator && !ci.returnThis {
+				lastTop := vm.top
+				if vm.openOuters != nil {
+					vm.closeOuters(base)
+				}
+				for n := 0; n < arg3; n++ {
+					assign(&vm.stack[base+n], vm.stack[base+arg2+n])
+				}
+				if err := vm.startCall(clo, ci.target, arg3, base, true); err != nil {
+					return Null, err
+				}
+				if lastTop >= vm.top {
+					vm.top = lastTop
+				}
+				continue
+			}
+			fallthrough
+		case OpCall:
+			if err := vm.callOp(vm.stack[base+arg1], int(int8(i.Arg0)), arg3, base+arg2); err != nil {
+				return Null, err
+			}
+		case OpPrepCall, OpPrepCallK:
+			var key Object
+			if i.Op == OpPrepCallK {
+				key = ci.literals[arg1]
+			} else {
+				key = vm.stack[base+arg1]
+			}
+			self := vm.stack[base+arg2]
+			val, err := vm.get(self, key, 0, arg2)
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg3], self)
+			assign(&vm.stack[base+arg0], val)
+		case OpGetK:
+			val, err := vm.get(vm.stack[base+arg2], ci.literals[arg1], 0, arg2)
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], val)
+		case OpMove:
+			assign(&vm.stack[tgt], vm.stack[base+arg1])
+		case OpNewSlot:
+			if err := vm.newSlot(vm.stack[base+arg1], vm.stack[base+arg2], vm.stack[base+arg3], false); err != nil {
+				return Null, err
+			}
+			if arg0 != MaxFuncStackSize {
+				assign(&vm.stack[base+arg0], vm.stack[base+arg3])
+			}
+		case OpDelete:
+			val, err := vm.deleteSlot(vm.stack[base+arg1], vm.stack[base+arg2])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], val)
+		case OpSet:
+			if err := vm.set(vm.stack[base+arg1], vm.stack[base+arg2], vm.stack[base+arg3], arg1); err != nil {
+				return Null, err
+			}
+			if arg0 != MaxFuncStackSize {
+				assign(&vm.stack[base+arg0], vm.stack[base+arg3])
+			}
+		case OpGet:
+			val, err := vm.get(vm.stack[base+arg1], vm.stack[base+arg2], 0, arg1)
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], val)
+		case OpEq, OpNe:
+			var other Object
+			if arg3 != 0 {
+				other = ci.literals[arg1]
+			} else {
+				other = vm.stack[base+arg1]
+			}
+			res := isEqual(vm.stack[base+arg2], other)
+			assign(&vm.stack[tgt], BoolValue(res == (i.Op == OpEq)))
+		case OpAdd, OpSub, OpMul, OpDiv, OpMod:
+			val, err := vm.arith(arithOps[i.Op-OpAdd], vm.stack[base+arg2], vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], val)
+		case OpBitW:
+			val, err := vm.bitwise(arg3, vm.stack[base+arg2], vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[tgt], val)
+		case OpReturn:
+			if ci.generator != nil {
+				ci.generator.kill()
+			}
+			if res, isRoot := vm.ret(arg0 != MaxFuncStackSize, arg1); isRoot {
+				return res, nil
+			}
+		case OpLoadNulls:
+			for n := 0; n < arg1; n++ {
+				assign(&vm.stack[base+arg0+n], Null)
+			}
+		case OpLoadRoot:
+			if root := ci.closure.closure().root; !root.IsNull() {
+				assign(&vm.stack[tgt], root)
+			} else {
+				assign(&vm.stack[tgt], vm.rootTable)
+			}
+		case OpLoadBool:
+			assign(&vm.stack[tgt], BoolValue(arg1 != 0))
+		case OpDMove:
+			assign(&vm.stack[base+arg0], vm.stack[base+arg1])
+			assign(&vm.stack[base+arg2], vm.stack[base+arg3])
+		case OpJmp:
+			ci.ip += arg1
+			if arg1 < 0 {
+				if vm.ss.done != nil {
+					if err := vm.checkContext(); err != nil {
+						return Null, err
+					}
+				}
+			}
+		case OpJCmp:
+			res, err := vm.cmpOp(arg3, vm.stack[base+arg2], vm.stack[base+arg0])
+			if err != nil {
+				return Null, err
+			}
+			if res.isFalse() {
+				ci.ip += arg1
+			}
+		case OpJz:
+			if vm.stack[tgt].isFalse() {
+				ci.ip += arg1
+			}
+		case OpGetOuter:
+			assign(&vm.stack[tgt], ci.closure.closure().outers[arg1].get())
+		case OpSetOuter:
+			ci.closure.closure().outers[arg1].set(vm.stack[base+arg2])
+			if arg0 != MaxFuncStackSize {
+				assign(&vm.stack[base+arg0], vm.stack[base+arg2])
+			}
+		case OpNewObj:
+			switch arg3 {
+			case NewObjTable:
+				assign(&vm.stack[tgt], vm.ss.newObject(TypeTable, newTable(arg1)))
+			case NewObjArray:
+				a := newArray(0)
+				a.values = make([]Object, 0, arg1)
+				assign(&vm.stack[tgt], vm.ss.newObject(TypeArray, a))
+			case NewObjClass:
+				c, err := vm.classOp(int(i.Arg1), arg2)
+				if err != nil {
+					return Null, err
+				}
+				assign(&vm.stack[base+arg0], c)
+			}
+		case OpAppendArray:
+			var val Object
+			switch arg2 {
+			case AppendStack:
+				val = vm.stack[base+arg1]
+			case AppendLiteral:
+				val = ci.literals[arg1]
+			case AppendInt:
+				val = IntegerValue(int64(i.Arg1))
+			case AppendFloat:
+				val = FloatValue(float64(math.Float32frombits(uint32(i.Arg1))))
+			case AppendBool:
+				val = BoolValue(arg1 != 0)
+			}
+			vm.stack[tgt].array().append(val)
+		case OpCompArith:
+			selfIdx := int(uint32(i.Arg1) >> 16)
+			val := vm.stack[base+int(i.Arg1&0xFFFF)]
+			res, err := vm.derefInc(byte(arg3), vm.stack[base+selfIdx], vm.stack[base+arg2], val, false, selfIdx)
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpInc, OpPInc:
+			incr := IntegerValue(int64(int8(i.Arg3)))
+			res, err := vm.derefInc('+', vm.stack[base+arg1], vm.stack[base+arg2], incr, i.Op == OpPInc, arg1)
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpIncL:
+			a := &vm.stack[base+arg1]
+			if a.typ == TypeInteger {
+				*a = IntegerValue(a.Integer() + int64(int8(i.Arg3)))
+			} else {
+				res, err := vm.arith('+', *a, IntegerValue(int64(int8(i.Arg3))))
+				if err != nil {
+					return Null, err
+				}
+				assign(&vm.stack[base+arg1], res)
+			}
+			assign(&vm.stack[base+arg0], vm.stack[base+arg1])
+		case OpPIncL:
+			a := vm.stack[base+arg1]
+			if a.typ == TypeInteger {
+				assign(&vm.stack[base+arg0], a)
+				assign(&vm.stack[base+arg1], IntegerValue(a.Integer()+int64(int8(i.Arg3))))
+			} else {
+				res, err := vm.arith('+', a, IntegerValue(int64(int8(i.Arg3))))
+				if err != nil {
+					return Null, err
+				}
+				assign(&vm.stack[base+arg0], a)
+				assign(&vm.stack[base+arg1], res)
+			}
+		case OpCmp:
+			res, err := vm.cmpOp(arg3, vm.stack[base+arg2], vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpExists:
+			_, err := vm.get(vm.stack[base+arg1], vm.stack[base+arg2], getRaw|getNoError, dontFallBack)
+			assign(&vm.stack[tgt], BoolValue(err == nil))
+		case OpInstanceOf:
+			cls, inst := vm.stack[base+arg1], vm.stack[base+arg2]
+			if cls.typ != TypeClass {
+				return Null, vm.raise("cannot apply instanceof between a %s and a %s", cls.typ, inst.typ)
+			}
+			assign(&vm.stack[tgt], BoolValue(inst.typ == TypeInstance && inst.instance().instanceOf(cls.class())))
+		case OpAnd:
+			if val := vm.stack[base+arg2]; val.isFalse() {
+				assign(&vm.stack[tgt], val)
+				ci.ip += arg1
+			}
+		case OpOr:
+			if val := vm.stack[base+arg2]; !val.isFalse() {
+				assign(&vm.stack[tgt], val)
+				ci.ip += arg1
+			}
+		case OpNeg:
+			res, err := vm.negOp(vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpNot:
+			assign(&vm.stack[tgt], BoolValue(vm.stack[base+arg1].isFalse()))
+		case OpBWNot:
+			val := vm.stack[base+arg1]
+			if val.typ != TypeInteger {
+				return Null, vm.raise("attempt to perform a bitwise op on a %s", val.typ)
+			}
+			assign(&vm.stack[tgt], IntegerValue(^val.Integer()))
+		case OpClosure:
+			assign(&vm.stack[tgt], vm.newClosureOp(proto.Functions[arg1]))
+		case OpYield:
+			if ci.generator == nil {
+				return Null, vm.raise("trying to yield a '%s',only genenerator can be yielded", TypeNull)
+			}
+			var val Object
+			if arg1 != MaxFuncStackSize {
+				val = vm.stack[base+arg1]
+			}
+			if vm.openOuters != nil {
+				vm.closeOuters(base)
+			}
+			if err := ci.generator.yield(vm, arg2); err != nil {
+				return Null, err
+			}
+			*traps -= ci.traps
+			if arg1 != MaxFuncStackSize {
+				assign(&vm.stack[base+arg1], val)
+			}
+			if res, isRoot := vm.ret(arg0 != MaxFuncStackSize, arg1); isRoot {
+				return res, nil
+			}
+		case OpResume:
+			gen := vm.stack[base+arg1]
+			if gen.typ != TypeGenerator {
+				return Null, vm.raise("trying to resume a '%s',only genenerator can be resumed", gen.typ)
+			}
+			if err := gen.generator().resume(vm, arg0); err != nil {
+				return Null, err
+			}
+			*traps += vm.ci.traps
+		case OpForeach:
+			jump, err := vm.foreachOp(arg0, arg2, arg1)
+			if err != nil {
+				return Null, err
+			}
+			ci.ip += jump
+		case OpPostForeach:
+			if vm.stack[base+arg0].generator().state == generatorDead {
+				ci.ip += arg1 - 1
+			}
+		case OpClone:
+			res, err := vm.clone(vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpTypeOf:
+			res, err := vm.typeOf(vm.stack[base+arg1])
+			if err != nil {
+				return Null, err
+			}
+			assign(&vm.stack[base+arg0], res)
+		case OpPushTrap:
+			vm.traps = append(vm.traps, exceptionTrap{
+				top:       vm.top,
+				stackBase: base,
+				ip:        ci.ip + arg1,
+				exTarget:  arg0,
+			})
+			*traps++
+			ci.traps++
+		case OpPopTrap:
+			for n := 0; n < arg0; n++ {
+				vm.traps = vm.traps[:len(vm.traps)-1]
+				*traps--
+				ci.traps--
+			}
+		case OpThrow:
+			return Null, vm.raiseObject(vm.stack[tgt])
+		case OpNewSlotA:
+			var attrs Object
+			if arg0&NewSlotAttributes != 0 {
+				attrs = vm.stack[base+arg2-1]
+			}
+			err := vm.newSlotA(vm.stack[base+arg1], vm.stack[base+arg2], vm.stack[base+arg3], attrs, arg0&NewSlotStatic != 0, false)
+			if err != nil {
+				return Null, err
+			}
+		case OpGetBase:
+			if b := ci.closure.closure().base; b != nil {
+				assign(&vm.stack[tgt], makeObject(TypeClass, b))
+			} else {
+				assign(&vm.stack[tgt], Null)
+			}
+		case OpClose:
+			if vm.openOuters != nil {
+				vm.closeOuters(base + arg1)
+			}
+		default:
+			return Null, vm.raise("internal vm error, unknown opcode %d", i.Op)
+		}
+	}
+}
+
+var arithOps = [...]byte{'+', '-', '*', '/', '%'}
+
+// callOp performs a call from script code, the callee is a value taken
+// from the stack and the arguments start at stackBase.
+func (vm *VM) callOp(clo Object, target, nArgs, stackBase int) error {
+	switch clo.typ {
+	case TypeClosure:
+		return vm.startCall(clo, target, nArgs, stackBase, false)
+	case TypeNativeClosure:
+		res, err := vm.callNative(clo, nArgs, stackBase, target)
+		if err != nil {
+			return err
+		}
+		if target != -1 {
+			assign(&vm.stack[vm.stackBase+target], res)
+		}
+		return nil
+	case TypeClass:
+		inst, ctor := vm.createClassInstance(clo.class())
+		switch ctor.typ {
+		case TypeClosure:
+			assign(&vm.stack[stackBase], inst)
+			depth := len(vm.callStack)
+			if err := vm.startCall(ctor, target, nArgs, stackBase, false); err != nil {
+				return err
+			}
+			if len(vm.callStack) > depth {
+				vm.ci.returnThis = true
+			}
+			return nil
+		case TypeNativeClosure:
+			assign(&vm.stack[stackBase], inst)
+			if _, err := vm.callNative(ctor, nArgs, stackBase, -1); err != nil {
+				return err
+			}
+		}
+		if target != -1 {
+			assign(&vm.stack[vm.stackBase+target], inst)
+		}
+		return nil
+	case TypeTable, TypeUserData, TypeInstance:
+		if mm, ok := vm.getMetaMethod(clo, mmCall); ok {
+			vm.push(clo)
+			for n := 0; n < nArgs; n++ {
+				vm.push(vm.stack[stackBase+n])
+			}
+			res, err := vm.callMetaMethod(mm, nArgs+1)
+			if err != nil {
+				return err
+			}
+			if target != -1 {
+				assign(&vm.stack[vm.stackBase+target], res)
+			}
+			return nil
+		}
+	}
+	return vm.raise("attempt to call '%s'", clo.typ)
+}
+
+func (vm *VM) callNative(clo Object, nArgs, newBase, target int) (Object, error) {
+	nc := clo.nativeClosure()
+	newTop := newBase + nArgs + len(nc.outers)
+
+	if vm.nNativeCalls+1 > maxNativeCalls {
+		return Null, vm.raise("Native stack overflow")
+	}
+
+	if nc.paramsCheck > 0 && nc.paramsCheck != nArgs ||
+		nc.paramsCheck < 0 && nArgs < -nc.paramsCheck {
+		return Null, vm.raise("wrong number of parameters")
+	}
+
+	for n := 0; n < nArgs && n < len(nc.typeCheck); n++ {
+		mask := nc.typeCheck[n]
+		if t := vm.stack[newBase+n].typ; mask != typeMaskAny && !mask.has(t) {
+			return Null, vm.raiseParamTypeError(n, mask, t)
+		}
+	}
+
+	if err := vm.enterFrame(newBase, newTop, false); err != nil {
+		return Null, err
+	}
+	assign(&vm.ci.closure, clo)
+	vm.ci.target = target
+
+	for n, o := range nc.outers {
+		assign(&vm.stack[newBase+nArgs+n], o)
+	}
+	if !nc.env.IsNull() {
+		assign(&vm.stack[newBase], realVal(nc.env))
+	}
+
+	vm.nNativeCalls++
+	vm.ss.nesting++
+	ret, err := nc.fn(vm)
+	vm.nNativeCalls--
+	vm.ss.nesting--
+
+	if err == errSuspended {
+		if ret > 0 {
+			assign(&vm.suspendedValue, vm.stack[vm.top-1])
+		}
+		vm.suspendedTarget = target
+		vm.leaveFrame()
+		return Null, err
+	}
+	if err != nil {
+		vm.leaveFrame()
+		return Null, vm.raiseNative(err)
+	}
+	var res Object
+	if ret > 0 {
+		res = vm.stack[vm.top-1]
+	}
+	vm.leaveFrame()
+	return res, nil
+}
+
+// call runs any callable object with the arguments already on the stack.
+func (vm *VM) call(clo Object, nArgs, stackBase int, raiseError bool) (Object, error) {
+	vm.ss.startBudget()
+	switch clo.typ {
+	case TypeClosure:
+		return vm.execute(clo, nArgs, stackBase, raiseError)
+	case TypeNativeClosure:
+		return vm.callNative(clo, nArgs, stackBase, -1)
+	case TypeClass:
+		inst, ctor := vm.createClassInstance(clo.class())
+		if ctor.typ == TypeClosure || ctor.typ == TypeNativeClosure {
+			assign(&vm.stack[stackBase], inst)
+			if _, err := vm.call(ctor, nArgs, stackBase, raiseError); err != nil {
+				return Null, err
+			}
+		}
+		return inst, nil
+	}
+	return Null, vm.raise("attempt to call '%s'", clo.typ)
+}
+
+func (vm *VM) callErrorHandler(err Object) {
+	if vm.errorHandler.IsNull() {
+		return
+	}
+	vm.push(vm.rootTable)
+	vm.push(err)
+	vm.call(vm.errorHandler, 2, vm.top-2, false)
+	vm.pop(2)
+}
@@ -0,0 +1,72 @@
+package sqvm
+
+// OuterType tells where a closure finds one of its outer values.
+type OuterType int
+
+const (
+	OuterLocal OuterType = iota // a local of the enclosing function
+	OuterOuter                  // an outer of the enclosing function
+)
+
+type OuterValue struct {
+	Type OuterType
+	Src  int // stack position or outer index
+	Name string
+}
+
+type LocalVarInfo struct {
+	Name    string
+	Pos     int
+	StartOp int
+	EndOp   int
+}
+
+type LineInfo struct {
+	Line int
+	Op   int
+}
+
+// FuncProto is a compiled function, shared by all closures created
+// from it.
+type FuncProto struct {
+	SourceName    string
+	Name          string // empty for anonymous functions
+	Literals      []Object
+	Parameters    []string
+	OuterValues   []OuterValue
+	LocalVarInfos []LocalVarInfo
+	LineInfos     []LineInfo
+	DefaultParams []int
+	Instructions  []Instruction
+	Functions     []*FuncProto
+	StackSize     int
+	IsGenerator   bool
+	VarParams     bool
+}
+
+// LineAt returns the source line of the instruction at pc.
+func (p *FuncProto) LineAt(pc int) int {
+	line := -1
+	if len(p.LineInfos) > 0 {
+		line = p.LineInfos[0].Line
+	}
+	for _, li := range p.LineInfos {
+		if li.Op > pc {
+			break
+		}
+		line = li.Line
+	}
+	return line
+}
+
+// LocalsAt returns the local variables alive at the instruction pc, in
+// the order of LocalVarInfos.
+func (p *FuncProto) LocalsAt(pc int) []LocalVarInfo {
+	var locals []LocalVarInfo
+	for _, lv := range p.LocalVarInfos {
+		if lv.StartOp <= pc && pc <= lv.EndOp {
+			locals = append(locals, lv)
+		}
+	}
+	return locals
+}
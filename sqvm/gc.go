@@ -0,0 +1,542 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// Object lifetime follows the reference implementation: heap objects are
+// reference counted so that they are released as soon as they become
+// unreachable, and a mark and sweep collector takes care of cycles.
+//
+// References held by heap objects, by the stack slots and call frames of
+// the VM and its threads and by the VM itself are counted. Go code of the
+// VM can still hold an object for the time of an instruction, so objects
+// whose count drops to zero are queued and released before the next
+// instruction runs, or by the API call that popped them when only the
+// host is running. Scripts called from native functions release them
+// too: natives have to keep the values they use on the stack, as with
+// the reference implementation.
+//
+// New objects have no references until they are stored. The ones that
+// never are, like the discarded result of a native function, are only
+// released when no native function is running, as the Go code that
+// created them may still use them.
+
+// ReleaseHook is called with the Go value attached to a userdata or an
+// instance when the object is released.
+type ReleaseHook func(up any)
+
+// gcHeader is embedded in every heap object shared with scripts.
+type gcHeader struct {
+	self       gcObject
+	ss         *sharedState // nil for objects internal to other objects
+	prev, next *gcHeader
+
+	refs     int
+	mark     uint32
+	queued   bool
+	released bool
+
+	weakRef *weakRef
+}
+
+func (h *gcHeader) header() *gcHeader {
+	return h
+}
+
+func (h *gcHeader) incRef() {
+	h.refs++
+}
+
+func (h *gcHeader) decRef() {
+	h.refs--
+	if h.refs == 0 && !h.queued && !h.released && h.ss != nil {
+		h.queued = true
+		h.ss.zeroRefs = append(h.ss.zeroRefs, h.self)
+	}
+}
+
+type gcObject interface {
+	header() *gcHeader
+	// traverse calls fn with every object referenced by the object.
+	traverse(fn func(gcObject))
+	// finalize drops the references held by the object.
+	finalize()
+}
+
+func gcOf(o Object) gcObject {
+	if !o.isRefCounted() {
+		return nil
+	}
+	g, _ := o.ref.(gcObject)
+	return g
+}
+
+func incRef(o Object) {
+	if g := gcOf(o); g != nil {
+		g.header().incRef()
+	}
+}
+
+func decRef(o Object) {
+	if g := gcOf(o); g != nil {
+		g.header().decRef()
+	}
+}
+
+// assign stores val in a counted slot. Plain values are stored directly,
+// the call stays cheap enough to be inlined.
+func assign(dst *Object, val Object) {
+	if (1<<uint(val.typ)|1<<uint(dst.typ))&^notRefCounted == 0 {
+		*dst = val
+		return
+	}
+	assignRef(dst, val)
+}
+
+// clearSlot nulls a counted slot.
+func clearSlot(dst *Object) {
+	if dst.isRefCounted() {
+		decRef(*dst)
+	}
+	*dst = Null
+}
+
+func assignRef(dst *Object, val Object) {
+	incRef(val)
+	old := *dst
+	*dst = val
+	decRef(old)
+}
+
+func visit(fn func(gcObject), o Object) {
+	if g := gcOf(o); g != nil {
+		fn(g)
+	}
+}
+
+func dropRef(g gcObject) {
+	g.header().decRef()
+}
+
+// newObject starts tracking a newly created heap object.
+func (ss *sharedState) newObject(typ ObjectType, g gcObject) Object {
+	h := g.header()
+	h.self = g
+	h.ss = ss
+	h.next = ss.gcChain
+	if ss.gcChain != nil {
+		ss.gcChain.prev = h
+	}
+	ss.gcChain = h
+	// nothing refers to it yet
+	ss.fresh = append(ss.fresh, g)
+	switch o := g.(type) {
+	case *array:
+		ss.charge(objectSize + len(o.values)*valueSize)
+	case *table:
+		ss.charge(objectSize + cap(o.nodes)*tableNodeSize)
+	default:
+		ss.charge(objectSize)
+	}
+	return makeObject(typ, g)
+}
+
+func (ss *sharedState) untrack(h *gcHeader) {
+	if h.prev != nil {
+		h.prev.next = h.next
+	} else {
+		ss.gcChain = h.next
+	}
+	if h.next != nil {
+		h.next.prev = h.prev
+	}
+	h.prev, h.next = nil, nil
+}
+
+func (ss *sharedState) release(g gcObject) {
+	h := g.header()
+	h.released = true
+	h.clearWeakRef()
+	ss.untrack(h)
+	g.finalize()
+}
+
+func (vm *VM) stackRefs(fn func(gcObject)) {
+	for _, o := range vm.stack[:vm.top] {
+		visit(fn, o)
+	}
+	for _, ci := range vm.callStack {
+		visit(fn, ci.closure)
+		if ci.generator != nil {
+			fn(ci.generator)
+		}
+	}
+	visit(fn, vm.lastError)
+	visit(fn, vm.suspendedValue)
+}
+
+// roots visits everything the collector starts marking from. Threads are
+// only marked when they are reachable.
+func (ss *sharedState) roots(fn func(gcObject)) {
+	ss.rootVM.traverse(fn)
+	visit(fn, ss.registry)
+	visit(fn, ss.consts)
+	for _, ref := range ss.refs {
+		visit(fn, ref.obj)
+	}
+	for _, d := range ss.defaultDelegates {
+		visit(fn, d)
+	}
+}
+
+// releaseDropped releases the objects that lost their last reference
+// and, unless a native function is running, the new objects that never
+// had one. Objects created during a native call are checked again once
+// there are twice as many as were kept the last time.
+func (ss *sharedState) releaseDropped() {
+	if ss.releasing {
+		// a release hook called the API, the outer call goes on
+		return
+	}
+	ss.releasing = true
+	defer func() {
+		ss.releasing = false
+	}()
+	if len(ss.fresh) > ss.freshKept && (ss.nesting <= 1 || len(ss.fresh) >= 2*ss.freshKept) {
+		ss.releaseFresh()
+	}
+	for len(ss.zeroRefs) > 0 {
+		batch := ss.zeroRefs
+		ss.zeroRefs = ss.spareRefs[:0]
+		for i, g := range batch {
+			batch[i] = nil
+			h := g.header()
+			h.queued = false
+			if h.refs == 0 && !h.released {
+				// releasing may queue more objects
+				ss.release(g)
+			}
+		}
+		ss.spareRefs = batch[:0]
+	}
+}
+
+// releaseFresh releases the new objects that are still unreferenced,
+// those created inside native calls are kept for later. Objects that got
+// referenced leave the list, dropping them queues them in zeroRefs.
+func (ss *sharedState) releaseFresh() {
+	fresh := ss.fresh
+	ss.fresh = ss.spareFresh[:0]
+	for i, g := range fresh {
+		fresh[i] = nil
+		h := g.header()
+		switch {
+		case h.refs > 0 || h.queued || h.released:
+		case ss.nesting > 1:
+			ss.fresh = append(ss.fresh, g)
+		default:
+			ss.release(g)
+		}
+	}
+	ss.spareFresh = fresh[:0]
+	ss.freshKept = len(ss.fresh)
+}
+
+// markReachable marks every object reachable from the roots with a new
+// epoch and returns it.
+func (ss *sharedState) markReachable() uint32 {
+	ss.gcEpoch++
+	epoch := ss.gcEpoch
+	var work []gcObject
+	mark := func(g gcObject) {
+		if h := g.header(); h.mark != epoch {
+			h.mark = epoch
+			work = append(work, g)
+		}
+	}
+	ss.roots(mark)
+	for len(work) > 0 {
+		g := work[len(work)-1]
+		work = work[:len(work)-1]
+		g.traverse(mark)
+	}
+	return epoch
+}
+
+func (ss *sharedState) unreachable() []gcObject {
+	epoch := ss.markReachable()
+	var res []gcObject
+	for h := ss.gcChain; h != nil; h = h.next {
+		if h.mark != epoch {
+			res = append(res, h.self)
+		}
+	}
+	return res
+}
+
+// collect releases all unreachable objects, cycles included, and returns
+// how many there were.
+func (ss *sharedState) collect() int {
+	garbage := ss.unreachable()
+	// mark everything first so that references between the released
+	// objects don't queue them again
+	for _, g := range garbage {
+		h := g.header()
+		h.released = true
+		h.clearWeakRef()
+		ss.untrack(h)
+	}
+	for _, g := range garbage {
+		g.finalize()
+	}
+	return len(garbage)
+}
+
+// releaseUnused releases the objects that lost their last reference, as
+// long as only the host is running.
+func (vm *VM) releaseUnused() {
+	if vm.ss.nesting == 0 {
+		vm.ss.releaseDropped()
+	}
+}
+
+// CollectGarbage runs the cycle collector and returns the number of
+// objects released.
+func (vm *VM) CollectGarbage() int {
+	return vm.ss.collect()
+}
+
+// ResurrectUnreachable pushes an array of the objects that are only kept
+// alive by reference cycles, or null if there are none. The objects are
+// not released.
+func (vm *VM) ResurrectUnreachable() {
+	garbage := vm.ss.unreachable()
+	if len(garbage) == 0 {
+		vm.push(Null)
+		return
+	}
+	a := newArray(0)
+	for _, g := range garbage {
+		// outers are not values scripts can handle
+		if t := typeOfGC(g); t != TypeOuter {
+			a.append(makeObject(t, g))
+		}
+	}
+	vm.push(vm.ss.newObject(TypeArray, a))
+}
+
+func typeOfGC(g gcObject) ObjectType {
+	switch g.(type) {
+	case *table:
+		return TypeTable
+	case *array:
+		return TypeArray
+	case *closure:
+		return TypeClosure
+	case *nativeClosure:
+		return TypeNativeClosure
+	case *generator:
+		return TypeGenerator
+	case *class:
+		return TypeClass
+	case *instance:
+		return TypeInstance
+	case *userData:
+		return TypeUserData
+	case *weakRef:
+		return TypeWeakRef
+	case *VM:
+		return TypeThread
+	}
+	return TypeOuter
+}
+
+// SetReleaseHook sets the function called when the userdata or instance
+// at idx is released. Set on a class it applies to the instances created
+// afterwards.
+func (vm *VM) SetReleaseHook(idx int, hook ReleaseHook) error {
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeUserData:
+		o.userData().hook = hook
+	case TypeInstance:
+		o.instance().hook = hook
+	case TypeClass:
+		o.class().hook = hook
+	default:
+		return fmt.Errorf("invalid object type")
+	}
+	return nil
+}
+
+// GetReleaseHook returns the release hook of the userdata, instance or
+// class at idx.
+func (vm *VM) GetReleaseHook(idx int) (ReleaseHook, error) {
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeUserData:
+		return o.userData().hook, nil
+	case TypeInstance:
+		return o.instance().hook, nil
+	case TypeClass:
+		return o.class().hook, nil
+	}
+	return nil, fmt.Errorf("invalid object type")
+}
+
+func (t *table) traverse(fn func(gcObject)) {
+	for _, n := range t.nodes {
+		if n.used {
+			visit(fn, n.key)
+			visit(fn, n.val)
+		}
+	}
+	if t.delegate != nil {
+		fn(t.delegate)
+	}
+}
+
+func (t *table) finalize() {
+	t.traverse(dropRef)
+	t.nodes = nil
+	t.index = map[tableKey]int{}
+	t.count = 0
+	t.delegate = nil
+}
+
+func (a *array) traverse(fn func(gcObject)) {
+	for _, v := range a.values {
+		visit(fn, v)
+	}
+}
+
+func (a *array) finalize() {
+	a.traverse(dropRef)
+	a.values = nil
+}
+
+func (c *closure) traverse(fn func(gcObject)) {
+	for _, o := range c.outers {
+		if o != nil {
+			fn(o)
+		}
+	}
+	for _, v := range c.defaultParams {
+		visit(fn, v)
+	}
+	visit(fn, c.env)
+	visit(fn, c.root)
+	if c.base != nil {
+		fn(c.base)
+	}
+}
+
+func (c *closure) finalize() {
+	c.traverse(dropRef)
+	c.outers = nil
+	c.defaultParams = nil
+	c.env = Null
+	c.root = Null
+	c.base = nil
+}
+
+func (c *nativeClosure) traverse(fn func(gcObject)) {
+	for _, v := range c.outers {
+		visit(fn, v)
+	}
+	visit(fn, c.env)
+}
+
+func (c *nativeClosure) finalize() {
+	c.traverse(dropRef)
+	c.outers = nil
+	c.env = Null
+}
+
+func (o *outer) traverse(fn func(gcObject)) {
+	if !o.open {
+		visit(fn, o.value)
+	}
+}
+
+func (o *outer) finalize() {
+	if o.open {
+		o.vm.unlinkOuter(o)
+		return
+	}
+	decRef(o.value)
+	o.value = Null
+}
+
+func (g *generator) traverse(fn func(gcObject)) {
+	visit(fn, g.closure)
+	for _, v := range g.stack {
+		visit(fn, v)
+	}
+}
+
+func (g *generator) finalize() {
+	g.traverse(dropRef)
+	g.state = generatorDead
+	g.stack = nil
+	g.closure = Null
+}
+
+func (c *class) traverse(fn func(gcObject)) {
+	if c.base != nil {
+		fn(c.base)
+	}
+	c.members.traverse(fn)
+	for _, m := range c.defaultValues {
+		visit(fn, m.val)
+		visit(fn, m.attrs)
+	}
+	for _, m := range c.methods {
+		visit(fn, m.val)
+		visit(fn, m.attrs)
+	}
+	for _, mm := range c.metaMethods {
+		visit(fn, mm)
+	}
+	visit(fn, c.attributes)
+}
+
+func (c *class) finalize() {
+	c.traverse(dropRef)
+	c.base = nil
+	c.members = newTable(0)
+	c.defaultValues = nil
+	c.methods = nil
+	c.metaMethods = [metaMethodCount]Object{}
+	c.attributes = Null
+}
+
+func (i *instance) traverse(fn func(gcObject)) {
+	fn(i.class)
+	for _, v := range i.values {
+		visit(fn, v)
+	}
+}
+
+func (i *instance) finalize() {
+	if i.hook != nil {
+		i.hook(i.up)
+	}
+	i.traverse(dropRef)
+	i.values = nil
+}
+
+func (u *userData) traverse(fn func(gcObject)) {
+	if u.delegate != nil {
+		fn(u.delegate)
+	}
+}
+
+func (u *userData) finalize() {
+	if u.hook != nil {
+		u.hook(u.value)
+	}
+	u.traverse(dropRef)
+	u.delegate = nil
+}
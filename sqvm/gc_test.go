@@ -0,0 +1,195 @@
+package sqvm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// run compiles src and calls it with the root table as this.
+func run(t *testing.T, vm *sqvm.VM, src string) error {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	vm.PushRootTable()
+	err := vm.Call(1, false, false)
+	vm.Pop(1)
+	return err
+}
+
+// register sets a native function in the root table.
+func register(vm *sqvm.VM, name string, fn sqvm.NativeFunc) {
+	vm.PushRootTable()
+	vm.PushString(name)
+	vm.NewClosure(fn, 0)
+	vm.NewSlot(-3, false)
+	vm.Pop(1)
+}
+
+// tracker counts the userdata created by the track() function of the
+// scripts that have been released.
+type tracker struct {
+	released map[string]int
+}
+
+func newTracker(vm *sqvm.VM) *tracker {
+	tr := &tracker{released: make(map[string]int)}
+	register(vm, "track", func(vm *sqvm.VM) (int, error) {
+		name := vm.GetString(2)
+		vm.NewUserData(name)
+		vm.SetReleaseHook(-1, func(up any) {
+			tr.released[up.(string)]++
+		})
+		return 1, nil
+	})
+	register(vm, "released", func(vm *sqvm.VM) (int, error) {
+		vm.PushInteger(int64(tr.released[vm.GetString(2)]))
+		return 1, nil
+	})
+	return tr
+}
+
+func TestReleaseOnReturn(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	newTracker(vm)
+	err := run(t, vm, `
+		function f() { local u = track("u") }
+		f()
+		if (released("u") != 1) throw "not released on return"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseInLoop(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	newTracker(vm)
+	err := run(t, vm, `
+		for (local i = 0; i < 100; i++) {
+			local t = {u = track("u")}
+		}
+		// the last one is still in its stack slot
+		if (released("u") < 99) throw "released " + released("u")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseOnDrop(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	newTracker(vm)
+	err := run(t, vm, `
+		local x = track("local")
+		x = null
+		if (released("local") != 1) throw "local not released"
+
+		local t = {v = track("slot")}
+		t.v = null
+		if (released("slot") != 1) throw "table slot not released"
+
+		local a = [track("item")]
+		a[0] = 1
+		if (released("item") != 1) throw "array item not released"
+
+		track("discarded")
+		if (released("discarded") != 1) throw "discarded result not released"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseInCallback(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	newTracker(vm)
+	err := run(t, vm, `
+		local n = 0
+		local arr = [3, 1, 2]
+		arr.sort(function(a, b) {
+			local x = track("cmp")
+			x = null
+			if (released("cmp") != ++n) throw "not released in the compare function"
+			return a <=> b
+		})
+		local m = [1, 2].map(function(v) {
+			local t = {u = track("map")}
+			t.u = null
+			return released("map")
+		})
+		if (m[0] != 1 || m[1] != 2) throw "not released in the map function"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseDeepStack(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	newTracker(vm)
+	err := run(t, vm, `
+		function deep(n) {
+			if (n > 0) return deep(n - 1) + 1
+			local x = track("deep")
+			x = null
+			if (released("deep") != 1) throw "not released on a deep stack"
+			return 0
+		}
+		deep(500)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReleaseFromHost(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	released := 0
+	vm.NewUserData(nil)
+	vm.SetReleaseHook(-1, func(any) { released++ })
+	obj := vm.GetStackObject(-1)
+	vm.AddRef(obj)
+	vm.Pop(1)
+	if released != 0 {
+		t.Fatal("released while referenced by the host")
+	}
+	if !vm.Release(obj) {
+		t.Fatal("Release didn't drop the last reference")
+	}
+	if released != 1 {
+		t.Fatalf("released %d times, want 1", released)
+	}
+}
+
+func TestCollectCycles(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	tr := newTracker(vm)
+	err := run(t, vm, `
+		local a = {u = track("cycle")}
+		local b = {a = a}
+		a.b <- b
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.released["cycle"] != 0 {
+		t.Fatal("a cycle was released by reference counting")
+	}
+	if n := vm.CollectGarbage(); n < 3 {
+		t.Fatalf("collected %d objects, want at least 3", n)
+	}
+	if tr.released["cycle"] != 1 {
+		t.Fatal("the cycle was not collected")
+	}
+}
@@ -0,0 +1,75 @@
+package sqvm
+
+// objectRef counts the references Go code holds to an object through
+// AddRef.
+type objectRef struct {
+	obj   Object
+	count int
+}
+
+// GetStackObject returns a handle to the value at idx. The handle stays
+// valid after the value is popped only if it is kept alive with AddRef
+// or stored somewhere reachable from scripts, such as the registry.
+func (vm *VM) GetStackObject(idx int) Object {
+	return vm.at(idx)
+}
+
+// PushObject pushes the object referred to by a handle.
+func (vm *VM) PushObject(obj Object) {
+	vm.push(obj)
+}
+
+// AddRef adds a strong reference to obj held by the host. Values that are
+// not reference counted (null, numbers, bools) are ignored.
+func (vm *VM) AddRef(obj Object) {
+	if !obj.isRefCounted() {
+		return
+	}
+	key, ok := keyOf(obj)
+	if !ok {
+		return
+	}
+	if ref, present := vm.ss.refs[key]; present {
+		ref.count++
+		return
+	}
+	incRef(obj)
+	vm.ss.refs[key] = &objectRef{obj: obj, count: 1}
+}
+
+// Release drops a reference taken with AddRef. It reports whether that
+// was the last reference the host held.
+func (vm *VM) Release(obj Object) bool {
+	if !obj.isRefCounted() {
+		return true
+	}
+	key, ok := keyOf(obj)
+	if !ok {
+		return true
+	}
+	ref, present := vm.ss.refs[key]
+	if !present {
+		return true
+	}
+	ref.count--
+	if ref.count > 0 {
+		return false
+	}
+	delete(vm.ss.refs, key)
+	decRef(obj)
+	vm.releaseUnused()
+	return true
+}
+
+// GetRefCount returns the number of references the host holds to obj
+// through AddRef.
+func (vm *VM) GetRefCount(obj Object) int {
+	key, ok := keyOf(obj)
+	if !ok {
+		return 0
+	}
+	if ref, present := vm.ss.refs[key]; present {
+		return ref.count
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package sqvm
+
+import (
+	"context"
+	"errors"
+)
+
+// Limits bound what the scripts of a VM and its threads may do, a zero
+// field means no limit. Exceeding one raises an error that scripts can
+// catch, but every instruction fails until the call made by the host
+// returns. The budgets are renewed at each call of the host.
+type Limits struct {
+	// MaxInstructions is the number of instructions a call may run.
+	MaxInstructions int64
+	// MaxCallDepth is the number of functions the call stack of a
+	// thread may hold, tail calls don't count.
+	MaxCallDepth int
+	// AllocationQuota is a soft bound on the bytes of the strings,
+	// tables, arrays and other objects allocated during a call. It is
+	// checked between instructions, and before allocating when a script
+	// asks for a size at once, as with array(n). Such sizes are refused
+	// beyond 1 GiB even without a quota. Memory freed during the call is
+	// not given back.
+	AllocationQuota int64
+}
+
+// Estimated sizes of what is charged against the allocation quota.
+const (
+	objectSize    = 64
+	valueSize     = 24
+	tableNodeSize = 64
+)
+
+// maxAllocation bounds the bytes of a single allocation asked for by a
+// script, such as array(n), whatever the limits of the VM. Larger ones
+// could only exhaust the memory of the host.
+const maxAllocation = 1 << 30
+
+var (
+	errAllocationQuota = errors.New("allocation quota exceeded")
+	errAllocationSize  = errors.New("allocation too large")
+)
+
+// SetLimits sets the limits of the VM, shared with its threads.
+func (vm *VM) SetLimits(l Limits) {
+	vm.ss.limits = l
+	vm.ss.limited = l.MaxInstructions > 0 || l.AllocationQuota > 0
+}
+
+func (vm *VM) Limits() Limits {
+	return vm.ss.limits
+}
+
+// startBudget renews the budgets when the host calls into the VM.
+func (ss *sharedState) startBudget() {
+	if ss.nesting == 0 {
+		ss.instructions = 0
+		ss.allocated = 0
+	}
+}
+
+// charge counts n bytes against the allocation quota. Objects internal
+// to others have no shared state and are not charged.
+func (ss *sharedState) charge(n int) {
+	if ss != nil {
+		ss.allocated += int64(n)
+	}
+}
+
+// checkAllocation returns an error if n items of size bytes are more
+// than maxAllocation or don't fit in what is left of the allocation
+// quota.
+func (ss *sharedState) checkAllocation(n, size int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if n > maxAllocation/size {
+		return errAllocationSize
+	}
+	if ss == nil || ss.limits.AllocationQuota <= 0 {
+		return nil
+	}
+	if n > (ss.limits.AllocationQuota-ss.allocated)/size {
+		return errAllocationQuota
+	}
+	return nil
+}
+
+// ChargeAllocation counts bytes about to be allocated for scripts against
+// the allocation quota. If they are too large for a single allocation or
+// don't fit in the quota, nothing is counted and an error is returned,
+// so that native functions can raise it instead of allocating.
+func (vm *VM) ChargeAllocation(bytes int64) error {
+	if err := vm.ss.checkAllocation(bytes, 1); err != nil {
+		return err
+	}
+	if bytes > 0 {
+		vm.ss.allocated += bytes
+	}
+	return nil
+}
+
+// checkBudget counts an instruction and raises an error once a budget
+// is spent.
+func (vm *VM) checkBudget() error {
+	ss := vm.ss
+	ss.instructions++
+	if max := ss.limits.MaxInstructions; max > 0 && ss.instructions > max {
+		return vm.raise("instruction limit exceeded")
+	}
+	if quota := ss.limits.AllocationQuota; quota > 0 && ss.allocated > quota {
+		return vm.raise("%s", errAllocationQuota)
+	}
+	return nil
+}
+
+// CallContext is Call with the scripts stopped once ctx is done. The
+// context is checked at every call and backward jump, the error raised
+// then can be caught by scripts but is raised again at the next check.
+// The returned error wraps ctx.Err().
+func (vm *VM) CallContext(ctx context.Context, nArgs int, pushResult, raiseError bool) error {
+	prevCtx, prevDone := vm.ss.ctx, vm.ss.done
+	vm.ss.ctx, vm.ss.done = ctx, ctx.Done()
+	defer func() {
+		vm.ss.ctx, vm.ss.done = prevCtx, prevDone
+	}()
+
+	err := vm.Call(nArgs, pushResult, raiseError)
+	var e *Error
+	if ctx.Err() != nil && errors.As(err, &e) && e.Err == nil {
+		e.Err = ctx.Err()
+	}
+	return err
+}
+
+// checkContext raises an error if the context of CallContext is done.
+func (vm *VM) checkContext() error {
+	select {
+	case <-vm.ss.done:
+		return vm.raise("%s", vm.ss.ctx.Err())
+	default:
+		return nil
+	}
+}
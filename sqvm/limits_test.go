@@ -0,0 +1,105 @@
+package sqvm_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// expectError runs src and checks that it fails with an error containing
+// msg, after the script could catch it.
+func expectError(t *testing.T, vm *sqvm.VM, src, msg string) {
+	t.Helper()
+	err := run(t, vm, src)
+	if err == nil || !strings.Contains(err.Error(), msg) {
+		t.Fatalf("got error %v, want %q", err, msg)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.SetLimits(sqvm.Limits{MaxInstructions: 10000})
+	expectError(t, vm, `while (true) {}`, "instruction limit exceeded")
+	// the budget is renewed at each call of the host
+	if err := run(t, vm, `for (local i = 0; i < 100; i++) {}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.SetLimits(sqvm.Limits{MaxCallDepth: 50})
+	expectError(t, vm, `function f(n) { return f(n + 1) + 1 } f(0)`, "stack overflow")
+	if err := run(t, vm, `function g(n) { return n == 0 ? 0 : g(n - 1) + 1 } g(40)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocationQuota(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.SetLimits(sqvm.Limits{AllocationQuota: 1 << 20})
+	expectError(t, vm, `local a = []; while (true) a.append({})`, "allocation quota exceeded")
+	// sizes asked at once are refused before allocating, and the error
+	// can be caught
+	err := run(t, vm, `
+		local caught = false
+		try {
+			[].resize(1 << 34)
+		} catch (e) {
+			caught = true
+		}
+		if (!caught) throw "resize was not refused"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.NewArray(0)
+	defer vm.Pop(1)
+	if err := vm.ArrayResize(-1, 1<<24); err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Fatalf("ArrayResize beyond the quota returned %v", err)
+	}
+	if err := vm.ChargeAllocation(1 << 34); err == nil {
+		t.Fatal("ChargeAllocation beyond the quota succeeded")
+	}
+	if err := vm.ChargeAllocation(1 << 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocationSize(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	// no quota, the sizes are still bounded
+	err := run(t, vm, `
+		foreach (n in [1 << 62, 1 << 40, 1 << 31]) {
+			local caught = false
+			try {
+				[1].resize(n)
+			} catch (e) {
+				caught = true
+			}
+			if (!caught) throw "resize to " + n + " was not refused"
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.NewArray(0)
+	defer vm.Pop(1)
+	if err := vm.ArrayResize(-1, math.MaxInt); err == nil {
+		t.Fatal("ArrayResize to MaxInt succeeded")
+	}
+	if err := vm.ArrayResize(-1, 1<<10); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.ChargeAllocation(math.MaxInt64); err == nil {
+		t.Fatal("ChargeAllocation of MaxInt64 bytes succeeded")
+	}
+}
@@ -0,0 +1,148 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// Opcode numbering follows the reference Squirrel 3.1 implementation so
+// that compiled function prototypes stay binary compatible.
+type Opcode uint8
+
+const (
+	OpLine Opcode = iota
+	OpLoad
+	OpLoadInt
+	OpLoadFloat
+	OpDLoad
+	OpTailCall
+	OpCall
+	OpPrepCall
+	OpPrepCallK
+	OpGetK
+	OpMove
+	OpNewSlot
+	OpDelete
+	OpSet
+	OpGet
+	OpEq
+	OpNe
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpBitW
+	OpReturn
+	OpLoadNulls
+	OpLoadRoot
+	OpLoadBool
+	OpDMove
+	OpJmp
+	OpJCmp
+	OpJz
+	OpSetOuter
+	OpGetOuter
+	OpNewObj
+	OpAppendArray
+	OpCompArith
+	OpInc
+	OpIncL
+	OpPInc
+	OpPIncL
+	OpCmp
+	OpExists
+	OpInstanceOf
+	OpAnd
+	OpOr
+	OpNeg
+	OpNot
+	OpBWNot
+	OpClosure
+	OpYield
+	OpResume
+	OpForeach
+	OpPostForeach
+	OpClone
+	OpTypeOf
+	OpPushTrap
+	OpPopTrap
+	OpThrow
+	OpNewSlotA
+	OpGetBase
+	OpClose
+)
+
+var opcodeNames = [...]string{
+	"LINE", "LOAD", "LOADINT", "LOADFLOAT", "DLOAD", "TAILCALL", "CALL",
+	"PREPCALL", "PREPCALLK", "GETK", "MOVE", "NEWSLOT", "DELETE", "SET", "GET",
+	"EQ", "NE", "ADD", "SUB", "MUL", "DIV", "MOD", "BITW", "RETURN", "LOADNULLS",
+	"LOADROOT", "LOADBOOL", "DMOVE", "JMP", "JCMP", "JZ", "SETOUTER", "GETOUTER",
+	"NEWOBJ", "APPENDARRAY", "COMPARITH", "INC", "INCL", "PINC", "PINCL", "CMP",
+	"EXISTS", "INSTANCEOF", "AND", "OR", "NEG", "NOT", "BWNOT", "CLOSURE",
+	"YIELD", "RESUME", "FOREACH", "POSTFOREACH", "CLONE", "TYPEOF", "PUSHTRAP",
+	"POPTRAP", "THROW", "NEWSLOTA", "GETBASE", "CLOSE",
+}
+
+func (op Opcode) String() string {
+	if int(op) >= len(opcodeNames) {
+		return fmt.Sprintf("OP(%d)", uint8(op))
+	}
+	return opcodeNames[op]
+}
+
+// Sub-operations of OpBitW
+const (
+	BitwAnd         = 0
+	BitwOr          = 2
+	BitwXor         = 3
+	BitwShiftLeft   = 4
+	BitwShiftRight  = 5
+	BitwUShiftRight = 6
+)
+
+// Sub-operations of OpCmp and OpJCmp
+const (
+	CmpGreater      = 0
+	CmpGreaterEqual = 2
+	CmpLess         = 3
+	CmpLessEqual    = 4
+	Cmp3Way         = 5
+)
+
+// Object kinds created by OpNewObj
+const (
+	NewObjTable = 0
+	NewObjArray = 1
+	NewObjClass = 2
+)
+
+// Operand kinds of OpAppendArray
+const (
+	AppendStack   = 0
+	AppendLiteral = 1
+	AppendInt     = 2
+	AppendFloat   = 3
+	AppendBool    = 4
+)
+
+// Flags of OpNewSlotA
+const (
+	NewSlotAttributes = 0x01
+	NewSlotStatic     = 0x02
+)
+
+// MaxFuncStackSize doubles as the "no register" marker in operands.
+const MaxFuncStackSize = 0xFF
+
+// Instruction mirrors the reference in-memory layout.
+type Instruction struct {
+	Arg1 int32
+	Op   Opcode
+	Arg0 uint8
+	Arg2 uint8
+	Arg3 uint8
+}
+
+func (i Instruction) String() string {
+	return fmt.Sprintf("%-12s %3d %5d %3d %3d", i.Op, i.Arg0, i.Arg1, i.Arg2, i.Arg3)
+}
@@ -0,0 +1,757 @@
+package sqvm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Flags of get
+const (
+	getRaw = 1 << iota
+	getNoError
+)
+
+// dontFallBack disables looking up missing keys in the root table.
+const dontFallBack = -1
+
+type fallBackResult int
+
+const (
+	fallBackOK fallBackResult = iota
+	fallBackNoMatch
+	fallBackError
+)
+
+func (vm *VM) get(self, key Object, flags int, selfIdx int) (Object, error) {
+	switch self.typ {
+	case TypeTable:
+		if val, ok := self.table().get(key); ok {
+			return val, nil
+		}
+	case TypeArray:
+		if key.typ.isNumeric() {
+			if val, ok := self.array().get(key.toInteger()); ok {
+				return val, nil
+			}
+			return Null, vm.raiseIdxError(key, flags)
+		}
+	case TypeInstance:
+		if val, ok := self.instance().get(key); ok {
+			return val, nil
+		}
+	case TypeClass:
+		if val, ok := self.class().get(key); ok {
+			return val, nil
+		}
+	case TypeString:
+		if key.typ.isNumeric() {
+			s := self.Str()
+			n := key.toInteger()
+			if n < 0 {
+				n += int64(len(s))
+			}
+			if n >= 0 && n < int64(len(s)) {
+				return IntegerValue(int64(s[n])), nil
+			}
+			return Null, vm.raiseIdxError(key, flags)
+		}
+	}
+
+	if flags&getRaw == 0 {
+		val, res := vm.fallBackGet(self, key)
+		switch res {
+		case fallBackOK:
+			return val, nil
+		case fallBackError:
+			return Null, errThrown
+		}
+		if val, ok := vm.invokeDefaultDelegate(self, key); ok {
+			return val, nil
+		}
+	}
+	if selfIdx == 0 && vm.ci != nil && vm.ci.closure.typ == TypeClosure {
+		if root := vm.ci.closure.closure().root; !root.IsNull() {
+			if val, err := vm.get(root, key, getNoError, dontFallBack); err == nil {
+				return val, nil
+			}
+		}
+	}
+	return Null, vm.raiseIdxError(key, flags)
+}
+
+// rawGet reads a slot without delegation and metamethods.
+func (vm *VM) rawGet(self, key Object) (Object, error) {
+	var val Object
+	ok := false
+	switch self.typ {
+	case TypeTable:
+		val, ok = self.table().get(key)
+	case TypeClass:
+		val, ok = self.class().get(key)
+	case TypeInstance:
+		val, ok = self.instance().get(key)
+	case TypeArray:
+		if !key.typ.isNumeric() {
+			return Null, vm.raise("invalid index type for an array")
+		}
+		val, ok = self.array().get(key.toInteger())
+	default:
+		return Null, vm.raise("rawget works only on array/table/instance and class")
+	}
+	if !ok {
+		return Null, vm.raise("the index doesn't exist")
+	}
+	return val, nil
+}
+
+func (vm *VM) fallBackGet(self, key Object) (Object, fallBackResult) {
+	switch self.typ {
+	case TypeTable, TypeUserData:
+		delegate := vm.delegateOf(self)
+		if delegate == nil {
+			return Null, fallBackNoMatch
+		}
+		if val, err := vm.get(makeObject(TypeTable, delegate), key, 0, dontFallBack); err == nil {
+			return val, fallBackOK
+		} else if err != errNoSlot {
+			return Null, fallBackError
+		}
+		fallthrough
+	case TypeInstance:
+		if mm, ok := vm.getMetaMethod(self, mmGet); ok {
+			vm.push(self)
+			vm.push(key)
+			val, err := vm.callMetaMethod(mm, 2)
+			if err == nil {
+				return val, fallBackOK
+			}
+			// throwing null means "not found"
+			if !vm.lastError.IsNull() {
+				return Null, fallBackError
+			}
+		}
+	}
+	return Null, fallBackNoMatch
+}
+
+func (vm *VM) set(self, key, val Object, selfIdx int) error {
+	switch self.typ {
+	case TypeTable:
+		if self.table().set(key, val) {
+			return nil
+		}
+	case TypeInstance:
+		if self.instance().set(key, val) {
+			return nil
+		}
+	case TypeArray:
+		if !key.typ.isNumeric() {
+			return vm.raise("indexing %s with %s", self.typ, key.typ)
+		}
+		if !self.array().set(key.toInteger(), val) {
+			return vm.raiseIdxError(key, 0)
+		}
+		return nil
+	case TypeUserData:
+		// must fall back
+	default:
+		return vm.raise("trying to set '%s'", self.typ)
+	}
+
+	switch vm.fallBackSet(self, key, val) {
+	case fallBackOK:
+		return nil
+	case fallBackError:
+		return errThrown
+	}
+	if selfIdx == 0 && vm.rootTable.table().set(key, val) {
+		return nil
+	}
+	return vm.raiseIdxError(key, 0)
+}
+
+// rawSet writes a slot without delegation and metamethods, creating it
+// in tables and classes.
+func (vm *VM) rawSet(self, key, val Object) error {
+	if key.IsNull() {
+		return vm.raise("null key")
+	}
+	switch self.typ {
+	case TypeTable:
+		if !self.table().newSlot(key, val) {
+			return vm.raise("invalid key type")
+		}
+		return nil
+	case TypeClass:
+		if !self.class().newSlot(vm.ss, key, val, false) {
+			return vm.raise("rawset failed")
+		}
+		return nil
+	case TypeInstance:
+		if !self.instance().set(key, val) {
+			return vm.raise("the index doesn't exist")
+		}
+		return nil
+	case TypeArray:
+		return vm.set(self, key, val, dontFallBack)
+	}
+	return vm.raise("rawset works only on array/table/class and instance")
+}
+
+func (vm *VM) fallBackSet(self, key, val Object) fallBackResult {
+	switch self.typ {
+	case TypeTable:
+		if delegate := self.table().delegate; delegate != nil {
+			if vm.set(makeObject(TypeTable, delegate), key, val, dontFallBack) == nil {
+				return fallBackOK
+			}
+		}
+		fallthrough
+	case TypeInstance, TypeUserData:
+		if mm, ok := vm.getMetaMethod(self, mmSet); ok {
+			vm.push(self)
+			vm.push(key)
+			vm.push(val)
+			if _, err := vm.callMetaMethod(mm, 3); err == nil {
+				return fallBackOK
+			}
+			// throwing null means "not found"
+			if !vm.lastError.IsNull() {
+				return fallBackError
+			}
+		}
+	}
+	return fallBackNoMatch
+}
+
+func (vm *VM) newSlot(self, key, val Object, static bool) error {
+	if key.IsNull() {
+		return vm.raise("null cannot be used as index")
+	}
+	switch self.typ {
+	case TypeTable:
+		t := self.table()
+		if t.delegate != nil {
+			if _, ok := t.get(key); !ok {
+				if mm, ok := vm.getMetaMethod(self, mmNewSlot); ok {
+					vm.push(self)
+					vm.push(key)
+					vm.push(val)
+					_, err := vm.callMetaMethod(mm, 3)
+					return err
+				}
+			}
+		}
+		if !t.newSlot(key, val) {
+			return vm.raise("invalid key type %s", key.typ)
+		}
+	case TypeInstance:
+		if mm, ok := vm.getMetaMethod(self, mmNewSlot); ok {
+			vm.push(self)
+			vm.push(key)
+			vm.push(val)
+			_, err := vm.callMetaMethod(mm, 3)
+			return err
+		}
+		return vm.raise("class instances do not support the new slot operator")
+	case TypeClass:
+		c := self.class()
+		if !c.newSlot(vm.ss, key, val, static) {
+			if c.locked {
+				return vm.raise("trying to modify a class that has already been instantiated")
+			}
+			return vm.raise("the property '%s' already exists", vm.printObjVal(key))
+		}
+	default:
+		return vm.raise("indexing %s with %s", self.typ, key.typ)
+	}
+	return nil
+}
+
+func (vm *VM) newSlotA(self, key, val, attrs Object, static, raw bool) error {
+	if self.typ != TypeClass {
+		return vm.raise("object must be a class")
+	}
+	c := self.class()
+	if !raw {
+		if mm := c.metaMethods[mmNewMember]; !mm.IsNull() {
+			vm.push(self)
+			vm.push(key)
+			vm.push(val)
+			vm.push(attrs)
+			vm.push(BoolValue(static))
+			_, err := vm.callMetaMethod(mm, 5)
+			return err
+		}
+	}
+	if err := vm.newSlot(self, key, val, static); err != nil {
+		return err
+	}
+	if !attrs.IsNull() {
+		if m, ok := c.member(key); ok {
+			assign(&m.attrs, attrs)
+		}
+	}
+	return nil
+}
+
+func (vm *VM) deleteSlot(self, key Object) (Object, error) {
+	switch self.typ {
+	case TypeTable, TypeInstance, TypeUserData:
+		if mm, ok := vm.getMetaMethod(self, mmDelSlot); ok {
+			vm.push(self)
+			vm.push(key)
+			return vm.callMetaMethod(mm, 2)
+		}
+		if self.typ != TypeTable {
+			return Null, vm.raise("cannot delete a slot from %s", self.typ)
+		}
+		t := self.table()
+		val, ok := t.get(key)
+		if !ok {
+			return Null, vm.raiseIdxError(key, 0)
+		}
+		t.remove(key)
+		return val, nil
+	}
+	return Null, vm.raise("attempt to delete a slot from a %s", self.typ)
+}
+
+func (vm *VM) delegateOf(o Object) *table {
+	switch o.typ {
+	case TypeTable:
+		return o.table().delegate
+	case TypeUserData:
+		return o.userData().delegate
+	}
+	return nil
+}
+
+func (vm *VM) getMetaMethod(o Object, mm metaMethod) (Object, bool) {
+	switch o.typ {
+	case TypeTable, TypeUserData:
+		if delegate := vm.delegateOf(o); delegate != nil {
+			return delegate.get(StringValue(metaMethodNames[mm]))
+		}
+	case TypeInstance:
+		if m := o.instance().class.metaMethods[mm]; !m.IsNull() {
+			return m, true
+		}
+	}
+	return Null, false
+}
+
+// callMetaMethod calls mm with the nArgs values on top of the stack and
+// pops them.
+func (vm *VM) callMetaMethod(mm Object, nArgs int) (Object, error) {
+	res, err := vm.call(mm, nArgs, vm.top-nArgs, false)
+	vm.pop(nArgs)
+	return res, err
+}
+
+func (vm *VM) arith(op byte, o1, o2 Object) (Object, error) {
+	switch {
+	case o1.typ == TypeInteger && o2.typ == TypeInteger:
+		i1, i2 := o1.Integer(), o2.Integer()
+		switch op {
+		case '+':
+			return IntegerValue(i1 + i2), nil
+		case '-':
+			return IntegerValue(i1 - i2), nil
+		case '*':
+			return IntegerValue(i1 * i2), nil
+		case '/':
+			if i2 == 0 {
+				return Null, vm.raise("division by zero")
+			} else if i2 == -1 && i1 == math.MinInt64 {
+				return Null, vm.raise("integer overflow")
+			}
+			return IntegerValue(i1 / i2), nil
+		case '%':
+			if i2 == 0 {
+				return Null, vm.raise("modulo by zero")
+			} else if i2 == -1 {
+				return IntegerValue(0), nil
+			}
+			return IntegerValue(i1 % i2), nil
+		}
+	case o1.typ.isNumeric() && o2.typ.isNumeric():
+		f1, f2 := o1.toFloat(), o2.toFloat()
+		switch op {
+		case '+':
+			return FloatValue(f1 + f2), nil
+		case '-':
+			return FloatValue(f1 - f2), nil
+		case '*':
+			return FloatValue(f1 * f2), nil
+		case '/':
+			return FloatValue(f1 / f2), nil
+		case '%':
+			return FloatValue(math.Mod(f1, f2)), nil
+		}
+	case op == '+' && (o1.typ == TypeString || o2.typ == TypeString):
+		return vm.stringCat(o1, o2)
+	}
+	return vm.arithMetaMethod(op, o1, o2)
+}
+
+func (vm *VM) arithMetaMethod(op byte, o1, o2 Object) (Object, error) {
+	var mm metaMethod
+	switch op {
+	case '+':
+		mm = mmAdd
+	case '-':
+		mm = mmSub
+	case '/':
+		mm = mmDiv
+	case '*':
+		mm = mmMul
+	case '%':
+		mm = mmModulo
+	}
+	if closure, ok := vm.getMetaMethod(o1, mm); ok {
+		vm.push(o1)
+		vm.push(o2)
+		return vm.callMetaMethod(closure, 2)
+	}
+	return Null, vm.raise("arith op %c on between '%s' and '%s'", op, o1.typ, o2.typ)
+}
+
+func (vm *VM) stringCat(o1, o2 Object) (Object, error) {
+	s1, err := vm.toString(o1)
+	if err != nil {
+		return Null, err
+	}
+	s2, err := vm.toString(o2)
+	if err != nil {
+		return Null, err
+	}
+	vm.ss.charge(len(s1) + len(s2))
+	return StringValue(s1 + s2), nil
+}
+
+func (vm *VM) bitwise(op int, o1, o2 Object) (Object, error) {
+	if o1.typ != TypeInteger || o2.typ != TypeInteger {
+		return Null, vm.raise("bitwise op between '%s' and '%s'", o1.typ, o2.typ)
+	}
+	i1, i2 := o1.Integer(), o2.Integer()
+	switch op {
+	case BitwAnd:
+		return IntegerValue(i1 & i2), nil
+	case BitwOr:
+		return IntegerValue(i1 | i2), nil
+	case BitwXor:
+		return IntegerValue(i1 ^ i2), nil
+	case BitwShiftLeft:
+		return IntegerValue(i1 << uint64(i2)), nil
+	case BitwShiftRight:
+		return IntegerValue(i1 >> uint64(i2)), nil
+	case BitwUShiftRight:
+		return IntegerValue(int64(uint64(i1) >> uint64(i2))), nil
+	}
+	return Null, vm.raise("internal vm error bitwise op failed")
+}
+
+func isEqual(o1, o2 Object) bool {
+	if o1.typ == o2.typ {
+		return o1.rawEquals(o2)
+	}
+	if o1.typ.isNumeric() && o2.typ.isNumeric() {
+		return o1.toFloat() == o2.toFloat()
+	}
+	return false
+}
+
+func (vm *VM) objCmp(o1, o2 Object) (int64, error) {
+	t1, t2 := o1.typ, o2.typ
+	if t1 == t2 {
+		if o1.rawEquals(o2) {
+			return 0, nil
+		}
+		switch t1 {
+		case TypeString:
+			return int64(strings.Compare(o1.Str(), o2.Str())), nil
+		case TypeInteger:
+			if o1.Integer() < o2.Integer() {
+				return -1, nil
+			}
+			return 1, nil
+		case TypeFloat:
+			if o1.Float() < o2.Float() {
+				return -1, nil
+			}
+			return 1, nil
+		case TypeTable, TypeUserData, TypeInstance:
+			if mm, ok := vm.getMetaMethod(o1, mmCmp); ok {
+				vm.push(o1)
+				vm.push(o2)
+				res, err := vm.callMetaMethod(mm, 2)
+				if err != nil {
+					return 0, err
+				}
+				if res.typ != TypeInteger {
+					return 0, vm.raise("_cmp must return an integer")
+				}
+				return res.Integer(), nil
+			}
+		}
+		if o1.address() < o2.address() {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	if t1.isNumeric() && t2.isNumeric() {
+		f1, f2 := o1.toFloat(), o2.toFloat()
+		if f1 == f2 {
+			return 0, nil
+		} else if f1 < f2 {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	if t1 == TypeNull {
+		return -1, nil
+	}
+	if t2 == TypeNull {
+		return 1, nil
+	}
+	return 0, vm.raise("comparison between '%.50s' and '%.50s'", vm.printObjVal(o1), vm.printObjVal(o2))
+}
+
+func (vm *VM) cmpOp(op int, o1, o2 Object) (Object, error) {
+	r, err := vm.objCmp(o1, o2)
+	if err != nil {
+		return Null, err
+	}
+	switch op {
+	case CmpGreater:
+		return BoolValue(r > 0), nil
+	case CmpGreaterEqual:
+		return BoolValue(r >= 0), nil
+	case CmpLess:
+		return BoolValue(r < 0), nil
+	case CmpLessEqual:
+		return BoolValue(r <= 0), nil
+	}
+	return IntegerValue(r), nil
+}
+
+func (vm *VM) negOp(o Object) (Object, error) {
+	switch o.typ {
+	case TypeInteger:
+		return IntegerValue(-o.Integer()), nil
+	case TypeFloat:
+		return FloatValue(-o.Float()), nil
+	case TypeTable, TypeUserData, TypeInstance:
+		if mm, ok := vm.getMetaMethod(o, mmUnm); ok {
+			vm.push(o)
+			return vm.callMetaMethod(mm, 1)
+		}
+	}
+	return Null, vm.raise("attempt to negate a %s", o.typ)
+}
+
+func (vm *VM) derefInc(op byte, self, key, incr Object, postfix bool, selfIdx int) (Object, error) {
+	tmp, err := vm.get(self, key, 0, selfIdx)
+	if err != nil {
+		return Null, err
+	}
+	res, err := vm.arith(op, tmp, incr)
+	if err != nil {
+		return Null, err
+	}
+	if err := vm.set(self, key, res, selfIdx); err != nil {
+		return Null, err
+	}
+	if postfix {
+		return tmp, nil
+	}
+	return res, nil
+}
+
+// foreachOp advances the iteration over the container in stack slot
+// container. Key, value and iterator live in slots idx, idx+1 and idx+2.
+// It returns the instruction offset to continue at.
+func (vm *VM) foreachOp(container, idx, exitPos int) (int, error) {
+	base := vm.stackBase
+	o1 := vm.stack[base+container]
+	itr := vm.stack[base+idx+2]
+	pos := 0
+	if itr.typ == TypeInteger {
+		pos = int(itr.Integer())
+	}
+
+	var key, val Object
+	switch o1.typ {
+	case TypeTable:
+		pos, key, val = o1.table().next(pos)
+	case TypeArray:
+		pos, key, val = o1.array().next(pos)
+	case TypeString:
+		if s := o1.Str(); pos < len(s) {
+			key, val = IntegerValue(int64(pos)), IntegerValue(int64(s[pos]))
+			pos++
+		} else {
+			pos = -1
+		}
+	case TypeClass:
+		pos, key, val = o1.class().next(pos)
+	case TypeUserData, TypeInstance:
+		mm, ok := vm.getMetaMethod(o1, mmNextI)
+		if !ok {
+			return 0, vm.raise("_nexti failed")
+		}
+		vm.push(o1)
+		vm.push(itr)
+		next, err := vm.callMetaMethod(mm, 2)
+		if err != nil {
+			return 0, err
+		}
+		assign(&vm.stack[base+idx], next)
+		assign(&vm.stack[base+idx+2], next)
+		if next.IsNull() {
+			return exitPos, nil
+		}
+		val, err := vm.get(o1, next, 0, dontFallBack)
+		if err != nil {
+			return 0, vm.raise("_nexti returned an invalid idx")
+		}
+		assign(&vm.stack[base+idx+1], val)
+		return 1, nil
+	case TypeGenerator:
+		gen := o1.generator()
+		if gen.state == generatorDead {
+			return exitPos, nil
+		}
+		if gen.state == generatorSuspended {
+			n := int64(0)
+			if itr.typ == TypeInteger {
+				n = itr.Integer() + 1
+			}
+			assign(&vm.stack[base+idx], IntegerValue(n))
+			assign(&vm.stack[base+idx+2], IntegerValue(n))
+			if err := gen.resume(vm, idx+1); err != nil {
+				return 0, err
+			}
+			return 0, nil
+		}
+		fallthrough
+	default:
+		return 0, vm.raise("cannot iterate %s", o1.typ)
+	}
+	if pos < 0 {
+		return exitPos, nil
+	}
+	assign(&vm.stack[base+idx], key)
+	assign(&vm.stack[base+idx+1], val)
+	assign(&vm.stack[base+idx+2], IntegerValue(int64(pos)))
+	return 1, nil
+}
+
+func (vm *VM) clone(self Object) (Object, error) {
+	var res Object
+	switch self.typ {
+	case TypeTable:
+		res = vm.ss.newObject(TypeTable, self.table().clone())
+	case TypeInstance:
+		res = vm.ss.newObject(TypeInstance, self.instance().clone())
+	case TypeArray:
+		return vm.ss.newObject(TypeArray, self.array().clone()), nil
+	default:
+		return Null, vm.raise("cloning a %s", self.typ)
+	}
+	if mm, ok := vm.getMetaMethod(res, mmCloned); ok {
+		vm.push(res)
+		vm.push(self)
+		if _, err := vm.callMetaMethod(mm, 2); err != nil {
+			return Null, err
+		}
+	}
+	return res, nil
+}
+
+func (vm *VM) typeOf(o Object) (Object, error) {
+	if mm, ok := vm.getMetaMethod(o, mmTypeOf); ok {
+		vm.push(o)
+		return vm.callMetaMethod(mm, 1)
+	}
+	return StringValue(o.typ.String()), nil
+}
+
+func (vm *VM) classOp(baseIdx, attrsIdx int) (Object, error) {
+	var base *class
+	if baseIdx != -1 {
+		b := vm.stack[vm.stackBase+baseIdx]
+		if b.typ != TypeClass {
+			return Null, vm.raise("trying to inherit from a %s", b.typ)
+		}
+		base = b.class()
+	}
+	var attrs Object
+	if attrsIdx != MaxFuncStackSize {
+		attrs = vm.stack[vm.stackBase+attrsIdx]
+	}
+	c := newClass(base)
+	res := vm.ss.newObject(TypeClass, c)
+	if mm := c.metaMethods[mmInherited]; !mm.IsNull() {
+		vm.push(res)
+		vm.push(attrs)
+		if _, err := vm.callMetaMethod(mm, 2); err != nil {
+			return Null, err
+		}
+	}
+	assign(&c.attributes, attrs)
+	return res, nil
+}
+
+func (vm *VM) createClassInstance(c *class) (Object, Object) {
+	inst := vm.ss.newObject(TypeInstance, c.createInstance())
+	ctor, _ := c.constructor()
+	return inst, ctor
+}
+
+// toString converts any object to a string, honouring _tostring.
+func (vm *VM) toString(o Object) (string, error) {
+	switch o.typ {
+	case TypeString:
+		return o.Str(), nil
+	case TypeFloat:
+		return strconv.FormatFloat(o.Float(), 'g', 6, 64), nil
+	case TypeInteger:
+		return strconv.FormatInt(o.Integer(), 10), nil
+	case TypeBool:
+		if o.Bool() {
+			return "true", nil
+		}
+		return "false", nil
+	case TypeNull:
+		return "null", nil
+	case TypeTable, TypeUserData, TypeInstance:
+		if mm, ok := vm.getMetaMethod(o, mmToString); ok {
+			vm.push(o)
+			res, err := vm.callMetaMethod(mm, 1)
+			if err != nil {
+				return "", err
+			}
+			if res.typ == TypeString {
+				return res.Str(), nil
+			}
+		}
+	}
+	return fmt.Sprintf("(%s : 0x%08x)", o.typ, o.address()), nil
+}
+
+// printObjVal formats values for error messages.
+func (vm *VM) printObjVal(o Object) string {
+	switch o.typ {
+	case TypeString:
+		return o.Str()
+	case TypeInteger:
+		return strconv.FormatInt(o.Integer(), 10)
+	case TypeFloat:
+		return strconv.FormatFloat(o.Float(), 'f', 14, 64)
+	}
+	return o.typ.String()
+}
@@ -0,0 +1,101 @@
+package sched
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// Future is the result of an operation running in the background. It
+// can be resolved from any goroutine.
+type Future struct {
+	once  sync.Once
+	done  chan struct{}
+	value any
+	err   error
+}
+
+func NewFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Go runs fn on a new goroutine and returns the future of its result.
+func Go(fn func() (any, error)) *Future {
+	f := NewFuture()
+	go func() {
+		f.Resolve(fn())
+	}()
+	return f
+}
+
+// Resolve sets the result of the future. Only the first call has any
+// effect.
+func (f *Future) Resolve(value any, err error) {
+	f.once.Do(func() {
+		f.value, f.err = value, err
+		close(f.done)
+	})
+}
+
+// Done returns a channel that is closed once the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is resolved and returns its result.
+func (f *Future) Wait() (any, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// checkAwaitable reports whether v is a future or a channel that can be
+// received from.
+func checkAwaitable(v any) error {
+	if _, ok := v.(*Future); ok {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Chan && rv.Type().ChanDir()&reflect.RecvDir != 0 {
+		return nil
+	}
+	return fmt.Errorf("cannot await a %T", v)
+}
+
+// wait blocks until v, a future or a channel, yields a value. A value
+// received that is an error becomes the error of the result, a closed
+// channel results in null.
+func wait(v any) (any, error) {
+	var value any
+	var err error
+	if f, ok := v.(*Future); ok {
+		value, err = f.Wait()
+	} else if x, ok := reflect.ValueOf(v).Recv(); ok {
+		value = x.Interface()
+	}
+	if e, ok := value.(error); ok && err == nil {
+		return nil, e
+	}
+	return value, err
+}
+
+// PushFunc pushes a value that PushGoValue can't convert by itself. It
+// runs on the goroutine of the VM.
+type PushFunc func(vm *sqvm.VM) error
+
+// push pushes the result of an operation, converted with PushGoValue
+// unless it pushes itself. Byte slices, such as the bodies of responses,
+// become strings rather than arrays of integers.
+func push(vm *sqvm.VM, v any) error {
+	switch v := v.(type) {
+	case []byte:
+		vm.PushString(string(v))
+		return nil
+	case PushFunc:
+		return v(vm)
+	case func(vm *sqvm.VM) error:
+		return v(vm)
+	}
+	return vm.PushGoValue(v)
+}
@@ -0,0 +1,265 @@
+// Package sched runs script threads cooperatively on top of a VM.
+//
+// Native functions created with Scheduler.Async return a future or a
+// channel instead of a value. The script thread that called them is
+// parked until the result arrives while the other threads keep running.
+// All script code, including resuming the parked threads, runs on the
+// goroutine that calls Run, so the VM never needs locking:
+//
+//	s := sched.New(vm)
+//	vm.PushRootTable()
+//	vm.PushString("http_get")
+//	vm.NewClosure(s.Async(func(vm *sqvm.VM) (any, error) {
+//		url := vm.GetString(2)
+//		return sched.Go(func() (any, error) {
+//			return fetch(url)
+//		}), nil
+//	}), 0)
+//	vm.NewSlot(-3, false)
+//	vm.Pop(1)
+//
+//	// push a closure and its arguments, "this" included
+//	s.Spawn(1)
+//	err := s.Run(ctx)
+//
+// A thread that calls suspend() lets the others run and is resumed with
+// null when its turn comes again.
+package sched
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+// AsyncFunc is a native function whose result becomes available later.
+// It returns a *Future or a channel the result is received from.
+type AsyncFunc func(vm *sqvm.VM) (any, error)
+
+// Task is a script thread run by the scheduler.
+type Task struct {
+	thread  *sqvm.VM
+	handle  sqvm.Object
+	nArgs   int
+	started bool
+	waiting bool
+	done    bool
+	err     error
+
+	// result of the operation the thread waits for
+	value    any
+	valueErr error
+	// dropped is closed when the scheduler stops waiting for the result
+	dropped chan struct{}
+}
+
+// Done reports whether the thread has finished.
+func (t *Task) Done() bool {
+	return t.done
+}
+
+// Err returns the error the thread failed with, if any.
+func (t *Task) Err() error {
+	return t.err
+}
+
+type completion struct {
+	task  *Task
+	value any
+	err   error
+}
+
+type Scheduler struct {
+	vm       *sqvm.VM
+	tasks    map[*sqvm.VM]*Task
+	ready    []*Task
+	nWaiting int
+	results  chan completion
+}
+
+func New(vm *sqvm.VM) *Scheduler {
+	return &Scheduler{
+		vm:      vm,
+		tasks:   map[*sqvm.VM]*Task{},
+		results: make(chan completion),
+	}
+}
+
+// Spawn creates a thread calling the closure found below the nArgs
+// arguments on top of the stack. The closure and the arguments are
+// popped. The thread starts running when Run is called.
+func (s *Scheduler) Spawn(nArgs int) *Task {
+	thread := s.vm.NewThread(sqvm.ThreadStackSize)
+	t := &Task{
+		thread: thread,
+		handle: s.vm.GetStackObject(-1),
+		nArgs:  nArgs,
+	}
+	s.vm.AddRef(t.handle)
+	for i := 0; i <= nArgs; i++ {
+		thread.Move(s.vm, -(nArgs + 2 - i))
+	}
+	s.vm.Pop(nArgs + 2)
+	s.tasks[thread] = t
+	s.ready = append(s.ready, t)
+	return t
+}
+
+// Async wraps fn into a native function that parks the calling thread
+// until the result of fn is available. Called outside of a thread of the
+// scheduler it blocks instead.
+func (s *Scheduler) Async(fn AsyncFunc) sqvm.NativeFunc {
+	return func(vm *sqvm.VM) (int, error) {
+		v, err := fn(vm)
+		if err != nil {
+			return 0, err
+		}
+		return s.Await(vm, v)
+	}
+}
+
+// Await returns the result of v, a *Future or a channel, from a native
+// function. See Async.
+func (s *Scheduler) Await(vm *sqvm.VM, v any) (int, error) {
+	if err := checkAwaitable(v); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	t, ok := s.tasks[vm]
+	if !ok {
+		value, err := wait(v)
+		return pushResult(vm, value, err)
+	}
+	vm.PushNull()
+	n, err := vm.SuspendVM()
+	if n == 0 {
+		// can't suspend through other natives, nothing is waiting yet
+		return n, err
+	}
+	t.waiting = true
+	t.dropped = make(chan struct{})
+	s.nWaiting++
+	go func(dropped <-chan struct{}) {
+		value, err := wait(v)
+		select {
+		case s.results <- completion{task: t, value: value, err: err}:
+		case <-dropped:
+		}
+	}(t.dropped)
+	return n, err
+}
+
+func pushResult(vm *sqvm.VM, value any, err error) (int, error) {
+	if err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	if err := push(vm, value); err != nil {
+		return vm.ThrowError("%s", err)
+	}
+	return 1, nil
+}
+
+// Run runs the threads until all of them have finished or ctx is done.
+// Errors of the threads are reported by their tasks, Run only fails if
+// ctx does. The threads waiting for a result are then dropped, their
+// tasks fail with the error of ctx; the others run again at the next
+// call of Run.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for len(s.ready) > 0 || s.nWaiting > 0 {
+		if len(s.ready) == 0 {
+			select {
+			case c := <-s.results:
+				s.complete(c)
+			case <-ctx.Done():
+				s.dropWaiting(ctx.Err())
+				return ctx.Err()
+			}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			s.dropWaiting(err)
+			return err
+		}
+		s.pollResults()
+		t := s.ready[0]
+		s.ready = s.ready[1:]
+		s.step(t)
+	}
+	return nil
+}
+
+// pollResults takes the results that already arrived without blocking.
+func (s *Scheduler) pollResults() {
+	for {
+		select {
+		case c := <-s.results:
+			s.complete(c)
+		default:
+			return
+		}
+	}
+}
+
+// dropWaiting ends the tasks waiting for a result with err.
+func (s *Scheduler) dropWaiting(err error) {
+	for _, t := range s.tasks {
+		if t.waiting {
+			t.waiting = false
+			close(t.dropped)
+			s.finish(t, err)
+		}
+	}
+	s.nWaiting = 0
+}
+
+func (s *Scheduler) complete(c completion) {
+	if c.task.done {
+		// dropped while its result was being sent
+		return
+	}
+	c.task.waiting = false
+	c.task.value, c.task.valueErr = c.value, c.err
+	s.nWaiting--
+	s.ready = append(s.ready, c.task)
+}
+
+// step runs t until it suspends or finishes.
+func (s *Scheduler) step(t *Task) {
+	var err error
+	if !t.started {
+		t.started = true
+		err = t.thread.Call(t.nArgs, false, true)
+	} else {
+		err = s.wakeup(t)
+	}
+	if err == nil && t.thread.GetVMState() == sqvm.VMStateSuspended {
+		if !t.waiting {
+			// suspended by the script, let the others run
+			s.ready = append(s.ready, t)
+		}
+		return
+	}
+	s.finish(t, err)
+}
+
+func (s *Scheduler) finish(t *Task, err error) {
+	t.done = true
+	t.err = err
+	delete(s.tasks, t.thread)
+	s.vm.Release(t.handle)
+}
+
+// wakeup resumes t with the result it waits for.
+func (s *Scheduler) wakeup(t *Task) error {
+	value, err := t.value, t.valueErr
+	t.value, t.valueErr = nil, nil
+	if err == nil {
+		err = push(t.thread, value)
+		if err == nil {
+			return t.thread.WakeupVM(true, false, true, false)
+		}
+	}
+	t.thread.PushString(fmt.Sprint(err))
+	t.thread.ThrowObject()
+	return t.thread.WakeupVM(false, false, true, true)
+}
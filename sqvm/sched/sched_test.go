@@ -0,0 +1,129 @@
+package sched_test
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+	"github.com/dexter3k/go-squirrel/sqvm/sched"
+)
+
+func register(vm *sqvm.VM, name string, fn sqvm.NativeFunc) {
+	vm.PushRootTable()
+	vm.PushString(name)
+	vm.NewClosure(fn, 0)
+	vm.NewSlot(-3, false)
+	vm.Pop(1)
+}
+
+// spawn compiles src and spawns a thread running it.
+func spawn(t *testing.T, vm *sqvm.VM, s *sched.Scheduler, src string) *sched.Task {
+	t.Helper()
+	if _, err := compiler.Compile(vm, t.Name(), strings.NewReader(src), false); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	vm.PushRootTable()
+	return s.Spawn(1)
+}
+
+func TestRun(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	s := sched.New(vm)
+	var got []int64
+	register(vm, "get", s.Async(func(vm *sqvm.VM) (any, error) {
+		n := vm.GetInteger(2)
+		return sched.Go(func() (any, error) {
+			time.Sleep(time.Duration(n) * time.Millisecond)
+			return n, nil
+		}), nil
+	}))
+	register(vm, "report", func(vm *sqvm.VM) (int, error) {
+		got = append(got, vm.GetInteger(2))
+		return 0, nil
+	})
+	a := spawn(t, vm, s, `report(get(20))`)
+	b := spawn(t, vm, s, `report(get(1))`)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Done() || !b.Done() || a.Err() != nil || b.Err() != nil {
+		t.Fatalf("tasks not done cleanly: %v, %v", a.Err(), b.Err())
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 20 {
+		t.Fatalf("got %v, want [1 20]", got)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	s := sched.New(vm)
+	release := make(chan struct{})
+	register(vm, "get", s.Async(func(vm *sqvm.VM) (any, error) {
+		return sched.Go(func() (any, error) {
+			<-release
+			return 1, nil
+		}), nil
+	}))
+	before := runtime.NumGoroutine()
+	task := spawn(t, vm, s, `get()`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run returned %v, want the deadline", err)
+	}
+	if !task.Done() || !errors.Is(task.Err(), context.DeadlineExceeded) {
+		t.Fatalf("the waiting task was not dropped: %v", task.Err())
+	}
+
+	finished := make(chan error)
+	go func() {
+		finished <- s.Run(context.Background())
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run blocked after a cancellation")
+	}
+
+	// the result arriving late must not block its goroutine
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResultBytes(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	s := sched.New(vm)
+	register(vm, "fetch", s.Async(func(vm *sqvm.VM) (any, error) {
+		return sched.Go(func() (any, error) {
+			return []byte("body"), nil
+		}), nil
+	}))
+	task := spawn(t, vm, s, `
+		local data = fetch()
+		if (typeof data != "string" || data != "body") throw "got " + typeof data
+	`)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if task.Err() != nil {
+		t.Fatal(task.Err())
+	}
+}
@@ -0,0 +1,488 @@
+package sqvm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// BytecodeTag starts every serialized closure, loaders look for it to
+// tell bytecode from source code.
+const BytecodeTag = 0xFAFA
+
+// IsBytecode reports whether r starts with BytecodeTag, a closure to read
+// with ReadClosure rather than source code. Nothing is consumed.
+func IsBytecode(r *bufio.Reader) bool {
+	head, _ := r.Peek(2)
+	return len(head) == 2 && binary.LittleEndian.Uint16(head) == BytecodeTag
+}
+
+// Tags of the closure stream, written as little endian 32 bit integers
+const (
+	streamHead = 'S'<<24 | 'Q'<<16 | 'I'<<8 | 'R'
+	streamPart = 'P'<<24 | 'A'<<16 | 'R'<<8 | 'T'
+	streamTail = 'T'<<24 | 'A'<<16 | 'I'<<8 | 'L'
+)
+
+// Raw type values of the reference implementation, used to tag the
+// serialized literals
+const (
+	rawTypeNull    = 0x01000001
+	rawTypeInteger = 0x05000002
+	rawTypeFloat   = 0x05000004
+	rawTypeBool    = 0x01000008
+	rawTypeString  = 0x08000010
+)
+
+var errCorruptStream = errors.New("invalid or corrupted closure stream")
+
+// WriteClosure serializes proto in the format of sq_writeclosure, as
+// produced by the default 64 bit builds of the reference implementation:
+// integers take 8 bytes and floats 4, so float literals lose precision.
+// Only functions that have no outer values can be written.
+func WriteClosure(w io.Writer, proto *FuncProto) error {
+	return writeClosure(w, proto, 4)
+}
+
+// WriteClosureDouble is like WriteClosure but writes 8 byte floats, as
+// the reference implementation built with SQUSEDOUBLE does. Only those
+// builds can load the result.
+func WriteClosureDouble(w io.Writer, proto *FuncProto) error {
+	return writeClosure(w, proto, 8)
+}
+
+func writeClosure(w io.Writer, proto *FuncProto, floatSize int) error {
+	if len(proto.OuterValues) > 0 {
+		return errors.New("a closure with free variables bound cannot be serialized")
+	}
+	cw := &closureWriter{w: w, floatSize: floatSize}
+	cw.u16(BytecodeTag)
+	cw.u32(streamHead)
+	cw.u32(1)                 // sizeof(SQChar)
+	cw.u32(8)                 // sizeof(SQInteger)
+	cw.u32(uint32(floatSize)) // sizeof(SQFloat)
+	cw.proto(proto)
+	cw.u32(streamTail)
+	return cw.err
+}
+
+type closureWriter struct {
+	w         io.Writer
+	floatSize int
+	buf       [8]byte
+	err       error
+}
+
+func (cw *closureWriter) write(p []byte) {
+	if cw.err != nil {
+		return
+	}
+	if _, err := cw.w.Write(p); err != nil {
+		cw.err = fmt.Errorf("io error (write function failure): %w", err)
+	}
+}
+
+func (cw *closureWriter) u16(v uint16) {
+	binary.LittleEndian.PutUint16(cw.buf[:], v)
+	cw.write(cw.buf[:2])
+}
+
+func (cw *closureWriter) u32(v uint32) {
+	binary.LittleEndian.PutUint32(cw.buf[:], v)
+	cw.write(cw.buf[:4])
+}
+
+func (cw *closureWriter) int(v int64) {
+	binary.LittleEndian.PutUint64(cw.buf[:], uint64(v))
+	cw.write(cw.buf[:8])
+}
+
+func (cw *closureWriter) object(o Object) {
+	switch o.typ {
+	case TypeNull:
+		cw.u32(rawTypeNull)
+	case TypeInteger:
+		cw.u32(rawTypeInteger)
+		cw.int(o.Integer())
+	case TypeBool:
+		cw.u32(rawTypeBool)
+		cw.int(int64(o.num))
+	case TypeFloat:
+		cw.u32(rawTypeFloat)
+		if cw.floatSize == 4 {
+			cw.u32(math.Float32bits(float32(o.Float())))
+		} else {
+			cw.int(int64(o.num))
+		}
+	case TypeString:
+		cw.u32(rawTypeString)
+		cw.int(int64(len(o.Str())))
+		cw.write([]byte(o.Str()))
+	default:
+		if cw.err == nil {
+			cw.err = fmt.Errorf("cannot serialize a %s", o.typ)
+		}
+	}
+}
+
+// name writes the name of a function, anonymous ones have none.
+func (cw *closureWriter) name(s string) {
+	if s == "" {
+		cw.object(Null)
+		return
+	}
+	cw.object(StringValue(s))
+}
+
+func (cw *closureWriter) proto(p *FuncProto) {
+	cw.u32(streamPart)
+	cw.object(StringValue(p.SourceName))
+	cw.name(p.Name)
+
+	cw.u32(streamPart)
+	for _, n := range []int{
+		len(p.Literals), len(p.Parameters), len(p.OuterValues),
+		len(p.LocalVarInfos), len(p.LineInfos), len(p.DefaultParams),
+		len(p.Instructions), len(p.Functions),
+	} {
+		cw.int(int64(n))
+	}
+
+	cw.u32(streamPart)
+	for _, o := range p.Literals {
+		cw.object(o)
+	}
+
+	cw.u32(streamPart)
+	for _, name := range p.Parameters {
+		cw.object(StringValue(name))
+	}
+
+	cw.u32(streamPart)
+	for _, ov := range p.OuterValues {
+		cw.int(int64(ov.Type))
+		cw.object(IntegerValue(int64(ov.Src)))
+		cw.object(StringValue(ov.Name))
+	}
+
+	cw.u32(streamPart)
+	for _, lv := range p.LocalVarInfos {
+		cw.object(StringValue(lv.Name))
+		cw.int(int64(lv.Pos))
+		cw.int(int64(lv.StartOp))
+		cw.int(int64(lv.EndOp))
+	}
+
+	cw.u32(streamPart)
+	for _, li := range p.LineInfos {
+		cw.int(int64(li.Line))
+		cw.int(int64(li.Op))
+	}
+
+	cw.u32(streamPart)
+	for _, dp := range p.DefaultParams {
+		cw.int(int64(dp))
+	}
+
+	cw.u32(streamPart)
+	for _, i := range p.Instructions {
+		binary.LittleEndian.PutUint32(cw.buf[:], uint32(i.Arg1))
+		cw.buf[4] = byte(i.Op)
+		cw.buf[5] = i.Arg0
+		cw.buf[6] = i.Arg2
+		cw.buf[7] = i.Arg3
+		cw.write(cw.buf[:8])
+	}
+
+	cw.u32(streamPart)
+	for _, f := range p.Functions {
+		cw.proto(f)
+	}
+
+	cw.int(int64(p.StackSize))
+	if p.IsGenerator {
+		cw.write([]byte{1})
+	} else {
+		cw.write([]byte{0})
+	}
+	if p.VarParams {
+		cw.int(1)
+	} else {
+		cw.int(0)
+	}
+}
+
+// ReadClosure reads a function serialized by WriteClosure,
+// WriteClosureDouble or sq_writeclosure. Integers and floats of 4 or 8
+// bytes are accepted, whatever the build that wrote the stream.
+func ReadClosure(r io.Reader) (*FuncProto, error) {
+	cr := &closureReader{r: r}
+	if tag := cr.u16(); cr.err == nil && tag != BytecodeTag {
+		return nil, errors.New("invalid stream")
+	}
+	cr.tag(streamHead)
+	cr.tag(1)
+	if n := cr.u32(); n != 4 && n != 8 {
+		cr.fail()
+	} else {
+		cr.intSize = int(n)
+	}
+	if n := cr.u32(); n != 4 && n != 8 {
+		cr.fail()
+	} else {
+		cr.floatSize = int(n)
+	}
+	p := cr.proto()
+	cr.tag(streamTail)
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	return p, nil
+}
+
+// maxStreamCount bounds the sizes read from a stream, larger ones can
+// only come from corrupted data.
+const maxStreamCount = 1 << 30
+
+type closureReader struct {
+	r         io.Reader
+	buf       [8]byte
+	intSize   int
+	floatSize int
+	err       error
+}
+
+func (cr *closureReader) fail() {
+	if cr.err == nil {
+		cr.err = errCorruptStream
+	}
+}
+
+func (cr *closureReader) read(p []byte) {
+	if cr.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(cr.r, p); err != nil {
+		cr.readError(err)
+	}
+}
+
+func (cr *closureReader) readError(err error) {
+	cr.err = fmt.Errorf("io error, read function failure, the origin stream could be corrupted/truncated: %w", err)
+}
+
+func (cr *closureReader) u16() uint16 {
+	cr.read(cr.buf[:2])
+	if cr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(cr.buf[:])
+}
+
+func (cr *closureReader) u32() uint32 {
+	cr.read(cr.buf[:4])
+	if cr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(cr.buf[:])
+}
+
+func (cr *closureReader) tag(want uint32) {
+	if got := cr.u32(); cr.err == nil && got != want {
+		cr.fail()
+	}
+}
+
+// int reads an SQInteger of the size given by the stream header.
+func (cr *closureReader) int() int64 {
+	if cr.intSize == 4 {
+		return int64(int32(cr.u32()))
+	}
+	cr.read(cr.buf[:8])
+	if cr.err != nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(cr.buf[:]))
+}
+
+func (cr *closureReader) float() float64 {
+	if cr.floatSize == 4 {
+		return float64(math.Float32frombits(cr.u32()))
+	}
+	cr.read(cr.buf[:8])
+	if cr.err != nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(cr.buf[:]))
+}
+
+func (cr *closureReader) count() int {
+	n := cr.int()
+	if n < 0 || n > maxStreamCount {
+		cr.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (cr *closureReader) object() Object {
+	switch t := cr.u32(); t {
+	case rawTypeNull:
+		return Null
+	case rawTypeInteger:
+		return IntegerValue(cr.int())
+	case rawTypeBool:
+		return BoolValue(cr.int() != 0)
+	case rawTypeFloat:
+		return FloatValue(cr.float())
+	case rawTypeString:
+		n := cr.count()
+		if cr.err != nil {
+			return Null
+		}
+		// Don't trust the length before the data is there
+		var sb strings.Builder
+		if _, err := io.CopyN(&sb, cr.r, int64(n)); err != nil {
+			cr.readError(err)
+			return Null
+		}
+		return StringValue(sb.String())
+	default:
+		if cr.err == nil {
+			cr.err = fmt.Errorf("cannot serialize a %s", rawTypeName(t))
+		}
+		return Null
+	}
+}
+
+// rawTypeName names a raw type value of the reference implementation,
+// the low bits tell the type apart.
+func rawTypeName(t uint32) string {
+	names := []string{
+		"null", "integer", "float", "bool", "string", "table", "array",
+		"userdata", "function", "function", "generator", "userpointer",
+		"thread", "function", "class", "instance", "weakref", "outer",
+	}
+	for i, name := range names {
+		if t&0x00FFFFFF == 1<<i {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+func (cr *closureReader) string() string {
+	o := cr.object()
+	if o.typ != TypeString {
+		cr.fail()
+	}
+	return o.Str()
+}
+
+func (cr *closureReader) proto() *FuncProto {
+	p := &FuncProto{}
+	cr.tag(streamPart)
+	p.SourceName = cr.string()
+	if name := cr.object(); name.typ == TypeString {
+		p.Name = name.Str()
+	} else if name.typ != TypeNull {
+		cr.fail()
+	}
+
+	cr.tag(streamPart)
+	nLiterals := cr.count()
+	nParameters := cr.count()
+	nOuterValues := cr.count()
+	nLocalVarInfos := cr.count()
+	nLineInfos := cr.count()
+	nDefaultParams := cr.count()
+	nInstructions := cr.count()
+	nFunctions := cr.count()
+	if cr.err != nil {
+		return nil
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nLiterals && cr.err == nil; i++ {
+		p.Literals = append(p.Literals, cr.object())
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nParameters && cr.err == nil; i++ {
+		p.Parameters = append(p.Parameters, cr.string())
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nOuterValues && cr.err == nil; i++ {
+		// The reference writes a 4 byte enum as an SQUnsignedInteger, the
+		// high half is padding
+		t := OuterType(uint32(cr.int()))
+		src := cr.object()
+		if src.typ != TypeInteger || (t != OuterLocal && t != OuterOuter) {
+			cr.fail()
+		}
+		p.OuterValues = append(p.OuterValues, OuterValue{
+			Type: t,
+			Src:  int(src.Integer()),
+			Name: cr.string(),
+		})
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nLocalVarInfos && cr.err == nil; i++ {
+		p.LocalVarInfos = append(p.LocalVarInfos, LocalVarInfo{
+			Name:    cr.string(),
+			Pos:     int(cr.int()),
+			StartOp: int(cr.int()),
+			EndOp:   int(cr.int()),
+		})
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nLineInfos && cr.err == nil; i++ {
+		p.LineInfos = append(p.LineInfos, LineInfo{
+			Line: int(cr.int()),
+			Op:   int(cr.int()),
+		})
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nDefaultParams && cr.err == nil; i++ {
+		p.DefaultParams = append(p.DefaultParams, int(cr.int()))
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nInstructions && cr.err == nil; i++ {
+		cr.read(cr.buf[:8])
+		in := Instruction{
+			Arg1: int32(binary.LittleEndian.Uint32(cr.buf[:])),
+			Op:   Opcode(cr.buf[4]),
+			Arg0: cr.buf[5],
+			Arg2: cr.buf[6],
+			Arg3: cr.buf[7],
+		}
+		if int(in.Op) >= len(opcodeNames) {
+			cr.fail()
+		}
+		p.Instructions = append(p.Instructions, in)
+	}
+
+	cr.tag(streamPart)
+	for i := 0; i < nFunctions && cr.err == nil; i++ {
+		p.Functions = append(p.Functions, cr.proto())
+	}
+
+	p.StackSize = int(cr.int())
+	var generator [1]byte
+	cr.read(generator[:])
+	p.IsGenerator = generator[0] != 0
+	p.VarParams = cr.int() != 0
+	if p.StackSize < 0 {
+		cr.fail()
+	}
+	return p
+}
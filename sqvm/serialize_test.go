@@ -0,0 +1,152 @@
+package sqvm_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/compiler"
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+const roundTripSrc = `
+class Point {
+	x = 0
+	y = 0
+	constructor(x, y) { this.x = x; this.y = y }
+	function len2() { return x * x + y * y }
+}
+local f = function(a, ...) { return a + vargv.len() }
+local t = {s = "str", n = null, b = true, fl = 0.5}
+local r = f(1, 2, 3) + Point(3, 4).len2() + t.s.len() + t.fl * 2
+if (t.n != null || !t.b) throw "bad literals"
+return r
+`
+
+func TestClosureRoundTrip(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	proto, err := compiler.Compile(vm, t.Name(), strings.NewReader(roundTripSrc), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Pop(1)
+	var buf bytes.Buffer
+	if err := sqvm.WriteClosure(&buf, proto); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if !sqvm.IsBytecode(bufio.NewReader(bytes.NewReader(data))) {
+		t.Fatal("written closure is not detected as bytecode")
+	}
+	if sqvm.IsBytecode(bufio.NewReader(strings.NewReader(roundTripSrc))) {
+		t.Fatal("source code is detected as bytecode")
+	}
+
+	loaded, err := sqvm.ReadClosure(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := sqvm.WriteClosure(&again, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), data) {
+		t.Fatal("the loaded closure serializes differently")
+	}
+
+	vm.PushClosure(loaded)
+	vm.PushRootTable()
+	if err := vm.Call(1, true, false); err != nil {
+		t.Fatal(err)
+	}
+	// 1 + 2 varargs, 25, 3, 1.0
+	if got := vm.GetFloat(-1); got != 32 {
+		t.Fatalf("loaded closure returned %v, want 32", got)
+	}
+}
+
+func TestReadClosureTruncated(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	proto, err := compiler.Compile(vm, t.Name(), strings.NewReader(roundTripSrc), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := sqvm.WriteClosure(&buf, proto); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 2, 16, buf.Len() / 2, buf.Len() - 1} {
+		if _, err := sqvm.ReadClosure(bytes.NewReader(buf.Bytes()[:n])); err == nil {
+			t.Errorf("reading %d of %d bytes succeeded", n, buf.Len())
+		}
+	}
+}
+
+func TestClosureFloatSize(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	proto, err := compiler.Compile(vm, t.Name(), strings.NewReader(`return 0.1`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Pop(1)
+	for _, c := range []struct {
+		write     func(w io.Writer, p *sqvm.FuncProto) error
+		floatSize uint32
+		want      float64
+	}{
+		{sqvm.WriteClosure, 4, float64(float32(0.1))},
+		{sqvm.WriteClosureDouble, 8, 0.1},
+	} {
+		var buf bytes.Buffer
+		if err := c.write(&buf, proto); err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.LittleEndian.Uint32(buf.Bytes()[14:]); got != c.floatSize {
+			t.Errorf("sizeof(SQFloat) is %d, want %d", got, c.floatSize)
+		}
+		loaded, err := sqvm.ReadClosure(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm.PushClosure(loaded)
+		vm.PushRootTable()
+		if err := vm.Call(1, true, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := vm.GetFloat(-1); got != c.want {
+			t.Errorf("%d byte floats: got %v, want %v", c.floatSize, got, c.want)
+		}
+		vm.Pop(2)
+	}
+}
+
+// testdata/fixture.cnut has the layout of the default 64 bit builds of the
+// reference implementation: 8 byte integers and 4 byte floats.
+func TestReadClosureFixture(t *testing.T) {
+	data, err := os.ReadFile("testdata/fixture.cnut")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	proto, err := sqvm.ReadClosure(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.PushClosure(proto)
+	vm.PushRootTable()
+	if err := vm.Call(1, true, false); err != nil {
+		t.Fatal(err)
+	}
+	// 0.25 + 5! + "bc".len()
+	if got := vm.GetFloat(-1); got != 122.25 {
+		t.Fatalf("fixture returned %v, want 122.25", got)
+	}
+}
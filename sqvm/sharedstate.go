@@ -0,0 +1,103 @@
+package sqvm
+
+import (
+	"context"
+)
+
+type metaMethod int
+
+const (
+	mmAdd metaMethod = iota
+	mmSub
+	mmMul
+	mmDiv
+	mmUnm
+	mmModulo
+	mmSet
+	mmGet
+	mmTypeOf
+	mmNextI
+	mmCmp
+	mmCall
+	mmCloned
+	mmNewSlot
+	mmDelSlot
+	mmToString
+	mmNewMember
+	mmInherited
+
+	metaMethodCount
+)
+
+var metaMethodNames = [metaMethodCount]string{
+	"_add", "_sub", "_mul", "_div", "_unm", "_modulo", "_set", "_get",
+	"_typeof", "_nexti", "_cmp", "_call", "_cloned", "_newslot", "_delslot",
+	"_tostring", "_newmember", "_inherited",
+}
+
+// sharedState is shared between a VM and all the threads created from it.
+type sharedState struct {
+	metaMethods map[string]metaMethod
+
+	registry Object
+	consts   Object
+	refs     map[tableKey]*objectRef
+
+	defaultDelegates [TypeOuter + 1]Object
+
+	rootVM  *VM
+	vms     []*VM // the root vm and all live threads
+	gcChain *gcHeader
+	// zeroRefs are the objects whose count dropped to zero, fresh the
+	// new objects not referenced yet, freshKept how many of those were
+	// kept at the last check. The spare slices are reused as buffers.
+	zeroRefs   []gcObject
+	fresh      []gcObject
+	freshKept  int
+	spareRefs  []gcObject
+	spareFresh []gcObject
+	releasing  bool // releaseDropped is running
+	gcEpoch    uint32
+	// nesting counts the calls into the VM running on the Go stack
+	nesting int
+
+	printFunc PrintFunc
+	errorFunc PrintFunc
+
+	compilerErrorHandler CompilerErrorHandler
+	debugInfo            bool
+
+	limits       Limits
+	limited      bool // an instruction or allocation budget is set
+	instructions int64
+	allocated    int64
+
+	// ctx is the context of the running CallContext, done its channel,
+	// nil when nothing can cancel the scripts
+	ctx  context.Context
+	done <-chan struct{}
+}
+
+func newSharedState() *sharedState {
+	ss := &sharedState{
+		metaMethods: make(map[string]metaMethod, metaMethodCount),
+		refs:        make(map[tableKey]*objectRef),
+	}
+	assign(&ss.registry, ss.newObject(TypeTable, newTable(0)))
+	assign(&ss.consts, ss.newObject(TypeTable, newTable(0)))
+	ss.initDefaultDelegates()
+	for i, name := range metaMethodNames {
+		ss.metaMethods[name] = metaMethod(i)
+	}
+	return ss
+}
+
+func (ss *sharedState) metaMethodIndex(key Object) metaMethod {
+	if key.typ != TypeString {
+		return -1
+	}
+	if mm, ok := ss.metaMethods[key.Str()]; ok {
+		return mm
+	}
+	return -1
+}
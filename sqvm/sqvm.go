@@ -1,92 +1,761 @@
 package sqvm
 
+import (
+	"fmt"
+)
+
+// MatchTypeMask makes SetParamsCheck expect exactly as many parameters as
+// the typemask describes.
+const MatchTypeMask = -0x7FFFFFFF
+
 type PrintFunc func(vm *VM, format string, args ...any)
 
+// CompilerErrorHandler is told about the errors of the compilations that
+// raise them.
+type CompilerErrorHandler func(vm *VM, desc, source string, line, column int)
+
 type VM struct {
+	gcHeader // used when the vm is a thread
+
+	ss *sharedState
+
+	stack     []Object
+	top       int
+	stackBase int
+
+	callStack  []*callInfo
+	ci         *callInfo
+	traps      []exceptionTrap
+	openOuters *outer
+
+	rootTable    Object
+	lastError    Object
+	errorHandler Object
+
+	debugHook        DebugHook
+	debugHookClosure Object
+	debugHooked      bool // set while a hook is installed and not running
+
+	nNativeCalls int
+
+	suspended       bool
+	suspendedTarget int
+	suspendedTraps  int
+	suspendedValue  Object
 }
 
 func Open(initialStackSize uint) *VM {
-	return &VM{}
+	vm := &VM{
+		ss:    newSharedState(),
+		stack: make([]Object, initialStackSize+minStackOverhead),
+	}
+	vm.ss.rootVM = vm
+	vm.ss.vms = append(vm.ss.vms, vm)
+	assign(&vm.rootTable, vm.ss.newObject(TypeTable, newTable(0)))
+	return vm
 }
 
+// Close releases all the objects of the VM, running their release hooks.
+// Threads are released like other objects, closing one only empties its
+// stack.
 func (vm *VM) Close() {
+	vm.reset()
+	if vm != vm.ss.rootVM {
+		return
+	}
+	assign(&vm.rootTable, Null)
+	assign(&vm.errorHandler, Null)
+	assign(&vm.debugHookClosure, Null)
+	assign(&vm.lastError, Null)
+	assign(&vm.ss.registry, Null)
+	assign(&vm.ss.consts, Null)
+	for i := range vm.ss.defaultDelegates {
+		assign(&vm.ss.defaultDelegates[i], Null)
+	}
+	for _, ref := range vm.ss.refs {
+		decRef(ref.obj)
+	}
+	vm.ss.refs = make(map[tableKey]*objectRef)
+	vm.ss.collect()
+	vm.ss.zeroRefs = nil
+	vm.ss.fresh = nil
+	vm.ss.freshKept = 0
 }
 
 func (vm *VM) SetPrintFunc(onPrint, onError PrintFunc) {
+	vm.ss.printFunc = onPrint
+	vm.ss.errorFunc = onError
+}
+
+// PrintFunc returns the function set with SetPrintFunc for normal output.
+func (vm *VM) PrintFunc() PrintFunc {
+	return vm.ss.printFunc
+}
+
+// ErrorFunc returns the function set with SetPrintFunc for error output.
+func (vm *VM) ErrorFunc() PrintFunc {
+	return vm.ss.errorFunc
+}
+
+// SetCompilerErrorHandler sets the handler of compilation errors, nil
+// removes it.
+func (vm *VM) SetCompilerErrorHandler(h CompilerErrorHandler) {
+	vm.ss.compilerErrorHandler = h
 }
 
+func (vm *VM) CompilerErrorHandler() CompilerErrorHandler {
+	return vm.ss.compilerErrorHandler
+}
+
+// EnableDebugInfo makes the compiler emit a line instruction at every
+// statement of the code it generates from now on, for debug hooks. Line
+// tables, local variable ranges and source names are always recorded.
+func (vm *VM) EnableDebugInfo(enable bool) {
+	vm.ss.debugInfo = enable
+}
+
+func (vm *VM) DebugInfoEnabled() bool {
+	return vm.ss.debugInfo
+}
+
+// SetErrorHandler pops a closure and makes it the handler called for
+// errors that are raised by Call with raiseError set.
 func (vm *VM) SetErrorHandler() {
+	o := vm.stack[vm.top-1]
+	if o.typ == TypeClosure || o.typ == TypeNativeClosure || o.typ == TypeNull {
+		assign(&vm.errorHandler, o)
+	}
+	vm.pop(1)
+}
+
+// GetErrorHandler pushes the current error handler.
+func (vm *VM) GetErrorHandler() {
+	vm.push(vm.errorHandler)
+}
+
+func (vm *VM) push(o Object) {
+	if vm.top >= len(vm.stack)-minStackOverhead {
+		vm.growStack(len(vm.stack)*2 + minStackOverhead)
+	}
+	assign(&vm.stack[vm.top], o)
+	vm.top++
+}
+
+func (vm *VM) pop(n int) {
+	for ; n > 0; n-- {
+		vm.top--
+		assign(&vm.stack[vm.top], Null)
+	}
+}
+
+// stackIndex turns an API index into an absolute stack position. Positive
+// indices count from the base of the current frame starting at 1,
+// negative ones from the top.
+func (vm *VM) stackIndex(idx int) int {
+	if idx >= 0 {
+		return vm.stackBase + idx - 1
+	}
+	return vm.top + idx
+}
+
+func (vm *VM) at(idx int) Object {
+	return vm.stack[vm.stackIndex(idx)]
 }
 
+// Push pushes a copy of the value at idx.
 func (vm *VM) Push(idx int) {
+	vm.push(vm.at(idx))
 }
 
 func (vm *VM) Pop(n int) {
+	vm.pop(n)
+	vm.releaseUnused()
 }
 
+// Remove removes the value at idx, shifting down the values above it.
 func (vm *VM) Remove(idx int) {
+	pos := vm.stackIndex(idx)
+	removed := vm.stack[pos]
+	copy(vm.stack[pos:vm.top], vm.stack[pos+1:vm.top])
+	// the top slot holds a copy of the value below it now, give it the
+	// reference of the removed value for pop to drop
+	vm.stack[vm.top-1] = removed
+	vm.pop(1)
+	vm.releaseUnused()
 }
 
 func (vm *VM) GetTop() int {
-	panic("not implemented")
+	return vm.top - vm.stackBase
 }
 
 func (vm *VM) SetTop(top int) {
+	newTop := vm.stackBase + top
+	for vm.top < newTop {
+		vm.push(Null)
+	}
+	if vm.top > newTop {
+		vm.pop(vm.top - newTop)
+		vm.releaseUnused()
+	}
 }
 
 func (vm *VM) PushString(value string) {
+	vm.ss.charge(len(value))
+	vm.push(StringValue(value))
 }
 
 func (vm *VM) PushFloat(value float64) {
+	vm.push(FloatValue(value))
 }
 
 func (vm *VM) PushInteger(value int64) {
+	vm.push(IntegerValue(value))
 }
 
 func (vm *VM) PushUserPointer(value any) {
+	vm.push(UserPointerValue(value))
 }
 
 func (vm *VM) PushBool(value bool) {
+	vm.push(BoolValue(value))
 }
 
 func (vm *VM) PushNull() {
+	vm.push(Null)
 }
 
 func (vm *VM) GetType(idx int) ObjectType {
-	return TypeNull
+	return vm.at(idx).typ
 }
 
 func (vm *VM) GetString(idx int) string {
-	panic("not implemented")
+	return vm.at(idx).Str()
 }
 
+// GetInteger returns the value at idx converted to an integer, numbers
+// and bools are converted, other types give 0.
 func (vm *VM) GetInteger(idx int) int64 {
-	panic("not implemented")
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeInteger, TypeFloat:
+		return o.toInteger()
+	case TypeBool:
+		return int64(o.num)
+	}
+	return 0
 }
 
 func (vm *VM) GetFloat(idx int) float64 {
-	panic("not implemented")
+	o := vm.at(idx)
+	if o.typ.isNumeric() {
+		return o.toFloat()
+	}
+	return 0
 }
 
 func (vm *VM) GetUserPointer(idx int) any {
-	panic("not implemented")
+	return vm.at(idx).UserPointer()
 }
 
 func (vm *VM) GetUserData(idx int) any {
-	panic("not implemented")
+	o := vm.at(idx)
+	if o.typ != TypeUserData {
+		return nil
+	}
+	return o.userData().value
 }
 
 func (vm *VM) GetBool(idx int) bool {
-	panic("not implemented")
+	o := vm.at(idx)
+	if o.typ != TypeBool {
+		return false
+	}
+	return o.Bool()
 }
 
+// Cmp compares the values at -2 and -1, returning -1, 0 or 1.
 func (vm *VM) Cmp() int64 {
-	panic("not implemented")
+	res, _ := vm.objCmp(vm.at(-2), vm.at(-1))
+	return res
 }
 
 func (vm *VM) PushRootTable() {
+	vm.push(vm.rootTable)
 }
 
+// SetRootTable pops a table and makes it the root table.
+func (vm *VM) SetRootTable() error {
+	o := vm.at(-1)
+	if o.typ != TypeTable && o.typ != TypeNull {
+		return fmt.Errorf("invalid type")
+	}
+	assign(&vm.rootTable, o)
+	vm.pop(1)
+	return nil
+}
+
+func (vm *VM) PushConstTable() {
+	vm.push(vm.ss.consts)
+}
+
+// SetConstTable pops a table and makes it the constant table.
+func (vm *VM) SetConstTable() error {
+	o := vm.at(-1)
+	if o.typ != TypeTable {
+		return fmt.Errorf("invalid type, expected table")
+	}
+	assign(&vm.ss.consts, o)
+	vm.pop(1)
+	return nil
+}
+
+// PushRegistryTable pushes a table that scripts cannot reach, so that
+// hosts can keep their own values in it.
+func (vm *VM) PushRegistryTable() {
+	vm.push(vm.ss.registry)
+}
+
+// Call calls the closure found below the nArgs arguments on top of the
+// stack. The arguments are popped, the closure is left on the stack.
 func (vm *VM) Call(nArgs int, pushResult, raiseError bool) error {
+	clo := vm.at(-(nArgs + 1))
+	res, err := vm.call(clo, nArgs, vm.top-nArgs, raiseError)
+	if !vm.suspended {
+		// the arguments stay in the frame of the suspended call
+		vm.pop(nArgs)
+	}
+	if err != nil {
+		return vm.apiError(err)
+	}
+	if pushResult {
+		vm.push(res)
+	}
+	vm.releaseUnused()
 	return nil
 }
+
+// ThrowError raises a string error from a native function. It is meant
+// to be used as its return value.
+func (vm *VM) ThrowError(format string, args ...any) (int, error) {
+	return 0, vm.raise(format, args...)
+}
+
+// ThrowObject pops a value and raises it from a native function.
+func (vm *VM) ThrowObject() (int, error) {
+	o := vm.at(-1)
+	vm.pop(1)
+	return 0, vm.raiseObject(o)
+}
+
+// GetLastError pushes the last error raised.
+func (vm *VM) GetLastError() {
+	vm.push(vm.lastError)
+}
+
+func (vm *VM) ResetError() {
+	assign(&vm.lastError, Null)
+}
+
+// ToString pushes the value at idx converted to a string.
+func (vm *VM) ToString(idx int) error {
+	s, err := vm.toString(vm.at(idx))
+	if err != nil {
+		return vm.apiError(err)
+	}
+	vm.push(StringValue(s))
+	return nil
+}
+
+// ToBool returns whether the value at idx is true in a condition.
+func (vm *VM) ToBool(idx int) bool {
+	return !vm.at(idx).isFalse()
+}
+
+func (vm *VM) NewTable() {
+	vm.push(vm.ss.newObject(TypeTable, newTable(0)))
+}
+
+func (vm *VM) NewArray(size int) {
+	vm.push(vm.ss.newObject(TypeArray, newArray(size)))
+}
+
+// NewUserData pushes a userdata wrapping value.
+func (vm *VM) NewUserData(value any) {
+	vm.push(vm.ss.newObject(TypeUserData, &userData{value: value}))
+}
+
+// NewClosure pops nFreeVars values and pushes a native closure that gets
+// them appended to its arguments when called.
+func (vm *VM) NewClosure(fn NativeFunc, nFreeVars int) {
+	nc := &nativeClosure{fn: fn}
+	if nFreeVars > 0 {
+		nc.outers = make([]Object, nFreeVars)
+		copy(nc.outers, vm.stack[vm.top-nFreeVars:vm.top])
+		for _, o := range nc.outers {
+			incRef(o)
+		}
+		vm.pop(nFreeVars)
+	}
+	vm.push(vm.ss.newObject(TypeNativeClosure, nc))
+}
+
+// PushClosure pushes a new closure of the compiled function proto.
+func (vm *VM) PushClosure(proto *FuncProto) {
+	vm.push(vm.ss.newObject(TypeClosure, newClosure(proto, vm.rootTable)))
+}
+
+// GetClosureProto returns the compiled function of the closure at idx.
+func (vm *VM) GetClosureProto(idx int) (*FuncProto, error) {
+	o := vm.at(idx)
+	if o.typ != TypeClosure {
+		return nil, vm.apiError(fmt.Errorf("closure expected"))
+	}
+	return o.closure().proto, nil
+}
+
+// SetParamsCheck sets the expected parameter count and types of the
+// native closure on top of the stack. A negative n means at least -n
+// parameters, 0 disables the check and MatchTypeMask takes the count from
+// typeMask. Each character of typeMask gives the
+// accepted types of one parameter, starting with "this".
+func (vm *VM) SetParamsCheck(n int, typeMask string) error {
+	o := vm.at(-1)
+	if o.typ != TypeNativeClosure {
+		return fmt.Errorf("native closure expected")
+	}
+	nc := o.nativeClosure()
+	nc.typeCheck = nil
+	if typeMask != "" {
+		mask, ok := compileTypeMask(typeMask)
+		if !ok {
+			return fmt.Errorf("invalid typemask")
+		}
+		nc.typeCheck = mask
+	}
+	if n == MatchTypeMask {
+		n = len(nc.typeCheck)
+	}
+	nc.paramsCheck = n
+	return nil
+}
+
+// SetNativeClosureName names the native closure at idx, for stack
+// traces.
+func (vm *VM) SetNativeClosureName(idx int, name string) error {
+	o := vm.at(idx)
+	if o.typ != TypeNativeClosure {
+		return fmt.Errorf("the object is not a nativeclosure")
+	}
+	o.nativeClosure().name = name
+	return nil
+}
+
+// NewSlot pops a key and a value and creates the slot in the table or
+// class at idx.
+func (vm *VM) NewSlot(idx int, static bool) error {
+	self := vm.at(idx)
+	if self.typ != TypeTable && self.typ != TypeClass {
+		return fmt.Errorf("table or class expected")
+	}
+	key, val := vm.at(-2), vm.at(-1)
+	if key.IsNull() {
+		return fmt.Errorf("null is not a valid key")
+	}
+	err := vm.newSlot(self, key, val, static)
+	vm.pop(2)
+	vm.releaseUnused()
+	return vm.apiError(err)
+}
+
+// DeleteSlot pops a key and removes the slot from the table at idx,
+// optionally pushing the removed value.
+func (vm *VM) DeleteSlot(idx int, pushVal bool) error {
+	self := vm.at(idx)
+	if self.typ != TypeTable {
+		return fmt.Errorf("table expected")
+	}
+	key := vm.at(-1)
+	val, err := vm.deleteSlot(self, key)
+	vm.pop(1)
+	if err != nil {
+		return vm.apiError(err)
+	}
+	if pushVal {
+		vm.push(val)
+	}
+	vm.releaseUnused()
+	return nil
+}
+
+// Set pops a key and a value and assigns the value to an existing slot
+// of the object at idx.
+func (vm *VM) Set(idx int) error {
+	self := vm.at(idx)
+	err := vm.set(self, vm.at(-2), vm.at(-1), dontFallBack)
+	vm.pop(2)
+	vm.releaseUnused()
+	return vm.apiError(err)
+}
+
+// RawSet is Set without delegation and metamethods.
+func (vm *VM) RawSet(idx int) error {
+	self := vm.at(idx)
+	key, val := vm.at(-2), vm.at(-1)
+	err := vm.rawSet(self, key, val)
+	vm.pop(2)
+	return vm.apiError(err)
+}
+
+// Get pops a key and pushes the value of the slot of the object at idx.
+func (vm *VM) Get(idx int) error {
+	self := vm.at(idx)
+	val, err := vm.get(self, vm.at(-1), 0, dontFallBack)
+	vm.pop(1)
+	if err != nil {
+		return vm.apiError(err)
+	}
+	vm.push(val)
+	return nil
+}
+
+// RawGet is Get without delegation and metamethods.
+func (vm *VM) RawGet(idx int) error {
+	self := vm.at(idx)
+	key := vm.at(-1)
+	vm.pop(1)
+	val, err := vm.rawGet(self, key)
+	if err != nil {
+		return vm.apiError(err)
+	}
+	vm.push(val)
+	return nil
+}
+
+// GetSize returns the length of a string, table, array or userdata.
+func (vm *VM) GetSize(idx int) (int, error) {
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeString:
+		return len(o.Str()), nil
+	case TypeTable:
+		return o.table().count, nil
+	case TypeArray:
+		return len(o.array().values), nil
+	case TypeInstance:
+		return len(o.instance().values), nil
+	case TypeClass:
+		return o.class().members.count, nil
+	}
+	return 0, fmt.Errorf("type %s has no size", o.typ)
+}
+
+// Next advances the iterator on top of the stack over the object at idx,
+// pushing key and value. Start by pushing null. It returns false once the
+// iteration is over.
+func (vm *VM) Next(idx int) bool {
+	self := vm.at(idx)
+	itr := vm.at(-1)
+	pos := 0
+	if itr.typ == TypeInteger {
+		pos = int(itr.Integer())
+	}
+	var key, val Object
+	switch self.typ {
+	case TypeTable:
+		pos, key, val = self.table().next(pos)
+	case TypeArray:
+		pos, key, val = self.array().next(pos)
+	case TypeClass:
+		pos, key, val = self.class().next(pos)
+	default:
+		return false
+	}
+	if pos < 0 {
+		return false
+	}
+	assign(&vm.stack[vm.top-1], IntegerValue(int64(pos)))
+	vm.push(key)
+	vm.push(val)
+	return true
+}
+
+// ArrayAppend pops a value and appends it to the array at idx.
+func (vm *VM) ArrayAppend(idx int) error {
+	o := vm.at(idx)
+	if o.typ != TypeArray {
+		return fmt.Errorf("array expected")
+	}
+	o.array().append(vm.at(-1))
+	vm.pop(1)
+	return nil
+}
+
+// ArrayPop removes the last element of the array at idx.
+func (vm *VM) ArrayPop(idx int, pushVal bool) error {
+	o := vm.at(idx)
+	if o.typ != TypeArray {
+		return fmt.Errorf("array expected")
+	}
+	a := o.array()
+	if len(a.values) == 0 {
+		return fmt.Errorf("empty array")
+	}
+	val := a.values[len(a.values)-1]
+	a.resize(len(a.values)-1, Null)
+	if pushVal {
+		vm.push(val)
+	}
+	return nil
+}
+
+// ArrayResize resizes the array at idx, new items are null. Growing it
+// beyond what a script may allocate is an error.
+func (vm *VM) ArrayResize(idx int, size int) error {
+	o := vm.at(idx)
+	if o.typ != TypeArray {
+		return fmt.Errorf("array expected")
+	}
+	if size < 0 {
+		return fmt.Errorf("negative size")
+	}
+	if err := o.array().checkGrow(int64(size)); err != nil {
+		return err
+	}
+	o.array().resize(size, Null)
+	return nil
+}
+
+// NewClass pushes a new class, popping its base class first if hasBase
+// is set.
+func (vm *VM) NewClass(hasBase bool) error {
+	var base *class
+	if hasBase {
+		b := vm.at(-1)
+		if b.typ != TypeClass {
+			return fmt.Errorf("invalid base type")
+		}
+		base = b.class()
+		vm.pop(1)
+	}
+	vm.push(vm.ss.newObject(TypeClass, newClass(base)))
+	return nil
+}
+
+// CreateInstance pushes an instance of the class at idx without calling
+// its constructor.
+func (vm *VM) CreateInstance(idx int) error {
+	o := vm.at(idx)
+	if o.typ != TypeClass {
+		return fmt.Errorf("class expected")
+	}
+	vm.push(vm.ss.newObject(TypeInstance, o.class().createInstance()))
+	return nil
+}
+
+// GetClass pushes the class of the instance at idx.
+func (vm *VM) GetClass(idx int) error {
+	o := vm.at(idx)
+	if o.typ != TypeInstance {
+		return fmt.Errorf("the object is not a class instance")
+	}
+	vm.push(makeObject(TypeClass, o.instance().class))
+	return nil
+}
+
+// SetInstanceUp attaches a Go value to the instance at idx.
+func (vm *VM) SetInstanceUp(idx int, up any) error {
+	o := vm.at(idx)
+	if o.typ != TypeInstance {
+		return fmt.Errorf("the object is not a class instance")
+	}
+	o.instance().up = up
+	return nil
+}
+
+func (vm *VM) GetInstanceUp(idx int) (any, error) {
+	o := vm.at(idx)
+	if o.typ != TypeInstance {
+		return nil, fmt.Errorf("the object is not a class instance")
+	}
+	return o.instance().up, nil
+}
+
+// SetTypeTag tags the class or userdata at idx so that natives can tell
+// their own objects apart.
+func (vm *VM) SetTypeTag(idx int, tag any) error {
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeClass:
+		o.class().typeTag = tag
+	case TypeUserData:
+		o.userData().typeTag = tag
+	default:
+		return fmt.Errorf("invalid object type")
+	}
+	return nil
+}
+
+func (vm *VM) GetTypeTag(idx int) (any, error) {
+	o := vm.at(idx)
+	switch o.typ {
+	case TypeClass:
+		return o.class().typeTag, nil
+	case TypeInstance:
+		return o.instance().class.typeTag, nil
+	case TypeUserData:
+		return o.userData().typeTag, nil
+	}
+	return nil, fmt.Errorf("invalid object type")
+}
+
+// SetDelegate pops a table and makes it the delegate of the table or
+// userdata at idx. Null removes the delegate.
+func (vm *VM) SetDelegate(idx int) error {
+	self := vm.at(idx)
+	d := vm.at(-1)
+	var delegate *table
+	switch d.typ {
+	case TypeTable:
+		delegate = d.table()
+	case TypeNull:
+	default:
+		return fmt.Errorf("invalid delegate type")
+	}
+	switch self.typ {
+	case TypeTable:
+		for t := delegate; t != nil; t = t.delegate {
+			if t == self.table() {
+				return fmt.Errorf("delegate cycle")
+			}
+		}
+		self.table().setDelegate(delegate)
+	case TypeUserData:
+		u := self.userData()
+		if delegate != nil {
+			delegate.incRef()
+		}
+		if u.delegate != nil {
+			u.delegate.decRef()
+		}
+		u.delegate = delegate
+	default:
+		return fmt.Errorf("wrong type")
+	}
+	vm.pop(1)
+	return nil
+}
+
+// GetDelegate pushes the delegate of the table or userdata at idx.
+func (vm *VM) GetDelegate(idx int) error {
+	self := vm.at(idx)
+	switch self.typ {
+	case TypeTable, TypeUserData:
+		if d := vm.delegateOf(self); d != nil {
+			vm.push(makeObject(TypeTable, d))
+		} else {
+			vm.push(Null)
+		}
+		return nil
+	}
+	return fmt.Errorf("wrong type")
+}
@@ -0,0 +1,157 @@
+package sqvm
+
+type tableKey struct {
+	typ ObjectType
+	num uint64
+	ref any
+}
+
+func keyOf(o Object) (tableKey, bool) {
+	if o.typ == TypeUserPointer && !isComparable(o.ref) {
+		return tableKey{}, false
+	}
+	return tableKey{typ: o.typ, num: o.num, ref: o.ref}, true
+}
+
+type tableNode struct {
+	key  Object
+	val  Object
+	used bool
+}
+
+// table keeps its slots in insertion order so that iteration is stable
+// and can be resumed from an integer position, as foreach requires.
+type table struct {
+	gcHeader
+
+	nodes    []tableNode
+	index    map[tableKey]int
+	count    int
+	delegate *table
+}
+
+func newTable(size int) *table {
+	return &table{
+		nodes: make([]tableNode, 0, size),
+		index: make(map[tableKey]int, size),
+	}
+}
+
+func (t *table) find(key Object) int {
+	k, ok := keyOf(key)
+	if !ok {
+		return -1
+	}
+	if i, present := t.index[k]; present {
+		return i
+	}
+	return -1
+}
+
+func (t *table) get(key Object) (Object, bool) {
+	if i := t.find(key); i >= 0 {
+		return realVal(t.nodes[i].val), true
+	}
+	return Null, false
+}
+
+// set only updates an existing slot.
+func (t *table) set(key, val Object) bool {
+	if i := t.find(key); i >= 0 {
+		assign(&t.nodes[i].val, val)
+		return true
+	}
+	return false
+}
+
+func (t *table) newSlot(key, val Object) bool {
+	k, ok := keyOf(key)
+	if !ok {
+		return false
+	}
+	if i, present := t.index[k]; present {
+		assign(&t.nodes[i].val, val)
+		return true
+	}
+	if len(t.nodes) >= 8 && len(t.nodes) >= 2*t.count {
+		t.compact()
+	}
+	incRef(key)
+	incRef(val)
+	t.ss.charge(tableNodeSize)
+	t.index[k] = len(t.nodes)
+	t.nodes = append(t.nodes, tableNode{key: key, val: val, used: true})
+	t.count++
+	return true
+}
+
+func (t *table) remove(key Object) {
+	k, ok := keyOf(key)
+	if !ok {
+		return
+	}
+	if i, present := t.index[k]; present {
+		n := t.nodes[i]
+		delete(t.index, k)
+		t.nodes[i] = tableNode{}
+		t.count--
+		decRef(n.key)
+		decRef(n.val)
+	}
+}
+
+func (t *table) compact() {
+	nodes := make([]tableNode, 0, t.count*2)
+	for _, n := range t.nodes {
+		if n.used {
+			k, _ := keyOf(n.key)
+			t.index[k] = len(nodes)
+			nodes = append(nodes, n)
+		}
+	}
+	t.nodes = nodes
+}
+
+// next returns the slot following iteration position pos, and the
+// position to continue from, or -1 when there are no more slots.
+func (t *table) next(pos int) (int, Object, Object) {
+	for ; pos < len(t.nodes); pos++ {
+		if n := t.nodes[pos]; n.used {
+			return pos + 1, n.key, realVal(n.val)
+		}
+	}
+	return -1, Null, Null
+}
+
+func (t *table) clone() *table {
+	nt := newTable(t.count)
+	for _, n := range t.nodes {
+		if n.used {
+			nt.newSlot(n.key, n.val)
+		}
+	}
+	nt.setDelegate(t.delegate)
+	return nt
+}
+
+func (t *table) setDelegate(d *table) {
+	if d != nil {
+		d.incRef()
+	}
+	if t.delegate != nil {
+		t.delegate.decRef()
+	}
+	t.delegate = d
+}
+
+func (t *table) clear() {
+	for _, n := range t.nodes {
+		if n.used {
+			decRef(n.key)
+			decRef(n.val)
+		}
+	}
+	t.nodes = t.nodes[:0]
+	t.index = map[tableKey]int{}
+	t.count = 0
+}
@@ -0,0 +1,224 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// VMState tells whether a vm is running code.
+type VMState int
+
+const (
+	VMStateIdle VMState = iota
+	VMStateRunning
+	VMStateSuspended
+)
+
+var vmStateNames = [...]string{"idle", "running", "suspended"}
+
+func (s VMState) String() string {
+	if s < 0 || int(s) >= len(vmStateNames) {
+		return fmt.Sprintf("sqvm.VMState(%d)", int(s))
+	}
+	return vmStateNames[s]
+}
+
+// ThreadStackSize is a good initial stack size for threads, their stack
+// grows as needed.
+const ThreadStackSize = 64
+
+// NewThread pushes a new thread and returns it. The thread has its own
+// stack but shares the root table and everything else with vm. Like any
+// other object it is released once it is no longer referenced, so Go code
+// using it has to keep a reference.
+func (vm *VM) NewThread(initialStackSize uint) *VM {
+	t := &VM{
+		ss:    vm.ss,
+		stack: make([]Object, initialStackSize+minStackOverhead),
+	}
+	assign(&t.rootTable, vm.rootTable)
+	assign(&t.errorHandler, vm.errorHandler)
+	assign(&t.debugHookClosure, vm.debugHookClosure)
+	t.debugHook = vm.debugHook
+	t.debugHooked = vm.debugHook != nil || !vm.debugHookClosure.IsNull()
+	vm.ss.vms = append(vm.ss.vms, t)
+	vm.push(vm.ss.newObject(TypeThread, t))
+	return t
+}
+
+// GetThread returns the thread at idx.
+func (vm *VM) GetThread(idx int) (*VM, error) {
+	o := vm.at(idx)
+	if o.typ != TypeThread {
+		return nil, fmt.Errorf("thread expected")
+	}
+	return o.thread(), nil
+}
+
+// Move pushes the value found at idx on the stack of from.
+func (vm *VM) Move(from *VM, idx int) {
+	vm.push(from.at(idx))
+}
+
+func (vm *VM) GetVMState() VMState {
+	switch {
+	case vm.suspended:
+		return VMStateSuspended
+	case len(vm.callStack) > 0:
+		return VMStateRunning
+	}
+	return VMStateIdle
+}
+
+// SuspendVM suspends the script that called the native function, which
+// has to return the results of SuspendVM. The value on top of the stack
+// is the result of the call that ran the script. Only a script called
+// directly from Go can be suspended.
+func (vm *VM) SuspendVM() (int, error) {
+	if vm.suspended {
+		return vm.ThrowError("cannot suspend an already suspended vm")
+	}
+	if vm.nNativeCalls != 2 {
+		return vm.ThrowError("cannot suspend through native calls/metamethods")
+	}
+	return 1, errSuspended
+}
+
+// WakeupVM resumes a suspended vm. If wakeupRet is set a value is popped
+// and becomes the result of the native function that suspended, null
+// otherwise. With throwError the last error, as set by ThrowObject, is
+// raised where the script was suspended instead. The result of the
+// script, or the value it is suspended with again, is pushed if
+// pushResult is set.
+func (vm *VM) WakeupVM(wakeupRet, pushResult, raiseError, throwError bool) error {
+	if !vm.suspended {
+		return fmt.Errorf("cannot resume a vm that is not running any code")
+	}
+	target := vm.suspendedTarget
+	if wakeupRet {
+		if target != -1 {
+			assign(&vm.stack[vm.stackBase+target], vm.stack[vm.top-1])
+		}
+		vm.pop(1)
+	} else if target != -1 {
+		assign(&vm.stack[vm.stackBase+target], Null)
+	}
+	res, err := vm.resume(raiseError, throwError)
+	if err != nil {
+		return vm.apiError(err)
+	}
+	if pushResult {
+		vm.push(res)
+	}
+	vm.releaseUnused()
+	return nil
+}
+
+// reset drops all frames and values from the stack.
+func (vm *VM) reset() {
+	if vm.openOuters != nil {
+		vm.closeOuters(0)
+	}
+	for i := range vm.stack[:vm.top] {
+		assign(&vm.stack[i], Null)
+	}
+	vm.top = 0
+	vm.stackBase = 0
+	for _, ci := range vm.callStack {
+		ci.clear()
+	}
+	vm.callStack = vm.callStack[:0]
+	vm.ci = nil
+	vm.traps = nil
+	assign(&vm.lastError, Null)
+	vm.suspended = false
+	assign(&vm.suspendedValue, Null)
+}
+
+func (vm *VM) traverse(fn func(gcObject)) {
+	vm.stackRefs(fn)
+	visit(fn, vm.rootTable)
+	visit(fn, vm.errorHandler)
+	visit(fn, vm.debugHookClosure)
+}
+
+func (vm *VM) finalize() {
+	vm.reset()
+	for i, t := range vm.ss.vms {
+		if t == vm {
+			vm.ss.vms = append(vm.ss.vms[:i], vm.ss.vms[i+1:]...)
+			break
+		}
+	}
+	assign(&vm.rootTable, Null)
+	assign(&vm.errorHandler, Null)
+	assign(&vm.debugHookClosure, Null)
+}
+
+func threadCall(vm *VM) (int, error) {
+	t := vm.at(1).thread()
+	nParams := vm.GetTop()
+	t.push(t.rootTable)
+	for i := 2; i <= nParams; i++ {
+		t.push(vm.at(i))
+	}
+	if err := t.Call(nParams, true, true); err != nil {
+		return 0, vm.raiseObject(t.lastError)
+	}
+	vm.push(t.at(-1))
+	t.pop(1)
+	return 1, nil
+}
+
+func threadWakeup(vm *VM) (int, error) {
+	t := vm.at(1).thread()
+	if err := t.checkSuspended(); err != nil {
+		return 0, vm.raise("%s", err)
+	}
+	wakeupRet := vm.GetTop() > 1
+	if wakeupRet {
+		t.push(vm.at(2))
+	}
+	return vm.wakeupThread(t, t.WakeupVM(wakeupRet, true, true, false), true)
+}
+
+func threadWakeupThrow(vm *VM) (int, error) {
+	t := vm.at(1).thread()
+	if err := t.checkSuspended(); err != nil {
+		return 0, vm.raise("%s", err)
+	}
+	assign(&t.lastError, vm.at(2))
+	rethrow := vm.GetTop() <= 2 || vm.GetBool(3)
+	return vm.wakeupThread(t, t.WakeupVM(false, true, true, true), rethrow)
+}
+
+// wakeupThread returns the result of waking up thread t to the script.
+func (vm *VM) wakeupThread(t *VM, err error, rethrow bool) (int, error) {
+	if err != nil {
+		t.SetTop(1)
+		if rethrow {
+			return 0, vm.raiseObject(t.lastError)
+		}
+		return 0, nil
+	}
+	vm.push(t.at(-1))
+	t.pop(1)
+	if t.GetVMState() == VMStateIdle {
+		t.SetTop(1) // pops the root table
+	}
+	return 1, nil
+}
+
+func (vm *VM) checkSuspended() error {
+	switch vm.GetVMState() {
+	case VMStateIdle:
+		return fmt.Errorf("cannot wakeup a idle thread")
+	case VMStateRunning:
+		return fmt.Errorf("cannot wakeup a running thread")
+	}
+	return nil
+}
+
+func threadGetStatus(vm *VM) (int, error) {
+	vm.PushString(vm.at(1).thread().GetVMState().String())
+	return 1, nil
+}
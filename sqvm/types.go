@@ -1,5 +1,11 @@
 package sqvm
 
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
 type ObjectType int
 
 const (
@@ -14,11 +20,227 @@ const (
 	TypeNativeClosure
 	TypeGenerator
 	TypeUserPointer
+	TypeThread
 	TypeBool
 	TypeInstance
 	TypeClass
 	TypeWeakRef
+	TypeFuncProto
+	TypeOuter
 )
 
-type FuncProto struct {
+var typeNames = [...]string{
+	TypeNull:          "null",
+	TypeInteger:       "integer",
+	TypeFloat:         "float",
+	TypeString:        "string",
+	TypeTable:         "table",
+	TypeArray:         "array",
+	TypeUserData:      "userdata",
+	TypeClosure:       "function",
+	TypeNativeClosure: "function",
+	TypeGenerator:     "generator",
+	TypeUserPointer:   "userpointer",
+	TypeThread:        "thread",
+	TypeBool:          "bool",
+	TypeInstance:      "instance",
+	TypeClass:         "class",
+	TypeWeakRef:       "weakref",
+	TypeFuncProto:     "function",
+	TypeOuter:         "outer",
+}
+
+// String returns the name Squirrel's typeof reports for the type.
+func (t ObjectType) String() string {
+	if t < 0 || int(t) >= len(typeNames) {
+		return fmt.Sprintf("sqvm.ObjectType(%d)", int(t))
+	}
+	return typeNames[t]
+}
+
+func (t ObjectType) isNumeric() bool {
+	return t == TypeInteger || t == TypeFloat
+}
+
+// Object is a single Squirrel value, the equivalent of HSQOBJECT.
+//
+// Objects are plain values and can be copied freely. A copy held by
+// Go code is not known to the VM, see VM.AddRef for keeping one alive.
+type Object struct {
+	typ ObjectType
+	num uint64 // integer, bool or float bits
+	ref any    // string, heap object or user pointer
+}
+
+// Null is the null object.
+var Null = Object{}
+
+func IntegerValue(value int64) Object {
+	return Object{typ: TypeInteger, num: uint64(value)}
+}
+
+func FloatValue(value float64) Object {
+	return Object{typ: TypeFloat, num: math.Float64bits(value)}
+}
+
+func BoolValue(value bool) Object {
+	if value {
+		return Object{typ: TypeBool, num: 1}
+	}
+	return Object{typ: TypeBool}
+}
+
+func StringValue(value string) Object {
+	return Object{typ: TypeString, ref: value}
+}
+
+func UserPointerValue(value any) Object {
+	return Object{typ: TypeUserPointer, ref: value}
+}
+
+func (o Object) Type() ObjectType {
+	return o.typ
+}
+
+func (o Object) IsNull() bool {
+	return o.typ == TypeNull
+}
+
+func (o Object) Integer() int64 {
+	return int64(o.num)
+}
+
+func (o Object) Float() float64 {
+	return math.Float64frombits(o.num)
+}
+
+func (o Object) Bool() bool {
+	return o.num != 0
+}
+
+func (o Object) Str() string {
+	s, _ := o.ref.(string)
+	return s
+}
+
+func (o Object) UserPointer() any {
+	if o.typ != TypeUserPointer {
+		return nil
+	}
+	return o.ref
+}
+
+// String formats the object for debugging output.
+func (o Object) String() string {
+	switch o.typ {
+	case TypeNull:
+		return "null"
+	case TypeInteger:
+		return fmt.Sprint(o.Integer())
+	case TypeFloat:
+		return formatFloat(o.Float())
+	case TypeBool:
+		if o.Bool() {
+			return "true"
+		}
+		return "false"
+	case TypeString:
+		return fmt.Sprintf("%q", o.Str())
+	case TypeUserPointer:
+		return fmt.Sprintf("(userpointer : %v)", o.ref)
+	}
+	return fmt.Sprintf("(%s : 0x%x)", o.typ, o.address())
+}
+
+func formatFloat(f float64) string {
+	return fmt.Sprintf("%.14g", f)
+}
+
+func (o Object) toInteger() int64 {
+	if o.typ == TypeFloat {
+		return int64(o.Float())
+	}
+	return o.Integer()
+}
+
+func (o Object) toFloat() float64 {
+	if o.typ == TypeInteger {
+		return float64(o.Integer())
+	}
+	return o.Float()
+}
+
+func (o Object) isFalse() bool {
+	switch o.typ {
+	case TypeNull:
+		return true
+	case TypeInteger, TypeBool:
+		return o.num == 0
+	case TypeFloat:
+		return o.Float() == 0
+	}
+	return false
+}
+
+// rawEquals compares objects the way the reference implementation
+// compares raw values: by identity for heap objects.
+func (o Object) rawEquals(other Object) bool {
+	if o.typ != other.typ {
+		return false
+	}
+	switch o.typ {
+	case TypeNull:
+		return true
+	case TypeInteger, TypeFloat, TypeBool:
+		return o.num == other.num
+	case TypeString:
+		return o.Str() == other.Str()
+	case TypeUserPointer:
+		if !isComparable(o.ref) || !isComparable(other.ref) {
+			return false
+		}
+		return o.ref == other.ref
+	}
+	return o.ref == other.ref
+}
+
+func isComparable(v any) bool {
+	return v == nil || reflect.TypeOf(v).Comparable()
+}
+
+// address is used to order and print heap objects.
+func (o Object) address() uintptr {
+	if o.ref == nil {
+		return 0
+	}
+	v := reflect.ValueOf(o.ref)
+	if v.Kind() == reflect.Pointer {
+		return v.Pointer()
+	}
+	return 0
+}
+
+func (o Object) table() *table                 { return o.ref.(*table) }
+func (o Object) array() *array                 { return o.ref.(*array) }
+func (o Object) closure() *closure             { return o.ref.(*closure) }
+func (o Object) nativeClosure() *nativeClosure { return o.ref.(*nativeClosure) }
+func (o Object) generator() *generator         { return o.ref.(*generator) }
+func (o Object) class() *class                 { return o.ref.(*class) }
+func (o Object) instance() *instance           { return o.ref.(*instance) }
+func (o Object) userData() *userData           { return o.ref.(*userData) }
+func (o Object) outer() *outer                 { return o.ref.(*outer) }
+func (o Object) thread() *VM                   { return o.ref.(*VM) }
+
+func makeObject(typ ObjectType, ref any) Object {
+	return Object{typ: typ, ref: ref}
+}
+
+// notRefCounted is the set of the types of plain values.
+const notRefCounted uint32 = 1<<TypeNull | 1<<TypeInteger | 1<<TypeFloat | 1<<TypeBool |
+	1<<TypeString | 1<<TypeUserPointer
+
+// isRefCounted reports whether o refers to a heap object that AddRef and
+// Release keep track of.
+func (o Object) isRefCounted() bool {
+	return notRefCounted&(1<<uint(o.typ)) == 0
 }
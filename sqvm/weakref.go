@@ -0,0 +1,98 @@
+package sqvm
+
+import (
+	"fmt"
+)
+
+// weakRef refers to an object without keeping it alive. It is nulled when
+// the object is released.
+type weakRef struct {
+	gcHeader
+
+	obj Object
+}
+
+func (w *weakRef) traverse(fn func(gcObject)) {}
+
+func (w *weakRef) finalize() {
+	if h := w.target(); h != nil && h.weakRef == w {
+		h.weakRef = nil
+	}
+	w.obj = Null
+}
+
+// value returns the object w refers to, or null if it lost its last
+// reference and is only waiting to be released.
+func (w *weakRef) value() Object {
+	if h := w.target(); h != nil && h.refs == 0 && h.queued {
+		return Null
+	}
+	return w.obj
+}
+
+func (w *weakRef) target() *gcHeader {
+	if g := gcOf(w.obj); g != nil {
+		return g.header()
+	}
+	return nil
+}
+
+func (o Object) weakRef() *weakRef { return o.ref.(*weakRef) }
+
+// realVal dereferences weak references stored in containers.
+func realVal(o Object) Object {
+	if o.typ == TypeWeakRef {
+		return o.weakRef().value()
+	}
+	return o
+}
+
+// clearWeakRef nulls the weak reference to a released object.
+func (h *gcHeader) clearWeakRef() {
+	if h.weakRef != nil {
+		h.weakRef.obj = Null
+		h.weakRef = nil
+	}
+}
+
+// weakRefOf returns the weak reference to o. Values that are not
+// reference counted are returned as they are.
+func (ss *sharedState) weakRefOf(o Object) Object {
+	g := gcOf(o)
+	if g == nil {
+		return o
+	}
+	h := g.header()
+	if h.weakRef == nil {
+		h.weakRef = &weakRef{obj: o}
+		return ss.newObject(TypeWeakRef, h.weakRef)
+	}
+	return makeObject(TypeWeakRef, h.weakRef)
+}
+
+// WeakRef pushes a weak reference to the object at idx. Values that are
+// not reference counted, like numbers, are pushed as they are.
+func (vm *VM) WeakRef(idx int) {
+	vm.push(vm.ss.weakRefOf(vm.at(idx)))
+}
+
+// GetWeakRefVal pushes the object the weak reference at idx refers to,
+// or null if it has been released.
+func (vm *VM) GetWeakRefVal(idx int) error {
+	o := vm.at(idx)
+	if o.typ != TypeWeakRef {
+		return fmt.Errorf("the object must be a weakref")
+	}
+	vm.push(o.weakRef().value())
+	return nil
+}
+
+func objWeakRef(vm *VM) (int, error) {
+	vm.WeakRef(1)
+	return 1, nil
+}
+
+func weakRefRef(vm *VM) (int, error) {
+	vm.push(vm.at(1).weakRef().value())
+	return 1, nil
+}
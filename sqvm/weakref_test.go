@@ -0,0 +1,96 @@
+package sqvm_test
+
+import (
+	"testing"
+
+	"github.com/dexter3k/go-squirrel/sqvm"
+)
+
+func TestWeakRefNulled(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	err := run(t, vm, `
+		local a = {}
+		local t = {p = a.weakref()}
+		local arr = [a.weakref()]
+		local w = a.weakref()
+		if (t.p != a || arr[0] != a || w.ref() != a) throw "nulled while alive"
+		a = null
+		if (t.p != null) throw "weak table value not nulled"
+		if (arr[0] != null) throw "weak array entry not nulled"
+		if (w.ref() != null) throw "weakref not nulled"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeakRefInCallback(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	err := run(t, vm, `
+		local a = {}
+		local w = a.weakref()
+		local t = {p = w}
+		local arr = [2, 1]
+		arr.sort(function(x, y) {
+			if (a != null) {
+				a = null
+				if (w.ref() != null) throw "weakref not nulled in the compare function"
+				if (t.p != null) throw "weak table value not nulled in the compare function"
+			}
+			return x <=> y
+		})
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeakRefDeepStack(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	err := run(t, vm, `
+		local a = {}
+		local w = a.weakref()
+		function deep(n) {
+			if (n > 0) return deep(n - 1) + 1
+			a = null
+			if (w.ref() != null) throw "weakref not nulled on a deep stack"
+			return 0
+		}
+		deep(500)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeakRefKeepsCountedObjects(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	err := run(t, vm, `
+		local holder = {a = {}}
+		local t = {p = holder.a.weakref()}
+		if (t.p != holder.a) throw "nulled while referenced by a table"
+		holder.a = null
+		if (t.p != null) throw "not nulled"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeakRefFromHost(t *testing.T) {
+	vm := sqvm.Open(1024)
+	defer vm.Close()
+	vm.NewTable()
+	vm.WeakRef(-1)
+	vm.Remove(-2)
+	if err := vm.GetWeakRefVal(-1); err != nil {
+		t.Fatal(err)
+	}
+	if vm.GetType(-1) != sqvm.TypeNull {
+		t.Fatalf("got %v, want null", vm.GetType(-1))
+	}
+}